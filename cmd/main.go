@@ -5,12 +5,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 
 	nested "github.com/antonfisher/nested-logrus-formatter"
 	"github.com/sirupsen/logrus"
 
 	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/config"
 	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/driver"
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/leaderelection"
 )
 
 const (
@@ -26,6 +28,9 @@ func main() {
 		configDir = flag.String("config-dir", defaultConfigDir, "driver config endpoint")
 		role      = flag.String("role", "", fmt.Sprintf("driver role: %v", driver.Roles))
 		version   = flag.Bool("version", false, "Print driver version")
+
+		leaderElection = flag.Bool(
+			"leader-election", false, "elect the controller replica that runs background jobs, Kubernetes only")
 	)
 
 	flag.Parse()
@@ -52,6 +57,7 @@ func main() {
 	l.Infof("- Node ID:          '%s'", *nodeID)
 	l.Infof("- CSI endpoint:     '%s'", *endpoint)
 	l.Infof("- Config directory: '%s'", *configDir)
+	l.Infof("- Leader election:  %t", *leaderElection)
 
 	// validate driver instance role
 	validatedRole, err := driver.ParseRole(string(*role))
@@ -85,12 +91,34 @@ func main() {
 		l.Infof("  - DynamicTargetLunAllocation: %+v", *config.DynamicTargetLunAllocation)
 	}
 
+	// controller replicas compete for the Lease named after the driver, background jobs run on the leader
+	var leaderElector driver.LeaderElector
+	if *leaderElection && validatedRole.IsController() {
+		identity := os.Getenv("POD_NAME")
+		if identity == "" {
+			identity, _ = os.Hostname()
+		}
+		elector, err := leaderelection.NewInCluster(leaderelection.Args{
+			LeaseName: strings.ReplaceAll(driver.Name, ".", "-") + "-controller",
+			Namespace: os.Getenv("POD_NAMESPACE"),
+			Identity:  identity,
+			Log:       l,
+		})
+		if err != nil {
+			writeTerminationMessage(err, l)
+			l.Fatalf("Cannot start leader election: %s", err)
+		}
+		go elector.Run(nil)
+		leaderElector = elector
+	}
+
 	d, err := driver.NewDriver(driver.Args{
-		Role:     validatedRole,
-		NodeID:   *nodeID,
-		Endpoint: *endpoint,
-		Config:   cfg,
-		Log:      l,
+		Role:          validatedRole,
+		NodeID:        *nodeID,
+		Endpoint:      *endpoint,
+		Config:        cfg,
+		Log:           l,
+		LeaderElector: leaderElector,
 	})
 	if err != nil {
 		writeTerminationMessage(err, l)
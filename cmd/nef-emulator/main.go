@@ -0,0 +1,128 @@
+// NexentaStor NEF REST API emulator, serves in-memory appliance over HTTPS to run the driver
+// and csi-sanity without real NexentaStor, e.g.:
+//
+//	nef-emulator --address 127.0.0.1:8443 --volume-groups pool1/csiVolumeGroup
+//
+// and use "restIp: https://127.0.0.1:8443" in driver config. State is kept in memory until the process exits.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"flag"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	nested "github.com/antonfisher/nested-logrus-formatter"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/nstest"
+)
+
+const (
+	defaultAddress      = "127.0.0.1:8443"
+	defaultUsername     = "admin"
+	defaultPassword     = "Nexenta@1"
+	defaultVolumeGroups = "pool1/csiVolumeGroup"
+)
+
+func main() {
+	var (
+		address      = flag.String("address", defaultAddress, "address to listen on [host:port]")
+		username     = flag.String("username", defaultUsername, "NEF username")
+		password     = flag.String("password", defaultPassword, "NEF password")
+		volumeGroups = flag.String("volume-groups", defaultVolumeGroups, "comma separated volume groups to create [pool/volumeGroup]")
+		poolSize     = flag.Int64("pool-size", nstest.DefaultPoolSize, "capacity of each pool in bytes")
+		tlsCert      = flag.String("tls-cert", "", "TLS certificate file, self-signed certificate is generated if not set")
+		tlsKey       = flag.String("tls-key", "", "TLS key file")
+		debug        = flag.Bool("debug", false, "print all requests and responses")
+	)
+
+	flag.Parse()
+
+	l := logrus.New().WithField("cmp", "Main")
+	l.Logger.SetFormatter(&nested.Formatter{
+		HideKeys:    true,
+		FieldsOrder: []string{"cmp", "req"},
+	})
+	if *debug {
+		l.Logger.SetLevel(logrus.DebugLevel)
+	}
+
+	var groups []string
+	for _, vg := range strings.Split(*volumeGroups, ",") {
+		if vg = strings.TrimSpace(vg); vg != "" {
+			groups = append(groups, vg)
+		}
+	}
+
+	l.Info("Run NEF emulator with CLI options:")
+	l.Infof("- Address:       '%s'", *address)
+	l.Infof("- Username:      '%s'", *username)
+	l.Infof("- Volume groups: %v", groups)
+	l.Infof("- Pool size:     %d", *poolSize)
+
+	appliance := nstest.NewAppliance(nstest.ApplianceArgs{
+		Username:     *username,
+		Password:     *password,
+		VolumeGroups: groups,
+		PoolSize:     *poolSize,
+	})
+
+	server := &http.Server{
+		Addr:    *address,
+		Handler: nstest.NewServer(appliance, l),
+	}
+
+	if *tlsCert != "" || *tlsKey != "" {
+		l.Fatal(server.ListenAndServeTLS(*tlsCert, *tlsKey))
+	}
+
+	cert, err := newSelfSignedCertificate(*address)
+	if err != nil {
+		l.Fatalf("Cannot generate self-signed certificate: %s", err)
+	}
+	l.Info("Using self-signed certificate, driver config must have 'insecureSkipVerify: true'")
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	l.Fatal(server.ListenAndServeTLS("", ""))
+}
+
+// newSelfSignedCertificate - creates certificate for the listen address host
+func newSelfSignedCertificate(address string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{Organization: []string{"NexentaStor NEF emulator"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if host, _, err := net.SplitHostPort(address); err == nil && host != "" {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
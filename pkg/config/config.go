@@ -13,13 +13,29 @@ import (
 )
 
 const DefaultInsecureSkipVerify = true
+
+// orphan collector modes: orphaned NexentaStor objects are not looked for, reported or reclaimed
+const (
+    OrphanCollectorOff     = "off"
+    OrphanCollectorDryRun  = "dryRun"
+    OrphanCollectorReclaim = "reclaim"
+)
+
+// DefaultOrphanGracePeriod - how long objects stay orphaned before the orphan collector reclaims them
+const DefaultOrphanGracePeriod = 24 * time.Hour
+
 // NexentaStor address format
 var regexpAddress = regexp.MustCompile("^https?://[^:]+:[0-9]{1,5}$")
 
+// volume group may be nested at any depth under the pool: "pool/group", "pool/tenant/env/volumes"
+var regexpVolumeGroup = regexp.MustCompile("^[^/@:]+(/[^/@:]+)+$")
+
 // Config - driver config from file
 type Config struct {
     NsMap               map[string]NsData   `yaml:"nexentastor_map"`
     Debug               bool                `yaml:"debug,omitempty"`
+    OrphanCollector     string              `yaml:"orphanCollector,omitempty"`
+    OrphanGracePeriod   string              `yaml:"orphanGracePeriod,omitempty"`
     filePath            string
     lastModTime         time.Time
     temporary           bool
@@ -29,7 +45,7 @@ type NsData struct {
     Address                     string `yaml:"restIp"`
     Username                    string `yaml:"username"`
     Password                    string `yaml:"password"`
-    Zone                        string `yaml: "zone"`
+    Zone                        string `yaml:"zone"`
     DefaultVolumeGroup          string `yaml:"defaultVolumeGroup,omitempty"`
     DefaultTargetGroup          string `yaml:"defaultTargetGroup,omitempty"`
     DefaultTarget               string `yaml:"defaultTarget,omitempty"`
@@ -45,6 +61,7 @@ type NsData struct {
     ChapSecret                  string `yaml:"chapSecret"`
     MountPointPermissions       string `yaml:"mountPointPermissions"`
     InsecureSkipVerify          *bool  `yaml:"insecureSkipVerify,omitempty"`
+    OvercommitRatio             float64 `yaml:"overcommitRatio,omitempty"`
 }
 
 // GetFilePath - get filepath of found config file
@@ -52,6 +69,15 @@ func (c *Config) GetFilePath() string {
     return c.filePath
 }
 
+// GetOrphanGracePeriod - orphan collector grace period, DefaultOrphanGracePeriod if it's not set
+func (c *Config) GetOrphanGracePeriod() time.Duration {
+    gracePeriod, err := time.ParseDuration(c.OrphanGracePeriod)
+    if err != nil {
+        return DefaultOrphanGracePeriod
+    }
+    return gracePeriod
+}
+
 // Refresh - read and validate config, return `true` if config has been changed
 func (c *Config) Refresh(secret string) (changed bool, err error) {
     if c.filePath == "" {
@@ -110,6 +136,15 @@ func (c *Config) Validate() error {
                 }
             }
         }
+        if data.DefaultVolumeGroup != "" && !regexpVolumeGroup.MatchString(data.DefaultVolumeGroup) {
+            errors = append(
+                errors,
+                fmt.Sprintf(
+                    "parameter 'defaultVolumeGroup' has invalid value: '%s', should be 'pool/volumeGroup[/...]'",
+                    data.DefaultVolumeGroup,
+                ),
+            )
+        }
         if data.Username == "" {
             errors = append(errors, fmt.Sprintf("parameter 'username' is required but not passed"))
         }
@@ -130,6 +165,12 @@ func (c *Config) Validate() error {
             }
         }
 
+        if data.OvercommitRatio < 0 {
+            errors = append(errors, fmt.Sprintf(
+                "parameter 'overcommitRatio' has invalid value: '%g', should be a non-negative number",
+                data.OvercommitRatio))
+        }
+
         if data.InsecureSkipVerify == nil {
             insecureSkipVerify := DefaultInsecureSkipVerify
             data.InsecureSkipVerify = &insecureSkipVerify
@@ -142,6 +183,20 @@ func (c *Config) Validate() error {
 
     }
 
+    switch c.OrphanCollector {
+    case "", OrphanCollectorOff, OrphanCollectorDryRun, OrphanCollectorReclaim:
+    default:
+        return fmt.Errorf(
+            "parameter 'orphanCollector' has invalid value: '%s', allowed values: %s, %s, %s",
+            c.OrphanCollector, OrphanCollectorOff, OrphanCollectorDryRun, OrphanCollectorReclaim)
+    }
+    if c.OrphanGracePeriod != "" {
+        if gracePeriod, err := time.ParseDuration(c.OrphanGracePeriod); err != nil || gracePeriod < 0 {
+            return fmt.Errorf(
+                "parameter 'orphanGracePeriod' has invalid value: '%s', should be a duration, e.g. '24h'",
+                c.OrphanGracePeriod)
+        }
+    }
 
     return nil
 }
@@ -171,7 +226,11 @@ func New(lookUpDir string) (*Config, error) {
         return nil, fmt.Errorf("Cannot find .yaml config file in '%s' directory", lookUpDir)
     }
 
-    // read config file
+    return Load(configFilePath)
+}
+
+// Load - create config instance from the file, each instance is refreshed on its own
+func Load(configFilePath string) (*Config, error) {
     config := &Config{filePath: configFilePath}
     if _, err := config.Refresh(""); err != nil {
         return nil, fmt.Errorf("Cannot refresh config from file '%s': %s", configFilePath, err)
@@ -0,0 +1,343 @@
+// Package csiid encodes and decodes CSI volume and snapshot IDs used by the driver.
+//
+// Version 1 IDs (all IDs created by the driver so far) have no version prefix:
+//
+//	volume:   <configName>:<pool>/<volumeGroup>/<volume>
+//	snapshot: <configName>:<pool>/<volumeGroup>/<volume>@<snapshot>
+//	group snapshot: <configName>:<pool>/<volumeGroup>@<snapshot>
+//
+// Volume group may be nested, the volume name is always the last path segment and everything before it
+// is the volume group path, e.g. "ns1:pool/tenant/env/volumes/pvc-1".
+//
+// Group snapshot is a recursive snapshot of the volume group, its members are snapshots of the volumes
+// with the same name, so member snapshot IDs are regular snapshot IDs. Group snapshot IDs are accepted
+// by group snapshot RPCs only: with nested volume group, a group snapshot ID may look like a snapshot ID.
+//
+// Explicitly versioned IDs have "v<N>:" prefix (e.g. "v1:<configName>:<path>"), so future formats
+// can be told apart from the old ones and IDs stored in existing PVs keep working.
+package csiid
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Version1 - "<configName>:<volumePath>[@<snapshot>]" format
+	Version1 = 1
+
+	// CurrentVersion - version of new IDs
+	CurrentVersion = Version1
+)
+
+const (
+	configSeparator   = ":"
+	snapshotSeparator = "@"
+	pathSeparator     = "/"
+
+	// minVolumePathDepth - volume path has at least pool, volume group and volume segments,
+	// volume group may be nested (e.g. "pool/tenant/env/volumes/pvc-1")
+	minVolumePathDepth = 3
+)
+
+var regexpVersion = regexp.MustCompile(`^v([0-9]+)$`)
+
+// Error - ID can't be decoded or encoded, such ID can't refer to an existing volume or snapshot,
+// returned from RPC as InvalidArgument
+type Error struct {
+	ID     string
+	Reason string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("Invalid ID '%s': %s", e.ID, e.Reason)
+}
+
+// GRPCStatus - makes status.Code() return InvalidArgument for this error
+func (e *Error) GRPCStatus() *status.Status {
+	return status.New(codes.InvalidArgument, e.Error())
+}
+
+// IsInvalid - true if err is ID format error
+func IsInvalid(err error) bool {
+	_, ok := err.(*Error)
+	return ok
+}
+
+// NotFound - converts ID format error to NotFound status for RPCs which must report unknown IDs this way
+func NotFound(err error) error {
+	return status.Error(codes.NotFound, err.Error())
+}
+
+// VolumeID - CSI volume ID
+type VolumeID struct {
+	Version int
+
+	// ConfigName - NexentaStor name in driver config (nexentastor_map key)
+	ConfigName string
+
+	// VolumeGroup - volume group path including pool, e.g. "pool1/csiVolumeGroup" or "pool1/tenant/env/volumes"
+	VolumeGroup string
+
+	// Name - volume name in the volume group
+	Name string
+}
+
+// NewVolumeID - creates ID of NexentaStor volume (e.g. "pool1/csiVolumeGroup/pvc-1") in the current format
+func NewVolumeID(configName, volumePath string) (VolumeID, error) {
+	id := VolumeID{Version: CurrentVersion, ConfigName: configName}
+	id.VolumeGroup, id.Name = splitPath(volumePath)
+	if err := id.validate(); err != nil {
+		return VolumeID{}, &Error{ID: configName + configSeparator + volumePath, Reason: err.Error()}
+	}
+	return id, nil
+}
+
+// ParseVolumeID - decodes CSI volume ID
+func ParseVolumeID(volumeID string) (VolumeID, error) {
+	version, configName, volumePath, err := parse(volumeID)
+	if err != nil {
+		return VolumeID{}, err
+	}
+	if strings.Contains(volumePath, snapshotSeparator) {
+		return VolumeID{}, &Error{ID: volumeID, Reason: "snapshot ID is used as volume ID"}
+	}
+
+	id := VolumeID{Version: version, ConfigName: configName}
+	id.VolumeGroup, id.Name = splitPath(volumePath)
+	if err := id.validate(); err != nil {
+		return VolumeID{}, &Error{ID: volumeID, Reason: err.Error()}
+	}
+	return id, nil
+}
+
+// Pool - pool name
+func (id VolumeID) Pool() string {
+	return strings.SplitN(id.VolumeGroup, pathSeparator, 2)[0]
+}
+
+// Path - NexentaStor volume path
+func (id VolumeID) Path() string {
+	return id.VolumeGroup + pathSeparator + id.Name
+}
+
+// String - encodes the ID, version 1 IDs are encoded without version prefix
+func (id VolumeID) String() string {
+	return encode(id.Version, id.ConfigName, id.Path())
+}
+
+// Snapshot - returns ID of the volume snapshot with the given name
+func (id VolumeID) Snapshot(name string) (SnapshotID, error) {
+	return newSnapshotID(id.String()+snapshotSeparator+name, id.Version, id.ConfigName, id.Path()+snapshotSeparator+name)
+}
+
+func (id VolumeID) validate() error {
+	if id.Version != Version1 {
+		return fmt.Errorf("unsupported ID version: %d", id.Version)
+	}
+	if id.ConfigName == "" {
+		return fmt.Errorf("NexentaStor config name is empty")
+	} else if strings.Contains(id.ConfigName, configSeparator) {
+		return fmt.Errorf("NexentaStor config name contains '%s'", configSeparator)
+	}
+	segments := strings.Split(id.Path(), pathSeparator)
+	if len(segments) < minVolumePathDepth {
+		return fmt.Errorf("volume path must be in <pool>/<volumeGroup>[/...]/<volume> format")
+	}
+	for _, s := range segments {
+		if s == "" {
+			return fmt.Errorf("volume path has empty segment")
+		} else if strings.Contains(s, configSeparator) || strings.Contains(s, snapshotSeparator) {
+			return fmt.Errorf("volume path segment '%s' contains reserved character", s)
+		}
+	}
+	return nil
+}
+
+// SnapshotID - CSI snapshot ID
+type SnapshotID struct {
+	// Volume - ID of snapshot parent volume
+	Volume VolumeID
+
+	// Name - snapshot name
+	Name string
+}
+
+// NewSnapshotID - creates ID of NexentaStor snapshot (e.g. "pool1/csiVolumeGroup/pvc-1@snap-1")
+// in the current format
+func NewSnapshotID(configName, snapshotPath string) (SnapshotID, error) {
+	return newSnapshotID(configName+configSeparator+snapshotPath, CurrentVersion, configName, snapshotPath)
+}
+
+// ParseSnapshotID - decodes CSI snapshot ID
+func ParseSnapshotID(snapshotID string) (SnapshotID, error) {
+	version, configName, snapshotPath, err := parse(snapshotID)
+	if err != nil {
+		return SnapshotID{}, err
+	}
+	return newSnapshotID(snapshotID, version, configName, snapshotPath)
+}
+
+func newSnapshotID(rawID string, version int, configName, snapshotPath string) (SnapshotID, error) {
+	parts := strings.Split(snapshotPath, snapshotSeparator)
+	if len(parts) != 2 {
+		return SnapshotID{}, &Error{ID: rawID, Reason: "snapshot path must be in <volume>@<snapshot> format"}
+	}
+	if parts[1] == "" {
+		return SnapshotID{}, &Error{ID: rawID, Reason: "snapshot name is empty"}
+	} else if strings.ContainsAny(parts[1], configSeparator+pathSeparator) {
+		return SnapshotID{}, &Error{ID: rawID, Reason: "snapshot name contains reserved character"}
+	}
+
+	volume := VolumeID{Version: version, ConfigName: configName}
+	volume.VolumeGroup, volume.Name = splitPath(parts[0])
+	if err := volume.validate(); err != nil {
+		return SnapshotID{}, &Error{ID: rawID, Reason: err.Error()}
+	}
+	return SnapshotID{Volume: volume, Name: parts[1]}, nil
+}
+
+// Path - NexentaStor snapshot path
+func (id SnapshotID) Path() string {
+	return id.Volume.Path() + snapshotSeparator + id.Name
+}
+
+// String - encodes the ID, version 1 IDs are encoded without version prefix
+func (id SnapshotID) String() string {
+	return encode(id.Volume.Version, id.Volume.ConfigName, id.Path())
+}
+
+// GroupSnapshotID - CSI volume group snapshot ID
+type GroupSnapshotID struct {
+	Version int
+
+	// ConfigName - NexentaStor name in driver config (nexentastor_map key)
+	ConfigName string
+
+	// VolumeGroup - path of the volume group snapshotted recursively
+	VolumeGroup string
+
+	// Name - snapshot name, all member snapshots have this name
+	Name string
+}
+
+// NewGroupSnapshotID - creates ID of recursive snapshot of the volume group in the current format
+func NewGroupSnapshotID(configName, volumeGroup, name string) (GroupSnapshotID, error) {
+	id := GroupSnapshotID{Version: CurrentVersion, ConfigName: configName, VolumeGroup: volumeGroup, Name: name}
+	if err := id.validate(); err != nil {
+		return GroupSnapshotID{}, &Error{ID: id.String(), Reason: err.Error()}
+	}
+	return id, nil
+}
+
+// ParseGroupSnapshotID - decodes CSI volume group snapshot ID
+func ParseGroupSnapshotID(groupSnapshotID string) (GroupSnapshotID, error) {
+	version, configName, snapshotPath, err := parse(groupSnapshotID)
+	if err != nil {
+		return GroupSnapshotID{}, err
+	}
+	parts := strings.Split(snapshotPath, snapshotSeparator)
+	if len(parts) != 2 {
+		return GroupSnapshotID{}, &Error{
+			ID:     groupSnapshotID,
+			Reason: "group snapshot path must be in <volumeGroup>@<snapshot> format",
+		}
+	}
+	id := GroupSnapshotID{Version: version, ConfigName: configName, VolumeGroup: parts[0], Name: parts[1]}
+	if err := id.validate(); err != nil {
+		return GroupSnapshotID{}, &Error{ID: groupSnapshotID, Reason: err.Error()}
+	}
+	return id, nil
+}
+
+// Path - NexentaStor snapshot path of the volume group
+func (id GroupSnapshotID) Path() string {
+	return id.VolumeGroup + snapshotSeparator + id.Name
+}
+
+// String - encodes the ID, version 1 IDs are encoded without version prefix
+func (id GroupSnapshotID) String() string {
+	return encode(id.Version, id.ConfigName, id.Path())
+}
+
+// Member - returns ID of the member snapshot of the volume, false if the volume isn't in the volume group
+func (id GroupSnapshotID) Member(volume VolumeID) (SnapshotID, bool) {
+	if volume.ConfigName != id.ConfigName || volume.VolumeGroup != id.VolumeGroup {
+		return SnapshotID{}, false
+	}
+	return SnapshotID{Volume: volume, Name: id.Name}, true
+}
+
+func (id GroupSnapshotID) validate() error {
+	if id.Version != Version1 {
+		return fmt.Errorf("unsupported ID version: %d", id.Version)
+	}
+	if id.ConfigName == "" {
+		return fmt.Errorf("NexentaStor config name is empty")
+	} else if strings.Contains(id.ConfigName, configSeparator) {
+		return fmt.Errorf("NexentaStor config name contains '%s'", configSeparator)
+	}
+	segments := strings.Split(id.VolumeGroup, pathSeparator)
+	if len(segments) < minVolumePathDepth-1 {
+		return fmt.Errorf("volume group path must be in <pool>/<volumeGroup>[/...] format")
+	}
+	for _, s := range segments {
+		if s == "" {
+			return fmt.Errorf("volume group path has empty segment")
+		} else if strings.Contains(s, configSeparator) || strings.Contains(s, snapshotSeparator) {
+			return fmt.Errorf("volume group path segment '%s' contains reserved character", s)
+		}
+	}
+	if id.Name == "" {
+		return fmt.Errorf("snapshot name is empty")
+	} else if strings.ContainsAny(id.Name, configSeparator+pathSeparator+snapshotSeparator) {
+		return fmt.Errorf("snapshot name contains reserved character")
+	}
+	return nil
+}
+
+// parse - splits ID to version, config name and NexentaStor path
+func parse(id string) (version int, configName, nsPath string, err error) {
+	if id == "" {
+		return 0, "", "", &Error{ID: id, Reason: "ID is empty"}
+	}
+
+	parts := strings.Split(id, configSeparator)
+	switch len(parts) {
+	case 2:
+		return Version1, parts[0], parts[1], nil
+	case 3:
+		match := regexpVersion.FindStringSubmatch(parts[0])
+		if match == nil {
+			break
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil || version != Version1 {
+			return 0, "", "", &Error{ID: id, Reason: fmt.Sprintf("unsupported ID version: %s", parts[0])}
+		}
+		return version, parts[1], parts[2], nil
+	}
+
+	return 0, "", "", &Error{ID: id, Reason: "ID must be in [v<N>:]<configName>:<path> format"}
+}
+
+func encode(version int, configName, nsPath string) string {
+	if version == Version1 {
+		return configName + configSeparator + nsPath
+	}
+	return fmt.Sprintf("v%d%s%s%s%s", version, configSeparator, configName, configSeparator, nsPath)
+}
+
+// splitPath - splits path to parent path and last segment
+func splitPath(p string) (parent, name string) {
+	i := strings.LastIndex(p, pathSeparator)
+	if i < 0 {
+		return "", p
+	}
+	return p[:i], p[i+1:]
+}
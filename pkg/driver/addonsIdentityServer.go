@@ -0,0 +1,85 @@
+package driver
+
+import (
+	"github.com/csi-addons/spec/lib/go/identity"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/config"
+)
+
+// AddonsIdentityServer - csi-addons identity server, csi-addons sidecar uses it to discover
+// that the controller serves the replication service
+type AddonsIdentityServer struct {
+	identity.UnimplementedIdentityServer
+	config *config.Config
+	log    *logrus.Entry
+}
+
+// GetIdentity - returns driver name and version
+func (ids *AddonsIdentityServer) GetIdentity(ctx context.Context, req *identity.GetIdentityRequest) (
+	*identity.GetIdentityResponse,
+	error,
+) {
+	ids.log.WithField("func", "GetIdentity()").Infof("request: '%+v'", req)
+
+	return &identity.GetIdentityResponse{
+		Name:          Name,
+		VendorVersion: Version,
+	}, nil
+}
+
+// GetCapabilities - returns csi-addons capabilities of the controller
+func (ids *AddonsIdentityServer) GetCapabilities(ctx context.Context, req *identity.GetCapabilitiesRequest) (
+	*identity.GetCapabilitiesResponse,
+	error,
+) {
+	ids.log.WithField("func", "GetCapabilities()").Infof("request: '%+v'", req)
+
+	return &identity.GetCapabilitiesResponse{
+		Capabilities: []*identity.Capability{
+			{
+				Type: &identity.Capability_Service_{
+					Service: &identity.Capability_Service{
+						Type: identity.Capability_Service_CONTROLLER_SERVICE,
+					},
+				},
+			},
+			{
+				Type: &identity.Capability_VolumeReplication_{
+					VolumeReplication: &identity.Capability_VolumeReplication{
+						Type: identity.Capability_VolumeReplication_VOLUME_REPLICATION,
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// Probe - returns driver status, it's ready if the config file can be used
+func (ids *AddonsIdentityServer) Probe(ctx context.Context, req *identity.ProbeRequest) (
+	*identity.ProbeResponse,
+	error,
+) {
+	ids.log.WithField("func", "Probe()").Infof("request: '%+v'", req)
+
+	if _, err := ids.config.Refresh(""); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
+	}
+
+	return &identity.ProbeResponse{Ready: wrapperspb.Bool(true)}, nil
+}
+
+// NewAddonsIdentityServer - create an instance of csi-addons identity service
+func NewAddonsIdentityServer(driver *Driver) *AddonsIdentityServer {
+	l := driver.log.WithField("cmp", "AddonsIdentityServer")
+	l.Info("create new AddonsIdentityServer...")
+
+	return &AddonsIdentityServer{
+		config: driver.config,
+		log:    l,
+	}
+}
@@ -0,0 +1,76 @@
+package driver
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/config"
+)
+
+// backgroundNS - config and NexentaStor resolvers of background loops (snapshot schedules, orphan collector,
+// trash purge). RPCs replace the driver config with the one of request secrets and update their resolvers
+// without a lock, so the loops read the config file on their own and run one at a time.
+type backgroundNS struct {
+	mux           sync.Mutex
+	config        *config.Config
+	newResolver   ResolverFactory
+	nsResolverMap map[string]ns.Resolver
+	log           *logrus.Entry
+}
+
+// refresh - rereads the config file, resolvers are recreated if it has been changed
+func (b *backgroundNS) refresh() error {
+	changed, err := b.config.Refresh("")
+	if err != nil {
+		return err
+	}
+	if !changed && b.nsResolverMap != nil {
+		return nil
+	}
+
+	// NexentaStors removed from the config are not resolved anymore
+	resolverMap := make(map[string]ns.Resolver, len(b.config.NsMap))
+	for name, cfg := range b.config.NsMap {
+		resolver, err := b.newResolver(ns.ResolverArgs{
+			Address:            cfg.Address,
+			Username:           cfg.Username,
+			Password:           cfg.Password,
+			Log:                b.log,
+			InsecureSkipVerify: *cfg.InsecureSkipVerify,
+		})
+		if err != nil {
+			return fmt.Errorf("Cannot create NexentaStor resolver: %s", err)
+		}
+		resolverMap[name] = *resolver
+	}
+	b.nsResolverMap = resolverMap
+	return nil
+}
+
+// withBackgroundNS - runs background job with the config file and its resolvers, jobs don't run concurrently,
+// so the config and resolvers don't change while the job uses them
+func (s *ControllerServer) withBackgroundNS(
+	job func(cfg *config.Config, nsResolverMap map[string]ns.Resolver) error,
+) error {
+	s.background.mux.Lock()
+	defer s.background.mux.Unlock()
+
+	if err := s.background.refresh(); err != nil {
+		return fmt.Errorf("Cannot use config file: %s", err)
+	}
+	return job(s.background.config, s.background.nsResolverMap)
+}
+
+// isLeader - the controller replica runs background jobs, the only replica does it if leader election is off
+func (s *ControllerServer) isLeader() bool {
+	return s.leader == nil || s.leader.IsLeader()
+}
+
+// leaderElected - the controller replica is elected by leader election, jobs which destroy objects
+// that RPCs of other replicas may still use run on the elected leader only
+func (s *ControllerServer) leaderElected() bool {
+	return s.leader != nil && s.leader.IsLeader()
+}
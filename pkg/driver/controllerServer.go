@@ -3,6 +3,7 @@ package driver
 import (
     "fmt"
     "path/filepath"
+    "sort"
     "strconv"
     "strings"
     "time"
@@ -10,6 +11,7 @@ import (
     "github.com/container-storage-interface/spec/lib/go/csi"
     // "google.golang.org/protobuf/ptypes"
     "google.golang.org/protobuf/types/known/timestamppb"
+    "google.golang.org/protobuf/types/known/wrapperspb"
     "github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
     "github.com/sirupsen/logrus"
     "golang.org/x/net/context"
@@ -18,6 +20,7 @@ import (
 
     "github.com/Nexenta/go-nexentastor/pkg/ns"
     "github.com/Nexenta/nexentastor-csi-driver-block/pkg/config"
+    "github.com/Nexenta/nexentastor-csi-driver-block/pkg/csiid"
 )
 
 const TopologyKeyZone = "topology.kubernetes.io/zone"
@@ -33,6 +36,10 @@ var supportedControllerCapabilities = []csi.ControllerServiceCapability_RPC_Type
     csi.ControllerServiceCapability_RPC_GET_CAPACITY,
     csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
     csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+    csi.ControllerServiceCapability_RPC_GET_VOLUME,
+    csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+    csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+    csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,
 }
 
 // supportedVolumeCapabilities - driver volume capabilities
@@ -57,8 +64,13 @@ var supportedVolumeCapabilities = []*csi.VolumeCapability{
 // ControllerServer - k8s csi driver controller server
 type ControllerServer struct {
     nsResolverMap   map[string]ns.Resolver
+    newResolver     ResolverFactory
     config          *config.Config
     log             *logrus.Entry
+    roundRobin      *roundRobinPlacement
+    orphans         *orphanCollector
+    background      *backgroundNS
+    leader          LeaderElector
 }
 
 type ResolveNSParams struct {
@@ -81,23 +93,38 @@ func (s *ControllerServer) refreshConfig(secret string) error {
     if changed {
         s.log.Info("config has been changed, updating...")
         for name, cfg := range s.config.NsMap {
-            resolver, err := ns.NewResolver(ns.ResolverArgs{
+            resolver, err := s.newResolver(ns.ResolverArgs{
                 Address:            cfg.Address,
                 Username:           cfg.Username,
                 Password:           cfg.Password,
                 Log:                s.log,
                 InsecureSkipVerify: *cfg.InsecureSkipVerify,
             })
-            s.nsResolverMap[name] = *resolver
             if err != nil {
                 return fmt.Errorf("Cannot create NexentaStor resolver: %s", err)
             }
+            s.nsResolverMap[name] = *resolver
         }
     }
 
     return nil
 }
 
+// configNames - NexentaStor config names (nexentastor_map keys) sorted by name
+func (s *ControllerServer) configNames() []string {
+    return sortedConfigNames(s.config)
+}
+
+// sortedConfigNames - nexentastor_map keys of the config sorted by name
+func sortedConfigNames(cfg *config.Config) []string {
+    names := make([]string, 0, len(cfg.NsMap))
+    for name := range cfg.NsMap {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
 func (s *ControllerServer) resolveNS(params ResolveNSParams) (response ResolveNSResponse, err error) {
     l := s.log.WithField("func", "resolveNS()")
     l.Infof("Resolving NS with params: %+v", params)
@@ -124,7 +151,7 @@ func (s *ControllerServer) resolveNS(params ResolveNSParams) (response ResolveNS
 }
 
 func (s *ControllerServer) resolveNSNoZone(params ResolveNSParams) (response ResolveNSResponse, err error) {
-    // No zone -> pick NS for given volumeGroup and configName. TODO: load balancing
+    // No zone -> pick NS for given volumeGroup and configName, new volumes are placed by placeVolume()
     l := s.log.WithField("func", "resolveNSNoZone()")
     l.Infof("Resolving without zone, params: %+v", params)
     var nsProvider ns.ProviderInterface
@@ -133,7 +160,14 @@ func (s *ControllerServer) resolveNSNoZone(params ResolveNSParams) (response Res
         if volumeGroup == "" {
             volumeGroup = s.config.NsMap[params.configName].DefaultVolumeGroup
         }
-        resolver := s.nsResolverMap[params.configName]
+        resolver, ok := s.nsResolverMap[params.configName]
+        if !ok {
+            // e.g. volume ID of NexentaStor that was removed from the config
+            return response, &ns.NefError{
+                Err: fmt.Errorf("NexentaStor '%s' is not in the config", params.configName),
+                Code: "ENOENT",
+            }
+        }
         nsProvider, err = resolver.ResolveFromVg(volumeGroup)
         if err != nil {
             return response, err
@@ -145,7 +179,8 @@ func (s *ControllerServer) resolveNSNoZone(params ResolveNSParams) (response Res
         }
         return response, nil
     } else {
-        for name, resolver := range s.nsResolverMap {
+        for _, name := range s.configNames() {
+            resolver := s.nsResolverMap[name]
             if params.volumeGroup == "" {
                 volumeGroup = s.config.NsMap[name].DefaultVolumeGroup
             }
@@ -169,7 +204,7 @@ func (s *ControllerServer) resolveNSNoZone(params ResolveNSParams) (response Res
 }
 
 func (s *ControllerServer) resolveNSWithZone(params ResolveNSParams) (response ResolveNSResponse, err error) {
-    // Pick NS with corresponding zone. TODO: load balancing
+    // Pick NS with corresponding zone, new volumes are placed by placeVolume()
     l := s.log.WithField("func", "resolveNSWithZone()")
     l.Infof("Resolving with zone, params: %+v", params)
     var nsProvider ns.ProviderInterface
@@ -195,7 +230,8 @@ func (s *ControllerServer) resolveNSWithZone(params ResolveNSParams) (response R
         }
         return response, nil
     } else {
-        for name, resolver := range s.nsResolverMap {
+        for _, name := range s.configNames() {
+            resolver := s.nsResolverMap[name]
             if params.zone == s.config.NsMap[name].Zone {
                 if volumeGroup == "" {
                     volumeGroup = s.config.NsMap[name].DefaultVolumeGroup
@@ -236,9 +272,8 @@ func (s *ControllerServer) ValidateVolumeCapabilities(ctx context.Context, req *
     if len(volumeId) == 0 {
         return nil, status.Error(codes.InvalidArgument, "Volume ID must be provided")
     }
-    splittedVol := strings.Split(volumeId, ":")
-    if len(splittedVol) != 2 {
-        return nil, status.Error(codes.NotFound, fmt.Sprintf("VolumeId is in wrong format: %s", volumeId))
+    if _, err := csiid.ParseVolumeID(volumeId); err != nil {
+        return nil, csiid.NotFound(err)
     }
 
     volumeCapabilities := req.GetVolumeCapabilities()
@@ -249,11 +284,7 @@ func (s *ControllerServer) ValidateVolumeCapabilities(ctx context.Context, req *
     // volume attributes are passed from ControllerServer.CreateVolume()
     volumeContext := req.GetVolumeContext()
 
-    var secret string
-    secrets := req.GetSecrets()
-    for _, v := range secrets {
-        secret = v
-    }
+    secret := getConfigSecret(req.GetSecrets())
     err := s.refreshConfig(secret)
     if err != nil {
         return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
@@ -297,17 +328,16 @@ func (s *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.
     l := s.log.WithField("func", "ControllerExpandVolume()")
     l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
 
-    var secret string
-    secrets := req.GetSecrets()
-    for _, v := range secrets {
-        secret = v
-    }
+    secret := getConfigSecret(req.GetSecrets())
     err := s.refreshConfig(secret)
     if err != nil {
         return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
     }
-    capacityBytes := req.GetCapacityRange().GetRequiredBytes()
-    if capacityBytes == 0 {
+    capacity, err := parseVolumeCapacity(req.GetCapacityRange(), nil)
+    if err != nil {
+        return nil, err
+    }
+    if capacity.requiredBytes == 0 {
         return nil, status.Error(codes.InvalidArgument, "GetRequiredBytes must be >0")
     }
 
@@ -315,22 +345,15 @@ func (s *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.
     if len(volumeId) == 0 {
         return nil, status.Error(codes.InvalidArgument, "Volume ID must be provided")
     }
-    splittedVol := strings.Split(volumeId, ":")
-    if len(splittedVol) != 2 {
-        return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("VolumeId is in wrong format: %s", volumeId))
-    }
-    configName, volumePath := splittedVol[0], splittedVol[1]
-
-    splittedPath := strings.Split(volumePath, "/")
-    if len(splittedPath) != 3 {
-        l.Infof("Got wrong volumeId, but that is OK for deletion")
-        return &csi.ControllerExpandVolumeResponse{}, nil
+    id, err := csiid.ParseVolumeID(volumeId)
+    if err != nil {
+        return nil, err
     }
-    volumeGroup := strings.Join(splittedPath[:2], "/")
+    volumePath := id.Path()
 
     params := ResolveNSParams{
-        volumeGroup: volumeGroup,
-        configName: configName,
+        volumeGroup: id.VolumeGroup,
+        configName: id.ConfigName,
     }
     resolveResp, err := s.resolveNS(params)
     if err != nil {
@@ -340,14 +363,26 @@ func (s *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.
 
     // Check if volume was not already expanded
     l.Debugf("Checking volume %s size", volumePath)
-    volInfo, err := nsProvider.GetVolume(volumePath)
+    volInfo, err := getVolumeStatus(nsProvider, volumePath)
     if err != nil {
         return nil, err
     }
     currentSize := volInfo.VolumeSize
     l.Debugf("Current size of volume %s = %+v", volumePath, currentSize)
 
+    // new size is rounded up to the volume block size and limited by max size of the StorageClass
+    capacity.maxBytes = volumeMaxSize(volInfo.UserProperties)
+    capacityBytes, err := capacity.size(volInfo.VolumeBlockSize)
+    if err != nil {
+        return nil, err
+    }
+
     if currentSize < capacityBytes {
+        err = checkOvercommit(nsProvider, id.VolumeGroup, volumePath, capacityBytes,
+            s.volumeOvercommitRatio(id.ConfigName, volInfo.UserProperties))
+        if err != nil {
+            return nil, err
+        }
         l.Infof("expanding volume %+v to %+v bytes", volumePath, capacityBytes)
         err = nsProvider.UpdateVolume(volumePath, ns.UpdateVolumeParams{
             VolumeSize: capacityBytes,
@@ -362,10 +397,70 @@ func (s *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.
         }, nil
     }
     return &csi.ControllerExpandVolumeResponse{
-        CapacityBytes: capacityBytes,
+        CapacityBytes: currentSize,
     }, nil
 }
 
+// ControllerModifyVolume - changes ZFS properties of existing volume to VolumeAttributesClass parameters
+func (s *ControllerServer) ControllerModifyVolume(ctx context.Context, req *csi.ControllerModifyVolumeRequest) (
+    *csi.ControllerModifyVolumeResponse,
+    error,
+) {
+    l := s.log.WithField("func", "ControllerModifyVolume()")
+    l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
+
+    volumeId := req.GetVolumeId()
+    if len(volumeId) == 0 {
+        return nil, status.Error(codes.InvalidArgument, "Volume ID must be provided")
+    }
+    id, err := csiid.ParseVolumeID(volumeId)
+    if err != nil {
+        return nil, csiid.NotFound(err)
+    }
+
+    // validate parameters before any NexentaStor request
+    update, err := parseVolumeUpdate(req.GetMutableParameters())
+    if err != nil {
+        return nil, status.Error(codes.InvalidArgument, err.Error())
+    }
+
+    secret := getConfigSecret(req.GetSecrets())
+    err = s.refreshConfig(secret)
+    if err != nil {
+        return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
+    }
+
+    params := ResolveNSParams{
+        volumeGroup: id.VolumeGroup,
+        configName: id.ConfigName,
+    }
+    resolveResp, err := s.resolveNS(params)
+    if err != nil {
+        return nil, err
+    }
+    nsProvider := resolveResp.nsProvider
+
+    volume, err := getVolumeStatus(nsProvider, id.Path())
+    if ns.IsNotExistNefError(err) {
+        return nil, status.Errorf(codes.NotFound, "Volume '%s' not found on %s", id.Path(), nsProvider)
+    } else if err != nil {
+        return nil, status.Errorf(codes.Internal, "Cannot get volume '%s': %s", id.Path(), err)
+    }
+    if err = update.setVolumeSize(volume.VolumeSize); err != nil {
+        return nil, status.Error(codes.InvalidArgument, err.Error())
+    }
+
+    // NEF sets the same values again if the request is retried
+    l.Infof("modifying volume '%s', parameters: %v", id.Path(), req.GetMutableParameters())
+    err = updateVolume(nsProvider, id.Path(), update)
+    if err != nil {
+        return nil, status.Errorf(codes.Internal, "Cannot modify volume '%s': %s", id.Path(), err)
+    }
+
+    l.Infof("volume '%s' has been modified", id.Path())
+    return &csi.ControllerModifyVolumeResponse{}, nil
+}
+
 func (s *ControllerServer) pickAvailabilityZone(requirement *csi.TopologyRequirement) string {
     l := s.log.WithField("func", "s.pickAvailabilityZone()")
     l.Infof("AccessibilityRequirements: '%+v'", requirement)
@@ -387,12 +482,101 @@ func (s *ControllerServer) pickAvailabilityZone(requirement *csi.TopologyRequire
     return ""
 }
 
+// ControllerGetVolume - returns volume capacity, condition and nodes the volume is published to
 func (s *ControllerServer) ControllerGetVolume(
     ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error,
 ) {
-    return nil, status.Errorf(codes.Unimplemented, "method CreateVolume not implemented")
+    l := s.log.WithField("func", "ControllerGetVolume()")
+    l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
+
+    volumeId := req.GetVolumeId()
+    if len(volumeId) == 0 {
+        return nil, status.Error(codes.InvalidArgument, "Volume ID must be provided")
+    }
+    id, err := csiid.ParseVolumeID(volumeId)
+    if err != nil {
+        return nil, csiid.NotFound(err)
+    }
+
+    err = s.refreshConfig("")
+    if err != nil {
+        return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
+    }
+
+    params := ResolveNSParams{
+        volumeGroup: id.VolumeGroup,
+        configName: id.ConfigName,
+    }
+    resolveResp, err := s.resolveNS(params)
+    if err != nil {
+        return nil, err
+    }
+    nsProvider := resolveResp.nsProvider
+
+    volume, condition, err := s.getVolumeCondition(nsProvider, id)
+    if err != nil {
+        return nil, err
+    }
+
+    publishedNodeIds := getPublishedNodes(volume)
+
+    l.Infof("volume '%s' condition: %+v, published to: %v", id.Path(), condition, publishedNodeIds)
+    return &csi.ControllerGetVolumeResponse{
+        Volume: &csi.Volume{
+            VolumeId: volumeId,
+            CapacityBytes: volume.VolumeSize,
+        },
+        Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+            PublishedNodeIds: publishedNodeIds,
+            VolumeCondition: condition,
+        },
+    }, nil
+}
+
+// getVolumeCondition - volume is abnormal if it's missing or offline, or its pool is not healthy,
+// returned volume has empty path if it doesn't exist
+func (s *ControllerServer) getVolumeCondition(nsProvider ns.ProviderInterface, id csiid.VolumeID) (
+    volume nefVolume, condition *csi.VolumeCondition, err error,
+) {
+    volume, err = getVolumeStatus(nsProvider, id.Path())
+    if ns.IsNotExistNefError(err) {
+        return nefVolume{}, &csi.VolumeCondition{
+            Abnormal: true,
+            Message: fmt.Sprintf("Volume '%s' not found on %s", id.Path(), nsProvider),
+        }, nil
+    } else if err != nil {
+        return volume, nil, status.Errorf(codes.Internal, "Cannot get volume '%s': %s", id.Path(), err)
+    }
+
+    pool, err := getPool(nsProvider, id.Pool())
+    if err != nil {
+        return volume, nil, status.Errorf(codes.Internal, "Cannot get pool '%s': %s", id.Pool(), err)
+    }
+    return volume, volumeCondition(volume, pool), nil
 }
 
+// volumeCondition - condition of existing volume located on the pool
+func volumeCondition(volume nefVolume, pool nefPool) *csi.VolumeCondition {
+    var problems []string
+    if volume.Status != "" && volume.Status != nefVolumeStatusOnline {
+        problems = append(problems, fmt.Sprintf("volume '%s' is %s", volume.Path, volume.Status))
+    }
+    if volume.encrypted() && volume.KeyStatus == nefKeyStatusUnavailable {
+        problems = append(problems, fmt.Sprintf("encryption key of volume '%s' is not loaded", volume.Path))
+    }
+    if pool.Health != nefPoolHealthOnline {
+        problems = append(problems, fmt.Sprintf("pool '%s' is %s", pool.Name, pool.Health))
+    }
+    if len(problems) != 0 {
+        return &csi.VolumeCondition{Abnormal: true, Message: strings.Join(problems, ", ")}
+    }
+    return &csi.VolumeCondition{Abnormal: false, Message: "Volume is online"}
+}
+
+// GetCapacity - returns space available for new volumes on NexentaStor(s) in the requested topology segment,
+// all of them if it's not set, configName parameter selects one appliance. Available space is summed across
+// the appliances, MaximumVolumeSize is the largest volume one of them can fit and MinimumVolumeSize
+// is the smallest volume block size of their volume groups
 func (s *ControllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (
     *csi.GetCapacityResponse,
     error,
@@ -400,35 +584,81 @@ func (s *ControllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacity
     l := s.log.WithField("func", "GetCapacity()")
     l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
 
+    err := s.refreshConfig("")
+    if err != nil {
+        return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
+    }
+
     reqParams := req.GetParameters()
     if reqParams == nil {
         reqParams = make(map[string]string)
     }
 
-    // get volumeGroup path from runtime params, set default if not specified
+    // get volumeGroup path from runtime params, default volume group of each NexentaStor if not specified
     volumeGroup := ""
     if v, ok := reqParams["volumeGroup"]; ok {
         volumeGroup = v
     }
-
-    params := ResolveNSParams{
-        volumeGroup: volumeGroup,
+    configName := ""
+    if v, ok := reqParams["configName"]; ok {
+        configName = v
+        if _, ok := s.config.NsMap[configName]; !ok {
+            return nil, status.Errorf(codes.InvalidArgument, "NexentaStor '%s' is not in the config", configName)
+        }
     }
-    resolveResp, err := s.resolveNS(params)
-    if err != nil {
-        return nil, err
+    zone := req.GetAccessibleTopology().GetSegments()[TopologyKeyZone]
+
+    res := &csi.GetCapacityResponse{}
+    var errors []string
+    resolved := false
+    for _, name := range s.configNames() {
+        if (configName != "" && name != configName) || (zone != "" && s.config.NsMap[name].Zone != zone) {
+            continue
+        }
+        resolveResp, err := s.resolveNS(ResolveNSParams{
+            volumeGroup: volumeGroup,
+            configName: name,
+        })
+        if status.Code(err) == codes.NotFound {
+            // the volume group is on other appliances, volumes can't be created on this one
+            l.Infof("skip NexentaStor '%s': %s", name, err)
+            continue
+        } else if err != nil {
+            errors = append(errors, err.Error())
+            continue
+        }
+        vg, err := getVolumeGroup(resolveResp.nsProvider, resolveResp.volumeGroup)
+        if err != nil {
+            errors = append(errors, fmt.Sprintf("cannot get volume group '%s' of NexentaStor '%s': %s",
+                resolveResp.volumeGroup, name, err))
+            continue
+        }
+        l.Infof("NexentaStor '%s', volume group '%s': %d bytes available", name, vg.Path, vg.BytesAvailable)
+        resolved = true
+        res.AvailableCapacity += vg.BytesAvailable
+        if vg.BytesAvailable > res.GetMaximumVolumeSize().GetValue() {
+            res.MaximumVolumeSize = wrapperspb.Int64(vg.BytesAvailable)
+        }
+        if vg.VolumeBlockSize > 0 &&
+            (res.MinimumVolumeSize == nil || vg.VolumeBlockSize < res.MinimumVolumeSize.GetValue()) {
+            res.MinimumVolumeSize = wrapperspb.Int64(vg.VolumeBlockSize)
+        }
     }
 
-    nsProvider := resolveResp.nsProvider
-    vgData, err := nsProvider.GetVolumeGroup(resolveResp.volumeGroup)
-    if err != nil {
-        return nil, err
+    // unreachable appliances are skipped, capacity of the rest is still reported to the scheduler
+    if len(errors) != 0 {
+        if !resolved {
+            return nil, status.Errorf(codes.Internal, "Cannot get capacity: %s", strings.Join(errors, "; "))
+        }
+        l.Warnf("capacity of some NexentaStor(s) is not reported: %s", strings.Join(errors, "; "))
     }
-    availableCapacity := vgData.BytesAvailable
-    l.Infof("Available capacity: '%+v' bytes", availableCapacity)
-    return &csi.GetCapacityResponse{
-        AvailableCapacity: availableCapacity,
-    }, nil
+    if resolved && res.MaximumVolumeSize == nil {
+        res.MaximumVolumeSize = wrapperspb.Int64(0)
+    }
+
+    l.Infof("available capacity: %d bytes, max volume size: %d bytes, min volume size: %d bytes",
+        res.GetAvailableCapacity(), res.GetMaximumVolumeSize().GetValue(), res.GetMinimumVolumeSize().GetValue())
+    return res, nil
 }
 
 // CreateVolume - creates volume on NexentaStor
@@ -442,11 +672,7 @@ func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolu
     if len(volumeName) == 0 {
         return nil, status.Error(codes.InvalidArgument, "req.Name must be provided")
     }
-    var secret string
-    secrets := req.GetSecrets()
-    for _, v := range secrets {
-        secret = v
-    }
+    secret := getConfigSecret(req.GetSecrets())
 
     err = s.refreshConfig(secret)
     if err != nil {
@@ -470,6 +696,12 @@ func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolu
     if reqParams == nil {
         reqParams = make(map[string]string)
     }
+    if template, ok := reqParams[paramVolumeNameTemplate]; ok {
+        volumeName, err = formatVolumeName(template, volumeName, reqParams)
+        if err != nil {
+            return nil, status.Error(codes.InvalidArgument, err.Error())
+        }
+    }
     volumeGroup := ""
     if v, ok := reqParams["volumeGroup"]; ok {
         volumeGroup = v
@@ -491,12 +723,48 @@ func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolu
         }
     }
 
+    properties, err := parseVolumeProperties(reqParams)
+    if err != nil {
+        return nil, status.Error(codes.InvalidArgument, err.Error())
+    }
+    setVolumeMetadata(&properties, reqParams)
+
+    reservation, err := parseRefReservation(reqParams, sparseVolume)
+    if err != nil {
+        return nil, status.Error(codes.InvalidArgument, err.Error())
+    }
+    if reservation != nil && reservation.reserveVolumeSize {
+        sparseVolume = false
+    }
+
+    encryption, err := parseVolumeEncryption(reqParams, req.GetSecrets())
+    if err != nil {
+        return nil, status.Error(codes.InvalidArgument, err.Error())
+    }
+
+    placement, err := parseVolumePlacement(reqParams)
+    if err != nil {
+        return nil, status.Error(codes.InvalidArgument, err.Error())
+    }
+
+    replication, err := parseVolumeReplication(reqParams)
+    if err != nil {
+        return nil, status.Error(codes.InvalidArgument, err.Error())
+    }
+    if replication.enabled() {
+        if err := s.validateVolumeReplication(replication, configName); err != nil {
+            return nil, err
+        }
+    }
+
     var sourceSnapshotId string
     var sourceVolumeId string
     var volumePath string
+    var volumeID csiid.VolumeID
     var contentSource *csi.VolumeContentSource
     var nsProvider ns.ProviderInterface
     var resolveResp ResolveNSResponse
+    var decision placementDecision
 
     if volumeContentSource := req.GetVolumeContentSource(); volumeContentSource != nil {
         if sourceSnapshot := volumeContentSource.GetSnapshot(); sourceSnapshot != nil {
@@ -514,6 +782,15 @@ func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolu
         }
     }
 
+    restoreFromTrash := reqParams[paramRestoreFromTrash]
+    if restoreFromTrash != "" && contentSource != nil {
+        return nil, status.Errorf(
+            codes.InvalidArgument,
+            "Parameter '%s' can't be used with volume content source",
+            paramRestoreFromTrash,
+        )
+    }
+
     requirements := req.GetAccessibilityRequirements()
     zone := s.pickAvailabilityZone(requirements)
     params := ResolveNSParams{
@@ -522,150 +799,241 @@ func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolu
         configName: configName,
     }
 
-    // get requested volume size from runtime params, set default if not specified
-    capacityBytes := req.GetCapacityRange().GetRequiredBytes()
-    if capacityBytes == 0 {
-        capacityBytes = 1073741824
+    // requested size is rounded up to the block size once the volume group is known,
+    // size of clones is checked once they exist, their block size is inherited from the source
+    capacity, err := parseVolumeCapacity(req.GetCapacityRange(), reqParams)
+    if err != nil {
+        return nil, err
+    }
+    capacity.setUserProperties(&properties)
+    capacityBytes, err := capacity.size(0)
+    if err != nil {
+        return nil, err
+    }
+    if reservation != nil {
+        if err := reservation.setVolumeSize(capacityBytes); err != nil {
+            return nil, status.Error(codes.InvalidArgument, err.Error())
+        }
     }
     if sourceSnapshotId != "" {
         // create new volume using existing snapshot
-        splittedSnap := strings.Split(sourceSnapshotId, ":")
-        if len(splittedSnap) != 2 {
-            return nil, status.Error(codes.NotFound, fmt.Sprintf("SnapshotId is in wrong format: %s", sourceSnapshotId))
+        var sourceSnapshot csiid.SnapshotID
+        sourceSnapshot, err = csiid.ParseSnapshotID(sourceSnapshotId)
+        if err != nil {
+            return nil, csiid.NotFound(err)
+        }
+        params.configName = s.cloneConfigName(configName, zone, sourceSnapshot.Volume.ConfigName)
+        if params.configName != sourceSnapshot.Volume.ConfigName {
+            // volume is copied to another NexentaStor, it's placed as a new one
+            decision, err = s.placeVolume(volumeName, params, placement)
+            resolveResp = decision.candidate.ResolveNSResponse
+        } else {
+            resolveResp, err = s.resolveNS(params)
         }
-        configName, sourceSnapshot := splittedSnap[0], splittedSnap[1]
-        params.configName = configName
-        resolveResp, err = s.resolveNS(params)
         if err != nil {
             return nil, err
         }
         nsProvider = resolveResp.nsProvider
         volumeGroup = resolveResp.volumeGroup
-        volumePath = filepath.Join(volumeGroup, volumeName)
-        err = s.createNewVolumeFromSnapshot(nsProvider, sourceSnapshot, volumePath, capacityBytes)
+        volumeID, err = csiid.NewVolumeID(resolveResp.configName, filepath.Join(volumeGroup, volumeName))
+        if err != nil {
+            return nil, err
+        }
+        volumePath = volumeID.Path()
+        err = checkOvercommit(nsProvider, volumeGroup, volumePath, capacityBytes,
+            s.volumeOvercommitRatio(resolveResp.configName, properties.UserProperties))
+        if err != nil {
+            return nil, err
+        }
+        if resolveResp.configName != sourceSnapshot.Volume.ConfigName {
+            // snapshot is on another NexentaStor, it's copied to the selected one
+            err = s.copySnapshotVolume(sourceSnapshot, resolveResp, volumePath, properties, encryption)
+        } else {
+            err = s.loadSourceKey(nsProvider, sourceSnapshot.Volume.Path(), encryption, req.GetSecrets())
+            if err != nil {
+                return nil, err
+            }
+            err = s.createNewVolumeFromSnapshot(
+                nsProvider, sourceSnapshot.Path(), volumePath, capacity, properties)
+        }
     } else if sourceVolumeId != "" {
         // clone existing volume
-        splittedVol := strings.Split(sourceVolumeId, ":")
-        if len(splittedVol) != 2 {
-            return nil, status.Error(codes.NotFound, fmt.Sprintf("VolumeId is in wrong format: %s", sourceVolumeId))
+        var sourceVolume csiid.VolumeID
+        sourceVolume, err = csiid.ParseVolumeID(sourceVolumeId)
+        if err != nil {
+            return nil, csiid.NotFound(err)
+        }
+        params.configName = s.cloneConfigName(configName, zone, sourceVolume.ConfigName)
+        if params.configName != sourceVolume.ConfigName {
+            // volume is copied to another NexentaStor, it's placed as a new one
+            decision, err = s.placeVolume(volumeName, params, placement)
+            resolveResp = decision.candidate.ResolveNSResponse
+        } else {
+            resolveResp, err = s.resolveNS(params)
+        }
+        if err != nil {
+            return nil, err
+        }
+        nsProvider = resolveResp.nsProvider
+        volumeGroup = resolveResp.volumeGroup
+        volumeID, err = csiid.NewVolumeID(resolveResp.configName, filepath.Join(volumeGroup, volumeName))
+        if err != nil {
+            return nil, err
+        }
+        volumePath = volumeID.Path()
+        err = checkOvercommit(nsProvider, volumeGroup, volumePath, capacityBytes,
+            s.volumeOvercommitRatio(resolveResp.configName, properties.UserProperties))
+        if err != nil {
+            return nil, err
+        }
+        if resolveResp.configName != sourceVolume.ConfigName {
+            // volume is on another NexentaStor, its snapshot is copied to the selected one
+            err = s.copyClonedVolume(sourceVolume, volumeName, resolveResp, volumePath, properties, encryption)
+        } else {
+            err = s.loadSourceKey(nsProvider, sourceVolume.Path(), encryption, req.GetSecrets())
+            if err != nil {
+                return nil, err
+            }
+            err = s.createClonedVolume(
+                nsProvider, sourceVolume.Path(), volumePath, volumeName, capacity, properties)
+        }
+    } else if restoreFromTrash != "" {
+        // trashed volume is moved back, ZFS can't move volumes to another pool or NexentaStor
+        var trashedVolume csiid.VolumeID
+        if restoreFromTrash != restoreFromTrashPVC {
+            trashedVolume, err = csiid.ParseVolumeID(restoreFromTrash)
+            if err != nil {
+                return nil, status.Errorf(codes.InvalidArgument, "Invalid %s parameter: %s", paramRestoreFromTrash, err)
+            }
+            if configName != "" && configName != trashedVolume.ConfigName {
+                return nil, status.Errorf(
+                    codes.InvalidArgument,
+                    "Trashed volume '%s' can't be restored to another NexentaStor '%s'",
+                    restoreFromTrash,
+                    configName,
+                )
+            }
+            params.configName = trashedVolume.ConfigName
         }
-        configName, sourceVolume := splittedVol[0], splittedVol[1]
-        params.configName = configName
         resolveResp, err = s.resolveNS(params)
         if err != nil {
             return nil, err
         }
         nsProvider = resolveResp.nsProvider
         volumeGroup = resolveResp.volumeGroup
-        volumePath = filepath.Join(volumeGroup, volumeName)
-        err = s.createClonedVolume(nsProvider, sourceVolume, volumePath, volumeName, capacityBytes)
+        volumeID, err = csiid.NewVolumeID(resolveResp.configName, filepath.Join(volumeGroup, volumeName))
+        if err != nil {
+            return nil, err
+        }
+        volumePath = volumeID.Path()
+        if restoreFromTrash == restoreFromTrashPVC {
+            // the trashed volume is looked for in the trash volume group of the StorageClass
+            trash, _ := getVolumeTrash(properties.UserProperties)
+            var trashedPath string
+            trashedPath, err = s.findTrashedPVCVolume(nsProvider, volumePath, trash, reqParams)
+            if err != nil {
+                return nil, err
+            }
+            trashedVolume, err = csiid.NewVolumeID(resolveResp.configName, trashedPath)
+            if err != nil {
+                return nil, err
+            }
+        }
+        if volumeID.Pool() != trashedVolume.Pool() {
+            return nil, status.Errorf(
+                codes.InvalidArgument,
+                "Trashed volume '%s' can't be restored to volume group '%s' of another pool",
+                restoreFromTrash,
+                volumeGroup,
+            )
+        }
+        err = s.restoreTrashedVolume(
+            nsProvider, trashedVolume.Path(), volumePath, properties, encryption, req.GetSecrets())
     } else {
-        resolveResp, err = s.resolveNS(params)
+        decision, err = s.placeVolume(volumeName, params, placement)
         if err != nil {
             return nil, err
         }
+        resolveResp = decision.candidate.ResolveNSResponse
         nsProvider = resolveResp.nsProvider
         volumeGroup = resolveResp.volumeGroup
-        volumePath = filepath.Join(volumeGroup, volumeName)
-        err = s.createNewVolume(nsProvider, volumePath, capacityBytes, sparseVolume)
+        volumeID, err = csiid.NewVolumeID(resolveResp.configName, filepath.Join(volumeGroup, volumeName))
+        if err != nil {
+            return nil, err
+        }
+        volumePath = volumeID.Path()
+        blockSize := properties.VolumeBlockSize
+        if blockSize == 0 {
+            vg, err := getVolumeGroup(nsProvider, volumeGroup)
+            if err != nil {
+                return nil, status.Errorf(codes.Internal, "Cannot get volume group '%s': %s", volumeGroup, err)
+            }
+            blockSize = vg.VolumeBlockSize
+        }
+        capacityBytes, err = capacity.size(blockSize)
+        if err != nil {
+            return nil, err
+        }
+        err = checkOvercommit(nsProvider, volumeGroup, volumePath, capacityBytes,
+            s.volumeOvercommitRatio(resolveResp.configName, properties.UserProperties))
+        if err != nil {
+            return nil, err
+        }
+        err = s.createNewVolume(nsProvider, volumePath, capacityBytes, sparseVolume, properties, encryption)
     }
 
     if err != nil {
         return nil, err
     }
 
-    cfg := s.config.NsMap[resolveResp.configName]
-    // get values from req params or set defaults
-    dataIP := ""
-    if v, ok := reqParams["dataIP"]; ok {
-        dataIP = v
-    } else {
-        dataIP = cfg.DefaultDataIP
-    }
-    target := ""
-    if v, ok := reqParams["target"]; ok {
-        target = v
-    } else {
-        target = cfg.DefaultTarget
-    }
-    hostGroup := ""
-    if v, ok := reqParams["hostGroup"]; ok {
-        hostGroup = v
-    } else {
-        hostGroup = cfg.DefaultHostGroup
-    }
-    iSCSIPort := ""
-    if v, ok := reqParams["iSCSIPort"]; ok {
-        iSCSIPort = v
-    } else {
-        iSCSIPort = cfg.DefaultISCSIPort
-    }
-    targetGroup := ""
-    if v, ok := reqParams["targetGroup"]; ok {
-        targetGroup = v
-    } else {
-        targetGroup = cfg.DefaultTargetGroup
-    }
-    iSCSITargetPrefix := ""
-    if v, ok := reqParams["iSCSITargetPrefix"]; ok {
-        iSCSITargetPrefix = v
-    } else {
-        iSCSITargetPrefix = cfg.ISCSITargetPrefix
-    }
-    numOfLunsPerTarget := ""
-    if v, ok := reqParams["numOfLunsPerTarget"]; ok {
-        numOfLunsPerTarget = v
-    } else {
-        numOfLunsPerTarget = cfg.NumOfLunsPerTarget
+    if replication.enabled() {
+        replicated, err := s.resolveReplicatedVolume(volumeID, replication)
+        if err != nil {
+            return nil, err
+        }
+        if err := s.enableVolumeReplication(replicated); err != nil {
+            return nil, err
+        }
     }
 
-    useChapAuth := ""
-    if v, ok := reqParams["useChapAuth"]; ok {
-        useChapAuth = v
-    } else {
-        useChapAuth = cfg.UseChapAuth
+    volume, err := getVolumeStatus(nsProvider, volumePath)
+    if err != nil {
+        return nil, status.Errorf(codes.Internal, "Cannot get created volume '%s': %s", volumePath, err)
     }
 
-    chapUser := ""
-    if v, ok := reqParams["chapUser"]; ok {
-        chapUser = v
-    } else {
-        chapUser = cfg.ChapUser
+    // clones, restored and copied volumes have the size of the source, they're expanded to the requested size
+    size, err := capacity.size(volume.VolumeBlockSize)
+    if err != nil {
+        return nil, err
     }
-
-    chapSecret := ""
-    if v, ok := reqParams["chapSecret"]; ok {
-        chapSecret = v
-    } else {
-        chapSecret = cfg.ChapSecret
+    if volume.VolumeSize < size {
+        l.Infof("expanding volume '%s' from %d to %d bytes", volumePath, volume.VolumeSize, size)
+        err = updateVolume(nsProvider, volumePath, ns.UpdateVolumeParams{VolumeSize: size})
+        if err != nil {
+            return nil, status.Errorf(codes.Internal, "Cannot expand volume '%s': %s", volumePath, err)
+        }
+        volume.VolumeSize = size
+    } else if err := capacity.fits(volume.VolumeSize); err != nil {
+        return nil, err
     }
 
-    mountPointPermissions := ""
-    if v, ok := reqParams["mountPointPermissions"]; ok {
-        mountPointPermissions = v
-    } else {
-        mountPointPermissions = cfg.MountPointPermissions
+    if reservation != nil {
+        if err := reservation.setVolumeSize(volume.VolumeSize); err != nil {
+            return nil, status.Error(codes.InvalidArgument, err.Error())
+        }
+        if err := updateVolume(nsProvider, volumePath, reservation); err != nil {
+            return nil, status.Errorf(codes.Internal, "Cannot set refreservation of volume '%s': %s", volumePath, err)
+        }
     }
 
+    volumeContext := getVolumeContext(s.config.NsMap[resolveResp.configName], reqParams, volumeGroup)
+    decision.setVolumeContext(volumeContext)
     res = &csi.CreateVolumeResponse{
         Volume: &csi.Volume{
             ContentSource: contentSource,
-            VolumeId:      fmt.Sprintf("%s:%s", resolveResp.configName, volumePath),
-            CapacityBytes: capacityBytes,
-            VolumeContext: map[string]string{
-                "DataIP": dataIP,
-                "VolumeGroup": volumeGroup,
-                "Target": target,
-                "TargetGroup": targetGroup,
-                "HostGroup": hostGroup,
-                "iSCSIPort": iSCSIPort,
-                "iSCSITargetPrefix": iSCSITargetPrefix,
-                "numOfLunsPerTarget": numOfLunsPerTarget,
-                "useChapAuth": useChapAuth,
-                "chapUser": chapUser,
-                "chapSecret": chapSecret,
-                "mountPointPermissions": mountPointPermissions,
-            },
+            VolumeId:      volumeID.String(),
+            CapacityBytes: volume.VolumeSize,
+            VolumeContext: volumeContext,
         },
     }
     if len(zone) > 0 {
@@ -678,24 +1046,71 @@ func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolu
     return res, nil
 }
 
+// volumeContextParams - StorageClass parameters passed to the node in VolumeContext, mapped to VolumeContext keys
+var volumeContextParams = map[string]string{
+    "dataIP": "DataIP",
+    "target": "Target",
+    "targetGroup": "TargetGroup",
+    "hostGroup": "HostGroup",
+    "iSCSIPort": "iSCSIPort",
+    "iSCSITargetPrefix": "iSCSITargetPrefix",
+    "numOfLunsPerTarget": "numOfLunsPerTarget",
+    "useChapAuth": "useChapAuth",
+    "chapUser": "chapUser",
+    "chapSecret": "chapSecret",
+    "mountPointPermissions": "mountPointPermissions",
+}
+
+// getVolumeContext - VolumeContext of the volume, StorageClass parameters override config defaults
+func getVolumeContext(cfg config.NsData, reqParams map[string]string, volumeGroup string) map[string]string {
+    volumeContext := map[string]string{
+        "DataIP": cfg.DefaultDataIP,
+        "VolumeGroup": volumeGroup,
+        "Target": cfg.DefaultTarget,
+        "TargetGroup": cfg.DefaultTargetGroup,
+        "HostGroup": cfg.DefaultHostGroup,
+        "iSCSIPort": cfg.DefaultISCSIPort,
+        "iSCSITargetPrefix": cfg.ISCSITargetPrefix,
+        "numOfLunsPerTarget": cfg.NumOfLunsPerTarget,
+        "useChapAuth": cfg.UseChapAuth,
+        "chapUser": cfg.ChapUser,
+        "chapSecret": cfg.ChapSecret,
+        "mountPointPermissions": cfg.MountPointPermissions,
+    }
+    for param, key := range volumeContextParams {
+        if v, ok := reqParams[param]; ok {
+            volumeContext[key] = v
+        }
+    }
+    return volumeContext
+}
+
 func (s *ControllerServer) createNewVolume(
     nsProvider ns.ProviderInterface,
     volumePath string,
     capacityBytes int64,
     sparseVolume bool,
+    properties volumeProperties,
+    encryption volumeEncryption,
 ) (error) {
     l := s.log.WithField("func", "createNewVolume()")
-    l.Infof("nsProvider: %s, volumePath: %s", nsProvider, volumePath)
-
-    err := nsProvider.CreateVolume(ns.CreateVolumeParams{
+    l.Infof(
+        "nsProvider: %s, volumePath: %s, properties: %+v, encryption: %+v",
+        nsProvider,
+        volumePath,
+        properties,
+        encryption,
+    )
+
+    err := createVolume(nsProvider, ns.CreateVolumeParams{
         Path:                volumePath,
         VolumeSize:          capacityBytes,
         SparseVolume:        sparseVolume,
-    })
+    }, properties, encryption)
 
     if err != nil {
         if ns.IsAlreadyExistNefError(err) {
-            existingVolume, err := nsProvider.GetVolume(volumePath)
+            existingVolume, err := getVolumeStatus(nsProvider, volumePath)
             if err != nil {
                 return status.Errorf(
                     codes.Internal,
@@ -711,6 +1126,14 @@ func (s *ControllerServer) createNewVolume(
                     capacityBytes,
                     existingVolume.VolumeSize,
                 )
+            } else if encryption.cipher() != existingVolume.cipher() {
+                return status.Errorf(
+                    codes.AlreadyExists,
+                    "Volume '%s' already exists, but with a different encryption: requested=%s, existing=%s",
+                    volumePath,
+                    encryption.cipher(),
+                    existingVolume.cipher(),
+                )
             }
             l.Infof("volume '%s' already exists and can be used", volumePath)
             return nil
@@ -728,17 +1151,79 @@ func (s *ControllerServer) createNewVolume(
     return nil
 }
 
+// loadSourceKey - clones inherit encryption of the source volume and its key must be loaded to create them,
+// the key is loaded using provisioner secret if appliance was rebooted
+func (s *ControllerServer) loadSourceKey(
+    nsProvider ns.ProviderInterface,
+    sourceVolumePath string,
+    encryption volumeEncryption,
+    secrets map[string]string,
+) (error) {
+    l := s.log.WithField("func", "loadSourceKey()")
+
+    source, err := getVolumeStatus(nsProvider, sourceVolumePath)
+    if ns.IsNotExistNefError(err) {
+        return status.Errorf(codes.NotFound, "Source volume '%s' not found on %s", sourceVolumePath, nsProvider)
+    } else if err != nil {
+        return status.Errorf(codes.Internal, "Cannot get source volume '%s': %s", sourceVolumePath, err)
+    }
+
+    if !source.encrypted() {
+        if encryption.enabled() {
+            return status.Errorf(
+                codes.InvalidArgument,
+                "Cannot create encrypted volume from unencrypted volume '%s', clones inherit source encryption",
+                sourceVolumePath,
+            )
+        }
+        return nil
+    }
+    if encryption.enabled() && encryption.Encryption != source.Encryption {
+        l.Warnf(
+            "volume inherits encryption '%s' of volume '%s', requested encryption '%s' is ignored",
+            source.Encryption,
+            sourceVolumePath,
+            encryption.Encryption,
+        )
+    }
+    if source.KeyStatus != nefKeyStatusUnavailable {
+        return nil
+    }
+
+    key := secrets[secretEncryptionKey]
+    if key == "" {
+        return status.Errorf(
+            codes.FailedPrecondition,
+            "Encryption key of volume '%s' is not loaded, provisioner secret '%s' is required to load it",
+            source.EncryptionRoot,
+            secretEncryptionKey,
+        )
+    }
+    l.Infof("loading encryption key of volume '%s'", source.EncryptionRoot)
+    err = loadVolumeKey(nsProvider, source.EncryptionRoot, secretValue(key))
+    if err != nil && !ns.IsAlreadyExistNefError(err) {
+        return status.Errorf(
+            codes.FailedPrecondition,
+            "Cannot load encryption key of volume '%s': %s",
+            source.EncryptionRoot,
+            err,
+        )
+    }
+    return nil
+}
+
 // create new volume using existing snapshot
 func (s *ControllerServer) createNewVolumeFromSnapshot(
     nsProvider ns.ProviderInterface,
     sourceSnapshotID string,
     volumePath string,
-    capacityBytes int64,
+    capacity volumeCapacity,
+    properties volumeProperties,
 ) (error) {
     l := s.log.WithField("func", "createNewVolumeFromSnapshot()")
-    l.Infof("snapshot: %s", sourceSnapshotID)
+    l.Infof("snapshot: %s, properties: %+v", sourceSnapshotID, properties)
 
-    snapshot, err := nsProvider.GetSnapshot(sourceSnapshotID)
+    snapshot, err := getSnapshot(nsProvider, sourceSnapshotID)
     if err != nil {
         message := fmt.Sprintf("Failed to find snapshot '%s': %s", sourceSnapshotID, err)
         if ns.IsNotExistNefError(err) || ns.IsBadArgNefError(err) {
@@ -746,10 +1231,20 @@ func (s *ControllerServer) createNewVolumeFromSnapshot(
         }
         return status.Error(codes.NotFound, message)
     }
+    if !snapshot.readyToUse() {
+        return status.Errorf(codes.FailedPrecondition, "Snapshot '%s' is not ready to use", snapshot.Path)
+    }
+    if err := capacity.fits(snapshot.sizeBytes()); err != nil {
+        return err
+    }
 
-    err = nsProvider.CloneSnapshot(snapshot.Path, ns.CloneSnapshotParams{
+    if properties.VolumeBlockSize != 0 {
+        l.Warnf(
+            "volume '%s' inherits volblocksize of snapshot '%s', requested value is ignored", volumePath, snapshot.Path)
+    }
+    err = cloneSnapshot(nsProvider, snapshot.Path, ns.CloneSnapshotParams{
         TargetPath: volumePath,
-    })
+    }, properties.withoutBlockSize())
     if err != nil {
         if ns.IsAlreadyExistNefError(err) {
             l.Infof("volume '%s' already exists and can be used", volumePath)
@@ -774,23 +1269,39 @@ func (s *ControllerServer) createClonedVolume(
     sourceVolumeID string,
     volumePath string,
     volumeName string,
-    capacityBytes int64,
+    capacity volumeCapacity,
+    properties volumeProperties,
 ) (error) {
 
     l := s.log.WithField("func", "createClonedVolume()")
-    l.Infof("clone volume source: %+v, target: %+v", sourceVolumeID, volumePath)
+    l.Infof("clone volume source: %+v, target: %+v, properties: %+v", sourceVolumeID, volumePath, properties)
+
+    source, err := getVolumeStatus(nsProvider, sourceVolumeID)
+    if err != nil {
+        if ns.IsNotExistNefError(err) {
+            return status.Errorf(codes.NotFound, "Source volume '%s' not found: %s", sourceVolumeID, err)
+        }
+        return status.Errorf(codes.Internal, "Cannot get source volume '%s': %s", sourceVolumeID, err)
+    }
+    if err := capacity.fits(source.VolumeSize); err != nil {
+        return err
+    }
 
     snapName := fmt.Sprintf("k8s-clone-snapshot-%s", volumeName)
     snapshotPath := fmt.Sprintf("%s@%s", sourceVolumeID, snapName)
 
-    _, err := s.CreateSnapshotOnNS(nsProvider, sourceVolumeID, snapName)
+    _, err = s.CreateSnapshotOnNS(nsProvider, sourceVolumeID, snapName, nil)
     if err != nil {
         return err
     }
 
-    err = nsProvider.CloneSnapshot(snapshotPath, ns.CloneSnapshotParams{
+    if properties.VolumeBlockSize != 0 {
+        l.Warnf(
+            "volume '%s' inherits volblocksize of volume '%s', requested value is ignored", volumePath, sourceVolumeID)
+    }
+    err = cloneSnapshot(nsProvider, snapshotPath, ns.CloneSnapshotParams{
         TargetPath: volumePath,
-    })
+    }, properties.withoutBlockSize())
 
     if err != nil {
         if ns.IsAlreadyExistNefError(err) {
@@ -819,11 +1330,7 @@ func (s *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolu
     l := s.log.WithField("func", "DeleteVolume()")
     l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
 
-    var secret string
-    secrets := req.GetSecrets()
-    for _, v := range secrets {
-        secret = v
-    }
+    secret := getConfigSecret(req.GetSecrets())
     err := s.refreshConfig(secret)
     if err != nil {
         return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
@@ -833,23 +1340,16 @@ func (s *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolu
     if len(volumeId) == 0 {
         return nil, status.Error(codes.InvalidArgument, "Volume ID must be provided")
     }
-    splittedVol := strings.Split(volumeId, ":")
-    if len(splittedVol) != 2 {
-        l.Infof("Got wrong volumeId, but that is OK for deletion")
-        return &csi.DeleteVolumeResponse{}, nil
-    }
-    configName, volumePath := splittedVol[0], splittedVol[1]
-
-    splittedPath := strings.Split(volumePath, "/")
-    if len(splittedPath) != 3 {
-        l.Infof("Got wrong volumeId, but that is OK for deletion")
+    id, err := csiid.ParseVolumeID(volumeId)
+    if err != nil {
+        l.Infof("Got wrong volumeId, but that is OK for deletion: %s", err)
         return &csi.DeleteVolumeResponse{}, nil
     }
-    volumeGroup := strings.Join(splittedPath[:2], "/")
+    volumePath := id.Path()
 
     params := ResolveNSParams{
-        volumeGroup: volumeGroup,
-        configName: configName,
+        volumeGroup: id.VolumeGroup,
+        configName: id.ConfigName,
     }
     resolveResp, err := s.resolveNS(params)
     if err != nil {
@@ -859,29 +1359,90 @@ func (s *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolu
         }
         return nil, err
     }
-    nsProvider := resolveResp.nsProvider
+    if err := s.deleteVolumeOnNS(resolveResp.nsProvider, volumePath); err != nil {
+        return nil, err
+    }
+    return &csi.DeleteVolumeResponse{}, nil
+}
+
+// deleteVolumeOnNS - removes LUN mappings and the replication service of the volume, then moves it to the trash
+// or destroys it with its snapshots, missing volume is deleted already
+func (s *ControllerServer) deleteVolumeOnNS(nsProvider ns.ProviderInterface, volumePath string) error {
+    l := s.log.WithField("func", "deleteVolumeOnNS()")
+
+    volume, err := getVolumeStatus(nsProvider, volumePath)
+    if err != nil && !ns.IsNotExistNefError(err) {
+        return status.Errorf(codes.Internal, "Cannot get volume '%s': %s", volumePath, err)
+    }
+    volumeExists := err == nil
+
+    // volumes deleted from the trash are destroyed, volumes which failed to move there are moved again
+    trash, err := getVolumeTrash(volume.UserProperties)
+    if err != nil {
+        return status.Errorf(codes.Internal, "Cannot delete volume '%s': %s", volumePath, err)
+    }
+    moveToTrash := volumeExists && trash.enabled() && !trash.contains(volumePath)
+
+    // the orphan collector finds the volume by this property if the deletion fails and is not retried,
+    // trashed volumes are purged instead. The mark is best effort, the deletion doesn't depend on it.
+    if volumeExists && !moveToTrash {
+        err = updateVolume(nsProvider, volumePath, map[string]interface{}{
+            "userProperties": map[string]string{deletingVolumeProperty: time.Now().UTC().Format(time.RFC3339)},
+        })
+        if err != nil && !ns.IsNotExistNefError(err) {
+            l.Warnf("cannot mark volume '%s' for deletion, deleting it anyway: %s", volumePath, err)
+        }
+    }
 
     lunMappingParams := ns.GetLunMappingsParams{
         Volume: volumePath,
     }
     luns, err := nsProvider.GetLunMappings(lunMappingParams)
     if err != nil {
-        return nil, err
+        return err
     }
     for _, lun := range luns {
+        // mapping may be already removed by previous request which response was lost
         err = nsProvider.DestroyLunMapping(lun.Id)
-        if err != nil{
-            return nil, err
+        if err != nil && !ns.IsNotExistNefError(err) {
+            return err
+        }
+    }
+
+    // the replica is kept on the peer NexentaStor as disaster recovery copy, only replicated volumes have the service
+    if volume.UserProperties[volumeReplicationProperty] != "" {
+        err = destroyVolumeReplicationService(nsProvider, volumePath)
+        if err != nil {
+            return err
         }
     }
 
+    // unload the key of encryption root, it stays loaded while clones sharing the key exist
+    if volume.encrypted() && volume.EncryptionRoot == volumePath && volume.KeyStatus == nefKeyStatusAvailable {
+        err = unloadVolumeKey(nsProvider, volumePath)
+        if ns.IsBusyNefError(err) {
+            l.Infof("encryption key of volume '%s' is used by its clones and stays loaded", volumePath)
+        } else if err != nil && !ns.IsNotExistNefError(err) {
+            return status.Errorf(
+                codes.Internal,
+                "Cannot unload encryption key of volume '%s': %s",
+                volumePath,
+                err,
+            )
+        }
+    }
+
+    if moveToTrash {
+        return s.moveVolumeToTrash(nsProvider, volumePath, trash, time.Now())
+    }
+
     // if here, than volumePath exists on some NS
     err = nsProvider.DestroyVolume(volumePath, ns.DestroyVolumeParams{
         DestroySnapshots:               true,
         PromoteMostRecentCloneIfExists: true,
     })
     if err != nil && !ns.IsNotExistNefError(err) {
-        return nil, status.Errorf(
+        return status.Errorf(
             codes.Internal,
             "Cannot delete '%s' volume: %s",
             volumePath,
@@ -890,7 +1451,7 @@ func (s *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolu
     }
 
     l.Infof("volume '%s' has been deleted", volumePath)
-    return &csi.DeleteVolumeResponse{}, nil
+    return nil
 }
 
 // CreateSnapshot creates a snapshot of given volume
@@ -901,7 +1462,8 @@ func (s *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSn
     l := s.log.WithField("func", "CreateSnapshot()")
     l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
 
-    err := s.refreshConfig("")
+    secret := getConfigSecret(req.GetSecrets())
+    err := s.refreshConfig(secret)
     if err != nil {
         return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
     }
@@ -910,34 +1472,41 @@ func (s *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSn
     if len(sourceVolumeId) == 0 {
         return nil, status.Error(codes.InvalidArgument, "Snapshot source volume ID must be provided")
     }
-    splittedVol := strings.Split(sourceVolumeId, ":")
-    if len(splittedVol) != 2 {
-        return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("VolumeId is in wrong format: %s", sourceVolumeId))
+    volumeID, err := csiid.ParseVolumeID(sourceVolumeId)
+    if err != nil {
+        return nil, err
     }
-    configName, volumePath := splittedVol[0], splittedVol[1]
+    volumePath := volumeID.Path()
 
     name := req.GetName()
     if len(name) == 0 {
         return nil, status.Error(codes.InvalidArgument, "Snapshot name must be provided")
     }
-
-    splittedPath := strings.Split(volumePath, "/")
-    if len(splittedPath) != 3 {
-        return nil, status.Errorf(codes.InvalidArgument, "Got wrong volumeId: %s", sourceVolumeId)
+    snapshotID, err := volumeID.Snapshot(name)
+    if err != nil {
+        return nil, err
     }
-    volumeGroup := strings.Join(splittedPath[:2], "/")
 
     params := ResolveNSParams{
-        volumeGroup: volumeGroup,
-        configName:  configName,
+        volumeGroup: volumeID.VolumeGroup,
+        configName:  volumeID.ConfigName,
     }
     resolveResp, err := s.resolveNS(params)
     if err != nil {
         return nil, err
     }
 
-    snapshotPath := fmt.Sprintf("%s@%s", volumePath, name)
-    createdSnapshot, err := s.CreateSnapshotOnNS(resolveResp.nsProvider, volumePath, name)
+    // snapshots are tagged with VolumeSnapshot names and PVC of the volume if csi-snapshotter adds them
+    var userProperties map[string]string
+    if reqParams := req.GetParameters(); hasSnapshotMetadata(reqParams) {
+        volume, err := getVolumeStatus(resolveResp.nsProvider, volumePath)
+        if err != nil {
+            l.Warnf("cannot get PVC of volume '%s', snapshot is tagged without it: %s", volumePath, err)
+        }
+        userProperties = snapshotMetadata(reqParams, volume.UserProperties)
+    }
+
+    createdSnapshot, err := s.CreateSnapshotOnNS(resolveResp.nsProvider, volumePath, name, userProperties)
     if err != nil {
         return nil, err
     }
@@ -947,13 +1516,14 @@ func (s *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSn
         return nil, err
     }
 
-    snapshotId := fmt.Sprintf("%s:%s", configName, snapshotPath)
+    snapshotId := snapshotID.String()
     res := &csi.CreateSnapshotResponse{
         Snapshot: &csi.Snapshot{
             SnapshotId:     snapshotId,
             SourceVolumeId: sourceVolumeId,
             CreationTime:   creationTime,
-            ReadyToUse:     true,
+            ReadyToUse:     createdSnapshot.readyToUse(),
+            SizeBytes:      createdSnapshot.sizeBytes(),
         },
     }
 
@@ -966,8 +1536,9 @@ func (s *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSn
     return res, nil
 }
 
-func (s *ControllerServer) CreateSnapshotOnNS(nsProvider ns.ProviderInterface, volumePath, snapName string) (
-    snapshot ns.Snapshot, err error) {
+func (s *ControllerServer) CreateSnapshotOnNS(
+    nsProvider ns.ProviderInterface, volumePath, snapName string, userProperties map[string]string) (
+    snapshot nefSnapshot, err error) {
 
     l := s.log.WithField("func", "CreateSnapshotOnNS()")
     l.Infof("creating snapshot %+v@%+v", volumePath, snapName)
@@ -993,14 +1564,12 @@ func (s *ControllerServer) CreateSnapshotOnNS(nsProvider ns.ProviderInterface, v
     snapshotPath := fmt.Sprintf("%s@%s", volumePath, snapName)
 
     // if here, than volumePath exists on some NS
-    err = nsProvider.CreateSnapshot(ns.CreateSnapshotParams{
-        Path: snapshotPath,
-    })
+    err = createSnapshot(nsProvider, snapshotPath, userProperties)
     if err != nil && !ns.IsAlreadyExistNefError(err) {
         return snapshot, status.Errorf(codes.Internal, "Cannot create snapshot '%s': %s", snapshotPath, err)
     }
 
-    snapshot, err = nsProvider.GetSnapshot(snapshotPath)
+    snapshot, err = getSnapshot(nsProvider, snapshotPath)
     if err != nil {
         return snapshot, status.Errorf(
             codes.Internal,
@@ -1021,7 +1590,8 @@ func (s *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSn
     l := s.log.WithField("func", "DeleteSnapshot()")
     l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
 
-    err := s.refreshConfig("")
+    secret := getConfigSecret(req.GetSecrets())
+    err := s.refreshConfig(secret)
     if err != nil {
         return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
     }
@@ -1031,30 +1601,14 @@ func (s *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSn
         return nil, status.Error(codes.InvalidArgument, "Snapshot ID must be provided")
     }
 
-    volume := ""
-    snapshot := ""
-    splittedString := strings.Split(snapshotId, "@")
-    if len(splittedString) == 2 {
-        volume = splittedString[0]
-        snapshot = splittedString[1]
-    } else {
-        l.Infof("snapshot '%s' not found, that's OK for deletion request", snapshotId)
+    id, err := csiid.ParseSnapshotID(snapshotId)
+    if err != nil {
+        l.Infof("snapshot '%s' not found, that's OK for deletion request: %s", snapshotId, err)
         return &csi.DeleteSnapshotResponse{}, nil
     }
-    splittedVol := strings.Split(volume, ":")
-    if len(splittedVol) != 2 {
-        return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("VolumeId is in wrong format: %s", volume))
-    }
-    configName, volumePath := splittedVol[0], splittedVol[1]
-
-    splittedPath := strings.Split(volumePath, "/")
-    if len(splittedPath) != 3 {
-        return nil, status.Errorf(codes.InvalidArgument, "Got wrong volume: %s", volume)
-    }
-    volumeGroup := strings.Join(splittedPath[:2], "/")
     params := ResolveNSParams{
-        volumeGroup: volumeGroup,
-        configName:  configName,
+        volumeGroup: id.Volume.VolumeGroup,
+        configName:  id.Volume.ConfigName,
     }
 
     resolveResp, err := s.resolveNS(params)
@@ -1068,7 +1622,7 @@ func (s *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSn
     nsProvider := resolveResp.nsProvider
 
     // if here, than snapshotPath exists on some NS
-    snapshotPath := strings.Join([]string{volumePath, snapshot}, "@")
+    snapshotPath := id.Path()
     err = nsProvider.DestroySnapshot(snapshotPath)
     if err != nil && !ns.IsNotExistNefError(err) {
         message := fmt.Sprintf("Failed to delete snapshot '%s'", snapshotPath)
@@ -1090,7 +1644,8 @@ func (s *ControllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnaps
     l := s.log.WithField("func", "ListSnapshots()")
     l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
 
-    err := s.refreshConfig("")
+    secret := getConfigSecret(req.GetSecrets())
+    err := s.refreshConfig(secret)
     if err != nil {
         return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
     }
@@ -1100,21 +1655,105 @@ func (s *ControllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnaps
     } else if req.GetSourceVolumeId() != "" {
         return s.getVolumeSnapshotList(req.GetSourceVolumeId(), req)
     } else {
-        response := csi.ListSnapshotsResponse{
-            Entries: []*csi.ListSnapshotsResponse_Entry{},
+        return s.getAllSnapshotsList(req)
+    }
+}
+
+// getAllSnapshotsList - lists snapshots of volumes of all volume groups of all NexentaStors.
+// Snapshots are ordered by config name and snapshot path, starting token is the ID of the first snapshot to return.
+func (s *ControllerServer) getAllSnapshotsList(req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+    l := s.log.WithField("func", "getAllSnapshotsList()")
+
+    startingToken := req.GetStartingToken()
+    maxEntries := int(req.GetMaxEntries())
+    if maxEntries < 0 {
+        return nil, status.Errorf(codes.InvalidArgument, "req.MaxEntries must be 0 or greater, got: %d", maxEntries)
+    }
+
+    var startID csiid.SnapshotID
+    if startingToken != "" {
+        var err error
+        startID, err = csiid.ParseSnapshotID(startingToken)
+        if err != nil {
+            return nil, status.Errorf(codes.Aborted, "Invalid starting token '%s': %s", startingToken, err)
+        }
+        if _, ok := s.config.NsMap[startID.Volume.ConfigName]; !ok {
+            return nil, status.Errorf(
+                codes.Aborted,
+                "Invalid starting token '%s': NexentaStor '%s' is not in the config",
+                startingToken,
+                startID.Volume.ConfigName,
+            )
+        }
+    }
+
+    response := csi.ListSnapshotsResponse{
+        Entries: []*csi.ListSnapshotsResponse_Entry{},
+    }
+    for _, configName := range sortedConfigNames(s.config) {
+        if startingToken != "" && configName < startID.Volume.ConfigName {
+            continue
+        }
+        resolveResp, err := s.resolveNS(ResolveNSParams{configName: configName})
+        if err != nil {
+            return nil, err
+        }
+
+        snapshots, err := getAllSnapshots(resolveResp.nsProvider)
+        if err != nil {
+            return nil, err
         }
-        for _, cfg := range s.config.NsMap {
-            resp, _ := s.getVolumeSnapshotList(cfg.DefaultVolumeGroup, req)
-            for _, snapshot := range resp.Entries {
-                response.Entries = append(response.Entries, snapshot)
+        for _, snapshot := range snapshots {
+            if configName == startID.Volume.ConfigName && snapshot.Path < startID.Path() {
+                continue
+            }
+            entry, err := convertNSSnapshotToCSISnapshot(snapshot, configName)
+            if err != nil {
+                l.Infof("skipping snapshot '%s': %s", snapshot.Path, err)
+                continue
             }
-            if len(resp.NextToken) > 0 {
-                response.NextToken = resp.NextToken
+            if maxEntries > 0 && len(response.Entries) == maxEntries {
+                response.NextToken = entry.Snapshot.SnapshotId
+                l.Infof("found %d snapshot(s), next token: '%s'", len(response.Entries), response.NextToken)
                 return &response, nil
             }
+            response.Entries = append(response.Entries, entry)
         }
-        return &response, nil
     }
+
+    l.Infof("found %d snapshot(s)", len(response.Entries))
+
+    return &response, nil
+}
+
+// getAllSnapshots - returns snapshots of volumes of all volume groups of the appliance sorted by path,
+// snapshots of volume groups themselves are not returned
+func getAllSnapshots(nsProvider ns.ProviderInterface) ([]nefSnapshot, error) {
+    volumeGroups, err := getVolumeGroups(nsProvider)
+    if err != nil {
+        return nil, status.Errorf(codes.Internal, "Cannot get volume groups on %s: %s", nsProvider, err)
+    }
+    isVolumeGroup := map[string]bool{}
+    for _, volumeGroup := range volumeGroups {
+        isVolumeGroup[volumeGroup] = true
+    }
+    snapshots := []nefSnapshot{}
+    for _, volumeGroup := range volumeGroups {
+        vgSnapshots, err := getSnapshots(nsProvider, volumeGroup, true)
+        if err != nil {
+            return nil, status.Errorf(
+                codes.Internal, "Cannot get snapshots of '%s' on %s: %s", volumeGroup, nsProvider, err)
+        }
+        for _, snapshot := range vgSnapshots {
+            // recursive list has snapshots of nested volume groups too, they're listed with their own group
+            if isVolumeGroup[snapshot.Parent] || filepath.Dir(snapshot.Parent) != volumeGroup {
+                continue
+            }
+            snapshots = append(snapshots, snapshot)
+        }
+    }
+    sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Path < snapshots[j].Path })
+    return snapshots, nil
 }
 
 func (s *ControllerServer) getSnapshotListWithSingleSnapshot(snapshotId string, req *csi.ListSnapshotsRequest) (
@@ -1128,23 +1767,16 @@ func (s *ControllerServer) getSnapshotListWithSingleSnapshot(snapshotId string,
         Entries: []*csi.ListSnapshotsResponse_Entry{},
     }
 
-    splittedSnapshotPath := strings.Split(snapshotId, "@")
-    if len(splittedSnapshotPath) != 2 {
+    id, err := csiid.ParseSnapshotID(snapshotId)
+    if err != nil {
         // bad snapshotID format, but it's ok, driver should return empty response
-        l.Infof("Bad snapshot format: %s", splittedSnapshotPath)
+        l.Infof("Bad snapshot format: %s", err)
         return &response, nil
     }
-    splittedSnapshotId := strings.Split(splittedSnapshotPath[0], ":")
-    configName, volumePath := splittedSnapshotId[0], splittedSnapshotId[1]
-
-    splittedPath := strings.Split(volumePath, "/")
-    if len(splittedPath) != 3 {
-        return nil, status.Errorf(codes.InvalidArgument, "Got wrong volume: %s", volumePath)
-    }
-    volumeGroup := strings.Join(splittedPath[:2], "/")
+    volumePath := id.Volume.Path()
     params := ResolveNSParams{
-        volumeGroup: volumeGroup,
-        configName:  configName,
+        volumeGroup: id.Volume.VolumeGroup,
+        configName:  id.Volume.ConfigName,
     }
 
     resolveResp, err := s.resolveNS(params)
@@ -1156,15 +1788,19 @@ func (s *ControllerServer) getSnapshotListWithSingleSnapshot(snapshotId string,
         return nil, err
     }
     nsProvider := resolveResp.nsProvider
-    snapshotPath := fmt.Sprintf("%s@%s", volumePath, splittedSnapshotPath[1])
-    snapshot, err := nsProvider.GetSnapshot(snapshotPath)
+    snapshotPath := id.Path()
+    snapshot, err := getSnapshot(nsProvider, snapshotPath)
     if err != nil {
         if ns.IsNotExistNefError(err) {
             return &response, nil
         }
         return nil, status.Errorf(codes.Internal, "Cannot get snapshot '%s' for snapshot list: %s", snapshotPath, err)
     }
-    response.Entries = append(response.Entries, convertNSSnapshotToCSISnapshot(snapshot, configName))
+    entry, err := convertNSSnapshotToCSISnapshot(snapshot, id.Volume.ConfigName)
+    if err != nil {
+        return nil, status.Errorf(codes.Internal, "Cannot get snapshot '%s' for snapshot list: %s", snapshotPath, err)
+    }
+    response.Entries = append(response.Entries, entry)
     l.Infof("snapshot '%s' found for '%s' filesystem", snapshot.Path, volumePath)
     return &response, nil
 }
@@ -1174,7 +1810,28 @@ func (s *ControllerServer) getVolumeSnapshotList(volumeId string, req *csi.ListS
     error,
 ) {
     l := s.log.WithField("func", "getVolumeSnapshotList()")
-    l.Infof("volume path: %s", volumeId)
+    l.Infof("volume ID: %s", volumeId)
+
+    id, err := csiid.ParseVolumeID(volumeId)
+    if err != nil {
+        // volume with malformed ID can't exist, so it has no snapshots
+        l.Infof("Bad volume format: %s", err)
+        return &csi.ListSnapshotsResponse{Entries: []*csi.ListSnapshotsResponse_Entry{}}, nil
+    }
+    params := ResolveNSParams{
+        volumeGroup: id.VolumeGroup,
+        configName:  id.ConfigName,
+    }
+    return s.getSnapshotList(params, id.Path(), req)
+}
+
+// getSnapshotList - lists snapshots of volume or all volumes in volume group by NexentaStor path
+func (s *ControllerServer) getSnapshotList(params ResolveNSParams, volumePath string, req *csi.ListSnapshotsRequest) (
+    *csi.ListSnapshotsResponse,
+    error,
+) {
+    l := s.log.WithField("func", "getSnapshotList()")
+    l.Infof("volume path: %s", volumePath)
 
     startingToken := req.GetStartingToken()
     maxEntries := req.GetMaxEntries()
@@ -1182,28 +1839,6 @@ func (s *ControllerServer) getVolumeSnapshotList(volumeId string, req *csi.ListS
     response := csi.ListSnapshotsResponse{
         Entries: []*csi.ListSnapshotsResponse_Entry{},
     }
-    splittedVol := strings.Split(volumeId, ":")
-    volumePath := ""
-    configName := ""
-    params := ResolveNSParams{}
-    if len(splittedVol) == 2 {
-        configName, volumePath = splittedVol[0], splittedVol[1]
-
-        splittedPath := strings.Split(volumePath, "/")
-        if len(splittedPath) != 3 {
-            return nil, status.Errorf(codes.InvalidArgument, "Got wrong volume: %s", volumePath)
-        }
-        volumeGroup := strings.Join(splittedPath[:2], "/")
-        params := ResolveNSParams{
-            volumeGroup: volumeGroup,
-            configName:  configName,
-        }
-        params.volumeGroup = volumeGroup
-        params.configName = configName
-    } else {
-        volumePath = volumeId
-        params.volumeGroup = volumePath
-    }
     resolveResp, err := s.resolveNS(params)
     if err != nil {
         l.Infof("volume '%s' not found, that's OK for list request", volumePath)
@@ -1211,7 +1846,7 @@ func (s *ControllerServer) getVolumeSnapshotList(volumeId string, req *csi.ListS
     }
 
     nsProvider := resolveResp.nsProvider
-    snapshots, err := nsProvider.GetSnapshots(volumePath, true)
+    snapshots, err := getSnapshots(nsProvider, volumePath, true)
     if err != nil {
         return nil, status.Errorf(codes.Internal, "Cannot get snapshot list for '%s': %s", volumePath, err)
     }
@@ -1225,7 +1860,13 @@ func (s *ControllerServer) getVolumeSnapshotList(volumeId string, req *csi.ListS
             continue
         }
 
-        response.Entries = append(response.Entries, convertNSSnapshotToCSISnapshot(snapshot, resolveResp.configName))
+        entry, err := convertNSSnapshotToCSISnapshot(snapshot, resolveResp.configName)
+        if err != nil {
+            // e.g. snapshot of the volume group itself, it's not a CSI snapshot
+            l.Infof("skipping snapshot '%s': %s", snapshot.Path, err)
+            continue
+        }
+        response.Entries = append(response.Entries, entry)
 
         // if the requested maximum is reached (and specified) than set next token
         if maxEntries != 0 && int32(len(response.Entries)) == maxEntries {
@@ -1247,21 +1888,28 @@ func (s *ControllerServer) getVolumeSnapshotList(volumeId string, req *csi.ListS
     return &response, nil
 }
 
-func convertNSSnapshotToCSISnapshot(snapshot ns.Snapshot, configName string) *csi.ListSnapshotsResponse_Entry {
+func convertNSSnapshotToCSISnapshot(snapshot nefSnapshot, configName string) (*csi.ListSnapshotsResponse_Entry, error) {
     creationTime := timestamppb.New(snapshot.CreationTime)
 
+    id, err := csiid.NewSnapshotID(configName, snapshot.Path)
+    if err != nil {
+        return nil, err
+    }
+
     return &csi.ListSnapshotsResponse_Entry{
         Snapshot: &csi.Snapshot{
-            SnapshotId:     fmt.Sprintf("%s:%s", configName, snapshot.Path),
-            SourceVolumeId: fmt.Sprintf("%s:%s", configName, snapshot.Parent),
+            SnapshotId:     id.String(),
+            SourceVolumeId: id.Volume.String(),
             CreationTime: creationTime,
-            ReadyToUse: true, //TODO use actual state
-            //SizeByte: 0 //TODO size of zero means it is unspecified
+            ReadyToUse: snapshot.readyToUse(),
+            SizeBytes: snapshot.sizeBytes(),
         },
-    }
+    }, nil
 }
 
-// ListVolumes - list volumes, shows only volumes created in defaultvolumeGroup
+// ListVolumes - list volumes, shows only volumes created in defaultvolumeGroup.
+// Volumes are ordered by config name and volume path, starting token is the ID of the first volume to return,
+// so pagination continues from the same position if the volume has been deleted in between
 func (s *ControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (
     *csi.ListVolumesResponse,
     error,
@@ -1279,10 +1927,30 @@ func (s *ControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumes
     if err != nil {
         return nil, status.Errorf(codes.Aborted, "Cannot use config file: %s", err)
     }
+
+    var startID csiid.VolumeID
+    if startingToken != "" {
+        startID, err = csiid.ParseVolumeID(startingToken)
+        if err != nil {
+            return nil, status.Errorf(codes.Aborted, "Invalid starting token '%s': %s", startingToken, err)
+        }
+        if _, ok := s.config.NsMap[startID.ConfigName]; !ok {
+            return nil, status.Errorf(
+                codes.Aborted,
+                "Invalid starting token '%s': NexentaStor '%s' is not in the config",
+                startingToken,
+                startID.ConfigName,
+            )
+        }
+    }
+
     nextToken := ""
     entries := []*csi.ListVolumesResponse_Entry{}
-    volumes := []ns.Volume{}
-    for configName, _ := range s.config.NsMap {
+configs:
+    for _, configName := range sortedConfigNames(s.config) {
+        if startingToken != "" && configName < startID.ConfigName {
+            continue
+        }
         params := ResolveNSParams{
             configName: configName,
         }
@@ -1291,29 +1959,50 @@ func (s *ControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumes
             return nil, err
         }
         nsProvider := resolveResp.nsProvider
-        volumeGroup := resolveResp.volumeGroup
 
-        volumes, nextToken, err = nsProvider.GetVolumesWithStartingToken(
-            volumeGroup,
-            startingToken,
-            maxEntries,
-        )
+        volumes, err := getAllVolumesWithStatus(nsProvider)
+        if err != nil {
+            return nil, err
+        }
+
+        pools := map[string]nefPool{}
+        for _, volume := range volumes {
+            id, err := csiid.NewVolumeID(configName, volume.Path)
+            if err != nil {
+                l.Infof("skipping volume '%s': %s", volume.Path, err)
+                continue
+            }
+            if configName == startID.ConfigName && id.Path() < startID.Path() {
+                continue
+            }
+            if maxEntries > 0 && len(entries) == maxEntries {
+                nextToken = id.String()
+                break configs
+            }
 
-        for _, item := range volumes {
+            pool, ok := pools[id.Pool()]
+            if !ok {
+                pool, err = getPool(nsProvider, id.Pool())
+                if err != nil {
+                    return nil, status.Errorf(codes.Internal, "Cannot get pool '%s': %s", id.Pool(), err)
+                }
+                pools[id.Pool()] = pool
+            }
             entries = append(entries, &csi.ListVolumesResponse_Entry{
-                Volume: &csi.Volume{VolumeId: fmt.Sprintf("%s:%s", configName, item.Path)},
+                Volume: &csi.Volume{
+                    VolumeId: id.String(),
+                    CapacityBytes: volume.VolumeSize,
+                    VolumeContext: getVolumeContext(s.config.NsMap[configName], nil, id.VolumeGroup),
+                },
+                Status: &csi.ListVolumesResponse_VolumeStatus{
+                    PublishedNodeIds: getPublishedNodes(volume),
+                    VolumeCondition: volumeCondition(volume, pool),
+                },
             })
         }
     }
-        
-    if startingToken != "" && len(entries) == 0 {
-        return nil, status.Errorf(
-            codes.Aborted,
-            fmt.Sprintf("Failed to find filesystem started from token '%s': %s", startingToken, err),
-        )
-    }
 
-    l.Infof("found %d entries(s)", len(entries))
+    l.Infof("found %d entries(s), next token: '%s'", len(entries), nextToken)
 
     return &csi.ListVolumesResponse{
         Entries:   entries,
@@ -1321,6 +2010,31 @@ func (s *ControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumes
     }, nil
 }
 
+// getAllVolumesWithStatus - returns volumes of all volume groups of the appliance sorted by path, the path of
+// the last listed volume is the starting token of the next page. Trashed volumes are not listed.
+func getAllVolumesWithStatus(nsProvider ns.ProviderInterface) ([]nefVolume, error) {
+    volumeGroups, err := getVolumeGroups(nsProvider)
+    if err != nil {
+        return nil, status.Errorf(codes.Internal, "Cannot get volume groups on %s: %s", nsProvider, err)
+    }
+    volumes := []nefVolume{}
+    for _, volumeGroup := range volumeGroups {
+        vgVolumes, err := getVolumesWithStatus(nsProvider, volumeGroup)
+        if err != nil {
+            return nil, status.Errorf(
+                codes.Internal, "Cannot get volumes of '%s' on %s: %s", volumeGroup, nsProvider, err)
+        }
+        for _, volume := range vgVolumes {
+            if !isTrashed(volume) {
+                volumes = append(volumes, volume)
+            }
+        }
+    }
+    // volumes of a nested volume group and of its parent aren't in path order, e.g. "vg/nested/pvc-2" < "vg/pvc-1"
+    sort.Slice(volumes, func(i, j int) bool { return volumes[i].Path < volumes[j].Path })
+    return volumes, nil
+}
+
 func (s *ControllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (
     *csi.ControllerPublishVolumeResponse,
     error,
@@ -1343,23 +2057,22 @@ func (s *ControllerServer) ControllerPublishVolume(ctx context.Context, req *csi
         return nil, status.Error(codes.InvalidArgument, "Node ID not provided")
     }
 
-    splittedVol := strings.Split(volumeID, ":")
-    if len(splittedVol) != 2 {
-        return nil, status.Error(codes.NotFound, fmt.Sprintf("VolumeId is in wrong format: %s", volumeID))
+    id, err := csiid.ParseVolumeID(volumeID)
+    if err != nil {
+        return nil, csiid.NotFound(err)
     }
-    configName, volumePath := splittedVol[0], splittedVol[1]
-    cfg := s.config.NsMap[configName]
+    volumePath := id.Path()
 
     params := ResolveNSParams{
-        volumeGroup: cfg.DefaultVolumeGroup,
-        configName: configName,
+        volumeGroup: id.VolumeGroup,
+        configName: id.ConfigName,
     }
     response, err := s.resolveNS(params)
     nsProvider := response.nsProvider
     if err != nil {
         return nil, err
     }
-    _, err = nsProvider.GetVolume(volumePath)
+    _, err = getVolume(nsProvider, volumePath)
     if err != nil {
         l.Warnf("GetVolume ERROR: %+v", err)
         return nil, status.Errorf(codes.NotFound, "Volume %v not found on NexentaStor", volumePath)
@@ -1369,7 +2082,11 @@ func (s *ControllerServer) ControllerPublishVolume(ctx context.Context, req *csi
         return nil, status.Errorf(codes.NotFound, "Incorrect node: %v", nodeID)
     }
 
-    // All attach operations are done in nodeStageVolume.
+    // All attach operations are done in nodeStageVolume, the node ID is kept for ControllerGetVolume and ListVolumes
+    err = setVolumePublishedNode(nsProvider, volumePath, nodeID, true)
+    if err != nil {
+        return nil, status.Errorf(codes.Internal, "Cannot set published node of volume '%s': %s", volumePath, err)
+    }
     return &csi.ControllerPublishVolumeResponse{}, nil
 }
 
@@ -1380,11 +2097,7 @@ func (s *ControllerServer) ControllerUnpublishVolume(ctx context.Context, req *c
     l := s.log.WithField("func", "ControllerUnpublishVolume()")
     l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
 
-    var secret string
-    secrets := req.GetSecrets()
-    for _, v := range secrets {
-        secret = v
-    }
+    secret := getConfigSecret(req.GetSecrets())
     err := s.refreshConfig(secret)
     if err != nil {
         return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
@@ -1394,23 +2107,16 @@ func (s *ControllerServer) ControllerUnpublishVolume(ctx context.Context, req *c
     if len(volumeId) == 0 {
         return nil, status.Error(codes.InvalidArgument, "Volume ID must be provided")
     }
-    splittedVol := strings.Split(volumeId, ":")
-    if len(splittedVol) != 2 {
-        l.Infof("Got wrong volumeId, but that is OK for deletion")
-        return &csi.ControllerUnpublishVolumeResponse{}, nil
-    }
-    configName, volumePath := splittedVol[0], splittedVol[1]
-
-    splittedPath := strings.Split(volumePath, "/")
-    if len(splittedPath) != 3 {
-        l.Infof("Got wrong volumeId, but that is OK for deletion")
+    id, err := csiid.ParseVolumeID(volumeId)
+    if err != nil {
+        l.Infof("Got wrong volumeId, but that is OK for deletion: %s", err)
         return &csi.ControllerUnpublishVolumeResponse{}, nil
     }
-    volumeGroup := strings.Join(splittedPath[:2], "/")
+    volumePath := id.Path()
 
     params := ResolveNSParams{
-        volumeGroup: volumeGroup,
-        configName: configName,
+        volumeGroup: id.VolumeGroup,
+        configName: id.ConfigName,
     }
     resolveResp, err := s.resolveNS(params)
     if err != nil {
@@ -1430,8 +2136,9 @@ func (s *ControllerServer) ControllerUnpublishVolume(ctx context.Context, req *c
         return nil, err
     }
     for _, lun := range luns {
+        // mapping may be already removed by previous request which response was lost
         err = nsProvider.DestroyLunMapping(lun.Id)
-        if err != nil{
+        if err != nil && !ns.IsNotExistNefError(err) {
             return nil, err
         }
     }
@@ -1456,6 +2163,20 @@ func (s *ControllerServer) ControllerUnpublishVolume(ctx context.Context, req *c
         }
     }
 
+    // the volume is unpublished from all nodes if the node ID is not set
+    if nodeID := req.GetNodeId(); len(nodeID) != 0 {
+        err = setVolumePublishedNode(nsProvider, volumePath, nodeID, false)
+    } else {
+        var volume nefVolume
+        volume, err = getVolumeStatus(nsProvider, volumePath)
+        if err == nil {
+            err = clearVolumePublishedNodes(nsProvider, volume)
+        }
+    }
+    if err != nil && !ns.IsNotExistNefError(err) {
+        return nil, status.Errorf(codes.Internal, "Cannot clear published nodes of volume '%s': %s", volumePath, err)
+    }
+
     return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
@@ -1492,7 +2213,7 @@ func NewControllerServer(driver *Driver) (*ControllerServer, error) {
     resolverMap := make(map[string]ns.Resolver)
 
     for name, cfg := range driver.config.NsMap {
-        nsResolver, err := ns.NewResolver(ns.ResolverArgs{
+        nsResolver, err := driver.newResolver(ns.ResolverArgs{
             Address:            cfg.Address,
             Username:           cfg.Username,
             Password:           cfg.Password,
@@ -1505,10 +2226,25 @@ func NewControllerServer(driver *Driver) (*ControllerServer, error) {
         resolverMap[name] = *nsResolver
     }
 
-    l.Info("Resolver map: %+v", resolverMap)
+    // background loops read the config file on their own, RPCs replace driver config with request secrets
+    backgroundConfig, err := config.Load(driver.config.GetFilePath())
+    if err != nil {
+        return nil, fmt.Errorf("Cannot use config file: %s", err)
+    }
+
+    l.Infof("Resolver map: %+v", resolverMap)
     return &ControllerServer{
         nsResolverMap: resolverMap,
+        newResolver:   driver.newResolver,
         config:     driver.config,
         log:        l,
+        roundRobin: &roundRobinPlacement{},
+        orphans:    &orphanCollector{},
+        background: &backgroundNS{
+            config:      backgroundConfig,
+            newResolver: driver.newResolver,
+            log:         l,
+        },
+        leader: driver.leader,
     }, nil
 }
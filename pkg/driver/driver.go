@@ -10,8 +10,12 @@ import (
 	"path/filepath"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/csi-addons/spec/lib/go/identity"
+	"github.com/csi-addons/spec/lib/go/replication"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"k8s.io/mount-utils"
+	utilexec "k8s.io/utils/exec"
 
 	"github.com/Nexenta/go-nexentastor/pkg/ns"
 	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/config"
@@ -32,14 +36,27 @@ var Commit string
 // go build -ldflags "-X github.com/Nexenta/nexentastor-csi-driver-block/pkg/driver.DateTime=..."
 var DateTime string
 
+// ResolverFactory - creates NexentaStor resolver for NsMap entry, ns.NewResolver is used by default
+type ResolverFactory func(args ns.ResolverArgs) (*ns.Resolver, error)
+
+// LeaderElector - tells if the controller replica is the elected leader, background jobs run on the leader only
+type LeaderElector interface {
+	IsLeader() bool
+}
+
 // Driver - K8s CSI driver for NexentaStor
 type Driver struct {
-	role     Role
-	nodeID   string
-	endpoint string
-	config   *config.Config
-	server   *grpc.Server
-	log      *logrus.Entry
+	role        Role
+	nodeID      string
+	endpoint    string
+	config      *config.Config
+	newResolver ResolverFactory
+	leader      LeaderElector
+	exec        utilexec.Interface
+	hostFS      HostFS
+	mounter     mount.Interface
+	server      *grpc.Server
+	log         *logrus.Entry
 }
 
 // Run - run the driver
@@ -83,6 +100,13 @@ func (d *Driver) Run() error {
 			return fmt.Errorf("Failed to create ControllerServer: %s", err)
 		}
 		csi.RegisterControllerServer(d.server, controllerServer)
+		csi.RegisterGroupControllerServer(d.server, controllerServer)
+		// csi-addons services are served on the same socket, csi-addons sidecar replicates volumes using them
+		identity.RegisterIdentityServer(d.server, NewAddonsIdentityServer(d))
+		replication.RegisterControllerServer(d.server, NewReplicationServer(controllerServer))
+		go controllerServer.runSnapshotSchedules(snapshotScheduleCheckInterval)
+		go controllerServer.runOrphanCollector(orphanCollectorInterval)
+		go controllerServer.runTrashPurge(trashPurgeInterval)
 	}
 
 	if d.role.IsNode() {
@@ -102,7 +126,7 @@ func (d *Driver) Run() error {
 // - in case of cluster, check if provided addresses belong to the same cluster
 func (d *Driver) Validate() error {
 	for _, cfg := range d.config.NsMap {
-		nsResolver, err := ns.NewResolver(ns.ResolverArgs{
+		nsResolver, err := d.newResolver(ns.ResolverArgs{
 			Address:            cfg.Address,
 			Username:           cfg.Username,
 			Password:           cfg.Password,
@@ -164,6 +188,18 @@ type Args struct {
 	Endpoint string
 	Config   *config.Config
 	Log      *logrus.Entry
+
+	// ResolverFactory - optional, overrides ns.NewResolver (e.g. to use in-memory NexentaStor in tests)
+	ResolverFactory ResolverFactory
+
+	// LeaderElector - optional, leader election of controller replicas, if it's not set the controller
+	// is expected to run as a single replica and never reclaims orphaned objects
+	LeaderElector LeaderElector
+
+	// Exec, HostFS, Mounter - optional, override node host access (commands, /host and sysfs files, mounts)
+	Exec    utilexec.Interface
+	HostFS  HostFS
+	Mounter mount.Interface
 }
 
 // NewDriver - new driver instance
@@ -177,12 +213,35 @@ func NewDriver(args Args) (*Driver, error) {
 	l := args.Log.WithField("cmp", "Driver")
 	l.Infof("create new driver: %s@%s-%s (%s)", Name, Version, Commit, DateTime)
 
+	newResolver := args.ResolverFactory
+	if newResolver == nil {
+		newResolver = ns.NewResolver
+	}
+
+	executor := args.Exec
+	if executor == nil {
+		executor = utilexec.New()
+	}
+	hostFS := args.HostFS
+	if hostFS == nil {
+		hostFS = OSHostFS{}
+	}
+	mounter := args.Mounter
+	if mounter == nil {
+		mounter = mount.New("")
+	}
+
 	d := &Driver{
-		role:     args.Role,
-		nodeID:   args.NodeID,
-		endpoint: args.Endpoint,
-		config:   args.Config,
-		log:      l,
+		role:        args.Role,
+		nodeID:      args.NodeID,
+		endpoint:    args.Endpoint,
+		config:      args.Config,
+		newResolver: newResolver,
+		leader:      args.LeaderElector,
+		exec:        executor,
+		hostFS:      hostFS,
+		mounter:     mounter,
+		log:         l,
 	}
 
 	return d, nil
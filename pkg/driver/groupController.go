@@ -0,0 +1,367 @@
+package driver
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/csiid"
+)
+
+// supportedGroupControllerCapabilities - driver group controller capabilities
+var supportedGroupControllerCapabilities = []csi.GroupControllerServiceCapability_RPC_Type{
+	csi.GroupControllerServiceCapability_RPC_CREATE_DELETE_GET_VOLUME_GROUP_SNAPSHOT,
+}
+
+// GroupControllerGetCapabilities - group controller capabilities
+func (s *ControllerServer) GroupControllerGetCapabilities(
+	ctx context.Context,
+	req *csi.GroupControllerGetCapabilitiesRequest,
+) (*csi.GroupControllerGetCapabilitiesResponse, error) {
+	s.log.WithField("func", "GroupControllerGetCapabilities()").Infof("request: '%+v'", req)
+
+	var capabilities []*csi.GroupControllerServiceCapability
+	for _, c := range supportedGroupControllerCapabilities {
+		capabilities = append(capabilities, &csi.GroupControllerServiceCapability{
+			Type: &csi.GroupControllerServiceCapability_Rpc{
+				Rpc: &csi.GroupControllerServiceCapability_RPC{Type: c},
+			},
+		})
+	}
+	return &csi.GroupControllerGetCapabilitiesResponse{Capabilities: capabilities}, nil
+}
+
+// CreateVolumeGroupSnapshot - snapshots source volumes atomically by one recursive snapshot of their volume group,
+// NEF can't snapshot several datasets at once, so snapshots of other datasets of the volume group are destroyed
+func (s *ControllerServer) CreateVolumeGroupSnapshot(
+	ctx context.Context,
+	req *csi.CreateVolumeGroupSnapshotRequest,
+) (*csi.CreateVolumeGroupSnapshotResponse, error) {
+	l := s.log.WithField("func", "CreateVolumeGroupSnapshot()")
+	l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
+
+	secret := getConfigSecret(req.GetSecrets())
+	err := s.refreshConfig(secret)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
+	}
+
+	name := req.GetName()
+	if len(name) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Group snapshot name must be provided")
+	}
+	if len(req.GetSourceVolumeIds()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Group snapshot source volume IDs must be provided")
+	}
+	volumeIDs, id, err := parseGroupSnapshotSources(name, req.GetSourceVolumeIds())
+	if err != nil {
+		return nil, err
+	}
+
+	resolveResp, err := s.resolveNS(ResolveNSParams{
+		volumeGroup: id.VolumeGroup,
+		configName:  id.ConfigName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	nsProvider := resolveResp.nsProvider
+
+	if err := checkGroupSnapshotSources(nsProvider, volumeIDs); err != nil {
+		return nil, err
+	}
+
+	// ZFS fails the whole recursive snapshot if any of the snapshots exists, so it's either a retry
+	// or the name is used by another group snapshot, member snapshots tell them apart
+	err = createRecursiveSnapshot(nsProvider, id.Path())
+	if err != nil && !ns.IsAlreadyExistNefError(err) {
+		return nil, status.Errorf(codes.Internal, "Cannot create group snapshot '%s': %s", id.Path(), err)
+	}
+
+	snapshots, err := getGroupSnapshots(nsProvider, id)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot get snapshots of group snapshot '%s': %s", id, err)
+	}
+	var members []nefSnapshot
+	for _, volumeID := range volumeIDs {
+		member, _ := id.Member(volumeID)
+		snapshot, ok := snapshots[member.Path()]
+		if !ok {
+			return nil, status.Errorf(
+				codes.AlreadyExists,
+				"Snapshot '%s' already exists in volume group '%s' and has no snapshot of volume '%s'",
+				name,
+				id.VolumeGroup,
+				volumeID,
+			)
+		}
+		members = append(members, snapshot)
+		delete(snapshots, member.Path())
+	}
+
+	// the rest are snapshots of the volume group itself, of its other volumes and nested volume groups,
+	// CO generates a unique name for each group snapshot, so these are left by this request or by its retry
+	for _, snapshotPath := range sortedSnapshotPaths(snapshots) {
+		err := nsProvider.DestroySnapshot(snapshotPath)
+		if err != nil && !ns.IsNotExistNefError(err) {
+			return nil, status.Errorf(
+				codes.Internal, "Cannot destroy snapshot '%s' which is not in the group: %s", snapshotPath, err)
+		}
+		l.Infof("snapshot '%s' is not in the group, destroyed", snapshotPath)
+	}
+
+	groupSnapshot, err := newVolumeGroupSnapshot(id, members)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot create group snapshot '%s': %s", id, err)
+	}
+
+	l.Infof("group snapshot '%s' of %d volume(s) has been created", id, len(members))
+	return &csi.CreateVolumeGroupSnapshotResponse{GroupSnapshot: groupSnapshot}, nil
+}
+
+// DeleteVolumeGroupSnapshot - destroys all snapshots of the group
+func (s *ControllerServer) DeleteVolumeGroupSnapshot(
+	ctx context.Context,
+	req *csi.DeleteVolumeGroupSnapshotRequest,
+) (*csi.DeleteVolumeGroupSnapshotResponse, error) {
+	l := s.log.WithField("func", "DeleteVolumeGroupSnapshot()")
+	l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
+
+	secret := getConfigSecret(req.GetSecrets())
+	err := s.refreshConfig(secret)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
+	}
+
+	groupSnapshotID := req.GetGroupSnapshotId()
+	if len(groupSnapshotID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Group snapshot ID must be provided")
+	}
+	id, err := csiid.ParseGroupSnapshotID(groupSnapshotID)
+	if err != nil {
+		l.Infof("group snapshot '%s' not found, that's OK for deletion request: %s", groupSnapshotID, err)
+		return &csi.DeleteVolumeGroupSnapshotResponse{}, nil
+	}
+	if err := checkGroupSnapshotMembers(id, req.GetSnapshotIds()); err != nil {
+		return nil, err
+	}
+
+	resolveResp, err := s.resolveNS(ResolveNSParams{
+		volumeGroup: id.VolumeGroup,
+		configName:  id.ConfigName,
+	})
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			l.Infof("group snapshot '%s' not found, that's OK for deletion request", groupSnapshotID)
+			return &csi.DeleteVolumeGroupSnapshotResponse{}, nil
+		}
+		return nil, err
+	}
+	nsProvider := resolveResp.nsProvider
+
+	snapshots, err := getGroupSnapshots(nsProvider, id)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot get snapshots of group snapshot '%s': %s", id, err)
+	}
+	for _, snapshotPath := range sortedSnapshotPaths(snapshots) {
+		err := nsProvider.DestroySnapshot(snapshotPath)
+		if err != nil && !ns.IsNotExistNefError(err) {
+			message := fmt.Sprintf("Failed to delete snapshot '%s'", snapshotPath)
+			if ns.IsBusyNefError(err) {
+				message += ", it has dependent filesystem"
+			}
+			return nil, status.Errorf(codes.Internal, "%s: %s", message, err)
+		}
+	}
+
+	l.Infof("group snapshot '%s' has been deleted", id)
+	return &csi.DeleteVolumeGroupSnapshotResponse{}, nil
+}
+
+// GetVolumeGroupSnapshot - returns group snapshot with all its member snapshots
+func (s *ControllerServer) GetVolumeGroupSnapshot(
+	ctx context.Context,
+	req *csi.GetVolumeGroupSnapshotRequest,
+) (*csi.GetVolumeGroupSnapshotResponse, error) {
+	l := s.log.WithField("func", "GetVolumeGroupSnapshot()")
+	l.Infof("request: '%+v'", protosanitizer.StripSecrets(req))
+
+	secret := getConfigSecret(req.GetSecrets())
+	err := s.refreshConfig(secret)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
+	}
+
+	groupSnapshotID := req.GetGroupSnapshotId()
+	if len(groupSnapshotID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Group snapshot ID must be provided")
+	}
+	id, err := csiid.ParseGroupSnapshotID(groupSnapshotID)
+	if err != nil {
+		return nil, csiid.NotFound(err)
+	}
+	if err := checkGroupSnapshotMembers(id, req.GetSnapshotIds()); err != nil {
+		return nil, err
+	}
+
+	resolveResp, err := s.resolveNS(ResolveNSParams{
+		volumeGroup: id.VolumeGroup,
+		configName:  id.ConfigName,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots, err := getGroupSnapshots(resolveResp.nsProvider, id)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot get snapshots of group snapshot '%s': %s", id, err)
+	}
+	var members []nefSnapshot
+	for _, snapshotPath := range sortedSnapshotPaths(snapshots) {
+		if snapshot := snapshots[snapshotPath]; path.Dir(snapshot.Parent) == id.VolumeGroup {
+			members = append(members, snapshot)
+		}
+	}
+	if len(members) == 0 {
+		return nil, status.Errorf(codes.NotFound, "Group snapshot '%s' not found", id)
+	}
+
+	groupSnapshot, err := newVolumeGroupSnapshot(id, members)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot get group snapshot '%s': %s", id, err)
+	}
+	return &csi.GetVolumeGroupSnapshotResponse{GroupSnapshot: groupSnapshot}, nil
+}
+
+// parseGroupSnapshotSources - returns IDs of the source volumes and of the group snapshot,
+// recursive snapshot is atomic for one volume group only, so all volumes must be in it
+func parseGroupSnapshotSources(name string, sourceVolumeIDs []string) (
+	volumeIDs []csiid.VolumeID,
+	id csiid.GroupSnapshotID,
+	err error,
+) {
+	seen := map[string]bool{}
+	for _, sourceVolumeID := range sourceVolumeIDs {
+		volumeID, err := csiid.ParseVolumeID(sourceVolumeID)
+		if err != nil {
+			return nil, id, err
+		}
+		if seen[volumeID.Path()] {
+			continue
+		}
+		seen[volumeID.Path()] = true
+
+		if len(volumeIDs) != 0 {
+			first := volumeIDs[0]
+			if volumeID.ConfigName != first.ConfigName {
+				return nil, id, status.Errorf(
+					codes.InvalidArgument,
+					"Group snapshot volumes must be on one NexentaStor, volume '%s' is on '%s', volume '%s' is on '%s'",
+					first,
+					first.ConfigName,
+					volumeID,
+					volumeID.ConfigName,
+				)
+			} else if volumeID.VolumeGroup != first.VolumeGroup {
+				return nil, id, status.Errorf(
+					codes.InvalidArgument,
+					"Group snapshot volumes must be in one volume group, volume '%s' is in '%s', volume '%s' is in '%s'",
+					first,
+					first.VolumeGroup,
+					volumeID,
+					volumeID.VolumeGroup,
+				)
+			}
+		}
+		volumeIDs = append(volumeIDs, volumeID)
+	}
+
+	id, err = csiid.NewGroupSnapshotID(volumeIDs[0].ConfigName, volumeIDs[0].VolumeGroup, name)
+	return volumeIDs, id, err
+}
+
+// checkGroupSnapshotSources - source volumes must exist, otherwise nothing is snapshotted
+func checkGroupSnapshotSources(nsProvider ns.ProviderInterface, volumeIDs []csiid.VolumeID) error {
+	for _, volumeID := range volumeIDs {
+		if _, err := getVolumeStatus(nsProvider, volumeID.Path()); err != nil {
+			if ns.IsNotExistNefError(err) {
+				return status.Errorf(codes.NotFound, "Source volume '%s' not found", volumeID)
+			}
+			return status.Errorf(codes.Internal, "Cannot get source volume '%s': %s", volumeID, err)
+		}
+	}
+	return nil
+}
+
+// checkGroupSnapshotMembers - all snapshot IDs of the request must be IDs of the group snapshot members
+func checkGroupSnapshotMembers(id csiid.GroupSnapshotID, snapshotIDs []string) error {
+	for _, snapshotID := range snapshotIDs {
+		if member, err := csiid.ParseSnapshotID(snapshotID); err == nil && member.Name == id.Name {
+			if _, ok := id.Member(member.Volume); ok {
+				continue
+			}
+		}
+		return status.Errorf(
+			codes.InvalidArgument, "Snapshot '%s' is not a member of group snapshot '%s'", snapshotID, id)
+	}
+	return nil
+}
+
+// getGroupSnapshots - returns snapshots with the group snapshot name in its volume group by path,
+// including the snapshots of the volume group itself and of nested volume groups
+func getGroupSnapshots(nsProvider ns.ProviderInterface, id csiid.GroupSnapshotID) (map[string]nefSnapshot, error) {
+	snapshots, err := getSnapshots(nsProvider, id.VolumeGroup, true)
+	if err != nil {
+		return nil, err
+	}
+	found := map[string]nefSnapshot{}
+	for _, snapshot := range snapshots {
+		if snapshot.Name == id.Name {
+			found[snapshot.Path] = snapshot
+		}
+	}
+	return found, nil
+}
+
+func sortedSnapshotPaths(snapshots map[string]nefSnapshot) []string {
+	paths := make([]string, 0, len(snapshots))
+	for p := range snapshots {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// newVolumeGroupSnapshot - converts member snapshots to CSI group snapshot, the group is ready to use
+// if all members are, its creation time is the earliest one of the members
+func newVolumeGroupSnapshot(id csiid.GroupSnapshotID, members []nefSnapshot) (*csi.VolumeGroupSnapshot, error) {
+	groupSnapshot := &csi.VolumeGroupSnapshot{
+		GroupSnapshotId: id.String(),
+		ReadyToUse:      true,
+	}
+	var creationTime time.Time
+	for _, member := range members {
+		entry, err := convertNSSnapshotToCSISnapshot(member, id.ConfigName)
+		if err != nil {
+			return nil, err
+		}
+		snapshot := entry.GetSnapshot()
+		snapshot.GroupSnapshotId = groupSnapshot.GroupSnapshotId
+		groupSnapshot.Snapshots = append(groupSnapshot.Snapshots, snapshot)
+		groupSnapshot.ReadyToUse = groupSnapshot.ReadyToUse && snapshot.GetReadyToUse()
+		if creationTime.IsZero() || member.CreationTime.Before(creationTime) {
+			creationTime = member.CreationTime
+		}
+	}
+	groupSnapshot.CreationTime = timestamppb.New(creationTime)
+	return groupSnapshot, nil
+}
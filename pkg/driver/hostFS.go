@@ -0,0 +1,67 @@
+package driver
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// HostFS - filesystem operations NodeServer performs on the node,
+// including host root mounted to "/host" and sysfs device attributes
+type HostFS interface {
+	Stat(name string) (os.FileInfo, error)
+	MkdirAll(path string, perm os.FileMode) error
+	Chmod(name string, mode os.FileMode) error
+	RemoveAll(path string) error
+	EvalSymlinks(path string) (string, error)
+	ReadFile(name string) ([]byte, error)
+
+	// AppendFile - writes data to the end of existing file (e.g. "/sys/block/sdb/device/rescan"),
+	// returns number of bytes written
+	AppendFile(name string, data []byte) (int, error)
+}
+
+// OSHostFS - HostFS implementation for the real node filesystem
+type OSHostFS struct{}
+
+// Stat - see os.Stat()
+func (OSHostFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+// MkdirAll - see os.MkdirAll()
+func (OSHostFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+// Chmod - see os.Chmod()
+func (OSHostFS) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+// RemoveAll - see os.RemoveAll()
+func (OSHostFS) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+// EvalSymlinks - see filepath.EvalSymlinks()
+func (OSHostFS) EvalSymlinks(path string) (string, error) {
+	return filepath.EvalSymlinks(path)
+}
+
+// ReadFile - see os.ReadFile()
+func (OSHostFS) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+// AppendFile - opens existing file in append mode and writes data to it
+func (OSHostFS) AppendFile(name string, data []byte) (int, error) {
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY, 0200)
+	if err != nil {
+		return 0, err
+	}
+	written, err := f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return written, err
+}
@@ -2,9 +2,7 @@ package driver
 
 import (
     "fmt"
-    "io/ioutil"
     "os"
-    "os/exec"
     "path/filepath"
     "strings"
     "strconv"
@@ -24,12 +22,17 @@ import (
     "github.com/cenkalti/backoff"
     "github.com/Nexenta/go-nexentastor/pkg/ns"
     "github.com/Nexenta/nexentastor-csi-driver-block/pkg/config"
+    "github.com/Nexenta/nexentastor-csi-driver-block/pkg/csiid"
 )
 
 // NodeServer - k8s csi driver node server
 type NodeServer struct {
     nodeID          string
     nsResolverMap   map[string]*ns.Resolver
+    newResolver     ResolverFactory
+    exec            utilexec.Interface
+    hostFS          HostFS
+    mounter         mount.Interface
     config          *config.Config
     log             *logrus.Entry
 }
@@ -76,7 +79,7 @@ func (s *NodeServer) refreshConfig(secret string) error {
     if changed {
         s.log.Info("config has been changed, updating...")
         for name, cfg := range s.config.NsMap {
-            s.nsResolverMap[name], err = ns.NewResolver(ns.ResolverArgs{
+            s.nsResolverMap[name], err = s.newResolver(ns.ResolverArgs{
                 Address:            cfg.Address,
                 Username:           cfg.Username,
                 Password:           cfg.Password,
@@ -126,21 +129,21 @@ func (s *NodeServer) resolveNS(configName, volumeGroup string) (nsProvider ns.Pr
 // ISCSILogInRescan - Attempts login to iSCSI target, rescan if already logged.
 func (s* NodeServer) ISCSILogInRescan(target, portal string) (error) {
     l := s.log.WithField("func", "ISCSILogInRescan()")
-    cmd := exec.Command("iscsiadm", "-m", "discovery", "-t", "sendtargets", "-p", portal)
+    cmd := s.exec.Command("iscsiadm", "-m", "discovery", "-t", "sendtargets", "-p", portal)
     l.Debugf("Executing command: %+v", cmd)
     out, err := cmd.CombinedOutput()
     if err != nil {
         l.Errorf("iscsiadm discovery error: %+v", err)
         return err
     }
-    cmd = exec.Command("iscsiadm", "-m", "node", "-T", target, "-p", portal, "-l")
+    cmd = s.exec.Command("iscsiadm", "-m", "node", "-T", target, "-p", portal, "-l")
     l.Debugf("Executing command: %+v", cmd)
     out, err = cmd.CombinedOutput()
     if err != nil {
         if !strings.Contains(string(out), "already present") {
             return status.Errorf(codes.Unauthenticated, "Was not able to login to target, err: %+v", err)
         } else {
-            cmd := exec.Command("iscsiadm", "-m", "node", "-T", target, "-p", portal, "--rescan")
+            cmd := s.exec.Command("iscsiadm", "-m", "node", "-T", target, "-p", portal, "--rescan")
             l.Debugf("Executing command: %+v", cmd)
             _, err = cmd.CombinedOutput()
             if err != nil {
@@ -155,7 +158,7 @@ func (s* NodeServer) ISCSILogInRescan(target, portal string) (error) {
 func (s *NodeServer) GetRealDeviceName(symLink string) (string, error) {
     l := s.log.WithField("func", "GetRealDeviceName()")
     l.Debugf("Evaluating symLink: %s", symLink)
-    devName, err := filepath.EvalSymlinks(fmt.Sprintf("/host/%s", symLink))
+    devName, err := s.hostFS.EvalSymlinks(fmt.Sprintf("/host/%s", symLink))
     if err != nil {
         l.Errorf("Could not evaluate symlink: %s, err: %+v", symLink, err)
         return "", err
@@ -170,21 +173,12 @@ func (s *NodeServer) GetRealDeviceName(symLink string) (string, error) {
 // RemoveDevice - remove device (e.g. /dev/sdb) after deleting LUN
 func (s *NodeServer) RemoveDevice(devName string) (error) {
     l := s.log.WithField("func", "RemoveDevice()")
-    var (
-        f   *os.File
-        err error
-    )
 
     filename := fmt.Sprintf("/host/sys/block%s/device/state", strings.TrimPrefix(devName, "/dev"))
-    if f, err = os.OpenFile(filename, os.O_APPEND | os.O_WRONLY, 0200); err != nil {
-        l.Errorf("Error while opening file %v: %v\n", filename, err.Error())
-        return err
-    }
-
-    defer f.Close()
     dataString := "offline\n"
     l.Debugf("Attempting to write '%s' to file: %s", dataString, filename)
-    if written, err := f.WriteString(dataString); err != nil {
+    if written, err := s.hostFS.AppendFile(filename, []byte(dataString)); err != nil {
+        l.Errorf("Error while writing to file %v: %v\n", filename, err.Error())
         return err
     } else if written == 0 {
         l.Warnf("No data written to file %s.", filename)
@@ -192,15 +186,10 @@ func (s *NodeServer) RemoveDevice(devName string) (error) {
     }
 
     filename = fmt.Sprintf("/host/sys/block%s/device/delete", strings.TrimPrefix(devName, "/dev"))
-    if f, err = os.OpenFile(filename, os.O_APPEND | os.O_WRONLY, 0200); err != nil {
-        l.Errorf("Error while opening file %v: %v\n", filename, err.Error())
-        return err
-    }
-
-    defer f.Close()
     dataString = "1"
     l.Debugf("Attempting to write '%s' to file: %s", dataString, filename)
-    if written, err := f.WriteString(dataString); err != nil {
+    if written, err := s.hostFS.AppendFile(filename, []byte(dataString)); err != nil {
+        l.Errorf("Error while writing to file %v: %v\n", filename, err.Error())
         return err
     } else if written == 0 {
         l.Warnf("No data written to file %s.", filename)
@@ -213,30 +202,19 @@ func (s *NodeServer) RemoveDevice(devName string) (error) {
 
 func (s *NodeServer) RescanDevice(devName string) (error) {
     l := s.log.WithField("func", "RescanDevice()")
-    var (
-        f   *os.File
-        err error
-    )
-    filename := fmt.Sprintf("/sys/block%s/device/rescan", strings.TrimPrefix(devName, "/dev"))
-    if f, err = os.OpenFile(filename, os.O_APPEND | os.O_WRONLY, 0200); err != nil {
-        l.Warnf("Could not open file %s for writing, err: %+v", filename, err)
-        return nil
-    }
 
+    filename := fmt.Sprintf("/sys/block%s/device/rescan", strings.TrimPrefix(devName, "/dev"))
     dataString := "1"
     l.Debugf("Attempting to write '%s' to file: %s", dataString, filename)
-    if written, err := f.WriteString(dataString); err != nil {
+    if written, err := s.hostFS.AppendFile(filename, []byte(dataString)); err != nil {
         l.Warnf("Could not write to file %s. Error: %+v", filename, err.Error())
-        f.Close()
         return nil
     } else if written == 0 {
         l.Warnf("No data written to file %s.", filename)
-        f.Close()
         return nil
     }
 
     l.Debugf("Successfully rescanned device: %s", devName)
-    f.Close()
     return nil
 }
 
@@ -353,6 +331,7 @@ func (s *NodeServer) CreateNewTargetTg(parsedContext ISCSIVolumeContext, nsProvi
     }
     err = nsProvider.CreateUpdateTargetGroup(createTargetGroupParams)
     if err != nil {
+        return target, targetGroup, err
     }
 
     if parsedContext.UseChapAuth == true {
@@ -532,27 +511,23 @@ func (s *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolu
         return nil, status.Error(codes.InvalidArgument, "Volume capability not provided")
     }
 
-    var secret string
-    secrets := req.GetSecrets()
-    for _, v := range secrets {
-        secret = v
-    }
+    secret := getConfigSecret(req.GetSecrets())
     // read and validate config
     err := s.refreshConfig(secret)
     if err != nil {
         return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
     }
 
-    splittedVol := strings.Split(volumeID, ":")
-    if len(splittedVol) != 2 {
-        return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("VolumeId is in wrong format: %s", volumeID))
+    id, err := csiid.ParseVolumeID(volumeID)
+    if err != nil {
+        return nil, err
     }
-    configName, volumePath := splittedVol[0], splittedVol[1]
-    cfg := s.config.NsMap[configName]
-    nsProvider, err, configName := s.resolveNS(configName, cfg.DefaultVolumeGroup)
+    volumePath := id.Path()
+    nsProvider, err, configName := s.resolveNS(id.ConfigName, id.VolumeGroup)
     if err != nil {
         return nil, err
     }
+    cfg := s.config.NsMap[configName]
 
     parsedContext, err := s.ParseVolumeContext(
         volumeContext, nsProvider, configName)
@@ -612,13 +587,13 @@ func (s *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolu
     if err != nil {
         return nil, err
     }
-    _, err = os.Stat(targetPath)
+    _, err = s.hostFS.Stat(targetPath)
     if os.IsNotExist(err) {
-        if err = os.MkdirAll(filepath.Dir(targetPath), permissions); err != nil {
+        if err = s.hostFS.MkdirAll(filepath.Dir(targetPath), permissions); err != nil {
             return nil, status.Error(codes.Internal, err.Error())
         }
     } else {
-        err = os.Chmod(targetPath, permissions)
+        err = s.hostFS.Chmod(targetPath, permissions)
         if err != nil {
             return nil, err
         }
@@ -642,7 +617,7 @@ func (s *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolu
         if err != nil {
             return nil, err
         }
-        if _, err := os.Stat(filepath.Join("/host", devByPath)); os.IsNotExist(err) {
+        if _, err := s.hostFS.Stat(filepath.Join("/host", devByPath)); os.IsNotExist(err) {
             l.Infof("Device %s not found, sleep %v", devByPath, sleepTime)
             time.Sleep(sleepTime)
             sleepTime *= 2
@@ -667,7 +642,7 @@ func (s *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolu
     switch volumeCapability.GetAccessType().(type) {
     case *csi.VolumeCapability_Block:
         targetPath = filepath.Join(targetPath, "device")
-        cmd := exec.Command("ln", "-s", source, targetPath)
+        cmd := s.exec.Command("ln", "-s", source, targetPath)
         l.Debugf("Executing command: %+v", cmd)
         _, err = cmd.CombinedOutput()
         if err != nil {
@@ -755,7 +730,7 @@ func (s *NodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstage
     // Raw block devices
     if strings.Contains(targetPath, "volumeDevices") {
         symLink := filepath.Join(targetPath, "device")
-        cmd := exec.Command("realpath", symLink)
+        cmd := s.exec.Command("realpath", symLink)
         l.Debugf("Executing command: %+v", cmd)
         out, err := cmd.CombinedOutput()
         if err != nil {
@@ -774,7 +749,7 @@ func (s *NodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstage
             errors = append(errors, err)
         }
 
-        mounter := mount.New("")
+        mounter := s.mounter
         notMountPoint, err := mounter.IsLikelyNotMountPoint(targetPath)
         if err != nil {
             errors = append(errors, err)
@@ -801,7 +776,7 @@ func (s *NodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstage
             l.Errorf(error.Error())
         }
     }
-    if err := os.RemoveAll(targetPath); err != nil {
+    if err := s.hostFS.RemoveAll(targetPath); err != nil {
         if os.IsNotExist(err) {
             l.Infof("mount point '%s' already doesn't exist: '%s', return OK", targetPath, err)
             return &csi.NodeUnstageVolumeResponse{}, nil
@@ -816,7 +791,7 @@ func (s *NodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstage
 func (s *NodeServer) FlushBufs(device string) (err error) {
     l := s.log.WithField("func", "FlushBufs()")
     l.Infof("device: '%+v'", device)
-    cmd := exec.Command("blockdev", "--flushbufs", device)
+    cmd := s.exec.Command("blockdev", "--flushbufs", device)
     l.Debugf("Executing command: %+v", cmd)
     out, err := cmd.CombinedOutput()
     if err != nil {
@@ -863,9 +838,9 @@ func (s *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublish
     }
 
     // Make dir if dir not present
-    _, err = os.Stat(targetPath)
+    _, err = s.hostFS.Stat(targetPath)
     if os.IsNotExist(err) {
-        if err = os.MkdirAll(filepath.Dir(targetPath), permissions); err != nil {
+        if err = s.hostFS.MkdirAll(filepath.Dir(targetPath), permissions); err != nil {
             return nil, status.Error(codes.Internal, err.Error())
         }
     }
@@ -874,7 +849,7 @@ func (s *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublish
     switch volumeCapability.GetAccessType().(type) {
     case *csi.VolumeCapability_Block:
         source = filepath.Join(source, "device")
-        cmd := exec.Command("realpath", source)
+        cmd := s.exec.Command("realpath", source)
         l.Debugf("Executing command: %+v", cmd)
         out, err := cmd.CombinedOutput()
         if err != nil {
@@ -882,7 +857,7 @@ func (s *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublish
             return nil, err
         }
         devName = strings.TrimSpace(string(out))
-        cmd = exec.Command("ln", "-s", devName, targetPath)
+        cmd = s.exec.Command("ln", "-s", devName, targetPath)
         l.Debugf("Executing command: %+v", cmd)
         _, err = cmd.CombinedOutput()
         if err != nil {
@@ -944,7 +919,7 @@ func (s *NodeServer) CreateUpdateHostGroup(nsProvider ns.ProviderInterface) (nam
 }
 
 func (s *NodeServer) GetNodeIQN() (initiatorName string, err error) {
-    content, err := ioutil.ReadFile(PathToInitiatorName)
+    content, err := s.hostFS.ReadFile(PathToInitiatorName)
     if err != nil {
         return initiatorName, err
     }
@@ -976,11 +951,11 @@ func (s *NodeServer) mountVolume(devName, targetPath, fsType string, mountOption
     l := s.log.WithField("func", "mountVolume()")
     l.Infof("Mounting device %s to targetPath %s with options %s", devName, targetPath, mountOptions)
 
-    mounter := mount.New("")
+    mounter := s.mounter
     notMnt, err := mounter.IsLikelyNotMountPoint(targetPath)
     if err != nil {
         if os.IsNotExist(err) {
-            if err := os.MkdirAll(targetPath, permissions); err != nil {
+            if err := s.hostFS.MkdirAll(targetPath, permissions); err != nil {
                 l.Errorf("Failed to mkdir to target path %s. Error: %s", targetPath, err)
                 return status.Error(codes.Internal, err.Error())
             }
@@ -1011,7 +986,7 @@ func (s *NodeServer) mountVolume(devName, targetPath, fsType string, mountOption
         return status.Error(codes.Internal, err.Error())
     }
 
-    err = os.Chmod(targetPath, permissions)
+    err = s.hostFS.Chmod(targetPath, permissions)
     if err != nil {
         return err
     }
@@ -1032,15 +1007,15 @@ func (s *NodeServer) formatVolume(device, fstype string) error {
         l.Debugf("Trying to format %s via %s", device, fstype)
         switch fstype {
         case "xfs":
-            cmd := exec.Command("mkfs.xfs", "-K", "-f", device)
+            cmd := s.exec.Command("mkfs.xfs", "-K", "-f", device)
             l.Debugf("Executing command: %+v", cmd)
             _, err = cmd.CombinedOutput()
         case "ext3":
-            cmd := exec.Command("mkfs.ext3", "-E", "nodiscard", "-F", device)
+            cmd := s.exec.Command("mkfs.ext3", "-E", "nodiscard", "-F", device)
             l.Debugf("Executing command: %+v", cmd)
             _, err = cmd.CombinedOutput()
         case "ext4":
-            cmd := exec.Command("mkfs.ext4", "-E", "nodiscard", "-F", device)
+            cmd := s.exec.Command("mkfs.ext4", "-E", "nodiscard", "-F", device)
             l.Debugf("Executing command: %+v", cmd)
             _, err = cmd.CombinedOutput()
         default:
@@ -1090,7 +1065,7 @@ func (s *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpub
     if len(targetPath) == 0 {
         return nil, status.Error(codes.InvalidArgument, "Target path must be provided")
     }
-    mounter := mount.New("")
+    mounter := s.mounter
     notMountPoint, err := mounter.IsLikelyNotMountPoint(targetPath)
     if err != nil {
         if os.IsNotExist(err) {
@@ -1106,7 +1081,7 @@ func (s *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpub
     }
 
     if notMountPoint {
-        if err := os.RemoveAll(targetPath); err != nil {
+        if err := s.hostFS.RemoveAll(targetPath); err != nil {
             l.Infof("Remove targetPath error: %s", err.Error())
         }
         return &csi.NodeUnpublishVolumeResponse{}, nil
@@ -1118,7 +1093,7 @@ func (s *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpub
         }
     }
 
-    if err := os.RemoveAll(targetPath); err != nil && !os.IsNotExist(err) {
+    if err := s.hostFS.RemoveAll(targetPath); err != nil && !os.IsNotExist(err) {
         return nil, status.Errorf(codes.Internal, "Cannot remove unmounted target path '%s': %s", targetPath, err)
     }
 
@@ -1182,20 +1157,19 @@ func (s *NodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVol
         return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
     }
 
-    splittedVol := strings.Split(volumeID, ":")
-    if len(splittedVol) != 2 {
-        return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("VolumeId is in wrong format: %s", volumeID))
+    id, err := csiid.ParseVolumeID(volumeID)
+    if err != nil {
+        return nil, err
     }
-    configName, volumePath := splittedVol[0], splittedVol[1]
-    nsProvider, err, _ := s.resolveNS(configName, volumePath)
+    nsProvider, err, _ := s.resolveNS(id.ConfigName, id.VolumeGroup)
     if err != nil {
         return nil, err
     }
 
-    l.Infof("resolved NS: %s, %s", nsProvider, volumePath)
+    l.Infof("resolved NS: %s, %s", nsProvider, id.Path())
 
     // get NexentaStor filesystem information
-    available, err := nsProvider.GetFilesystemAvailableCapacity(volumePath)
+    available, err := nsProvider.GetFilesystemAvailableCapacity(id.Path())
     if err != nil {
         return nil, status.Errorf(codes.NotFound, "Cannot find filesystem '%s': %s", volumeID, err)
     }
@@ -1223,20 +1197,19 @@ func (s *NodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVo
         return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
     }
 
-    splittedVol := strings.Split(volumeID, ":")
-    if len(splittedVol) != 2 {
-        return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("VolumeId is in wrong format: %s", volumeID))
+    id, err := csiid.ParseVolumeID(volumeID)
+    if err != nil {
+        return nil, err
     }
-    configName, volumePath := splittedVol[0], splittedVol[1]
-    cfg := s.config.NsMap[configName]
-    nsProvider, err, configName := s.resolveNS(configName, cfg.DefaultVolumeGroup)
+    volumePath := id.Path()
+    nsProvider, err, _ := s.resolveNS(id.ConfigName, id.VolumeGroup)
     if err != nil {
         return nil, err
     }
 
     // Check if volume was not already expanded
     l.Debugf("Checking volume %s size", volumePath)
-    _, err = nsProvider.GetVolume(volumePath)
+    _, err = getVolume(nsProvider, volumePath)
     if err != nil {
         return nil, status.Errorf(codes.NotFound, "Did not find volume %s: %s", volumePath, err)
     }
@@ -1257,7 +1230,7 @@ func (s *NodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVo
         if err != nil {
             return nil, err
         }
-        r := mount.NewResizeFs(utilexec.New())
+        r := mount.NewResizeFs(s.exec)
         if _, err = r.Resize(devName, volumePath); err != nil {
             return nil, status.Errorf(
                 codes.Internal, "Could not resize volume %q (%q):  %v", volumeID, devName, err)
@@ -1278,7 +1251,7 @@ func (s *NodeServer) DeviceFromTargetPath(volumePath string) (deviceName string,
     ctx, cancel := context.WithTimeout(context.Background(), DefaultFindMntTimeout * time.Second)
     defer cancel()
 
-    cmd := exec.CommandContext(ctx, "findmnt", "-o", "source", "--noheadings", "--target", volumePath)
+    cmd := s.exec.CommandContext(ctx, "findmnt", "-o", "source", "--noheadings", "--target", volumePath)
     l.Debugf("Executing command: %+v", cmd)
     out, err := cmd.CombinedOutput()
     if err != nil {
@@ -1288,7 +1261,7 @@ func (s *NodeServer) DeviceFromTargetPath(volumePath string) (deviceName string,
     }
     devicePath := strings.TrimSpace(string(out))
 
-    cmd = exec.CommandContext(ctx, "findmnt", "-o", "source", "--noheadings", "--target", "/")
+    cmd = s.exec.CommandContext(ctx, "findmnt", "-o", "source", "--noheadings", "--target", "/")
     out, err = cmd.CombinedOutput()
     if err != nil {
         return "", status.Errorf(codes.Internal, "Could not determine device path: %v", err)
@@ -1305,7 +1278,7 @@ func (s *NodeServer) DeviceFromTargetPath(volumePath string) (deviceName string,
 
 func (s *NodeServer) getBlockSizeBytes(devicePath string) (int64, error) {
     l := s.log.WithField("func", "getBlockSizeBytes()")
-    cmd := exec.Command("blockdev", "--getsize64", devicePath)
+    cmd := s.exec.Command("blockdev", "--getsize64", devicePath)
     l.Debugf("Executing command: %+v", cmd)
     out, err := cmd.CombinedOutput()
     if err != nil {
@@ -1328,7 +1301,7 @@ func NewNodeServer(driver *Driver) (*NodeServer, error) {
     resolverMap := make(map[string]*ns.Resolver)
 
     for name, cfg := range driver.config.NsMap {
-        nsResolver, err := ns.NewResolver(ns.ResolverArgs{
+        nsResolver, err := driver.newResolver(ns.ResolverArgs{
             Address:            cfg.Address,
             Username:           cfg.Username,
             Password:           cfg.Password,
@@ -1344,6 +1317,10 @@ func NewNodeServer(driver *Driver) (*NodeServer, error) {
     return &NodeServer{
         nodeID:         driver.nodeID,
         nsResolverMap:  resolverMap,
+        newResolver:    driver.newResolver,
+        exec:           driver.exec,
+        hostFS:         driver.hostFS,
+        mounter:        driver.mounter,
         config:         driver.config,
         log:            l,
     }, nil
@@ -1372,7 +1349,7 @@ func stringInArray(arr []string, tofind string) bool {
 // getFSType returns the filesystem for the supplied devName.
 func (s *NodeServer) getFSType(devName string) string {
     l := s.log.WithField("func", "getFSType()")
-    cmd := exec.Command("blkid", devName)
+    cmd := s.exec.Command("blkid", devName)
     l.Debugf("Executing command: %+v", cmd)
     out, err := cmd.CombinedOutput()
     fsType := ""
@@ -0,0 +1,527 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+)
+
+// nefJobTimeout - max time to wait for NEF async job started by nefRequest()
+const nefJobTimeout = 5 * time.Minute
+
+// nefVolumeListLimit - NEF rejects collection requests with limit of 100 and more
+const nefVolumeListLimit = 99
+
+// NEF pool health and volume status values
+const (
+	nefPoolHealthOnline   = "ONLINE"
+	nefVolumeStatusOnline = "ONLINE"
+)
+
+// nefPool - NEF pool fields, ns.Pool has the name only
+type nefPool struct {
+	Name   string `json:"poolName"`
+	Health string `json:"health"`
+	Status string `json:"status"`
+}
+
+// nefVolume - NEF volume fields, ns.Volume doesn't have the status
+type nefVolume struct {
+	ns.Volume
+	nefVolumeEncryption
+	VolumeBlockSize int64             `json:"volumeBlockSize"`
+	Status          string            `json:"status"`
+	UserProperties  map[string]string `json:"userProperties"`
+}
+
+// nefSnapshotFields - snapshot fields requested from NEF, go-nexentastor requests neither the size nor the state
+const nefSnapshotFields = "path,name,parent,creationTime,creationTxg,clones,volumeSize,bytesReferenced,deferDestroy"
+
+// nefSnapshot - NEF snapshot fields, ns.Snapshot has neither the size nor the state
+type nefSnapshot struct {
+	ns.Snapshot
+	VolumeSize      int64 `json:"volumeSize"`
+	BytesReferenced int64 `json:"bytesReferenced"`
+	DeferDestroy    bool  `json:"deferDestroy"`
+}
+
+// readyToUse - snapshot creation is committed and the snapshot isn't being destroyed
+func (s nefSnapshot) readyToUse() bool {
+	return s.CreationTxg != "" && !s.DeferDestroy
+}
+
+// sizeBytes - size of the volume at the snapshot time, it's the minimum size of a volume restored from the snapshot,
+// referenced bytes are returned if NEF doesn't report the volume size
+func (s nefSnapshot) sizeBytes() int64 {
+	if s.VolumeSize != 0 {
+		return s.VolumeSize
+	}
+	return s.BytesReferenced
+}
+
+// getVolume - returns NexentaStor volume, use it instead of nsProvider.GetVolume():
+// go-nexentastor panics on any GetVolume() request error except ENOENT
+func getVolume(nsProvider ns.ProviderInterface, volumePath string) (volume ns.Volume, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Cannot get volume '%s' from %s: request failed", volumePath, nsProvider)
+		}
+	}()
+	return nsProvider.GetVolume(volumePath)
+}
+
+// getVolumeStatus - returns NexentaStor volume with its status, ENOENT NefError if volume doesn't exist
+func getVolumeStatus(nsProvider ns.ProviderInterface, volumePath string) (volume nefVolume, err error) {
+	response := struct {
+		Data []nefVolume `json:"data"`
+	}{}
+	uri := "storage/volumes?" + url.Values{"path": {volumePath}}.Encode()
+	if err := nefRequest(nsProvider, http.MethodGet, uri, nil, &response); err != nil {
+		return volume, err
+	}
+	if len(response.Data) == 0 {
+		return volume, &ns.NefError{Err: fmt.Errorf("Volume '%s' not found", volumePath), Code: "ENOENT"}
+	}
+	return response.Data[0], nil
+}
+
+// createVolume - creates volume with ZFS properties and encryption, ns.CreateVolumeParams has neither
+func createVolume(
+	nsProvider ns.ProviderInterface,
+	params ns.CreateVolumeParams,
+	properties volumeProperties,
+	encryption volumeEncryption,
+) error {
+	data := struct {
+		ns.CreateVolumeParams
+		volumeProperties
+		volumeEncryption
+	}{params, properties, encryption}
+	return nefRequest(nsProvider, http.MethodPost, "storage/volumes", data, nil)
+}
+
+// loadVolumeKey - loads wrapping key of encryption root
+func loadVolumeKey(nsProvider ns.ProviderInterface, encryptionRoot string, key secretValue) error {
+	data := struct {
+		Key secretValue `json:"key"`
+	}{key}
+	uri := fmt.Sprintf("storage/volumes/%s/loadKey", url.PathEscape(encryptionRoot))
+	return nefRequest(nsProvider, http.MethodPost, uri, data, nil)
+}
+
+// unloadVolumeKey - unloads wrapping key of encryption root, NEF fails with EBUSY if the key is in use
+func unloadVolumeKey(nsProvider ns.ProviderInterface, encryptionRoot string) error {
+	uri := fmt.Sprintf("storage/volumes/%s/unloadKey", url.PathEscape(encryptionRoot))
+	return nefRequest(nsProvider, http.MethodPost, uri, nil, nil)
+}
+
+// cloneSnapshot - clones snapshot to a volume with ZFS properties, ns.CloneSnapshotParams has no properties
+func cloneSnapshot(
+	nsProvider ns.ProviderInterface, snapshotPath string, params ns.CloneSnapshotParams, properties volumeProperties,
+) error {
+	data := struct {
+		ns.CloneSnapshotParams
+		volumeProperties
+	}{params, properties}
+	uri := fmt.Sprintf("storage/snapshots/%s/clone", url.PathEscape(snapshotPath))
+	return nefRequest(nsProvider, http.MethodPost, uri, data, nil)
+}
+
+// updateVolume - changes volume properties, ns.UpdateVolumeParams has the volume size only
+func updateVolume(nsProvider ns.ProviderInterface, volumePath string, data interface{}) error {
+	uri := fmt.Sprintf("storage/volumes/%s", url.PathEscape(volumePath))
+	return nefRequest(nsProvider, http.MethodPut, uri, data, nil)
+}
+
+// renameVolume - moves volume with its snapshots to another path in the same pool, NEF fails with EBUSY
+// if the volume is mapped
+func renameVolume(nsProvider ns.ProviderInterface, volumePath, newPath string) error {
+	data := struct {
+		NewPath string `json:"newPath"`
+	}{newPath}
+	uri := fmt.Sprintf("storage/volumes/%s/rename", url.PathEscape(volumePath))
+	return nefRequest(nsProvider, http.MethodPost, uri, data, nil)
+}
+
+// getVolumesWithStatus - returns all volumes of the volume group with their statuses sorted by path,
+// go-nexentastor GetVolumesWithStartingToken() returns the first NEF page only
+func getVolumesWithStatus(nsProvider ns.ProviderInterface, volumeGroup string) ([]nefVolume, error) {
+	volumes := []nefVolume{}
+	for offset := 0; ; offset += nefVolumeListLimit {
+		response := struct {
+			Data []nefVolume `json:"data"`
+		}{}
+		uri := "storage/volumes?" + url.Values{
+			"parent": {volumeGroup},
+			"limit":  {fmt.Sprint(nefVolumeListLimit)},
+			"offset": {fmt.Sprint(offset)},
+		}.Encode()
+		if err := nefRequest(nsProvider, http.MethodGet, uri, nil, &response); err != nil {
+			return nil, err
+		}
+		volumes = append(volumes, response.Data...)
+		if len(response.Data) < nefVolumeListLimit {
+			break
+		}
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].Path < volumes[j].Path })
+	return volumes, nil
+}
+
+// nefVolumeGroup - NEF volume group with the default block size of its volumes, ns.VolumeGroup doesn't have it
+type nefVolumeGroup struct {
+	Path            string `json:"path"`
+	BytesAvailable  int64  `json:"bytesAvailable"`
+	BytesUsed       int64  `json:"bytesUsed"`
+	VolumeBlockSize int64  `json:"volumeBlockSize"`
+}
+
+// getVolumeGroup - returns volume group with its space usage, ENOENT NefError if it doesn't exist
+func getVolumeGroup(nsProvider ns.ProviderInterface, vgPath string) (volumeGroup nefVolumeGroup, err error) {
+	response := struct {
+		Data []nefVolumeGroup `json:"data"`
+	}{}
+	uri := "storage/volumeGroups?" + url.Values{
+		"path":   {vgPath},
+		"fields": {"path,bytesAvailable,bytesUsed,volumeBlockSize"},
+	}.Encode()
+	if err := nefRequest(nsProvider, http.MethodGet, uri, nil, &response); err != nil {
+		return volumeGroup, err
+	}
+	if len(response.Data) == 0 {
+		return volumeGroup, &ns.NefError{Err: fmt.Errorf("Volume group '%s' not found", vgPath), Code: "ENOENT"}
+	}
+	return response.Data[0], nil
+}
+
+// getVolumeGroups - returns paths of all volume groups of the appliance, including nested ones, sorted by path
+func getVolumeGroups(nsProvider ns.ProviderInterface) ([]string, error) {
+	volumeGroups := []string{}
+	for offset := 0; ; offset += nefVolumeListLimit {
+		response := struct {
+			Data []ns.VolumeGroup `json:"data"`
+		}{}
+		uri := "storage/volumeGroups?" + url.Values{
+			"fields": {"path"},
+			"limit":  {fmt.Sprint(nefVolumeListLimit)},
+			"offset": {fmt.Sprint(offset)},
+		}.Encode()
+		if err := nefRequest(nsProvider, http.MethodGet, uri, nil, &response); err != nil {
+			return nil, err
+		}
+		for _, vg := range response.Data {
+			volumeGroups = append(volumeGroups, vg.Path)
+		}
+		if len(response.Data) < nefVolumeListLimit {
+			break
+		}
+	}
+	sort.Strings(volumeGroups)
+	return volumeGroups, nil
+}
+
+// createVolumeGroup - creates volume group, EEXIST NefError if it exists
+func createVolumeGroup(nsProvider ns.ProviderInterface, vgPath string) error {
+	data := struct {
+		Path string `json:"path"`
+	}{vgPath}
+	return nefRequest(nsProvider, http.MethodPost, "storage/volumeGroups", data, nil)
+}
+
+// getSnapshot - returns NexentaStor snapshot with its size and state, use it instead of nsProvider.GetSnapshot()
+func getSnapshot(nsProvider ns.ProviderInterface, snapshotPath string) (snapshot nefSnapshot, err error) {
+	uri := fmt.Sprintf("storage/snapshots/%s?", url.PathEscape(snapshotPath)) +
+		url.Values{"fields": {nefSnapshotFields}}.Encode()
+	err = nefRequest(nsProvider, http.MethodGet, uri, nil, &snapshot)
+	return snapshot, err
+}
+
+// getSnapshots - returns snapshots of the volume with their sizes and states, use it instead of
+// nsProvider.GetSnapshots()
+func getSnapshots(nsProvider ns.ProviderInterface, volumePath string, recursive bool) ([]nefSnapshot, error) {
+	response := struct {
+		Data []nefSnapshot `json:"data"`
+	}{}
+	uri := "storage/snapshots?" + url.Values{
+		"parent":    {volumePath},
+		"recursive": {fmt.Sprint(recursive)},
+		"fields":    {nefSnapshotFields},
+	}.Encode()
+	if err := nefRequest(nsProvider, http.MethodGet, uri, nil, &response); err != nil {
+		return nil, err
+	}
+	return response.Data, nil
+}
+
+// getISCSITargets - returns names of all iSCSI targets sorted, go-nexentastor gets targets by name only
+func getISCSITargets(nsProvider ns.ProviderInterface) ([]string, error) {
+	targets := []string{}
+	for offset := 0; ; offset += nefVolumeListLimit {
+		response := struct {
+			Data []ns.ISCSITarget `json:"data"`
+		}{}
+		uri := "san/iscsi/targets?" + url.Values{
+			"fields": {"name"},
+			"limit":  {fmt.Sprint(nefVolumeListLimit)},
+			"offset": {fmt.Sprint(offset)},
+		}.Encode()
+		if err := nefRequest(nsProvider, http.MethodGet, uri, nil, &response); err != nil {
+			return nil, err
+		}
+		for _, target := range response.Data {
+			targets = append(targets, target.Name)
+		}
+		if len(response.Data) < nefVolumeListLimit {
+			break
+		}
+	}
+	sort.Strings(targets)
+	return targets, nil
+}
+
+// destroyISCSITarget - destroys the iSCSI target, it must not be a member of any target group
+func destroyISCSITarget(nsProvider ns.ProviderInterface, name string) error {
+	uri := fmt.Sprintf("san/iscsi/targets/%s", url.PathEscape(name))
+	return nefRequest(nsProvider, http.MethodDelete, uri, nil, nil)
+}
+
+// destroyTargetGroup - destroys the target group, it must not be used by LUN mappings
+func destroyTargetGroup(nsProvider ns.ProviderInterface, name string) error {
+	uri := fmt.Sprintf("san/targetgroups/%s", url.PathEscape(name))
+	return nefRequest(nsProvider, http.MethodDelete, uri, nil, nil)
+}
+
+// destroyHostGroup - destroys the host group, it must not be used by LUN mappings
+func destroyHostGroup(nsProvider ns.ProviderInterface, name string) error {
+	uri := fmt.Sprintf("san/hostgroups/%s", url.PathEscape(name))
+	return nefRequest(nsProvider, http.MethodDelete, uri, nil, nil)
+}
+
+// createSnapshot - creates the snapshot with ZFS user properties, ns.CreateSnapshotParams has no properties
+func createSnapshot(nsProvider ns.ProviderInterface, snapshotPath string, userProperties map[string]string) error {
+	data := map[string]interface{}{"path": snapshotPath}
+	if len(userProperties) != 0 {
+		data["userProperties"] = userProperties
+	}
+	return nefRequest(nsProvider, http.MethodPost, "storage/snapshots", data, nil)
+}
+
+// createRecursiveSnapshot - snapshots the dataset and all its children atomically in one txg,
+// ns.CreateSnapshotParams has no recursive flag
+func createRecursiveSnapshot(nsProvider ns.ProviderInterface, snapshotPath string) error {
+	data := map[string]interface{}{"path": snapshotPath, "recursive": true}
+	return nefRequest(nsProvider, http.MethodPost, "storage/snapshots", data, nil)
+}
+
+// NEF replication service states
+const (
+	nefReplicationStateIdle    = "idle"
+	nefReplicationStateRunning = "running"
+	nefReplicationStateFailed  = "failed"
+)
+
+// nefRemoteNode - appliance NEF replication service sends snapshots to
+type nefRemoteNode struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+}
+
+// nefReplicationService - NEF HPR (high performance replication) service, it sends SourceSnapshot
+// of SourceDataset to DestinationDataset on the remote node when started, services without SourceSnapshot
+// take a new snapshot for each run and send it incrementally, enabled ones run every Interval seconds
+type nefReplicationService struct {
+	Name               string        `json:"name"`
+	SourceDataset      string        `json:"sourceDataset"`
+	DestinationDataset string        `json:"destinationDataset"`
+	RemoteNode         nefRemoteNode `json:"remoteNode"`
+	SourceSnapshot     string        `json:"sourceSnapshot,omitempty"`
+	Interval           int           `json:"interval,omitempty"`
+	Enabled            bool          `json:"enabled,omitempty"`
+	State              string        `json:"state,omitempty"`
+	Progress           int           `json:"progress,omitempty"`
+	LastSnapshot       string        `json:"lastSnapshot,omitempty"`
+	LastSyncTime       *time.Time    `json:"lastSyncTime,omitempty"`
+	LastError          string        `json:"lastError,omitempty"`
+}
+
+// getRemoteNode - returns replication remote node of the provider, it's taken from the provider REST address
+func getRemoteNode(nsProvider ns.ProviderInterface) (node nefRemoteNode, err error) {
+	p, ok := nsProvider.(*ns.Provider)
+	if !ok {
+		return node, fmt.Errorf("Replication is not supported by %T provider", nsProvider)
+	}
+	u, err := url.Parse(p.Address)
+	if err != nil || u.Hostname() == "" {
+		return node, fmt.Errorf("Cannot get replication remote node from NexentaStor address '%s'", nsProvider)
+	}
+	node.Host = u.Hostname()
+	if u.Port() != "" {
+		if node.Port, err = strconv.Atoi(u.Port()); err != nil {
+			return node, fmt.Errorf("Invalid port in NexentaStor address '%s': %s", nsProvider, err)
+		}
+	}
+	return node, nil
+}
+
+// createReplicationService - creates NEF replication service on the source appliance
+func createReplicationService(nsProvider ns.ProviderInterface, service nefReplicationService) error {
+	return nefRequest(nsProvider, http.MethodPost, "hpr/services", service, nil)
+}
+
+// getReplicationService - returns NEF replication service with its state
+func getReplicationService(nsProvider ns.ProviderInterface, name string) (service nefReplicationService, err error) {
+	uri := fmt.Sprintf("hpr/services/%s", url.PathEscape(name))
+	err = nefRequest(nsProvider, http.MethodGet, uri, nil, &service)
+	return service, err
+}
+
+// getReplicationServices - returns all NEF replication services of the appliance with their states
+func getReplicationServices(nsProvider ns.ProviderInterface) ([]nefReplicationService, error) {
+	services := []nefReplicationService{}
+	for offset := 0; ; offset += nefVolumeListLimit {
+		response := struct {
+			Data []nefReplicationService `json:"data"`
+		}{}
+		uri := "hpr/services?" + url.Values{
+			"limit":  {fmt.Sprint(nefVolumeListLimit)},
+			"offset": {fmt.Sprint(offset)},
+		}.Encode()
+		if err := nefRequest(nsProvider, http.MethodGet, uri, nil, &response); err != nil {
+			return nil, err
+		}
+		services = append(services, response.Data...)
+		if len(response.Data) < nefVolumeListLimit {
+			break
+		}
+	}
+	return services, nil
+}
+
+// startReplicationService - starts sending the snapshot, the transfer runs in background on NexentaStor
+func startReplicationService(nsProvider ns.ProviderInterface, name string) error {
+	uri := fmt.Sprintf("hpr/services/%s/start", url.PathEscape(name))
+	return nefRequest(nsProvider, http.MethodPost, uri, nil, nil)
+}
+
+// enableReplicationService - enables scheduled runs of NEF replication service
+func enableReplicationService(nsProvider ns.ProviderInterface, name string) error {
+	uri := fmt.Sprintf("hpr/services/%s/enable", url.PathEscape(name))
+	return nefRequest(nsProvider, http.MethodPost, uri, nil, nil)
+}
+
+// destroyReplicationService - destroys NEF replication service, replicated datasets are kept
+func destroyReplicationService(nsProvider ns.ProviderInterface, name string) error {
+	uri := fmt.Sprintf("hpr/services/%s", url.PathEscape(name))
+	return nefRequest(nsProvider, http.MethodDelete, uri, nil, nil)
+}
+
+// getPool - returns NexentaStor pool with its health, ENOENT NefError if pool doesn't exist
+func getPool(nsProvider ns.ProviderInterface, poolName string) (pool nefPool, err error) {
+	response := struct {
+		Data []nefPool `json:"data"`
+	}{}
+	uri := "storage/pools?" + url.Values{"poolName": {poolName}, "fields": {"poolName,health,status"}}.Encode()
+	if err := nefRequest(nsProvider, http.MethodGet, uri, nil, &response); err != nil {
+		return pool, err
+	}
+	for _, p := range response.Data {
+		if p.Name == poolName {
+			return p, nil
+		}
+	}
+	return pool, &ns.NefError{Err: fmt.Errorf("Pool '%s' not found", poolName), Code: "ENOENT"}
+}
+
+// nefRequest - sends NEF request which go-nexentastor has no method for,
+// re-login, async jobs and NEF errors are handled the same way ns.Provider does
+func nefRequest(nsProvider ns.ProviderInterface, method, uri string, data, response interface{}) error {
+	p, ok := nsProvider.(*ns.Provider)
+	if !ok {
+		return fmt.Errorf("Request '%s %s' is not supported by %T provider", method, uri, nsProvider)
+	}
+
+	code, body, err := p.RestClient.Send(method, uri, data)
+	if err != nil {
+		return err
+	}
+	if code == http.StatusUnauthorized {
+		if err := p.LogIn(); err != nil {
+			return err
+		}
+		if code, body, err = p.RestClient.Send(method, uri, data); err != nil {
+			return err
+		}
+	}
+
+	if code == http.StatusAccepted {
+		return waitForNefJob(p, body)
+	} else if code >= 300 {
+		return parseNefError(method, uri, code, body)
+	}
+
+	if response != nil {
+		if err := json.Unmarshal(body, response); err != nil {
+			return fmt.Errorf("Request '%s %s': cannot parse response '%s': %s", method, uri, body, err)
+		}
+	}
+	return nil
+}
+
+// waitForNefJob - waits for async job from "202 Accepted" response body
+func waitForNefJob(p *ns.Provider, body []byte) error {
+	job := struct {
+		Links []struct {
+			Rel  string `json:"rel"`
+			Href string `json:"href"`
+		} `json:"links"`
+	}{}
+	if err := json.Unmarshal(body, &job); err != nil {
+		return fmt.Errorf("Cannot parse NEF async job '%s': %s", body, err)
+	}
+
+	jobID := ""
+	for _, link := range job.Links {
+		if link.Rel == "monitor" {
+			jobID = strings.TrimPrefix(link.Href, "/jobStatus/")
+		}
+	}
+	if jobID == "" {
+		return fmt.Errorf("NEF async job has no monitor link: %s", body)
+	}
+
+	deadline := time.Now().Add(nefJobTimeout)
+	for {
+		done, err := p.IsJobDone(jobID)
+		if err != nil {
+			return err
+		} else if done {
+			return nil
+		} else if time.Now().After(deadline) {
+			return fmt.Errorf("NEF async job '%s' is not completed in %s", jobID, nefJobTimeout)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// parseNefError - converts NEF error response to ns.NefError, so ns.Is*NefError() helpers can be used
+func parseNefError(method, uri string, code int, body []byte) error {
+	response := struct {
+		Name    string `json:"name"`
+		Message string `json:"message"`
+		Code    string `json:"code"`
+	}{}
+	if err := json.Unmarshal(body, &response); err != nil || response.Message == "" {
+		return fmt.Errorf("Request '%s %s' returned %d code: %s", method, uri, code, body)
+	}
+	return &ns.NefError{
+		Err:  fmt.Errorf("Request '%s %s' error: %s: %s", method, uri, response.Name, response.Message),
+		Code: response.Code,
+	}
+}
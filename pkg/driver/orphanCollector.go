@@ -0,0 +1,314 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/config"
+)
+
+// deletingVolumeProperty - ZFS user property with the time DeleteVolume started to delete the volume,
+// volumes which keep it were left by failed deletions
+const deletingVolumeProperty = "user:csi.nexenta.com:deleting"
+
+// orphanCollectorInterval - how often the controller looks for orphaned objects
+const orphanCollectorInterval = 10 * time.Minute
+
+// kinds of orphaned objects in the order they are reclaimed, objects are destroyed before the ones they use
+const (
+	orphanVolumeCopy  = "volume copy"
+	orphanVolume      = "volume"
+	orphanLunMapping  = "LUN mapping"
+	orphanTargetGroup = "target group"
+	orphanTarget      = "iSCSI target"
+	orphanHostGroup   = "host group"
+)
+
+// Orphan - NexentaStor object created by the driver which no live volume uses
+type Orphan struct {
+	ConfigName string
+	Address    string
+	Kind       string
+	Name       string
+	Reason     string
+
+	// FirstSeen - when the object was found orphaned, it's reclaimed once the grace period passes
+	FirstSeen time.Time
+
+	// Reclaimed - the object has been destroyed
+	Reclaimed bool
+}
+
+// String - orphan in "<kind> '<name>' on <address>" format
+func (o Orphan) String() string {
+	return fmt.Sprintf("%s '%s' on %s", o.Kind, o.Name, o.Address)
+}
+
+// orphanCollector - times objects were found orphaned first, objects which are not orphaned anymore are forgotten,
+// so the grace period starts again if they are orphaned later or the controller restarts
+type orphanCollector struct {
+	mux       sync.Mutex
+	firstSeen map[string]time.Time
+}
+
+// isDriverTargetGroup - target group is created by CreateNewTargetTg(), it's named by UUID
+func isDriverTargetGroup(name string) bool {
+	_, err := uuid.Parse(name)
+	return err == nil
+}
+
+// isDriverTarget - iSCSI target is created by CreateNewTargetTg(), it's named "<prefix>:<UUID>"
+func isDriverTarget(name string) bool {
+	i := strings.LastIndex(name, ":")
+	return i != -1 && isDriverTargetGroup(name[i+1:])
+}
+
+// isDriverHostGroup - host group is created by CreateUpdateHostGroup(), it's named "csi-<UUID>"
+func isDriverHostGroup(name string) bool {
+	prefix := HostGroupPrefix + "-"
+	return strings.HasPrefix(name, prefix) && isDriverTargetGroup(strings.TrimPrefix(name, prefix))
+}
+
+// runOrphanCollector - looks for orphaned objects on the leader until the process exits,
+// does nothing if the collector is off
+func (s *ControllerServer) runOrphanCollector(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		if !s.isLeader() {
+			continue
+		}
+		if _, err := s.CollectOrphans(now); err != nil {
+			s.log.WithField("func", "runOrphanCollector()").Warn(err)
+		}
+	}
+}
+
+// CollectOrphans - finds copies of volumes CO has given up on, volumes left by failed deletions, LUN mappings
+// of missing and orphaned volumes, target groups, iSCSI targets and host groups created by the driver which live
+// LUN mappings don't use.
+// Orphans are reported in "dryRun" mode and destroyed in "reclaim" mode once they stay orphaned for the grace
+// period, errors of single objects don't stop it. Orphans are reclaimed by the elected leader only,
+// without leader election "reclaim" mode reports them like "dryRun" does.
+func (s *ControllerServer) CollectOrphans(now time.Time) (orphans []Orphan, err error) {
+	l := s.log.WithField("func", "CollectOrphans()")
+
+	err = s.withBackgroundNS(func(cfg *config.Config, nsResolverMap map[string]ns.Resolver) error {
+		mode := cfg.OrphanCollector
+		if mode == "" || mode == config.OrphanCollectorOff {
+			return nil
+		} else if mode == config.OrphanCollectorReclaim && !s.leaderElected() {
+			l.Warnf(
+				"orphans are reclaimed by the controller elected with --leader-election only, running in '%s' mode",
+				config.OrphanCollectorDryRun,
+			)
+			mode = config.OrphanCollectorDryRun
+		}
+		gracePeriod := cfg.GetOrphanGracePeriod()
+
+		s.orphans.mux.Lock()
+		defer s.orphans.mux.Unlock()
+
+		firstSeen := map[string]time.Time{}
+		var errors []string
+		for _, configName := range sortedConfigNames(cfg) {
+			resolver, ok := nsResolverMap[configName]
+			if !ok {
+				continue
+			}
+			// pools of HA cluster are imported on one of the nodes, each node has its own SAN objects
+			for _, nsProvider := range resolver.Nodes {
+				found, err := s.findOrphans(nsProvider, configName, cfg.NsMap[configName])
+				if err != nil {
+					errors = append(errors, fmt.Sprintf("cannot look for orphans on %s: %s", nsProvider, err))
+					continue
+				}
+				for _, orphan := range found {
+					key := strings.Join([]string{configName, orphan.Address, orphan.Kind, orphan.Name}, "|")
+					orphan.FirstSeen = now
+					if t, ok := s.orphans.firstSeen[key]; ok {
+						orphan.FirstSeen = t
+					}
+					firstSeen[key] = orphan.FirstSeen
+
+					reclaimAt := orphan.FirstSeen.Add(gracePeriod)
+					if mode != config.OrphanCollectorReclaim || now.Before(reclaimAt) {
+						l.Infof(
+							"orphaned %s: %s, it may be reclaimed after %s",
+							orphan,
+							orphan.Reason,
+							reclaimAt.Format(time.RFC3339),
+						)
+					} else if orphan.Reclaimed, err = s.reclaimOrphan(nsProvider, orphan, nsResolverMap); err != nil {
+						errors = append(errors, err.Error())
+					} else if orphan.Reclaimed {
+						delete(firstSeen, key)
+						l.Infof("orphaned %s has been reclaimed: %s", orphan, orphan.Reason)
+					}
+					orphans = append(orphans, orphan)
+				}
+			}
+		}
+		s.orphans.firstSeen = firstSeen
+
+		if len(errors) != 0 {
+			return fmt.Errorf("Orphan collector failed: %s", strings.Join(errors, "; "))
+		}
+		return nil
+	})
+	return orphans, err
+}
+
+// findOrphans - returns orphaned objects of the NexentaStor in the order they must be reclaimed,
+// objects set in the config as defaults are never orphaned
+func (s *ControllerServer) findOrphans(
+	nsProvider ns.ProviderInterface, configName string, cfg config.NsData,
+) ([]Orphan, error) {
+	var orphans []Orphan
+	add := func(kind, name, reason string) {
+		orphans = append(orphans, Orphan{
+			ConfigName: configName,
+			Address:    fmt.Sprint(nsProvider),
+			Kind:       kind,
+			Name:       name,
+			Reason:     reason,
+		})
+	}
+
+	// CreateVolume destroys the service once the copy is done, so the service of a finished copy is left
+	// if the PVC has been deleted while CreateVolume waited for it, running copies are checked when they finish
+	services, err := getReplicationServices(nsProvider)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get replication services: %s", err)
+	}
+	for _, service := range services {
+		if strings.HasPrefix(service.Name, volumeCopyServicePrefix) && service.State != nefReplicationStateRunning {
+			add(orphanVolumeCopy, service.Name, fmt.Sprintf(
+				"copy of '%s@%s' to '%s' is %s and CreateVolume hasn't finished it",
+				service.SourceDataset,
+				service.SourceSnapshot,
+				service.DestinationDataset,
+				service.State,
+			))
+		}
+	}
+
+	volumeGroups, err := getVolumeGroups(nsProvider)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get volume groups: %s", err)
+	}
+	liveVolumes := map[string]bool{}
+	for _, volumeGroup := range volumeGroups {
+		volumes, err := getVolumesWithStatus(nsProvider, volumeGroup)
+		if err != nil {
+			return nil, fmt.Errorf("cannot get volumes of '%s': %s", volumeGroup, err)
+		}
+		for _, volume := range volumes {
+			deleting, ok := volume.UserProperties[deletingVolumeProperty]
+			liveVolumes[volume.Path] = !ok
+			if ok {
+				add(orphanVolume, volume.Path, fmt.Sprintf("deletion attempted at %s has not finished", deleting))
+			}
+		}
+	}
+
+	lunMappings, err := nsProvider.GetLunMappings(ns.GetLunMappingsParams{})
+	if err != nil {
+		return nil, fmt.Errorf("cannot get LUN mappings: %s", err)
+	}
+	liveTargetGroups := map[string]bool{}
+	liveHostGroups := map[string]bool{}
+	for _, lunMapping := range lunMappings {
+		live, ok := liveVolumes[lunMapping.Volume]
+		if !ok {
+			add(orphanLunMapping, lunMapping.Id, fmt.Sprintf("volume '%s' doesn't exist", lunMapping.Volume))
+		} else if !live {
+			add(orphanLunMapping, lunMapping.Id, fmt.Sprintf("volume '%s' is orphaned", lunMapping.Volume))
+		} else {
+			liveTargetGroups[lunMapping.TargetGroup] = true
+			liveHostGroups[lunMapping.HostGroup] = true
+		}
+	}
+
+	targetGroups, err := nsProvider.GetTargetGroups()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get target groups: %s", err)
+	}
+	liveTargets := map[string]bool{}
+	for _, targetGroup := range targetGroups {
+		if liveTargetGroups[targetGroup.Name] || targetGroup.Name == cfg.DefaultTargetGroup ||
+			!isDriverTargetGroup(targetGroup.Name) {
+			for _, target := range targetGroup.Members {
+				liveTargets[target] = true
+			}
+			continue
+		}
+		add(orphanTargetGroup, targetGroup.Name, "no live LUN mappings use it")
+	}
+
+	targets, err := getISCSITargets(nsProvider)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get iSCSI targets: %s", err)
+	}
+	for _, target := range targets {
+		if !liveTargets[target] && target != cfg.DefaultTarget && isDriverTarget(target) {
+			add(orphanTarget, target, "it's not a member of live target groups")
+		}
+	}
+
+	hostGroups, err := nsProvider.GetHostGroups()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get host groups: %s", err)
+	}
+	for _, hostGroup := range hostGroups {
+		name := hostGroup.Name
+		if !liveHostGroups[name] && name != cfg.DefaultHostGroup && isDriverHostGroup(name) {
+			add(orphanHostGroup, name, "no live LUN mappings use it")
+		}
+	}
+	return orphans, nil
+}
+
+// reclaimOrphan - destroys orphaned object, volumes are deleted the way DeleteVolume does it, objects which are already
+// destroyed are reclaimed, objects still used by orphans which are not reclaimed yet are kept
+func (s *ControllerServer) reclaimOrphan(
+	nsProvider ns.ProviderInterface, orphan Orphan, nsResolverMap map[string]ns.Resolver,
+) (reclaimed bool, err error) {
+	l := s.log.WithField("func", "reclaimOrphan()")
+
+	switch orphan.Kind {
+	case orphanVolumeCopy:
+		// the target volume is on another NexentaStor
+		reclaimed, err := reclaimVolumeCopy(nsProvider, orphan.Name, nsResolverMap)
+		if err != nil {
+			return false, fmt.Errorf("cannot reclaim %s: %s", orphan, err)
+		} else if !reclaimed {
+			l.Infof("orphaned %s is kept, the copy has been started again", orphan)
+		}
+		return reclaimed, nil
+	case orphanVolume:
+		// the volume is deleted on the NexentaStor it was found on, config of RPCs may point to another one
+		if err := s.deleteVolumeOnNS(nsProvider, orphan.Name); err != nil {
+			return false, fmt.Errorf("cannot reclaim %s: %s", orphan, err)
+		}
+		return true, nil
+	case orphanLunMapping:
+		err = nsProvider.DestroyLunMapping(orphan.Name)
+	case orphanTargetGroup:
+		err = destroyTargetGroup(nsProvider, orphan.Name)
+	case orphanTarget:
+		err = destroyISCSITarget(nsProvider, orphan.Name)
+	case orphanHostGroup:
+		err = destroyHostGroup(nsProvider, orphan.Name)
+	}
+	if ns.IsBusyNefError(err) {
+		l.Infof("orphaned %s is kept, it's still in use: %s", orphan, err)
+		return false, nil
+	} else if err != nil && !ns.IsNotExistNefError(err) {
+		return false, fmt.Errorf("cannot reclaim %s: %s", orphan, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,172 @@
+package driver
+
+import (
+	"github.com/csi-addons/spec/lib/go/replication"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/csiid"
+)
+
+// ReplicationServer - csi-addons replication server, it manages NEF replication services sending volume snapshots
+// to the peer NexentaStor set in VolumeReplicationClass parameters
+type ReplicationServer struct {
+	replication.UnimplementedControllerServer
+	controller *ControllerServer
+	log        *logrus.Entry
+}
+
+// resolveVolume - refreshes the config and resolves the volume and its peer by the request parameters
+func (s *ReplicationServer) resolveVolume(volumeID string, params, secrets map[string]string) (
+	replicatedVolume,
+	error,
+) {
+	if err := s.controller.refreshConfig(getConfigSecret(secrets)); err != nil {
+		return replicatedVolume{}, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
+	}
+	if len(volumeID) == 0 {
+		return replicatedVolume{}, status.Error(codes.InvalidArgument, "Volume ID must be provided")
+	}
+	id, err := csiid.ParseVolumeID(volumeID)
+	if err != nil {
+		return replicatedVolume{}, csiid.NotFound(err)
+	}
+	volumeReplication, err := parseVolumeReplication(params)
+	if err != nil {
+		return replicatedVolume{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return s.controller.resolveReplicatedVolume(id, volumeReplication)
+}
+
+// EnableVolumeReplication - starts sending the volume to the peer, the volume becomes primary
+func (s *ReplicationServer) EnableVolumeReplication(
+	ctx context.Context,
+	req *replication.EnableVolumeReplicationRequest,
+) (*replication.EnableVolumeReplicationResponse, error) {
+	s.log.WithField("func", "EnableVolumeReplication()").Infof("request: '%+v'", protosanitizer.StripSecrets(req))
+
+	v, err := s.resolveVolume(req.GetVolumeId(), req.GetParameters(), req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.controller.enableVolumeReplication(v); err != nil {
+		return nil, err
+	}
+	return &replication.EnableVolumeReplicationResponse{}, nil
+}
+
+// DisableVolumeReplication - stops sending the volume to the peer, the replica is kept
+func (s *ReplicationServer) DisableVolumeReplication(
+	ctx context.Context,
+	req *replication.DisableVolumeReplicationRequest,
+) (*replication.DisableVolumeReplicationResponse, error) {
+	s.log.WithField("func", "DisableVolumeReplication()").Infof("request: '%+v'", protosanitizer.StripSecrets(req))
+
+	v, err := s.resolveVolume(req.GetVolumeId(), req.GetParameters(), req.GetSecrets())
+	if status.Code(err) == codes.NotFound {
+		return &replication.DisableVolumeReplicationResponse{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := s.controller.disableVolumeReplication(v); err != nil {
+		return nil, err
+	}
+	return &replication.DisableVolumeReplicationResponse{}, nil
+}
+
+// PromoteVolume - makes the volume primary, the peer volume is overwritten by its snapshots since then
+func (s *ReplicationServer) PromoteVolume(
+	ctx context.Context,
+	req *replication.PromoteVolumeRequest,
+) (*replication.PromoteVolumeResponse, error) {
+	s.log.WithField("func", "PromoteVolume()").Infof("request: '%+v'", protosanitizer.StripSecrets(req))
+
+	v, err := s.resolveVolume(req.GetVolumeId(), req.GetParameters(), req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.controller.promoteVolume(v, req.GetForce()); err != nil {
+		return nil, err
+	}
+	return &replication.PromoteVolumeResponse{}, nil
+}
+
+// DemoteVolume - stops sending the volume to the peer, so the peer volume can be promoted
+func (s *ReplicationServer) DemoteVolume(
+	ctx context.Context,
+	req *replication.DemoteVolumeRequest,
+) (*replication.DemoteVolumeResponse, error) {
+	s.log.WithField("func", "DemoteVolume()").Infof("request: '%+v'", protosanitizer.StripSecrets(req))
+
+	v, err := s.resolveVolume(req.GetVolumeId(), req.GetParameters(), req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.controller.demoteVolume(v); err != nil {
+		return nil, err
+	}
+	return &replication.DemoteVolumeResponse{}, nil
+}
+
+// ResyncVolume - restarts replication to the demoted volume, it's ready once the volume is in sync
+func (s *ReplicationServer) ResyncVolume(
+	ctx context.Context,
+	req *replication.ResyncVolumeRequest,
+) (*replication.ResyncVolumeResponse, error) {
+	s.log.WithField("func", "ResyncVolume()").Infof("request: '%+v'", protosanitizer.StripSecrets(req))
+
+	v, err := s.resolveVolume(req.GetVolumeId(), req.GetParameters(), req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	ready, err := s.controller.resyncVolume(v)
+	if err != nil {
+		return nil, err
+	}
+	return &replication.ResyncVolumeResponse{Ready: ready}, nil
+}
+
+// GetVolumeReplicationInfo - returns the time of the last snapshot sent to the secondary volume,
+// the request has no parameters, so the peer is taken from the volume user property
+func (s *ReplicationServer) GetVolumeReplicationInfo(
+	ctx context.Context,
+	req *replication.GetVolumeReplicationInfoRequest,
+) (*replication.GetVolumeReplicationInfoResponse, error) {
+	s.log.WithField("func", "GetVolumeReplicationInfo()").Infof("request: '%+v'", protosanitizer.StripSecrets(req))
+
+	if err := s.controller.refreshConfig(getConfigSecret(req.GetSecrets())); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Cannot use config file: %s", err)
+	}
+	id, err := csiid.ParseVolumeID(req.GetVolumeId())
+	if err != nil {
+		return nil, csiid.NotFound(err)
+	}
+	v, err := s.controller.resolveReplicatedVolumeByProperty(id)
+	if err != nil {
+		return nil, err
+	}
+	lastSyncTime, err := s.controller.getVolumeLastSyncTime(v)
+	if err != nil {
+		return nil, err
+	}
+	res := &replication.GetVolumeReplicationInfoResponse{}
+	if lastSyncTime != nil {
+		res.LastSyncTime = timestamppb.New(*lastSyncTime)
+	}
+	return res, nil
+}
+
+// NewReplicationServer - create an instance of csi-addons replication service
+func NewReplicationServer(controller *ControllerServer) *ReplicationServer {
+	l := controller.log.WithField("cmp", "ReplicationServer")
+	l.Info("create new ReplicationServer...")
+
+	return &ReplicationServer{
+		controller: controller,
+		log:        l,
+	}
+}
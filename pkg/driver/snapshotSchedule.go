@@ -0,0 +1,253 @@
+package driver
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/config"
+)
+
+// paramSnapshotSchedule - StorageClass and VolumeAttributesClass parameter with snapshot periods
+// and the number of snapshots to keep, e.g. "hourly=24,daily=7", "none" removes the schedule
+const paramSnapshotSchedule = "snapshotSchedule"
+
+// snapshotScheduleProperty - ZFS user property with the schedule of the volume,
+// so schedules are kept on NexentaStor and survive controller restarts
+const snapshotScheduleProperty = "user:csi.nexenta.com:snapshot-schedule"
+
+// snapshotScheduleNone - schedule value of volume without scheduled snapshots
+const snapshotScheduleNone = "none"
+
+// scheduledSnapshotPrefix - name prefix of snapshots taken by schedule,
+// the name is "scheduled-<period>-<volume>-<UTC time of the period start>"
+const scheduledSnapshotPrefix = "scheduled-"
+
+// snapshotScheduleCheckInterval - how often the controller checks schedules of all volumes
+const snapshotScheduleCheckInterval = time.Minute
+
+// snapshotPeriods - schedule periods in the order they are printed, daily and weekly periods start at 00:00 UTC,
+// weekly ones on Monday
+var snapshotPeriods = []struct {
+	name     string
+	interval time.Duration
+}{
+	{"hourly", time.Hour},
+	{"daily", 24 * time.Hour},
+	{"weekly", 7 * 24 * time.Hour},
+}
+
+// snapshotRetention - snapshot period and the number of its snapshots to keep
+type snapshotRetention struct {
+	period   string
+	interval time.Duration
+	keep     int
+}
+
+// snapshotSchedule - retention policies of the volume, one per period
+type snapshotSchedule []snapshotRetention
+
+// String - schedule in "period=keep,..." format, "none" if the schedule is empty
+func (s snapshotSchedule) String() string {
+	if len(s) == 0 {
+		return snapshotScheduleNone
+	}
+	var policies []string
+	for _, r := range s {
+		policies = append(policies, fmt.Sprintf("%s=%d", r.period, r.keep))
+	}
+	return strings.Join(policies, ",")
+}
+
+// parseSnapshotSchedule - parses "hourly=24,daily=7" schedule, empty value or "none" is an empty schedule
+func parseSnapshotSchedule(value string) (schedule snapshotSchedule, err error) {
+	value = strings.TrimSpace(value)
+	if value == "" || value == snapshotScheduleNone {
+		return nil, nil
+	}
+
+	keep := map[string]int{}
+	for _, policy := range strings.Split(value, ",") {
+		parts := strings.Split(strings.TrimSpace(policy), "=")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("'%s', should be in '<period>=<number of snapshots to keep>,...' format", value)
+		}
+		period := strings.TrimSpace(parts[0])
+		if _, ok := keep[period]; ok {
+			return nil, fmt.Errorf("'%s', period '%s' is set twice", value, period)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("'%s', number of '%s' snapshots to keep should be a positive number", value, period)
+		}
+		keep[period] = n
+	}
+
+	for _, p := range snapshotPeriods {
+		if n, ok := keep[p.name]; ok {
+			schedule = append(schedule, snapshotRetention{period: p.name, interval: p.interval, keep: n})
+			delete(keep, p.name)
+		}
+	}
+	for period := range keep {
+		var names []string
+		for _, p := range snapshotPeriods {
+			names = append(names, p.name)
+		}
+		return nil, fmt.Errorf("'%s', unknown period '%s', allowed periods: %s", value, period, strings.Join(names, ", "))
+	}
+	return schedule, nil
+}
+
+// scheduledSnapshotName - name of the snapshot of the period started at periodStart
+func scheduledSnapshotName(period, volumeName string, periodStart time.Time) string {
+	// the volume name makes names unique in the volume group, CreateSnapshotOnNS() requires that
+	return fmt.Sprintf(
+		"%s%s-%s-%s", scheduledSnapshotPrefix, period, volumeName, periodStart.UTC().Format("20060102-150405"))
+}
+
+// runSnapshotSchedules - checks snapshot schedules of all volumes on the leader until the process exits,
+// so replicas don't take the same snapshots
+func (s *ControllerServer) runSnapshotSchedules(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		if !s.isLeader() {
+			continue
+		}
+		if err := s.RunSnapshotSchedules(now); err != nil {
+			s.log.WithField("func", "runSnapshotSchedules()").Warn(err)
+		}
+	}
+}
+
+// RunSnapshotSchedules - takes snapshots of all volumes with schedules which are due at the given time
+// and destroys the oldest scheduled snapshots over the retention limits, errors of single volumes don't stop it
+func (s *ControllerServer) RunSnapshotSchedules(now time.Time) error {
+	return s.withBackgroundNS(func(cfg *config.Config, nsResolverMap map[string]ns.Resolver) error {
+		var errors []string
+		for _, configName := range sortedConfigNames(cfg) {
+			resolver, ok := nsResolverMap[configName]
+			if !ok {
+				continue
+			}
+			// pools of HA cluster are imported on one of the nodes, each node lists its own volume groups
+			for _, nsProvider := range resolver.Nodes {
+				volumeGroups, err := getVolumeGroups(nsProvider)
+				if err != nil {
+					errors = append(errors, fmt.Sprintf("cannot get volume groups of %s: %s", nsProvider, err))
+					continue
+				}
+				for _, volumeGroup := range volumeGroups {
+					errors = append(errors, s.runVolumeGroupSchedules(nsProvider, volumeGroup, now)...)
+				}
+			}
+		}
+
+		if len(errors) != 0 {
+			return fmt.Errorf("Snapshot schedules failed: %s", strings.Join(errors, "; "))
+		}
+		return nil
+	})
+}
+
+// runVolumeGroupSchedules - runs schedules of the volumes of the volume group, snapshots are listed once
+// for all volumes of the group and only if some of them has a schedule, returns errors of single volumes
+func (s *ControllerServer) runVolumeGroupSchedules(
+	nsProvider ns.ProviderInterface, volumeGroup string, now time.Time,
+) (errors []string) {
+	l := s.log.WithField("func", "runVolumeGroupSchedules()")
+
+	volumes, err := getVolumesWithStatus(nsProvider, volumeGroup)
+	if err != nil {
+		return []string{fmt.Sprintf("cannot get volumes of '%s': %s", volumeGroup, err)}
+	}
+
+	// snapshots of the volumes by volume path
+	var snapshots map[string][]nefSnapshot
+	for _, volume := range volumes {
+		value, ok := volume.UserProperties[snapshotScheduleProperty]
+		if !ok || isTrashed(volume) {
+			continue
+		}
+		schedule, err := parseSnapshotSchedule(value)
+		if err != nil {
+			l.Warnf("volume '%s' has invalid snapshot schedule: %s", volume.Path, err)
+			continue
+		} else if len(schedule) == 0 {
+			continue
+		}
+		if snapshots == nil {
+			// recursive list has snapshots of nested volume groups too, they're not used here
+			list, err := getSnapshots(nsProvider, volumeGroup, true)
+			if err != nil {
+				return append(errors, fmt.Sprintf("cannot get snapshots of '%s': %s", volumeGroup, err))
+			}
+			snapshots = map[string][]nefSnapshot{}
+			for _, snapshot := range list {
+				snapshots[snapshot.Parent] = append(snapshots[snapshot.Parent], snapshot)
+			}
+		}
+		for _, retention := range schedule {
+			err := s.runSnapshotRetention(nsProvider, volume.Path, snapshots[volume.Path], retention, now)
+			if err != nil {
+				errors = append(errors, err.Error())
+			}
+		}
+	}
+	return errors
+}
+
+// runSnapshotRetention - takes the snapshot of the current period if the volume has no snapshot of it or later one,
+// then destroys the oldest snapshots of the period over the limit, snapshots with clones are kept
+func (s *ControllerServer) runSnapshotRetention(
+	nsProvider ns.ProviderInterface,
+	volumePath string,
+	snapshots []nefSnapshot,
+	retention snapshotRetention,
+	now time.Time,
+) error {
+	l := s.log.WithField("func", "runSnapshotRetention()")
+
+	prefix := scheduledSnapshotPrefix + retention.period + "-"
+	var scheduled []nefSnapshot
+	for _, snapshot := range snapshots {
+		if strings.HasPrefix(snapshot.Name, prefix) {
+			scheduled = append(scheduled, snapshot)
+		}
+	}
+	// names end with the period start time, so they sort in the order snapshots are taken
+	sort.Slice(scheduled, func(i, j int) bool { return scheduled[i].Name < scheduled[j].Name })
+
+	name := scheduledSnapshotName(retention.period, path.Base(volumePath), now.UTC().Truncate(retention.interval))
+	if len(scheduled) == 0 || scheduled[len(scheduled)-1].Name < name {
+		// CreateSnapshotOnNS() isn't used: it lists snapshots of the whole volume group for every snapshot
+		// to check that other volumes don't have its name, while snapshots are listed once per volume group here.
+		// The volume name makes the scheduled snapshot name unique in the volume group, so the check isn't needed.
+		snapshotPath := fmt.Sprintf("%s@%s", volumePath, name)
+		err := createSnapshot(nsProvider, snapshotPath, nil)
+		if err != nil && !ns.IsAlreadyExistNefError(err) {
+			return fmt.Errorf("cannot take %s snapshot of '%s': %s", retention.period, volumePath, err)
+		}
+		l.Infof("%s snapshot '%s' has been taken", retention.period, snapshotPath)
+		scheduled = append(scheduled, nefSnapshot{
+			Snapshot: ns.Snapshot{Path: snapshotPath, Name: name, Parent: volumePath},
+		})
+	}
+
+	for i := 0; i < len(scheduled)-retention.keep; i++ {
+		snapshotPath := scheduled[i].Path
+		if err := nsProvider.DestroySnapshot(snapshotPath); err != nil {
+			if ns.IsBusyNefError(err) {
+				l.Infof("%s snapshot '%s' has dependent clones and is kept: %s", retention.period, snapshotPath, err)
+				continue
+			} else if !ns.IsNotExistNefError(err) {
+				return fmt.Errorf("cannot destroy %s snapshot '%s': %s", retention.period, snapshotPath, err)
+			}
+		}
+		l.Infof("%s snapshot '%s' is over the limit of %d, destroyed", retention.period, snapshotPath, retention.keep)
+	}
+	return nil
+}
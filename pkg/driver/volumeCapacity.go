@@ -0,0 +1,180 @@
+package driver
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// StorageClass parameters of volume size limits, sizes in bytes or with K/M/G/T suffix
+const (
+	// paramMinVolumeSize - smallest volume size which may be requested
+	paramMinVolumeSize = "minVolumeSize"
+
+	// paramMaxVolumeSize - largest volume size, volumes can't be expanded beyond it either
+	paramMaxVolumeSize = "maxVolumeSize"
+)
+
+// maxVolumeSizeProperty - ZFS user property with the StorageClass max volume size for expansion,
+// see overcommitRatioProperty
+const maxVolumeSizeProperty = "user:csi.nexenta.com:max-volume-size"
+
+// defaultVolumeSize - size of a new volume if CapacityRange doesn't require any
+const defaultVolumeSize int64 = 1024 * 1024 * 1024
+
+// volumeCapacity - volume size range requested by CapacityRange and limited by StorageClass parameters,
+// zero values mean no bound
+type volumeCapacity struct {
+	requiredBytes int64
+	limitBytes    int64
+	minBytes      int64
+	maxBytes      int64
+}
+
+// parseVolumeCapacity - validates CapacityRange against size limits set in StorageClass parameters,
+// InvalidArgument is returned for invalid values and OutOfRange for sizes which can't be provisioned
+func parseVolumeCapacity(capacityRange *csi.CapacityRange, params map[string]string) (volumeCapacity, error) {
+	capacity := volumeCapacity{
+		requiredBytes: capacityRange.GetRequiredBytes(),
+		limitBytes:    capacityRange.GetLimitBytes(),
+	}
+	if capacity.requiredBytes < 0 || capacity.limitBytes < 0 {
+		return capacity, status.Errorf(codes.InvalidArgument, "Capacity range must not be negative: %+v", capacityRange)
+	}
+
+	var err error
+	sizeParams := map[string]*int64{
+		paramMinVolumeSize: &capacity.minBytes,
+		paramMaxVolumeSize: &capacity.maxBytes,
+	}
+	for param, size := range sizeParams {
+		if value, ok := params[param]; ok {
+			if *size, err = parseSize(value); err != nil {
+				return capacity, status.Errorf(codes.InvalidArgument, "Invalid %s parameter: %s", param, err)
+			}
+		}
+	}
+	if capacity.maxBytes != 0 && capacity.minBytes > capacity.maxBytes {
+		return capacity, status.Errorf(
+			codes.InvalidArgument,
+			"%s parameter is greater than %s: %d > %d",
+			paramMinVolumeSize,
+			paramMaxVolumeSize,
+			capacity.minBytes,
+			capacity.maxBytes,
+		)
+	}
+
+	if capacity.limitBytes != 0 && capacity.requiredBytes > capacity.limitBytes {
+		return capacity, status.Errorf(
+			codes.OutOfRange,
+			"Required bytes are greater than limit bytes: %d > %d",
+			capacity.requiredBytes,
+			capacity.limitBytes,
+		)
+	}
+	if capacity.requiredBytes != 0 && capacity.requiredBytes < capacity.minBytes {
+		return capacity, status.Errorf(
+			codes.OutOfRange,
+			"Requested size %d is less than %s %d of the StorageClass",
+			capacity.requiredBytes,
+			paramMinVolumeSize,
+			capacity.minBytes,
+		)
+	}
+	if capacity.limitBytes != 0 && capacity.limitBytes < capacity.minBytes {
+		return capacity, status.Errorf(
+			codes.OutOfRange,
+			"Size limit %d is less than %s %d of the StorageClass",
+			capacity.limitBytes,
+			paramMinVolumeSize,
+			capacity.minBytes,
+		)
+	}
+	if capacity.maxBytes != 0 && capacity.requiredBytes > capacity.maxBytes {
+		return capacity, status.Errorf(
+			codes.OutOfRange,
+			"Requested size %d is greater than %s %d of the StorageClass",
+			capacity.requiredBytes,
+			paramMaxVolumeSize,
+			capacity.maxBytes,
+		)
+	}
+	return capacity, nil
+}
+
+// upperBound - largest size allowed by LimitBytes and max volume size, 0 if there is no bound
+func (c volumeCapacity) upperBound() int64 {
+	if c.limitBytes != 0 && (c.maxBytes == 0 || c.limitBytes < c.maxBytes) {
+		return c.limitBytes
+	}
+	return c.maxBytes
+}
+
+// size - volume size rounded up to the block size, defaultVolumeSize (or min volume size if it's bigger)
+// is used if no size is required, it's reduced to fit the upper bound
+func (c volumeCapacity) size(blockSize int64) (int64, error) {
+	if blockSize <= 0 {
+		blockSize = 1
+	}
+	upperBound := c.upperBound()
+
+	size := c.requiredBytes
+	if size == 0 {
+		size = defaultVolumeSize
+		if size < c.minBytes {
+			size = c.minBytes
+		}
+	}
+	rounded := (size + blockSize - 1) / blockSize * blockSize
+	if c.requiredBytes == 0 && upperBound != 0 && rounded > upperBound {
+		// no size is required, the largest multiple of the block size which fits is taken
+		rounded = upperBound / blockSize * blockSize
+	}
+
+	if rounded == 0 || rounded < c.minBytes || c.fits(rounded) != nil {
+		return 0, status.Errorf(
+			codes.OutOfRange,
+			"Volume size %d rounded up to %d bytes block size is out of the range: %s",
+			size,
+			blockSize,
+			c,
+		)
+	}
+	return rounded, nil
+}
+
+// fits - returns OutOfRange error if the size is greater than the upper bound, e.g. clone of a bigger volume,
+// smaller volumes are expanded
+func (c volumeCapacity) fits(size int64) error {
+	if upperBound := c.upperBound(); upperBound != 0 && size > upperBound {
+		return status.Errorf(
+			codes.OutOfRange, "Volume size %d is greater than the limit %d: %s", size, upperBound, c)
+	}
+	return nil
+}
+
+// String - capacity range in "required=,limit=,min=,max=" format
+func (c volumeCapacity) String() string {
+	return fmt.Sprintf("required=%d,limit=%d,min=%d,max=%d", c.requiredBytes, c.limitBytes, c.minBytes, c.maxBytes)
+}
+
+// setUserProperties - keeps max volume size in the volume user property to check expansions
+func (c volumeCapacity) setUserProperties(properties *volumeProperties) {
+	if c.maxBytes == 0 {
+		return
+	}
+	if properties.UserProperties == nil {
+		properties.UserProperties = map[string]string{}
+	}
+	properties.UserProperties[maxVolumeSizeProperty] = strconv.FormatInt(c.maxBytes, 10)
+}
+
+// volumeMaxSize - max volume size kept in the volume user property, 0 if there is no limit
+func volumeMaxSize(userProperties map[string]string) int64 {
+	size, _ := strconv.ParseInt(userProperties[maxVolumeSizeProperty], 10, 64)
+	return size
+}
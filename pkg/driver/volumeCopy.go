@@ -0,0 +1,354 @@
+package driver
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/csiid"
+)
+
+// volumeCopyServicePrefix - name prefix of NEF replication services copying snapshots between appliances,
+// the service is named after the new volume, so retried CreateVolume calls find the copy in progress
+const volumeCopyServicePrefix = "csi-copy-"
+
+// volumeCopySnapshotPrefix - name prefix of snapshots taken to copy a volume, they are destroyed once the copy is done
+const volumeCopySnapshotPrefix = "k8s-clone-snapshot-"
+
+// volumeCopyProperty - ZFS user property with the path of the snapshot the volume has been copied from,
+// it's set once the copy is done, so partial copies and other volumes with the same name aren't taken for the copy
+const volumeCopyProperty = "user:csi.nexenta.com:copied-from"
+
+// cloneConfigName - returns NexentaStor config name to create a clone or a restored volume on,
+// it's the source appliance unless StorageClass or topology requirements select another one
+func (s *ControllerServer) cloneConfigName(configName, zone, sourceConfigName string) string {
+	if configName != "" {
+		return configName
+	}
+	if zone != "" && s.config.NsMap[sourceConfigName].Zone != zone {
+		return ""
+	}
+	return sourceConfigName
+}
+
+// copySnapshotVolume - creates volume from the snapshot on another NexentaStor
+func (s *ControllerServer) copySnapshotVolume(
+	sourceSnapshot csiid.SnapshotID,
+	target ResolveNSResponse,
+	volumePath string,
+	properties volumeProperties,
+	encryption volumeEncryption,
+) error {
+	source, err := s.resolveNS(ResolveNSParams{
+		volumeGroup: sourceSnapshot.Volume.VolumeGroup,
+		configName:  sourceSnapshot.Volume.ConfigName,
+	})
+	if err != nil {
+		return err
+	}
+	return s.copyVolume(source, sourceSnapshot.Path(), false, target, volumePath, properties, encryption)
+}
+
+// copyClonedVolume - creates clone of the volume on another NexentaStor, the volume snapshot is taken and copied
+func (s *ControllerServer) copyClonedVolume(
+	sourceVolume csiid.VolumeID,
+	volumeName string,
+	target ResolveNSResponse,
+	volumePath string,
+	properties volumeProperties,
+	encryption volumeEncryption,
+) error {
+	source, err := s.resolveNS(ResolveNSParams{
+		volumeGroup: sourceVolume.VolumeGroup,
+		configName:  sourceVolume.ConfigName,
+	})
+	if err != nil {
+		return err
+	}
+	if err := checkVolumeCopySource(source, sourceVolume.Path(), encryption); err != nil {
+		return err
+	}
+	snapshot, err := s.CreateSnapshotOnNS(
+		source.nsProvider, sourceVolume.Path(), volumeCopySnapshotPrefix+volumeName, nil)
+	if err != nil {
+		return err
+	}
+	return s.copyVolume(source, snapshot.Path, true, target, volumePath, properties, encryption)
+}
+
+// copyVolume - creates volume from a snapshot on another NexentaStor, the snapshot is sent by NEF replication
+// service in background and Aborted error is returned until the copy completes, so CO retries the request.
+// destroySourceSnapshot is set for snapshots taken to copy a volume, they are destroyed once the copy is done
+func (s *ControllerServer) copyVolume(
+	source ResolveNSResponse,
+	snapshotPath string,
+	destroySourceSnapshot bool,
+	target ResolveNSResponse,
+	volumePath string,
+	properties volumeProperties,
+	encryption volumeEncryption,
+) error {
+	l := s.log.WithField("func", "copyVolume()")
+	l.Infof("snapshot: %s on %s, volume: %s on %s", snapshotPath, source.nsProvider, volumePath, target.nsProvider)
+
+	serviceName := volumeCopyServicePrefix + path.Base(volumePath)
+	_, snapshotName := splitSnapshotPath(snapshotPath)
+	replicatedSnapshotPath := fmt.Sprintf("%s@%s", volumePath, snapshotName)
+
+	// finish - destroys the snapshot taken for the copy, it's not a clone origin and isn't needed anymore
+	finish := func() error {
+		if !destroySourceSnapshot {
+			return nil
+		}
+		err := source.nsProvider.DestroySnapshot(snapshotPath)
+		if err != nil && !ns.IsNotExistNefError(err) {
+			return status.Errorf(codes.Internal, "Cannot destroy snapshot '%s': %s", snapshotPath, err)
+		}
+		return nil
+	}
+
+	service, err := getReplicationService(source.nsProvider, serviceName)
+	if ns.IsNotExistNefError(err) {
+		// there is no copy in progress, the volume is either copied already or the copy has to be started
+		volume, err := getVolumeStatus(target.nsProvider, volumePath)
+		if ns.IsNotExistNefError(err) {
+			return s.startVolumeCopy(source, snapshotPath, target, volumePath, serviceName, encryption)
+		} else if err != nil {
+			return status.Errorf(codes.Internal, "Cannot get volume '%s': %s", volumePath, err)
+		}
+		if volume.UserProperties[volumeCopyProperty] == snapshotPath {
+			l.Infof("volume '%s' already exists and can be used", volumePath)
+			return finish()
+		}
+		// the snapshot has been received, but the service is gone before the copy was finished
+		_, err = getSnapshot(target.nsProvider, replicatedSnapshotPath)
+		if ns.IsNotExistNefError(err) {
+			return status.Errorf(
+				codes.AlreadyExists,
+				"Volume '%s' already exists on %s and is not a copy of snapshot '%s'",
+				volumePath,
+				target.nsProvider,
+				snapshotPath,
+			)
+		} else if err != nil {
+			return status.Errorf(codes.Internal, "Cannot get snapshot '%s': %s", replicatedSnapshotPath, err)
+		}
+		if err := s.completeVolumeCopy(target, volumePath, snapshotPath, properties); err != nil {
+			return err
+		}
+		return finish()
+	} else if err != nil {
+		return status.Errorf(
+			codes.Internal, "Cannot get replication service '%s' on %s: %s", serviceName, source.nsProvider, err)
+	}
+
+	switch {
+	case service.State == nefReplicationStateRunning:
+		return status.Errorf(
+			codes.Aborted,
+			"Volume '%s' is being copied from snapshot '%s' on %s: %d%% done",
+			volumePath,
+			snapshotPath,
+			source.nsProvider,
+			service.Progress,
+		)
+	case service.State == nefReplicationStateFailed:
+		// the partial copy and the service are destroyed, so the copy starts over on the next request
+		err := target.nsProvider.DestroyVolume(volumePath, ns.DestroyVolumeParams{DestroySnapshots: true})
+		if err != nil && !ns.IsNotExistNefError(err) {
+			l.Warnf("cannot destroy partial copy '%s' on %s: %s", volumePath, target.nsProvider, err)
+		}
+		if err := destroyReplicationService(source.nsProvider, serviceName); err != nil {
+			l.Warnf("cannot destroy failed replication service '%s': %s", serviceName, err)
+		}
+		return status.Errorf(
+			codes.Internal,
+			"Cannot copy snapshot '%s' from %s to volume '%s': %s",
+			snapshotPath,
+			source.nsProvider,
+			volumePath,
+			service.LastError,
+		)
+	case service.LastSnapshot != snapshotName:
+		// the service has been created, but previous request has failed to start it
+		if err := startReplicationService(source.nsProvider, serviceName); err != nil {
+			return status.Errorf(codes.Internal, "Cannot start replication service '%s': %s", serviceName, err)
+		}
+		return status.Errorf(
+			codes.Aborted, "Copy of snapshot '%s' to volume '%s' has been started", snapshotPath, volumePath)
+	}
+
+	// the copy is done, the service is destroyed last, so failed steps are retried
+	if err := s.completeVolumeCopy(target, volumePath, snapshotPath, properties); err != nil {
+		return err
+	}
+	err = destroyReplicationService(source.nsProvider, serviceName)
+	if err != nil && !ns.IsNotExistNefError(err) {
+		return status.Errorf(codes.Internal, "Cannot destroy replication service '%s': %s", serviceName, err)
+	}
+
+	l.Infof("volume '%s' has been copied from snapshot '%s' on %s", volumePath, snapshotPath, source.nsProvider)
+	return finish()
+}
+
+// completeVolumeCopy - destroys the replicated snapshot and sets StorageClass properties, replication streams
+// don't carry them, volumeCopyProperty is set with them as the last step
+func (s *ControllerServer) completeVolumeCopy(
+	target ResolveNSResponse,
+	volumePath string,
+	snapshotPath string,
+	properties volumeProperties,
+) error {
+	l := s.log.WithField("func", "completeVolumeCopy()")
+
+	sourceVolumePath, snapshotName := splitSnapshotPath(snapshotPath)
+	replicatedSnapshotPath := fmt.Sprintf("%s@%s", volumePath, snapshotName)
+	err := target.nsProvider.DestroySnapshot(replicatedSnapshotPath)
+	if err != nil && !ns.IsNotExistNefError(err) {
+		return status.Errorf(codes.Internal, "Cannot destroy snapshot '%s': %s", replicatedSnapshotPath, err)
+	}
+	if properties.VolumeBlockSize != 0 {
+		l.Warnf(
+			"volume '%s' keeps volblocksize of volume '%s', requested value is ignored", volumePath, sourceVolumePath)
+	}
+	properties = properties.withoutBlockSize()
+	userProperties := map[string]string{volumeCopyProperty: snapshotPath}
+	for name, value := range properties.UserProperties {
+		userProperties[name] = value
+	}
+	properties.UserProperties = userProperties
+	if err := updateVolume(target.nsProvider, volumePath, properties); err != nil {
+		return status.Errorf(codes.Internal, "Cannot set properties of volume '%s': %s", volumePath, err)
+	}
+	return nil
+}
+
+// reclaimVolumeCopy - destroys the copy CO has given up on, e.g. the PVC has been deleted while CreateVolume waited
+// for it: the target volume, the snapshot taken for the copy and the service, which is destroyed last,
+// so failed steps are retried. The target appliance is found by the remote node of the service.
+func reclaimVolumeCopy(
+	nsProvider ns.ProviderInterface, serviceName string, nsResolverMap map[string]ns.Resolver,
+) (reclaimed bool, err error) {
+	service, err := getReplicationService(nsProvider, serviceName)
+	if ns.IsNotExistNefError(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	if service.State == nefReplicationStateRunning {
+		return false, nil
+	}
+
+	var target ns.ProviderInterface
+	for _, resolver := range nsResolverMap {
+		for _, node := range resolver.Nodes {
+			if remoteNode, err := getRemoteNode(node); err == nil && remoteNode == service.RemoteNode {
+				target = node
+			}
+		}
+	}
+	if target == nil {
+		return false, fmt.Errorf(
+			"remote node %s:%d of the copy is not in the config", service.RemoteNode.Host, service.RemoteNode.Port)
+	}
+	err = target.DestroyVolume(service.DestinationDataset, ns.DestroyVolumeParams{DestroySnapshots: true})
+	if err != nil && !ns.IsNotExistNefError(err) {
+		return false, err
+	}
+	if strings.HasPrefix(service.SourceSnapshot, volumeCopySnapshotPrefix) {
+		err = nsProvider.DestroySnapshot(service.SourceDataset + "@" + service.SourceSnapshot)
+		if err != nil && !ns.IsNotExistNefError(err) {
+			return false, err
+		}
+	}
+	err = destroyReplicationService(nsProvider, serviceName)
+	if err != nil && !ns.IsNotExistNefError(err) {
+		return false, err
+	}
+	return true, nil
+}
+
+// startVolumeCopy - creates and starts NEF replication service sending the snapshot to the target appliance,
+// returns Aborted error on success, the copy is in progress then
+func (s *ControllerServer) startVolumeCopy(
+	source ResolveNSResponse,
+	snapshotPath string,
+	target ResolveNSResponse,
+	volumePath string,
+	serviceName string,
+	encryption volumeEncryption,
+) error {
+	l := s.log.WithField("func", "startVolumeCopy()")
+
+	sourceVolumePath, snapshotName := splitSnapshotPath(snapshotPath)
+	if err := checkVolumeCopySource(source, sourceVolumePath, encryption); err != nil {
+		return err
+	}
+
+	snapshot, err := getSnapshot(source.nsProvider, snapshotPath)
+	if err != nil {
+		return status.Errorf(codes.NotFound, "Failed to find snapshot '%s': %s", snapshotPath, err)
+	}
+	if !snapshot.readyToUse() {
+		return status.Errorf(codes.FailedPrecondition, "Snapshot '%s' is not ready to use", snapshot.Path)
+	}
+
+	remoteNode, err := getRemoteNode(target.nsProvider)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	err = createReplicationService(source.nsProvider, nefReplicationService{
+		Name:               serviceName,
+		SourceDataset:      sourceVolumePath,
+		DestinationDataset: volumePath,
+		RemoteNode:         remoteNode,
+		SourceSnapshot:     snapshotName,
+	})
+	if err != nil && !ns.IsAlreadyExistNefError(err) {
+		return status.Errorf(
+			codes.Internal, "Cannot create replication service '%s' on %s: %s", serviceName, source.nsProvider, err)
+	}
+	if err := startReplicationService(source.nsProvider, serviceName); err != nil {
+		return status.Errorf(codes.Internal, "Cannot start replication service '%s': %s", serviceName, err)
+	}
+
+	l.Infof(
+		"copy of snapshot '%s' on %s to volume '%s' on %s has been started",
+		snapshotPath,
+		source.nsProvider,
+		volumePath,
+		target.nsProvider,
+	)
+	return status.Errorf(
+		codes.Aborted, "Copy of snapshot '%s' to volume '%s' has been started", snapshotPath, volumePath)
+}
+
+// checkVolumeCopySource - checks that the source volume exists and can be copied to another NexentaStor
+func checkVolumeCopySource(source ResolveNSResponse, sourceVolumePath string, encryption volumeEncryption) error {
+	sourceVolume, err := getVolumeStatus(source.nsProvider, sourceVolumePath)
+	if ns.IsNotExistNefError(err) {
+		return status.Errorf(codes.NotFound, "Source volume '%s' not found on %s", sourceVolumePath, source.nsProvider)
+	} else if err != nil {
+		return status.Errorf(codes.Internal, "Cannot get source volume '%s': %s", sourceVolumePath, err)
+	}
+	// the wrapping key stays on the source appliance, raw replication stream can't be decrypted by the target one
+	if sourceVolume.encrypted() || encryption.enabled() {
+		return status.Errorf(
+			codes.InvalidArgument,
+			"Encrypted volumes cannot be copied between NexentaStor appliances: '%s' on %s",
+			sourceVolumePath,
+			source.nsProvider,
+		)
+	}
+	return nil
+}
+
+// splitSnapshotPath - returns volume path and snapshot name of "pool/vg/volume@snapshot" path
+func splitSnapshotPath(snapshotPath string) (volumePath, snapshotName string) {
+	volumePath, snapshotName, _ = strings.Cut(snapshotPath, "@")
+	return volumePath, snapshotName
+}
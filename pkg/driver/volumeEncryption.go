@@ -0,0 +1,173 @@
+package driver
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/arrays"
+)
+
+// StorageClass parameters of ZFS encryption
+const (
+	paramEncryption = "encryption"
+	paramKeyFormat  = "keyformat"
+)
+
+// secretEncryptionKey - provisioner secret key with the wrapping key of encrypted volumes,
+// set by "csi.storage.k8s.io/provisioner-secret-name" StorageClass parameter
+const secretEncryptionKey = "encryptionKey"
+
+const (
+	encryptionOff           = "off"
+	encryptionOn            = "on"
+	defaultEncryptionCipher = "aes-256-gcm"
+)
+
+// ZFS key formats
+const (
+	keyFormatPassphrase = "passphrase"
+	keyFormatHex        = "hex"
+	keyFormatRaw        = "raw"
+)
+
+// NEF key status of encrypted volume
+const (
+	nefKeyStatusAvailable   = "available"
+	nefKeyStatusUnavailable = "unavailable"
+)
+
+var encryptionCiphers = []string{
+	"aes-128-ccm", "aes-192-ccm", "aes-256-ccm", "aes-128-gcm", "aes-192-gcm", "aes-256-gcm",
+}
+
+var keyFormats = []string{keyFormatPassphrase, keyFormatHex, keyFormatRaw}
+
+// secretValue - string which is never printed, go-nexentastor logs NEF request data on debug level
+type secretValue string
+
+func (v secretValue) String() string {
+	return "******"
+}
+
+// volumeEncryption - NEF encryption fields of new volume, empty for unencrypted volume
+type volumeEncryption struct {
+	Encryption string      `json:"encryption,omitempty"`
+	KeyFormat  string      `json:"keyFormat,omitempty"`
+	Key        secretValue `json:"key,omitempty"`
+}
+
+func (e volumeEncryption) enabled() bool {
+	return e.Encryption != ""
+}
+
+// cipher - requested cipher or "off"
+func (e volumeEncryption) cipher() string {
+	if !e.enabled() {
+		return encryptionOff
+	}
+	return e.Encryption
+}
+
+// nefVolumeEncryption - NEF encryption fields of existing volume
+type nefVolumeEncryption struct {
+	Encryption     string `json:"encryption"`
+	KeyStatus      string `json:"keyStatus"`
+	EncryptionRoot string `json:"encryptionRoot"`
+}
+
+func (e nefVolumeEncryption) encrypted() bool {
+	return e.Encryption != "" && e.Encryption != encryptionOff
+}
+
+// cipher - volume cipher or "off"
+func (e nefVolumeEncryption) cipher() string {
+	if !e.encrypted() {
+		return encryptionOff
+	}
+	return e.Encryption
+}
+
+// parseVolumeEncryption - validates encryption StorageClass parameters and the key from provisioner secrets,
+// errors never contain the key
+func parseVolumeEncryption(params, secrets map[string]string) (encryption volumeEncryption, err error) {
+	cipher, ok := params[paramEncryption]
+	if !ok || cipher == encryptionOff {
+		if _, ok := params[paramKeyFormat]; ok {
+			return encryption, fmt.Errorf(
+				"Parameter '%s' requires '%s' parameter to be set", paramKeyFormat, paramEncryption)
+		}
+		return encryption, nil
+	}
+	if cipher == encryptionOn {
+		cipher = defaultEncryptionCipher
+	}
+	if !arrays.ContainsString(encryptionCiphers, cipher) {
+		return encryption, fmt.Errorf(
+			"Parameter '%s' has invalid value: '%s', allowed values: %s, %s, %s",
+			paramEncryption,
+			cipher,
+			encryptionOn,
+			encryptionOff,
+			strings.Join(encryptionCiphers, ", "),
+		)
+	}
+
+	keyFormat := keyFormatPassphrase
+	if v, ok := params[paramKeyFormat]; ok {
+		keyFormat = v
+	}
+	if !arrays.ContainsString(keyFormats, keyFormat) {
+		return encryption, fmt.Errorf(
+			"Parameter '%s' has invalid value: '%s', allowed values: %s",
+			paramKeyFormat,
+			keyFormat,
+			strings.Join(keyFormats, ", "),
+		)
+	}
+
+	key, ok := secrets[secretEncryptionKey]
+	if !ok || key == "" {
+		return encryption, fmt.Errorf(
+			"Encrypted volume requires '%s' key in provisioner secret, "+
+				"set 'csi.storage.k8s.io/provisioner-secret-name' StorageClass parameter",
+			secretEncryptionKey,
+		)
+	}
+	if err := validateEncryptionKey(keyFormat, key); err != nil {
+		return encryption, fmt.Errorf("Provisioner secret '%s' is invalid: %s", secretEncryptionKey, err)
+	}
+
+	return volumeEncryption{Encryption: cipher, KeyFormat: keyFormat, Key: secretValue(key)}, nil
+}
+
+// validateEncryptionKey - ZFS requires passphrase of 8-512 bytes, 32 bytes key as 64 hex digits or raw
+func validateEncryptionKey(keyFormat, key string) error {
+	switch keyFormat {
+	case keyFormatPassphrase:
+		if len(key) < 8 || len(key) > 512 {
+			return fmt.Errorf("passphrase must be from 8 to 512 bytes long, got %d bytes", len(key))
+		}
+	case keyFormatHex:
+		if decoded, err := hex.DecodeString(key); err != nil || len(decoded) != 32 {
+			return fmt.Errorf("hex key must be 64 hexadecimal digits")
+		}
+	case keyFormatRaw:
+		if len(key) != 32 {
+			return fmt.Errorf("raw key must be 32 bytes long, got %d bytes", len(key))
+		}
+	}
+	return nil
+}
+
+// getConfigSecret - returns driver config from CSI request secrets, the encryption key is skipped
+func getConfigSecret(secrets map[string]string) string {
+	var secret string
+	for k, v := range secrets {
+		if k == secretEncryptionKey {
+			continue
+		}
+		secret = v
+	}
+	return secret
+}
@@ -0,0 +1,163 @@
+package driver
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// CreateVolume and CreateSnapshot parameters added by csi-provisioner and csi-snapshotter
+// run with --extra-create-metadata flag
+const (
+	paramPVCName                   = "csi.storage.k8s.io/pvc/name"
+	paramPVCNamespace              = "csi.storage.k8s.io/pvc/namespace"
+	paramPVName                    = "csi.storage.k8s.io/pv/name"
+	paramVolumeSnapshotName        = "csi.storage.k8s.io/volumesnapshot/name"
+	paramVolumeSnapshotNamespace   = "csi.storage.k8s.io/volumesnapshot/namespace"
+	paramVolumeSnapshotContentName = "csi.storage.k8s.io/volumesnapshotcontent/name"
+)
+
+// paramVolumeNameTemplate - StorageClass parameter with the name of new volumes,
+// e.g. "${pvc.namespace}-${pvc.name}-${pv.name}"
+const paramVolumeNameTemplate = "volumeNameTemplate"
+
+// volumeNameTemplate placeholders
+const (
+	volumeNamePVCName      = "pvc.name"
+	volumeNamePVCNamespace = "pvc.namespace"
+	volumeNamePVName       = "pv.name"
+)
+
+// ZFS user properties with Kubernetes objects of volumes and snapshots
+const (
+	pvcNameProperty                   = "user:csi.nexenta.com:pvc-name"
+	pvcNamespaceProperty              = "user:csi.nexenta.com:pvc-namespace"
+	pvNameProperty                    = "user:csi.nexenta.com:pv-name"
+	volumeSnapshotNameProperty        = "user:csi.nexenta.com:volumesnapshot-name"
+	volumeSnapshotNamespaceProperty   = "user:csi.nexenta.com:volumesnapshot-namespace"
+	volumeSnapshotContentNameProperty = "user:csi.nexenta.com:volumesnapshotcontent-name"
+)
+
+// volumeMetadataProperties - ZFS user properties set from CreateVolume parameters
+var volumeMetadataProperties = map[string]string{
+	paramPVCName:      pvcNameProperty,
+	paramPVCNamespace: pvcNamespaceProperty,
+	paramPVName:       pvNameProperty,
+}
+
+// snapshotMetadataProperties - ZFS user properties set from CreateSnapshot parameters
+var snapshotMetadataProperties = map[string]string{
+	paramVolumeSnapshotName:        volumeSnapshotNameProperty,
+	paramVolumeSnapshotNamespace:   volumeSnapshotNamespaceProperty,
+	paramVolumeSnapshotContentName: volumeSnapshotContentNameProperty,
+}
+
+// volume name limits, ZFS limits the whole dataset path to 255 characters, the volume group takes a part of it
+const (
+	maxVolumeNameLength  = 128
+	maxVolumeNameSegment = 63
+)
+
+var regexpVolumeNamePlaceholder = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+// regexpVolumeNameInvalidChars - characters NexentaStor doesn't allow in dataset names,
+// ':' and '@' are reserved by volume and snapshot IDs
+var regexpVolumeNameInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// setVolumeMetadata - keeps PVC and PV names of the volume in its user properties
+func setVolumeMetadata(properties *volumeProperties, params map[string]string) {
+	for param, property := range volumeMetadataProperties {
+		if value := params[param]; value != "" {
+			if properties.UserProperties == nil {
+				properties.UserProperties = map[string]string{}
+			}
+			properties.UserProperties[property] = value
+		}
+	}
+}
+
+// snapshotMetadata - user properties of a new snapshot: VolumeSnapshot names and PVC and PV names
+// of the source volume, nil if there are none
+func snapshotMetadata(params, volumeUserProperties map[string]string) map[string]string {
+	var userProperties map[string]string
+	set := func(property, value string) {
+		if value == "" {
+			return
+		}
+		if userProperties == nil {
+			userProperties = map[string]string{}
+		}
+		userProperties[property] = value
+	}
+	for param, property := range snapshotMetadataProperties {
+		set(property, params[param])
+	}
+	for _, property := range volumeMetadataProperties {
+		set(property, volumeUserProperties[property])
+	}
+	return userProperties
+}
+
+// hasSnapshotMetadata - csi-snapshotter added VolumeSnapshot names to CreateSnapshot parameters
+func hasSnapshotMetadata(params map[string]string) bool {
+	for param := range snapshotMetadataProperties {
+		if params[param] != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// formatVolumeName - volume name made by volumeNameTemplate parameter, the template must contain "${pv.name}"
+// to keep names unique, PVC names require csi-provisioner to run with --extra-create-metadata flag.
+// Values are sanitized to NexentaStor naming rules: invalid characters are replaced with '-', PVC names
+// are cut to 63 characters.
+func formatVolumeName(template, pvName string, params map[string]string) (string, error) {
+	values := map[string]string{
+		volumeNamePVName:       pvName,
+		volumeNamePVCName:      params[paramPVCName],
+		volumeNamePVCNamespace: params[paramPVCNamespace],
+	}
+	if !strings.Contains(template, "${"+volumeNamePVName+"}") {
+		return "", fmt.Errorf(
+			"parameter '%s' must contain '${%s}' to keep volume names unique", paramVolumeNameTemplate, volumeNamePVName)
+	}
+
+	var errors []string
+	name := regexpVolumeNamePlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		key := regexpVolumeNamePlaceholder.FindStringSubmatch(placeholder)[1]
+		value, ok := values[key]
+		if !ok {
+			errors = append(errors, fmt.Sprintf(
+				"unknown placeholder '%s', supported placeholders: ${%s}, ${%s}, ${%s}",
+				placeholder,
+				volumeNamePVCNamespace,
+				volumeNamePVCName,
+				volumeNamePVName,
+			))
+		} else if value == "" {
+			errors = append(errors, fmt.Sprintf(
+				"placeholder '%s' has no value, csi-provisioner must run with --extra-create-metadata flag",
+				placeholder,
+			))
+		} else if key != volumeNamePVName && len(value) > maxVolumeNameSegment {
+			value = value[:maxVolumeNameSegment]
+		}
+		return value
+	})
+	if len(errors) != 0 {
+		return "", fmt.Errorf("parameter '%s' is invalid: %s", paramVolumeNameTemplate, strings.Join(errors, "; "))
+	}
+
+	// dataset name must start with a letter or a number
+	name = strings.TrimLeft(regexpVolumeNameInvalidChars.ReplaceAllString(name, "-"), "_.-")
+	if len(name) > maxVolumeNameLength {
+		return "", fmt.Errorf(
+			"volume name '%s' made by parameter '%s' is longer than %d characters",
+			name,
+			paramVolumeNameTemplate,
+			maxVolumeNameLength,
+		)
+	}
+	return name, nil
+}
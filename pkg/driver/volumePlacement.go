@@ -0,0 +1,356 @@
+package driver
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+)
+
+// StorageClass parameters of new volume placement
+const (
+	// paramPlacementPolicy - how the NexentaStor and the volume group of a new volume are chosen
+	paramPlacementPolicy = "placementPolicy"
+
+	// paramVolumeGroups - comma separated candidate volume groups, volumeGroup parameter
+	// or defaultVolumeGroup of each NexentaStor is the only candidate if not set
+	paramVolumeGroups = "volumeGroups"
+
+	// paramPlacementWeights - weights of the weighted policy, e.g. "nstor-box1=3,nstor-box2:pool2/vg=1",
+	// keys are config names or "configName:volumeGroup", candidates not listed have weight 1
+	paramPlacementWeights = "placementWeights"
+)
+
+// Placement policies
+const (
+	// placementMostFreeSpace - volume group with the most available space
+	placementMostFreeSpace = "mostFreeSpace"
+
+	// placementRoundRobin - candidates are taken in turn, the position is kept in memory of the controller
+	placementRoundRobin = "roundRobin"
+
+	// placementWeighted - volume name is hashed against the candidates, so each of them gets a share
+	// of volumes proportional to its weight and a retried request gets the same candidate
+	placementWeighted = "weighted"
+
+	// placementPinned - first volume group of configName NexentaStor, no other candidate is tried
+	placementPinned = "pinned"
+)
+
+// defaultPlacementPolicy - placement policy if StorageClass doesn't set it
+const defaultPlacementPolicy = placementMostFreeSpace
+
+// defaultPlacementWeight - weight of candidates missing in placementWeights parameter
+const defaultPlacementWeight = 1
+
+// VolumeContext keys of the placement decision
+const (
+	volumeContextPlacementPolicy = "PlacementPolicy"
+	volumeContextPlacement       = "Placement"
+	volumeContextPlacementReason = "PlacementReason"
+)
+
+// volumePlacement - placement policy and candidates set by StorageClass parameters
+type volumePlacement struct {
+	policy       string
+	volumeGroups []string
+	weights      map[string]int64
+}
+
+// parseVolumePlacement - parses placement parameters, mostFreeSpace among default volume groups if none is set
+func parseVolumePlacement(params map[string]string) (placement volumePlacement, err error) {
+	placement = volumePlacement{policy: defaultPlacementPolicy}
+	if v, ok := params[paramPlacementPolicy]; ok {
+		switch v {
+		case placementMostFreeSpace, placementRoundRobin, placementWeighted, placementPinned:
+			placement.policy = v
+		default:
+			return placement, fmt.Errorf(
+				"Invalid %s parameter '%s', should be one of: %s",
+				paramPlacementPolicy,
+				v,
+				strings.Join([]string{
+					placementMostFreeSpace,
+					placementRoundRobin,
+					placementWeighted,
+					placementPinned,
+				}, ", "),
+			)
+		}
+	}
+
+	if v, ok := params[paramVolumeGroups]; ok {
+		if params["volumeGroup"] != "" {
+			return placement, fmt.Errorf("volumeGroup and %s parameters can't be set together", paramVolumeGroups)
+		}
+		for _, volumeGroup := range strings.Split(v, ",") {
+			if volumeGroup = strings.TrimSpace(volumeGroup); volumeGroup != "" {
+				placement.volumeGroups = append(placement.volumeGroups, volumeGroup)
+			}
+		}
+		if len(placement.volumeGroups) == 0 {
+			return placement, fmt.Errorf("%s parameter must list at least one volume group", paramVolumeGroups)
+		}
+	}
+
+	if v, ok := params[paramPlacementWeights]; ok {
+		if placement.policy != placementWeighted {
+			return placement, fmt.Errorf(
+				"%s parameter requires %s=%s", paramPlacementWeights, paramPlacementPolicy, placementWeighted)
+		}
+		placement.weights = map[string]int64{}
+		for _, entry := range strings.Split(v, ",") {
+			if entry = strings.TrimSpace(entry); entry == "" {
+				continue
+			}
+			parts := strings.SplitN(entry, "=", 2)
+			var weight int64
+			if len(parts) == 2 {
+				weight, err = strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+			}
+			if len(parts) != 2 || err != nil || weight < 0 || strings.TrimSpace(parts[0]) == "" {
+				return placement, fmt.Errorf(
+					"Invalid %s parameter entry '%s', should be 'configName[:volumeGroup]=weight'",
+					paramPlacementWeights,
+					entry,
+				)
+			}
+			placement.weights[strings.TrimSpace(parts[0])] = weight
+		}
+	}
+
+	if placement.policy == placementPinned && params["configName"] == "" {
+		return placement, fmt.Errorf(
+			"configName parameter must be set to use %s=%s", paramPlacementPolicy, placementPinned)
+	}
+	return placement, nil
+}
+
+// weight - weight of the candidate, volume group entry overrides NexentaStor one
+func (p volumePlacement) weight(candidate placementCandidate) int64 {
+	if weight, ok := p.weights[candidate.String()]; ok {
+		return weight
+	}
+	if weight, ok := p.weights[candidate.configName]; ok {
+		return weight
+	}
+	return defaultPlacementWeight
+}
+
+// placementCandidate - volume group a new volume can be created in
+type placementCandidate struct {
+	ResolveNSResponse
+	bytesAvailable int64
+}
+
+// String - candidate in "configName:volumeGroup" format
+func (c placementCandidate) String() string {
+	return c.configName + ":" + c.volumeGroup
+}
+
+// placementDecision - chosen candidate and the reason it's chosen
+type placementDecision struct {
+	policy    string
+	candidate placementCandidate
+	reason    string
+}
+
+// setVolumeContext - adds the placement decision to VolumeContext, volumes placed otherwise have no keys
+func (d placementDecision) setVolumeContext(volumeContext map[string]string) {
+	if d.policy == "" {
+		return
+	}
+	volumeContext[volumeContextPlacementPolicy] = d.policy
+	volumeContext[volumeContextPlacement] = d.candidate.String()
+	volumeContext[volumeContextPlacementReason] = d.reason
+}
+
+// roundRobinPlacement - next position of each candidate list of roundRobin policy
+type roundRobinPlacement struct {
+	mu        sync.Mutex
+	positions map[string]int
+}
+
+// next - returns position of the candidate to take and moves to the next one
+func (r *roundRobinPlacement) next(candidates []placementCandidate) int {
+	keys := make([]string, len(candidates))
+	for i, candidate := range candidates {
+		keys[i] = candidate.String()
+	}
+	key := strings.Join(keys, ",")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.positions == nil {
+		r.positions = map[string]int{}
+	}
+	position := r.positions[key] % len(candidates)
+	r.positions[key] = position + 1
+	return position
+}
+
+// placementCandidates - volume groups of NexentaStor(s) matching configName and zone, sorted by config name
+// and volumeGroups parameter order, volume groups missing on a NexentaStor are skipped
+func (s *ControllerServer) placementCandidates(params ResolveNSParams, placement volumePlacement) (
+	[]placementCandidate,
+	error,
+) {
+	if params.configName != "" && params.zone != "" && s.config.NsMap[params.configName].Zone != params.zone {
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			"requested zone [%s] does not match requested NexentaStor name [%s]",
+			params.zone,
+			params.configName,
+		)
+	}
+
+	volumeGroups := placement.volumeGroups
+	if len(volumeGroups) == 0 {
+		volumeGroups = []string{params.volumeGroup}
+	}
+	if placement.policy == placementPinned {
+		volumeGroups = volumeGroups[:1]
+	}
+
+	candidates := []placementCandidate{}
+	var errors []string
+	for _, name := range s.configNames() {
+		if (params.configName != "" && name != params.configName) ||
+			(params.zone != "" && s.config.NsMap[name].Zone != params.zone) {
+			continue
+		}
+		for _, volumeGroup := range volumeGroups {
+			resolved, err := s.resolveNS(ResolveNSParams{volumeGroup: volumeGroup, configName: name})
+			if status.Code(err) == codes.NotFound {
+				continue
+			} else if err != nil {
+				errors = append(errors, err.Error())
+				continue
+			}
+			vg, err := getVolumeGroup(resolved.nsProvider, resolved.volumeGroup)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf(
+					"cannot get volume group '%s' of NexentaStor '%s': %s", resolved.volumeGroup, name, err))
+				continue
+			}
+			candidates = append(candidates, placementCandidate{
+				ResolveNSResponse: resolved,
+				bytesAvailable:    vg.BytesAvailable,
+			})
+		}
+	}
+
+	if len(candidates) == 0 {
+		if len(errors) != 0 {
+			return nil, status.Errorf(codes.Internal, "Cannot place volume: %s", strings.Join(errors, "; "))
+		}
+		return nil, status.Errorf(
+			codes.NotFound,
+			"No NexentaStor has volume group(s) %v for params: %+v",
+			volumeGroups,
+			params,
+		)
+	}
+	if len(errors) != 0 {
+		s.log.WithField("func", "placementCandidates()").Warnf(
+			"some NexentaStor(s) are not considered for placement: %s", strings.Join(errors, "; "))
+	}
+	return candidates, nil
+}
+
+// placeVolume - chooses NexentaStor and volume group of a new volume by the placement policy,
+// volume with the same name found on one of the candidates is chosen to keep CreateVolume idempotent
+func (s *ControllerServer) placeVolume(volumeName string, params ResolveNSParams, placement volumePlacement) (
+	decision placementDecision,
+	err error,
+) {
+	l := s.log.WithField("func", "placeVolume()")
+
+	candidates, err := s.placementCandidates(params, placement)
+	if err != nil {
+		return decision, err
+	}
+	decision.policy = placement.policy
+
+	if len(candidates) > 1 {
+		for _, candidate := range candidates {
+			volumePath := filepath.Join(candidate.volumeGroup, volumeName)
+			_, err := getVolumeStatus(candidate.nsProvider, volumePath)
+			if err == nil {
+				decision.candidate = candidate
+				decision.reason = "volume already exists"
+				l.Infof("volume '%s' is placed on [%s]: %s", volumeName, candidate, decision.reason)
+				return decision, nil
+			} else if !ns.IsNotExistNefError(err) {
+				return decision, status.Errorf(
+					codes.Internal, "Cannot check volume '%s' on NexentaStor '%s': %s", volumePath, candidate.configName, err)
+			}
+		}
+	}
+
+	switch placement.policy {
+	case placementMostFreeSpace:
+		chosen := 0
+		for i, candidate := range candidates {
+			if candidate.bytesAvailable > candidates[chosen].bytesAvailable {
+				chosen = i
+			}
+		}
+		decision.candidate = candidates[chosen]
+		decision.reason = fmt.Sprintf("%d bytes available", decision.candidate.bytesAvailable)
+	case placementRoundRobin:
+		position := s.roundRobin.next(candidates)
+		decision.candidate = candidates[position]
+		decision.reason = fmt.Sprintf("candidate %d of %d", position+1, len(candidates))
+	case placementWeighted:
+		chosen := -1
+		maxScore := 0.0
+		for i, candidate := range candidates {
+			weight := placement.weight(candidate)
+			if weight == 0 {
+				continue
+			}
+			if score := weightedScore(volumeName, candidate, weight); chosen == -1 || score > maxScore {
+				chosen = i
+				maxScore = score
+			}
+		}
+		if chosen == -1 {
+			return decision, status.Errorf(
+				codes.InvalidArgument, "All placement candidates %v have zero weight", candidates)
+		}
+		decision.candidate = candidates[chosen]
+		decision.reason = fmt.Sprintf("weight %d", placement.weight(decision.candidate))
+	case placementPinned:
+		decision.candidate = candidates[0]
+		decision.reason = "pinned by StorageClass"
+	}
+
+	l.Infof(
+		"volume '%s' is placed on [%s] by %s policy (%s), candidates: %v",
+		volumeName,
+		decision.candidate,
+		decision.policy,
+		decision.reason,
+		candidates,
+	)
+	return decision, nil
+}
+
+// weightedScore - weighted rendezvous hashing score of the candidate for the volume, the candidate with
+// the highest score gets the volume, so volumes are spread proportionally to the weights
+func weightedScore(volumeName string, candidate placementCandidate, weight int64) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(volumeName + "/" + candidate.String()))
+	// uniform value in (0, 1)
+	u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+	return -float64(weight) / math.Log(u)
+}
@@ -0,0 +1,320 @@
+package driver
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/arrays"
+)
+
+// StorageClass parameters of ZFS volume properties
+const (
+	paramCompression    = "compression"
+	paramChecksum       = "checksum"
+	paramDedup          = "dedup"
+	paramVolBlockSize   = "volblocksize"
+	paramLogBias        = "logbias"
+	paramSync           = "sync"
+	paramCopies         = "copies"
+	paramPrimaryCache   = "primarycache"
+	paramSecondaryCache = "secondarycache"
+
+	// parameters with this prefix are set as ZFS user properties as is, e.g. "user:team"
+	paramUserPropertyPrefix = "user:"
+
+	// refreservation of existing volume: size, "auto" to reserve the whole volume or "none"
+	paramRefReservation = "refreservation"
+
+	paramSparseVolume = "sparseVolume"
+)
+
+// refreservation special values
+const (
+	refReservationAuto = "auto"
+	refReservationNone = "none"
+)
+
+// mutableVolumeParams - parameters ControllerModifyVolume can change, besides user properties
+var mutableVolumeParams = []string{
+	paramCompression,
+	paramChecksum,
+	paramDedup,
+	paramLogBias,
+	paramSync,
+	paramCopies,
+	paramPrimaryCache,
+	paramSecondaryCache,
+	paramRefReservation,
+	paramSnapshotSchedule,
+	paramTrashRetention,
+	paramTrashVolumeGroup,
+}
+
+// immutableVolumeParams - parameters which are set on volume creation only, with the reason
+var immutableVolumeParams = map[string]string{
+	paramVolBlockSize: "ZFS doesn't allow to change volblocksize of existing volume",
+	paramSparseVolume: "use 'refreservation' parameter to change reservation of existing volume",
+	paramEncryption:   "ZFS encryption can be set on volume creation only",
+	paramKeyFormat:    "ZFS encryption can be set on volume creation only",
+}
+
+// volblocksize limits, ZFS accepts powers of 2 only
+const (
+	minVolBlockSize = 512
+	maxVolBlockSize = 1024 * 1024
+)
+
+// ZFS user property limits
+const (
+	maxUserPropertyNameLength  = 256
+	maxUserPropertyValueLength = 8191
+)
+
+var regexpCompression = regexp.MustCompile("^(on|off|lzjb|gzip|gzip-[1-9]|zle|lz4)$")
+var regexpUserPropertyName = regexp.MustCompile("^[a-z0-9][a-z0-9:+._-]*$")
+
+// volumePropertyValues - allowed values of ZFS properties with fixed set of values
+var volumePropertyValues = map[string][]string{
+	paramChecksum: {"on", "off", "fletcher2", "fletcher4", "sha256", "noparity", "sha512", "skein", "edonr"},
+	paramDedup: {
+		"on", "off", "verify", "sha256", "sha256,verify", "sha512", "sha512,verify", "skein", "skein,verify",
+		"edonr,verify",
+	},
+	paramLogBias:        {"latency", "throughput"},
+	paramSync:           {"standard", "always", "disabled"},
+	paramCopies:         {"1", "2", "3"},
+	paramPrimaryCache:   {"all", "none", "metadata"},
+	paramSecondaryCache: {"all", "none", "metadata"},
+}
+
+// volumeProperties - ZFS properties set on volume creation, appliance defaults are used for empty values
+type volumeProperties struct {
+	VolumeBlockSize int64             `json:"volumeBlockSize,omitempty"`
+	CompressionMode string            `json:"compressionMode,omitempty"`
+	ChecksumMode    string            `json:"checksumMode,omitempty"`
+	DedupMode       string            `json:"dedupMode,omitempty"`
+	LogicalBias     string            `json:"logicalBias,omitempty"`
+	SyncMode        string            `json:"syncMode,omitempty"`
+	Copies          int               `json:"copies,omitempty"`
+	PrimaryCache    string            `json:"primaryCache,omitempty"`
+	SecondaryCache  string            `json:"secondaryCache,omitempty"`
+	UserProperties  map[string]string `json:"userProperties,omitempty"`
+}
+
+// parseVolumeProperties - validates and returns ZFS properties set in StorageClass parameters,
+// all invalid parameters are reported in one error
+func parseVolumeProperties(params map[string]string) (properties volumeProperties, err error) {
+	var errors []string
+
+	for _, name := range []string{
+		paramChecksum, paramDedup, paramLogBias, paramSync, paramCopies, paramPrimaryCache, paramSecondaryCache,
+	} {
+		value, ok := params[name]
+		if !ok {
+			continue
+		}
+		if !arrays.ContainsString(volumePropertyValues[name], value) {
+			errors = append(errors, fmt.Sprintf(
+				"parameter '%s' has invalid value: '%s', allowed values: %s",
+				name,
+				value,
+				strings.Join(volumePropertyValues[name], ", "),
+			))
+		}
+	}
+
+	if value, ok := params[paramCompression]; ok && !regexpCompression.MatchString(value) {
+		errors = append(errors, fmt.Sprintf(
+			"parameter '%s' has invalid value: '%s', allowed values: on, off, lzjb, gzip, gzip-[1-9], zle, lz4",
+			paramCompression,
+			value,
+		))
+	}
+
+	if value, ok := params[paramVolBlockSize]; ok {
+		blockSize, err := parseVolBlockSize(value)
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("parameter '%s' has invalid value: %s", paramVolBlockSize, err))
+		}
+		properties.VolumeBlockSize = blockSize
+	}
+
+	for name, value := range params {
+		if !strings.HasPrefix(name, paramUserPropertyPrefix) {
+			continue
+		}
+		if len(name) > maxUserPropertyNameLength || !regexpUserPropertyName.MatchString(name) {
+			errors = append(errors, fmt.Sprintf(
+				"user property '%s' has invalid name, it may contain lowercase letters, numbers and ':+._-' only, "+
+					"max length is %d",
+				name,
+				maxUserPropertyNameLength,
+			))
+		} else if len(value) > maxUserPropertyValueLength {
+			errors = append(errors, fmt.Sprintf(
+				"user property '%s' value is too long, max length is %d", name, maxUserPropertyValueLength))
+		}
+		if properties.UserProperties == nil {
+			properties.UserProperties = map[string]string{}
+		}
+		properties.UserProperties[name] = value
+	}
+
+	if value, ok := params[paramSnapshotSchedule]; ok {
+		schedule, err := parseSnapshotSchedule(value)
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("parameter '%s' has invalid value: %s", paramSnapshotSchedule, err))
+		} else {
+			if properties.UserProperties == nil {
+				properties.UserProperties = map[string]string{}
+			}
+			properties.UserProperties[snapshotScheduleProperty] = schedule.String()
+		}
+	}
+
+	if value, ok := params[paramOvercommitRatio]; ok {
+		if _, err := parseOvercommitRatio(value); err != nil {
+			errors = append(errors, fmt.Sprintf("parameter '%s' has invalid value: %s", paramOvercommitRatio, err))
+		} else {
+			if properties.UserProperties == nil {
+				properties.UserProperties = map[string]string{}
+			}
+			properties.UserProperties[overcommitRatioProperty] = value
+		}
+	}
+
+	errors = append(errors, setTrashProperties(params, &properties)...)
+
+	if len(errors) != 0 {
+		sort.Strings(errors)
+		return properties, fmt.Errorf("Invalid volume properties: %s", strings.Join(errors, "; "))
+	}
+
+	properties.CompressionMode = params[paramCompression]
+	properties.ChecksumMode = params[paramChecksum]
+	properties.DedupMode = params[paramDedup]
+	properties.LogicalBias = params[paramLogBias]
+	properties.SyncMode = params[paramSync]
+	properties.PrimaryCache = params[paramPrimaryCache]
+	properties.SecondaryCache = params[paramSecondaryCache]
+	if value, ok := params[paramCopies]; ok {
+		properties.Copies, _ = strconv.Atoi(value)
+	}
+	return properties, nil
+}
+
+// parseSize - parses size in bytes or with binary K/M/G/T suffix: "8192", "8K", "128k", "1M", "10Gi"
+func parseSize(value string) (int64, error) {
+	number := value
+	multiplier := int64(1)
+	if unit := strings.TrimSuffix(number, "i"); len(unit) != 0 {
+		if i := strings.IndexByte("KMGT", strings.ToUpper(unit[len(unit)-1:])[0]); i != -1 {
+			multiplier = int64(1) << (10 * (i + 1))
+			number = unit[:len(unit)-1]
+		}
+	}
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("'%s', should be a size in bytes or with K/M/G/T suffix", value)
+	}
+	if size > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("'%s', should be at most %d bytes", value, int64(math.MaxInt64))
+	}
+	return size * multiplier, nil
+}
+
+// parseVolBlockSize - parses block size in bytes or with K/M suffix: "8192", "8K", "128k", "1M"
+func parseVolBlockSize(value string) (int64, error) {
+	size, err := parseSize(value)
+	if err != nil {
+		return 0, err
+	}
+	if size < minVolBlockSize || size > maxVolBlockSize || size&(size-1) != 0 {
+		return 0, fmt.Errorf(
+			"'%s', should be a power of 2 from %d to %d bytes", value, minVolBlockSize, maxVolBlockSize)
+	}
+	return size, nil
+}
+
+// withoutBlockSize - properties which can be set on a clone, clones inherit volblocksize of the origin
+func (p volumeProperties) withoutBlockSize() volumeProperties {
+	p.VolumeBlockSize = 0
+	return p
+}
+
+// volumeUpdate - NEF request to change properties of existing volume
+type volumeUpdate struct {
+	volumeProperties
+	ReferencedReservationSize *int64 `json:"referencedReservationSize,omitempty"`
+
+	// reserveVolumeSize - refreservation is "auto", volume size must be set as ReferencedReservationSize
+	reserveVolumeSize bool
+}
+
+// parseVolumeUpdate - validates and returns ZFS properties set in VolumeAttributesClass parameters,
+// unknown and immutable parameters are rejected
+func parseVolumeUpdate(params map[string]string) (update volumeUpdate, err error) {
+	var errors []string
+	for name := range params {
+		if reason, ok := immutableVolumeParams[name]; ok {
+			errors = append(errors, fmt.Sprintf("parameter '%s' cannot be changed: %s", name, reason))
+			continue
+		}
+		if !strings.HasPrefix(name, paramUserPropertyPrefix) && !arrays.ContainsString(mutableVolumeParams, name) {
+			errors = append(errors, fmt.Sprintf(
+				"parameter '%s' is not supported, supported parameters: %s, %s*",
+				name,
+				strings.Join(mutableVolumeParams, ", "),
+				paramUserPropertyPrefix,
+			))
+		}
+	}
+
+	if value, ok := params[paramRefReservation]; ok {
+		switch value {
+		case refReservationAuto:
+			update.reserveVolumeSize = true
+		case refReservationNone:
+			update.ReferencedReservationSize = new(int64)
+		default:
+			size, err := parseSize(value)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf(
+					"parameter '%s' has invalid value: %s, '%s' or '%s'",
+					paramRefReservation,
+					err,
+					refReservationAuto,
+					refReservationNone,
+				))
+			}
+			update.ReferencedReservationSize = &size
+		}
+	}
+
+	if len(errors) != 0 {
+		sort.Strings(errors)
+		return update, fmt.Errorf("Invalid volume parameters: %s", strings.Join(errors, "; "))
+	}
+
+	update.volumeProperties, err = parseVolumeProperties(params)
+	return update, err
+}
+
+// setVolumeSize - sets "auto" refreservation to the volume size, refreservation can't be greater than the volume
+func (u *volumeUpdate) setVolumeSize(volumeSize int64) error {
+	if u.reserveVolumeSize {
+		u.ReferencedReservationSize = &volumeSize
+	} else if u.ReferencedReservationSize != nil && *u.ReferencedReservationSize > volumeSize {
+		return fmt.Errorf(
+			"Invalid volume parameters: parameter '%s' is greater than volume size: %d > %d",
+			paramRefReservation,
+			*u.ReferencedReservationSize,
+			volumeSize,
+		)
+	}
+	return nil
+}
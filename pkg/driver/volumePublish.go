@@ -0,0 +1,60 @@
+package driver
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+)
+
+// publishedNodePropertyPrefix - ZFS user properties with IDs of nodes the volume is published to,
+// each node has its own property, so concurrent requests for different nodes don't overwrite each other.
+// NEF can't remove user properties, unpublished node has an empty value.
+const publishedNodePropertyPrefix = "user:csi.nexenta.com:published-node-"
+
+// publishedNodeProperty - name of the node property, node ID is hashed: ZFS property names allow lowercase
+// letters, digits and ":-._" only
+func publishedNodeProperty(nodeID string) string {
+	hash := fnv.New64a()
+	hash.Write([]byte(nodeID))
+	return fmt.Sprintf("%s%016x", publishedNodePropertyPrefix, hash.Sum64())
+}
+
+// setVolumePublishedNode - keeps the node ID in the volume user property while the volume is published to the node
+func setVolumePublishedNode(nsProvider ns.ProviderInterface, volumePath, nodeID string, published bool) error {
+	value := ""
+	if published {
+		value = nodeID
+	}
+	return updateVolume(nsProvider, volumePath, volumeProperties{
+		UserProperties: map[string]string{publishedNodeProperty(nodeID): value},
+	})
+}
+
+// clearVolumePublishedNodes - empties properties of all nodes the volume is published to
+func clearVolumePublishedNodes(nsProvider ns.ProviderInterface, volume nefVolume) error {
+	userProperties := map[string]string{}
+	for name, value := range volume.UserProperties {
+		if strings.HasPrefix(name, publishedNodePropertyPrefix) && value != "" {
+			userProperties[name] = ""
+		}
+	}
+	if len(userProperties) == 0 {
+		return nil
+	}
+	return updateVolume(nsProvider, volume.Path, volumeProperties{UserProperties: userProperties})
+}
+
+// getPublishedNodes - returns sorted IDs of nodes the volume is published to
+func getPublishedNodes(volume nefVolume) []string {
+	nodes := []string{}
+	for name, value := range volume.UserProperties {
+		if strings.HasPrefix(name, publishedNodePropertyPrefix) && value != "" {
+			nodes = append(nodes, value)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
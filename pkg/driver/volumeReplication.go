@@ -0,0 +1,458 @@
+package driver
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/csiid"
+)
+
+// StorageClass and VolumeReplicationClass parameters of asynchronous volume replication
+const (
+	// paramReplicationTarget - config name (nexentastor_map key) of the peer NexentaStor to replicate volumes to
+	paramReplicationTarget = "replicationTarget"
+
+	// paramReplicationVolumeGroup - volume group of replicated volumes on the peer, its defaultVolumeGroup if not set
+	paramReplicationVolumeGroup = "replicationVolumeGroup"
+
+	// paramReplicationInterval - how often volume snapshots are sent to the peer, e.g. "5m"
+	paramReplicationInterval = "replicationInterval"
+)
+
+// volumeReplicationServicePrefix - name prefix of NEF replication services sending volumes to the peer,
+// the service is named after the volume, replicated volume has the same name on the peer,
+// so the service of either direction is found by the volume name
+const volumeReplicationServicePrefix = "csi-replication-"
+
+// volumeReplicationProperty - ZFS user property with replication parameters of the volume,
+// GetVolumeReplicationInfo requests don't carry VolumeReplicationClass parameters
+const volumeReplicationProperty = "user:csi.nexenta.com:replication"
+
+// defaultReplicationInterval - replication interval if StorageClass doesn't set it
+const defaultReplicationInterval = 5 * time.Minute
+
+// minReplicationInterval - each run takes a snapshot, more frequent runs would flood the volume with snapshots
+const minReplicationInterval = time.Minute
+
+// volumeReplication - peer NexentaStor and schedule of the volume replication
+type volumeReplication struct {
+	target      string
+	volumeGroup string
+	interval    time.Duration
+}
+
+// enabled - replication target is set
+func (r volumeReplication) enabled() bool {
+	return r.target != ""
+}
+
+// parseVolumeReplication - parses replication parameters, replication is disabled if there are none
+func parseVolumeReplication(params map[string]string) (replication volumeReplication, err error) {
+	replication = volumeReplication{
+		target:      params[paramReplicationTarget],
+		volumeGroup: params[paramReplicationVolumeGroup],
+		interval:    defaultReplicationInterval,
+	}
+	if v, ok := params[paramReplicationInterval]; ok {
+		replication.interval, err = time.ParseDuration(v)
+		if err != nil || replication.interval < minReplicationInterval {
+			return replication, fmt.Errorf(
+				"Invalid %s parameter '%s', should be a duration of %s or more",
+				paramReplicationInterval,
+				v,
+				minReplicationInterval,
+			)
+		}
+	}
+	if replication.target == "" && (replication.volumeGroup != "" || params[paramReplicationInterval] != "") {
+		return replication, fmt.Errorf(
+			"%s parameter must be set to replicate volumes, got: %+v", paramReplicationTarget, params)
+	}
+	return replication, nil
+}
+
+// String - replication parameters in "parameter=value,..." format, volumeReplicationProperty value
+func (r volumeReplication) String() string {
+	params := []string{fmt.Sprintf("%s=%s", paramReplicationTarget, r.target)}
+	if r.volumeGroup != "" {
+		params = append(params, fmt.Sprintf("%s=%s", paramReplicationVolumeGroup, r.volumeGroup))
+	}
+	params = append(params, fmt.Sprintf("%s=%s", paramReplicationInterval, r.interval))
+	return strings.Join(params, ",")
+}
+
+// parseVolumeReplicationProperty - parses volumeReplicationProperty value
+func parseVolumeReplicationProperty(value string) (volumeReplication, error) {
+	params := map[string]string{}
+	for _, param := range strings.Split(value, ",") {
+		name, v, ok := strings.Cut(param, "=")
+		if !ok {
+			return volumeReplication{}, fmt.Errorf("'%s', should be in '<parameter>=<value>,...' format", param)
+		}
+		params[name] = v
+	}
+	return parseVolumeReplication(params)
+}
+
+// replicatedVolume - volume and the location of its replica on the peer NexentaStor
+type replicatedVolume struct {
+	volumePath  string
+	peerPath    string
+	serviceName string
+	local       ResolveNSResponse
+	replication volumeReplication
+}
+
+// validateVolumeReplication - checks that the replication target is another NexentaStor from the config
+func (s *ControllerServer) validateVolumeReplication(replication volumeReplication, configName string) error {
+	if _, ok := s.config.NsMap[replication.target]; !ok {
+		return status.Errorf(
+			codes.InvalidArgument, "Replication target '%s' is not in the config", replication.target)
+	}
+	if replication.target == configName {
+		return status.Errorf(
+			codes.InvalidArgument, "Volumes of NexentaStor '%s' cannot be replicated to itself", configName)
+	}
+	return nil
+}
+
+// resolveReplicatedVolume - resolves NexentaStor of the existing volume and the path of its replica
+func (s *ControllerServer) resolveReplicatedVolume(id csiid.VolumeID, replication volumeReplication) (
+	v replicatedVolume, err error,
+) {
+	if !replication.enabled() {
+		return v, status.Errorf(codes.InvalidArgument, "%s parameter must be provided", paramReplicationTarget)
+	}
+	if err := s.validateVolumeReplication(replication, id.ConfigName); err != nil {
+		return v, err
+	}
+	local, err := s.resolveNS(ResolveNSParams{volumeGroup: id.VolumeGroup, configName: id.ConfigName})
+	if err != nil {
+		return v, err
+	}
+	_, err = getVolumeStatus(local.nsProvider, id.Path())
+	if ns.IsNotExistNefError(err) {
+		return v, status.Errorf(codes.NotFound, "Volume '%s' not found on %s", id.Path(), local.nsProvider)
+	} else if err != nil {
+		return v, status.Errorf(codes.Internal, "Cannot get volume '%s': %s", id.Path(), err)
+	}
+
+	peerVolumeGroup := replication.volumeGroup
+	if peerVolumeGroup == "" {
+		peerVolumeGroup = s.config.NsMap[replication.target].DefaultVolumeGroup
+	}
+	volumeName := path.Base(id.Path())
+	return replicatedVolume{
+		volumePath:  id.Path(),
+		peerPath:    path.Join(peerVolumeGroup, volumeName),
+		serviceName: volumeReplicationServicePrefix + volumeName,
+		local:       local,
+		replication: replication,
+	}, nil
+}
+
+// resolveReplicatedVolumeByProperty - resolves the volume using replication parameters kept in its user property
+func (s *ControllerServer) resolveReplicatedVolumeByProperty(id csiid.VolumeID) (replicatedVolume, error) {
+	local, err := s.resolveNS(ResolveNSParams{volumeGroup: id.VolumeGroup, configName: id.ConfigName})
+	if err != nil {
+		return replicatedVolume{}, err
+	}
+	volume, err := getVolumeStatus(local.nsProvider, id.Path())
+	if ns.IsNotExistNefError(err) {
+		return replicatedVolume{}, status.Errorf(
+			codes.NotFound, "Volume '%s' not found on %s", id.Path(), local.nsProvider)
+	} else if err != nil {
+		return replicatedVolume{}, status.Errorf(codes.Internal, "Cannot get volume '%s': %s", id.Path(), err)
+	}
+	value, ok := volume.UserProperties[volumeReplicationProperty]
+	if !ok {
+		return replicatedVolume{}, status.Errorf(
+			codes.FailedPrecondition, "Replication of volume '%s' is not enabled", id.Path())
+	}
+	replication, err := parseVolumeReplicationProperty(value)
+	if err != nil {
+		return replicatedVolume{}, status.Errorf(
+			codes.Internal, "Volume '%s' has invalid replication property: %s", id.Path(), err)
+	}
+	return s.resolveReplicatedVolume(id, replication)
+}
+
+// resolveReplicationPeer - resolves the peer NexentaStor, it's Unavailable if the peer site is down
+func (s *ControllerServer) resolveReplicationPeer(v replicatedVolume) (ResolveNSResponse, error) {
+	peer, err := s.resolveNS(ResolveNSParams{
+		volumeGroup: path.Dir(v.peerPath),
+		configName:  v.replication.target,
+	})
+	if err != nil {
+		return peer, status.Errorf(
+			codes.Unavailable, "Replication target '%s' is unavailable: %s", v.replication.target, err)
+	}
+	return peer, nil
+}
+
+// getVolumeReplicationService - returns the replication service of the volume sending source to destination,
+// false if the appliance has no such service
+func getVolumeReplicationService(nsProvider ns.ProviderInterface, name, source, destination string) (
+	service nefReplicationService, found bool, err error,
+) {
+	service, err = getReplicationService(nsProvider, name)
+	if ns.IsNotExistNefError(err) {
+		return service, false, nil
+	} else if err != nil {
+		return service, false, status.Errorf(
+			codes.Internal, "Cannot get replication service '%s' on %s: %s", name, nsProvider, err)
+	}
+	return service, service.SourceDataset == source && service.DestinationDataset == destination, nil
+}
+
+// primaryService - returns the service sending the volume to the peer, false if the volume isn't primary
+func (v replicatedVolume) primaryService() (nefReplicationService, bool, error) {
+	return getVolumeReplicationService(v.local.nsProvider, v.serviceName, v.volumePath, v.peerPath)
+}
+
+// secondaryService - returns the peer service sending its volume to this one, false if the volume isn't secondary
+func (v replicatedVolume) secondaryService(peer ResolveNSResponse) (nefReplicationService, bool, error) {
+	return getVolumeReplicationService(peer.nsProvider, v.serviceName, v.peerPath, v.volumePath)
+}
+
+// enableVolumeReplication - makes the volume primary unless it's replicated already in either direction
+func (s *ControllerServer) enableVolumeReplication(v replicatedVolume) error {
+	l := s.log.WithField("func", "enableVolumeReplication()")
+
+	if _, primary, err := v.primaryService(); err != nil {
+		return err
+	} else if primary {
+		// the service has been created by previous request which has failed to enable it
+		return s.startVolumeReplication(v, nil)
+	}
+	peer, err := s.resolveReplicationPeer(v)
+	if err != nil {
+		return err
+	}
+	if _, secondary, err := v.secondaryService(peer); err != nil {
+		return err
+	} else if secondary {
+		l.Infof("volume '%s' is a replica of '%s' on %s", v.volumePath, v.peerPath, peer.nsProvider)
+		return setVolumeReplicationProperty(v)
+	}
+	return s.startVolumeReplication(v, peer.nsProvider)
+}
+
+// disableVolumeReplication - stops sending the volume to the peer, replica and its snapshots are kept
+func (s *ControllerServer) disableVolumeReplication(v replicatedVolume) error {
+	l := s.log.WithField("func", "disableVolumeReplication()")
+
+	if _, primary, err := v.primaryService(); err != nil || !primary {
+		return err
+	}
+	err := destroyReplicationService(v.local.nsProvider, v.serviceName)
+	if err != nil && !ns.IsNotExistNefError(err) {
+		return status.Errorf(
+			codes.Internal, "Cannot destroy replication service '%s' on %s: %s", v.serviceName, v.local.nsProvider, err)
+	}
+	l.Infof("replication of volume '%s' to %s has been disabled", v.volumePath, v.replication.target)
+	return nil
+}
+
+// promoteVolume - makes the volume primary: the peer service sending its volume here is destroyed
+// and the volume is sent in the reverse direction, force promotes the volume if the peer is unavailable
+func (s *ControllerServer) promoteVolume(v replicatedVolume, force bool) error {
+	l := s.log.WithField("func", "promoteVolume()")
+
+	if _, primary, err := v.primaryService(); err != nil {
+		return err
+	} else if primary {
+		return s.startVolumeReplication(v, nil)
+	}
+
+	var remote ns.ProviderInterface
+	peer, err := s.resolveReplicationPeer(v)
+	if err != nil {
+		if !force {
+			return err
+		}
+		// the peer site is down, its service keeps failing after it's back until the volume there is demoted
+		l.Warnf("volume '%s' is promoted without demoting its peer: %s", v.volumePath, err)
+		resolver := s.nsResolverMap[v.replication.target]
+		if len(resolver.Nodes) == 0 {
+			return status.Errorf(
+				codes.Internal, "Replication target '%s' has no NexentaStor nodes", v.replication.target)
+		}
+		remote = resolver.Nodes[0]
+	} else {
+		remote = peer.nsProvider
+		if _, secondary, err := v.secondaryService(peer); err != nil {
+			return err
+		} else if secondary {
+			err := destroyReplicationService(peer.nsProvider, v.serviceName)
+			if err != nil && !ns.IsNotExistNefError(err) {
+				return status.Errorf(
+					codes.Internal,
+					"Cannot destroy replication service '%s' on %s: %s",
+					v.serviceName,
+					peer.nsProvider,
+					err,
+				)
+			}
+		}
+	}
+
+	if err := s.startVolumeReplication(v, remote); err != nil {
+		return err
+	}
+	l.Infof("volume '%s' has been promoted", v.volumePath)
+	return nil
+}
+
+// demoteVolume - stops sending the volume to the peer, it becomes secondary once the peer volume is promoted
+func (s *ControllerServer) demoteVolume(v replicatedVolume) error {
+	return s.disableVolumeReplication(v)
+}
+
+// resyncVolume - restarts failed replication to the secondary volume, the volume is rolled back to the latest
+// snapshot it has in common with the primary one, returns true once the volume is in sync
+func (s *ControllerServer) resyncVolume(v replicatedVolume) (ready bool, err error) {
+	l := s.log.WithField("func", "resyncVolume()")
+
+	peer, err := s.resolveReplicationPeer(v)
+	if err != nil {
+		return false, err
+	}
+	service, secondary, err := v.secondaryService(peer)
+	if err != nil {
+		return false, err
+	} else if !secondary {
+		return false, status.Errorf(
+			codes.FailedPrecondition,
+			"Volume '%s' is not a replica of '%s' on %s, promote the peer volume first",
+			v.volumePath,
+			v.peerPath,
+			peer.nsProvider,
+		)
+	}
+
+	switch {
+	case service.State == nefReplicationStateRunning:
+		return false, nil
+	case service.State == nefReplicationStateIdle && service.LastError == "" && service.LastSnapshot != "":
+		return true, nil
+	}
+	l.Infof("restarting replication service '%s' on %s: %s", v.serviceName, peer.nsProvider, service.LastError)
+	if err := startReplicationService(peer.nsProvider, v.serviceName); err != nil && !ns.IsBusyNefError(err) {
+		return false, status.Errorf(
+			codes.Internal, "Cannot start replication service '%s' on %s: %s", v.serviceName, peer.nsProvider, err)
+	}
+	return false, nil
+}
+
+// getVolumeLastSyncTime - returns the time of the last snapshot sent to the secondary volume,
+// nil if no snapshot has been sent yet
+func (s *ControllerServer) getVolumeLastSyncTime(v replicatedVolume) (*time.Time, error) {
+	service, primary, err := v.primaryService()
+	if err != nil {
+		return nil, err
+	} else if primary {
+		return service.LastSyncTime, nil
+	}
+	peer, err := s.resolveReplicationPeer(v)
+	if err != nil {
+		return nil, err
+	}
+	service, secondary, err := v.secondaryService(peer)
+	if err != nil {
+		return nil, err
+	} else if !secondary {
+		return nil, status.Errorf(codes.FailedPrecondition, "Replication of volume '%s' is not enabled", v.volumePath)
+	}
+	return service.LastSyncTime, nil
+}
+
+// startVolumeReplication - creates NEF replication service sending the volume to the remote NexentaStor
+// and enables its scheduled runs, the service is only enabled if remote is nil, it exists then
+func (s *ControllerServer) startVolumeReplication(v replicatedVolume, remote ns.ProviderInterface) error {
+	l := s.log.WithField("func", "startVolumeReplication()")
+
+	if remote != nil {
+		remoteNode, err := getRemoteNode(remote)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		err = createReplicationService(v.local.nsProvider, nefReplicationService{
+			Name:               v.serviceName,
+			SourceDataset:      v.volumePath,
+			DestinationDataset: v.peerPath,
+			RemoteNode:         remoteNode,
+			Interval:           int(v.replication.interval.Seconds()),
+		})
+		if ns.IsAlreadyExistNefError(err) {
+			// services of existing volumes are found by primaryService(), this one replicates another volume
+			return status.Errorf(
+				codes.AlreadyExists,
+				"Replication service '%s' on %s replicates another volume",
+				v.serviceName,
+				v.local.nsProvider,
+			)
+		} else if err != nil {
+			return status.Errorf(
+				codes.Internal,
+				"Cannot create replication service '%s' on %s: %s",
+				v.serviceName,
+				v.local.nsProvider,
+				err,
+			)
+		}
+	}
+	if err := enableReplicationService(v.local.nsProvider, v.serviceName); err != nil {
+		return status.Errorf(
+			codes.Internal, "Cannot enable replication service '%s' on %s: %s", v.serviceName, v.local.nsProvider, err)
+	}
+	if err := setVolumeReplicationProperty(v); err != nil {
+		return err
+	}
+
+	l.Infof(
+		"volume '%s' is replicated to '%s' on '%s' every %s",
+		v.volumePath,
+		v.peerPath,
+		v.replication.target,
+		v.replication.interval,
+	)
+	return nil
+}
+
+// setVolumeReplicationProperty - keeps replication parameters in the volume user property
+func setVolumeReplicationProperty(v replicatedVolume) error {
+	err := updateVolume(v.local.nsProvider, v.volumePath, volumeProperties{
+		UserProperties: map[string]string{volumeReplicationProperty: v.replication.String()},
+	})
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot set replication property of volume '%s': %s", v.volumePath, err)
+	}
+	return nil
+}
+
+// destroyVolumeReplicationService - destroys the service sending deleted volume to the peer,
+// the replica is kept on the peer as the disaster recovery copy
+func destroyVolumeReplicationService(nsProvider ns.ProviderInterface, volumePath string) error {
+	name := volumeReplicationServicePrefix + path.Base(volumePath)
+	service, err := getReplicationService(nsProvider, name)
+	if ns.IsNotExistNefError(err) {
+		return nil
+	} else if err != nil {
+		return status.Errorf(codes.Internal, "Cannot get replication service '%s' on %s: %s", name, nsProvider, err)
+	}
+	if service.SourceDataset != volumePath {
+		return nil
+	}
+	err = destroyReplicationService(nsProvider, name)
+	if err != nil && !ns.IsNotExistNefError(err) {
+		return status.Errorf(codes.Internal, "Cannot destroy replication service '%s' on %s: %s", name, nsProvider, err)
+	}
+	return nil
+}
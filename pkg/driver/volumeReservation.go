@@ -0,0 +1,128 @@
+package driver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+)
+
+// paramOvercommitRatio - StorageClass parameter overriding overcommitRatio of the NexentaStor config:
+// how many times the sum of volume sizes in the pool may exceed its available bytes, "0" means no limit
+const paramOvercommitRatio = "overcommitRatio"
+
+// overcommitRatioProperty - ZFS user property with the StorageClass overcommit ratio of the volume.
+// StorageClass parameters which limit expansion are kept in user properties of the volume on creation:
+// ControllerExpandVolume requests don't carry StorageClass parameters.
+const overcommitRatioProperty = "user:csi.nexenta.com:overcommit-ratio"
+
+// parseOvercommitRatio - parses overcommit ratio, it's a non-negative number
+func parseOvercommitRatio(value string) (float64, error) {
+	ratio, err := strconv.ParseFloat(value, 64)
+	if err != nil || ratio < 0 {
+		return 0, fmt.Errorf("'%s', should be a non-negative number, e.g. '1.5'", value)
+	}
+	return ratio, nil
+}
+
+// volumeOvercommitRatio - overcommit ratio of the volume: StorageClass one kept in the user property
+// or overcommitRatio of the NexentaStor config
+func (s *ControllerServer) volumeOvercommitRatio(configName string, userProperties map[string]string) float64 {
+	if value, ok := userProperties[overcommitRatioProperty]; ok {
+		ratio, err := parseOvercommitRatio(value)
+		if err == nil {
+			return ratio
+		}
+		s.log.WithField("func", "volumeOvercommitRatio()").Warnf(
+			"invalid %s property, overcommitRatio of NexentaStor '%s' is used: %s",
+			overcommitRatioProperty,
+			configName,
+			err,
+		)
+	}
+	return s.config.NsMap[configName].OvercommitRatio
+}
+
+// checkOvercommit - fails with ResourceExhausted if the sum of logical sizes of the volumes of the pool would exceed
+// BytesAvailable of the pool multiplied by the ratio once volumePath volume has volumeSize bytes.
+// Volumes of all volume groups of the pool are counted. Written data and reservations of thick volumes are not
+// available any more, so the more of them the pool has, the less volume size fits the limit.
+// Every volume group of the pool is listed on each call, i.e. on each CreateVolume and ControllerExpandVolume
+// with a ratio. The listing is not cached: concurrent requests must see volumes created by each other.
+func checkOvercommit(
+	nsProvider ns.ProviderInterface, volumeGroup, volumePath string, volumeSize int64, ratio float64,
+) error {
+	if ratio == 0 {
+		return nil
+	}
+	// volume groups have no quota, so their available bytes are the ones of the pool
+	vg, err := getVolumeGroup(nsProvider, volumeGroup)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot get volume group '%s': %s", volumeGroup, err)
+	}
+	pool := strings.Split(volumeGroup, "/")[0]
+	volumeGroups, err := getVolumeGroups(nsProvider)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot get volume groups: %s", err)
+	}
+
+	logicalSize := volumeSize
+	for _, vgPath := range volumeGroups {
+		if !strings.HasPrefix(vgPath, pool+"/") {
+			continue
+		}
+		volumes, err := getVolumesWithStatus(nsProvider, vgPath)
+		if err != nil {
+			return status.Errorf(codes.Internal, "Cannot get volumes of volume group '%s': %s", vgPath, err)
+		}
+		for _, volume := range volumes {
+			if volume.Path != volumePath {
+				logicalSize += volume.VolumeSize
+			} else if volume.VolumeSize >= volumeSize {
+				// volume already has the size, e.g. retried request
+				return nil
+			}
+		}
+	}
+	limit := int64(float64(vg.BytesAvailable) * ratio)
+	if logicalSize > limit {
+		return status.Errorf(
+			codes.ResourceExhausted,
+			"Volume '%s' of %d bytes would overcommit pool '%s': volumes of the pool would have %d bytes, "+
+				"limit is %d bytes (overcommit ratio %g of %d bytes available)",
+			volumePath,
+			volumeSize,
+			pool,
+			logicalSize,
+			limit,
+			ratio,
+			vg.BytesAvailable,
+		)
+	}
+	return nil
+}
+
+// parseRefReservation - refreservation of a new volume set in StorageClass: "auto" reserves the whole volume,
+// size reserves a part of it, nil is returned if it's not set or "none"
+func parseRefReservation(params map[string]string, sparseVolume bool) (*volumeUpdate, error) {
+	value, ok := params[paramRefReservation]
+	if !ok || value == refReservationNone {
+		return nil, nil
+	}
+	update, err := parseVolumeUpdate(map[string]string{paramRefReservation: value})
+	if err != nil {
+		return nil, err
+	}
+	if !sparseVolume && !update.reserveVolumeSize {
+		return nil, fmt.Errorf(
+			"Invalid volume parameters: parameter '%s' must be '%s' for thick volumes (sparseVolume=false)",
+			paramRefReservation,
+			refReservationAuto,
+		)
+	}
+	return &update, nil
+}
@@ -0,0 +1,410 @@
+package driver
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/config"
+)
+
+// StorageClass and VolumeAttributesClass parameters of the trash
+const (
+	// paramTrashRetention - how long deleted volumes are kept in the trash, e.g. "72h" or "7d",
+	// volumes are destroyed right away if it's not set or "none"
+	paramTrashRetention = "trashRetention"
+
+	// paramTrashVolumeGroup - trash volume group in the pool of the volume, ZFS can't move volumes between pools
+	paramTrashVolumeGroup = "trashVolumeGroup"
+)
+
+// paramRestoreFromTrash - CreateVolume parameter with the ID of a trashed volume, which is moved back
+// as the new volume
+const paramRestoreFromTrash = "restoreFromTrash"
+
+// restoreFromTrashPVC - restoreFromTrash value to restore the latest trashed volume of the PVC with the same
+// namespace and name, one StorageClass restores volumes of any PVC this way
+const restoreFromTrashPVC = "pvc"
+
+// ZFS user properties of the trash, DeleteVolume requests don't carry StorageClass parameters,
+// empty values are the same as not set ones: NEF can't remove user properties
+const (
+	trashRetentionProperty   = "user:csi.nexenta.com:trash-retention"
+	trashVolumeGroupProperty = "user:csi.nexenta.com:trash-volume-group"
+
+	// trashedAtProperty - time the volume has been moved to the trash, it's purged once the retention passes
+	trashedAtProperty = "user:csi.nexenta.com:trashed-at"
+
+	// trashedFromProperty - path the volume had before it was moved to the trash
+	trashedFromProperty = "user:csi.nexenta.com:trashed-from"
+)
+
+// trashRetentionNone - retention of volumes which are destroyed without the trash
+const trashRetentionNone = "none"
+
+// defaultTrashVolumeGroup - trash volume group in the pool if the StorageClass doesn't set it
+const defaultTrashVolumeGroup = "csi-trash"
+
+// trashPurgeInterval - how often the controller destroys trashed volumes with expired retention
+const trashPurgeInterval = 10 * time.Minute
+
+var regexpTrashVolumeGroup = regexp.MustCompile(`^[a-zA-Z0-9_.-]+(/[a-zA-Z0-9_.-]+)*$`)
+
+// volumeTrash - trash settings of the volume, volumes without retention aren't trashed
+type volumeTrash struct {
+	retention   time.Duration
+	volumeGroup string
+}
+
+// enabled - volume is moved to the trash on deletion
+func (t volumeTrash) enabled() bool {
+	return t.retention > 0
+}
+
+// volumeGroupPath - path of the trash volume group in the pool of the volume
+func (t volumeTrash) volumeGroupPath(volumePath string) string {
+	return strings.Split(volumePath, "/")[0] + "/" + t.volumeGroup
+}
+
+// contains - volume is in the trash volume group, it's deleted permanently
+func (t volumeTrash) contains(volumePath string) bool {
+	return path.Dir(volumePath) == t.volumeGroupPath(volumePath)
+}
+
+// parseTrashRetention - parses retention as Go duration ("72h") or days ("7d"), "none" is no retention
+func parseTrashRetention(value string) (time.Duration, error) {
+	if value == trashRetentionNone {
+		return 0, nil
+	}
+	var retention time.Duration
+	var err error
+	if days := strings.TrimSuffix(value, "d"); days != value {
+		var n int
+		n, err = strconv.Atoi(days)
+		retention = time.Duration(n) * 24 * time.Hour
+	} else {
+		retention, err = time.ParseDuration(value)
+	}
+	if err != nil || retention <= 0 {
+		return 0, fmt.Errorf("'%s', should be a positive duration, e.g. '72h' or '7d', or '%s'", value, trashRetentionNone)
+	}
+	return retention, nil
+}
+
+// setTrashProperties - validates trash parameters and keeps them in the user properties of the volume,
+// returns errors of invalid parameters
+func setTrashProperties(params map[string]string, properties *volumeProperties) (errors []string) {
+	set := func(property, value string) {
+		if properties.UserProperties == nil {
+			properties.UserProperties = map[string]string{}
+		}
+		properties.UserProperties[property] = value
+	}
+	if value, ok := params[paramTrashRetention]; ok {
+		if _, err := parseTrashRetention(value); err != nil {
+			errors = append(errors, fmt.Sprintf("parameter '%s' has invalid value: %s", paramTrashRetention, err))
+		} else {
+			set(trashRetentionProperty, value)
+		}
+	}
+	if value, ok := params[paramTrashVolumeGroup]; ok {
+		if !regexpTrashVolumeGroup.MatchString(value) {
+			errors = append(errors, fmt.Sprintf(
+				"parameter '%s' has invalid value: '%s', should be a volume group path in the pool, e.g. '%s'",
+				paramTrashVolumeGroup,
+				value,
+				defaultTrashVolumeGroup,
+			))
+		} else {
+			set(trashVolumeGroupProperty, value)
+		}
+	}
+	return errors
+}
+
+// getVolumeTrash - trash settings kept in the user properties of the volume
+func getVolumeTrash(userProperties map[string]string) (trash volumeTrash, err error) {
+	if value := userProperties[trashRetentionProperty]; value != "" {
+		if trash.retention, err = parseTrashRetention(value); err != nil {
+			return trash, fmt.Errorf("invalid %s property: %s", trashRetentionProperty, err)
+		}
+	}
+	trash.volumeGroup = defaultTrashVolumeGroup
+	if value := userProperties[trashVolumeGroupProperty]; value != "" {
+		trash.volumeGroup = value
+	}
+	return trash, nil
+}
+
+// isTrashed - volume has been moved to the trash and waits to be purged
+func isTrashed(volume nefVolume) bool {
+	return volume.UserProperties[trashedAtProperty] != ""
+}
+
+// trashedVolumeName - name of the volume in the trash, the deletion time keeps names unique
+func trashedVolumeName(volumePath string, deletedAt time.Time) string {
+	return fmt.Sprintf("%s-deleted-%s", path.Base(volumePath), deletedAt.UTC().Format("20060102-150405"))
+}
+
+// moveVolumeToTrash - renames unmapped volume into the trash volume group, which is created if it doesn't exist,
+// the volume is marked before it's moved, so the purge finds it even if the rename fails
+func (s *ControllerServer) moveVolumeToTrash(
+	nsProvider ns.ProviderInterface, volumePath string, trash volumeTrash, now time.Time,
+) error {
+	l := s.log.WithField("func", "moveVolumeToTrash()")
+
+	// nested trash volume group is created with its parents
+	trashGroup := trash.volumeGroupPath(volumePath)
+	parts := strings.Split(trashGroup, "/")
+	for i := 2; i <= len(parts); i++ {
+		vgPath := strings.Join(parts[:i], "/")
+		err := createVolumeGroup(nsProvider, vgPath)
+		if err != nil && !ns.IsAlreadyExistNefError(err) {
+			return status.Errorf(codes.Internal, "Cannot create trash volume group '%s': %s", vgPath, err)
+		}
+	}
+
+	err := updateVolume(nsProvider, volumePath, map[string]interface{}{
+		"userProperties": map[string]string{
+			trashedAtProperty:   now.UTC().Format(time.RFC3339),
+			trashedFromProperty: volumePath,
+		},
+	})
+	if err != nil && !ns.IsNotExistNefError(err) {
+		return status.Errorf(codes.Internal, "Cannot mark volume '%s' as trashed: %s", volumePath, err)
+	}
+
+	trashedPath := path.Join(trashGroup, trashedVolumeName(volumePath, now))
+	err = renameVolume(nsProvider, volumePath, trashedPath)
+	if ns.IsNotExistNefError(err) {
+		// volume may be moved by previous request which response was lost
+		l.Infof("volume '%s' not found, that's OK for deletion request", volumePath)
+		return nil
+	} else if err != nil {
+		return status.Errorf(codes.Internal, "Cannot move volume '%s' to trash: %s", volumePath, err)
+	}
+
+	l.Infof(
+		"volume '%s' has been moved to trash as '%s', it will be purged after %s",
+		volumePath,
+		trashedPath,
+		now.Add(trash.retention).UTC().Format(time.RFC3339),
+	)
+	return nil
+}
+
+// restoreTrashedVolume - moves trashed volume back to the new volume path and sets StorageClass properties on it,
+// the encryption key of the volume is loaded using provisioner secrets if it's unloaded
+func (s *ControllerServer) restoreTrashedVolume(
+	nsProvider ns.ProviderInterface,
+	trashedPath string,
+	volumePath string,
+	properties volumeProperties,
+	encryption volumeEncryption,
+	secrets map[string]string,
+) error {
+	l := s.log.WithField("func", "restoreTrashedVolume()")
+
+	trashed, err := getVolumeStatus(nsProvider, trashedPath)
+	if ns.IsNotExistNefError(err) {
+		// volume may be moved by previous request which response was lost
+		existing, err := getVolumeStatus(nsProvider, volumePath)
+		if ns.IsNotExistNefError(err) {
+			return status.Errorf(codes.NotFound, "Trashed volume '%s' not found on %s", trashedPath, nsProvider)
+		} else if err != nil {
+			return status.Errorf(codes.Internal, "Cannot get volume '%s': %s", volumePath, err)
+		}
+		if !isTrashed(existing) {
+			l.Infof("volume '%s' already exists and can be used", volumePath)
+			return nil
+		}
+	} else if err != nil {
+		return status.Errorf(codes.Internal, "Cannot get trashed volume '%s': %s", trashedPath, err)
+	} else if !isTrashed(trashed) {
+		if trashedPath == volumePath {
+			l.Infof("volume '%s' already exists and can be used", volumePath)
+			return nil
+		}
+		return status.Errorf(codes.FailedPrecondition, "Volume '%s' is not in trash", trashedPath)
+	} else {
+		if err := s.loadSourceKey(nsProvider, trashedPath, encryption, secrets); err != nil {
+			return err
+		}
+		err = renameVolume(nsProvider, trashedPath, volumePath)
+		if ns.IsAlreadyExistNefError(err) {
+			return status.Errorf(codes.AlreadyExists, "Cannot restore volume '%s': %s", trashedPath, err)
+		} else if err != nil {
+			return status.Errorf(codes.Internal, "Cannot restore volume '%s': %s", trashedPath, err)
+		}
+	}
+
+	// the volume keeps trashedFromProperty, the purge skips volumes without trashedAtProperty
+	properties = properties.withoutBlockSize()
+	userProperties := map[string]string{trashedAtProperty: ""}
+	for name, value := range properties.UserProperties {
+		userProperties[name] = value
+	}
+	properties.UserProperties = userProperties
+	if err := updateVolume(nsProvider, volumePath, properties); err != nil {
+		return status.Errorf(codes.Internal, "Cannot set properties of restored volume '%s': %s", volumePath, err)
+	}
+
+	l.Infof("trashed volume '%s' has been restored as '%s'", trashedPath, volumePath)
+	return nil
+}
+
+// findTrashedPVCVolume - path of the latest trashed volume of the PVC in the trash volume group of the pool,
+// volumes are matched by PVC metadata kept with --extra-create-metadata,
+// the new volume path is returned if the volume has been restored by previous request which response was lost
+func (s *ControllerServer) findTrashedPVCVolume(
+	nsProvider ns.ProviderInterface, volumePath string, trash volumeTrash, params map[string]string,
+) (string, error) {
+	pvcName := params[paramPVCName]
+	pvcNamespace := params[paramPVCNamespace]
+	if pvcName == "" || pvcNamespace == "" {
+		return "", status.Errorf(
+			codes.InvalidArgument,
+			"Parameter '%s: %s' requires PVC metadata, run csi-provisioner with --extra-create-metadata",
+			paramRestoreFromTrash,
+			restoreFromTrashPVC,
+		)
+	}
+
+	existing, err := getVolumeStatus(nsProvider, volumePath)
+	if err == nil && !isTrashed(existing) {
+		return volumePath, nil
+	} else if err != nil && !ns.IsNotExistNefError(err) {
+		return "", status.Errorf(codes.Internal, "Cannot get volume '%s': %s", volumePath, err)
+	}
+
+	trashGroup := trash.volumeGroupPath(volumePath)
+	volumes, err := getVolumesWithStatus(nsProvider, trashGroup)
+	if err != nil && !ns.IsNotExistNefError(err) {
+		return "", status.Errorf(codes.Internal, "Cannot get volumes of '%s': %s", trashGroup, err)
+	}
+	trashedPath := ""
+	var latest time.Time
+	for _, volume := range volumes {
+		if !isTrashed(volume) ||
+			volume.UserProperties[pvcNameProperty] != pvcName ||
+			volume.UserProperties[pvcNamespaceProperty] != pvcNamespace {
+			continue
+		}
+		trashedAt, err := time.Parse(time.RFC3339, volume.UserProperties[trashedAtProperty])
+		if err != nil {
+			continue
+		}
+		if trashedPath == "" || trashedAt.After(latest) {
+			trashedPath = volume.Path
+			latest = trashedAt
+		}
+	}
+	if trashedPath == "" {
+		return "", status.Errorf(
+			codes.NotFound,
+			"Trashed volume of PVC '%s/%s' not found in '%s' on %s",
+			pvcNamespace,
+			pvcName,
+			trashGroup,
+			nsProvider,
+		)
+	}
+	return trashedPath, nil
+}
+
+// runTrashPurge - destroys trashed volumes with expired retention on the leader until the process exits
+func (s *ControllerServer) runTrashPurge(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		if !s.isLeader() {
+			continue
+		}
+		if err := s.PurgeTrash(now); err != nil {
+			s.log.WithField("func", "runTrashPurge()").Warn(err)
+		}
+	}
+}
+
+// PurgeTrash - destroys volumes which have been in the trash longer than their retention at the given time
+// with their snapshots, errors of single volumes don't stop it. The trash is purged by the elected leader only,
+// volumes are kept in the trash without leader election.
+func (s *ControllerServer) PurgeTrash(now time.Time) error {
+	l := s.log.WithField("func", "PurgeTrash()")
+
+	if !s.leaderElected() {
+		l.Warn("trash is purged by the controller elected with --leader-election only, trashed volumes are kept")
+		return nil
+	}
+
+	return s.withBackgroundNS(func(cfg *config.Config, nsResolverMap map[string]ns.Resolver) error {
+		var errors []string
+		for _, configName := range sortedConfigNames(cfg) {
+			resolver, ok := nsResolverMap[configName]
+			if !ok {
+				continue
+			}
+			// pools of HA cluster are imported on one of the nodes, each node lists its own volume groups
+			for _, nsProvider := range resolver.Nodes {
+				volumeGroups, err := getVolumeGroups(nsProvider)
+				if err != nil {
+					errors = append(errors, fmt.Sprintf("cannot get volume groups of %s: %s", nsProvider, err))
+					continue
+				}
+				for _, volumeGroup := range volumeGroups {
+					errors = append(errors, s.purgeVolumeGroupTrash(nsProvider, volumeGroup, now)...)
+				}
+			}
+		}
+
+		if len(errors) != 0 {
+			return fmt.Errorf("Trash purge failed: %s", strings.Join(errors, "; "))
+		}
+		return nil
+	})
+}
+
+// purgeVolumeGroupTrash - destroys trashed volumes of the volume group with expired retention,
+// returns errors of single volumes
+func (s *ControllerServer) purgeVolumeGroupTrash(
+	nsProvider ns.ProviderInterface, volumeGroup string, now time.Time,
+) (errors []string) {
+	l := s.log.WithField("func", "purgeVolumeGroupTrash()")
+
+	volumes, err := getVolumesWithStatus(nsProvider, volumeGroup)
+	if err != nil {
+		return []string{fmt.Sprintf("cannot get volumes of '%s': %s", volumeGroup, err)}
+	}
+	for _, volume := range volumes {
+		if !isTrashed(volume) {
+			continue
+		}
+		trashedAt, err := time.Parse(time.RFC3339, volume.UserProperties[trashedAtProperty])
+		if err != nil {
+			l.Warnf("trashed volume '%s' has invalid %s property: %s", volume.Path, trashedAtProperty, err)
+			continue
+		}
+		trash, err := getVolumeTrash(volume.UserProperties)
+		if err != nil {
+			l.Warnf("trashed volume '%s' is kept: %s", volume.Path, err)
+			continue
+		} else if !trash.enabled() || now.Before(trashedAt.Add(trash.retention)) {
+			continue
+		}
+		err = nsProvider.DestroyVolume(volume.Path, ns.DestroyVolumeParams{
+			DestroySnapshots:               true,
+			PromoteMostRecentCloneIfExists: true,
+		})
+		if err != nil && !ns.IsNotExistNefError(err) {
+			errors = append(errors, fmt.Sprintf("cannot purge trashed volume '%s': %s", volume.Path, err))
+			continue
+		}
+		l.Infof("trashed volume '%s' has been purged, it was deleted at %s", volume.Path, trashedAt)
+	}
+	return errors
+}
@@ -0,0 +1,110 @@
+package hosttest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	utilexec "k8s.io/utils/exec"
+	testingexec "k8s.io/utils/exec/testing"
+)
+
+// CommandFunc - scripted command, returns combined output and error (use ExitError() for non-zero exit codes)
+type CommandFunc func(args []string) ([]byte, error)
+
+// Command - executed command record
+type Command struct {
+	Name string
+	Args []string
+}
+
+func (c Command) String() string {
+	return strings.TrimSpace(fmt.Sprintf("%s %s", c.Name, strings.Join(c.Args, " ")))
+}
+
+// Exec - utilexec.Interface implementation that runs scripted commands and records all executions,
+// commands without script fail with 127 exit code
+type Exec struct {
+	mux      sync.Mutex
+	scripts  map[string]CommandFunc
+	commands []Command
+}
+
+var _ utilexec.Interface = &Exec{}
+
+// Script - sets handler for the command name (e.g. "iscsiadm"), replaces previous one
+func (e *Exec) Script(name string, fn CommandFunc) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.scripts[name] = fn
+}
+
+// Commands - returns all executed commands in execution order
+func (e *Exec) Commands() []Command {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return append([]Command{}, e.commands...)
+}
+
+// CommandsByName - returns executed commands with the name
+func (e *Exec) CommandsByName(name string) []Command {
+	commands := []Command{}
+	for _, c := range e.Commands() {
+		if c.Name == name {
+			commands = append(commands, c)
+		}
+	}
+	return commands
+}
+
+// Command - returns command that runs the script on execution
+func (e *Exec) Command(cmd string, args ...string) utilexec.Cmd {
+	action := func() ([]byte, []byte, error) {
+		e.mux.Lock()
+		e.commands = append(e.commands, Command{Name: cmd, Args: append([]string{}, args...)})
+		fn, ok := e.scripts[cmd]
+		e.mux.Unlock()
+
+		if !ok {
+			return []byte(fmt.Sprintf("%s: command not found", cmd)), nil, ExitError(127)
+		}
+		out, err := fn(args)
+		return out, nil, err
+	}
+
+	fakeCmd := &testingexec.FakeCmd{
+		CombinedOutputScript: []testingexec.FakeAction{action},
+		OutputScript:         []testingexec.FakeAction{action},
+		RunScript:            []testingexec.FakeAction{action},
+	}
+	return testingexec.InitFakeCmd(fakeCmd, cmd, args...)
+}
+
+// CommandContext - same as Command(), context is ignored
+func (e *Exec) CommandContext(ctx context.Context, cmd string, args ...string) utilexec.Cmd {
+	return e.Command(cmd, args...)
+}
+
+// LookPath - returns "/usr/bin/<file>" for scripted commands
+func (e *Exec) LookPath(file string) (string, error) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	if _, ok := e.scripts[file]; !ok {
+		return "", utilexec.ErrExecutableNotFound
+	}
+	return "/usr/bin/" + file, nil
+}
+
+// ExitError - returns error of the command exited with the status
+func ExitError(status int) error {
+	return testingexec.FakeExitError{Status: status}
+}
+
+// NewExec - creates executor without scripts
+func NewExec() *Exec {
+	return &Exec{
+		scripts:  map[string]CommandFunc{},
+		commands: []Command{},
+	}
+}
@@ -0,0 +1,260 @@
+// Package hosttest provides an in-memory node host (filesystem, mounts and scripted commands)
+// to run driver NodeServer code in unit tests without iSCSI, block devices or root permissions.
+package hosttest
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// maxSymlinkHops - same limit as Linux kernel has
+const maxSymlinkHops = 40
+
+type node struct {
+	mode    os.FileMode
+	data    []byte
+	link    string
+	modTime time.Time
+}
+
+type fileInfo struct {
+	name string
+	node *node
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return int64(len(fi.node.data)) }
+func (fi *fileInfo) Mode() os.FileMode  { return fi.node.mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.node.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.node.mode.IsDir() }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+
+// FS - in-memory filesystem, implements driver.HostFS
+type FS struct {
+	mux   sync.Mutex
+	nodes map[string]*node
+}
+
+// Stat - returns file info, symlinks are followed
+func (fs *FS) Stat(name string) (os.FileInfo, error) {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	p, n, err := fs.resolve("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{name: path.Base(p), node: n}, nil
+}
+
+// MkdirAll - creates directory with all missing parents
+func (fs *FS) MkdirAll(name string, perm os.FileMode) error {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	return fs.mkdirAll(name, perm)
+}
+
+// Chmod - changes permission bits of the file
+func (fs *FS) Chmod(name string, mode os.FileMode) error {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	_, n, err := fs.resolve("chmod", name, true)
+	if err != nil {
+		return err
+	}
+	n.mode = (n.mode &^ os.ModePerm) | (mode & os.ModePerm)
+	return nil
+}
+
+// RemoveAll - removes the file or directory with all its children, it's OK if the path doesn't exist
+func (fs *FS) RemoveAll(name string) error {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	parent, _, err := fs.resolve("removeall", path.Dir(clean(name)), true)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	p := path.Join(parent, path.Base(clean(name)))
+	if p == "/" {
+		return &os.PathError{Op: "removeall", Path: name, Err: syscall.EPERM}
+	}
+	for k := range fs.nodes {
+		if k == p || strings.HasPrefix(k, p+"/") {
+			delete(fs.nodes, k)
+		}
+	}
+	return nil
+}
+
+// EvalSymlinks - returns the path after evaluation of all symlinks, the path must exist
+func (fs *FS) EvalSymlinks(name string) (string, error) {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	p, _, err := fs.resolve("lstat", name, true)
+	return p, err
+}
+
+// ReadFile - returns content of the file
+func (fs *FS) ReadFile(name string) ([]byte, error) {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	_, n, err := fs.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	} else if n.mode.IsDir() {
+		return nil, &os.PathError{Op: "read", Path: name, Err: syscall.EISDIR}
+	}
+	return append([]byte{}, n.data...), nil
+}
+
+// AppendFile - writes data to the end of existing file
+func (fs *FS) AppendFile(name string, data []byte) (int, error) {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	_, n, err := fs.resolve("open", name, true)
+	if err != nil {
+		return 0, err
+	} else if n.mode.IsDir() {
+		return 0, &os.PathError{Op: "write", Path: name, Err: syscall.EISDIR}
+	}
+	n.data = append(n.data, data...)
+	n.modTime = time.Now()
+	return len(data), nil
+}
+
+// WriteFile - creates or truncates the file, missing parent directories are created
+func (fs *FS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	if err := fs.mkdirAll(path.Dir(clean(name)), 0755); err != nil {
+		return err
+	}
+	parent, _, err := fs.resolve("open", path.Dir(clean(name)), true)
+	if err != nil {
+		return err
+	}
+	p := path.Join(parent, path.Base(clean(name)))
+	if n, ok := fs.nodes[p]; ok && n.mode.IsDir() {
+		return &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+	fs.nodes[p] = &node{mode: perm & os.ModePerm, data: append([]byte{}, data...), modTime: time.Now()}
+	return nil
+}
+
+// Symlink - creates newname as a symbolic link to oldname, parent directory must exist
+func (fs *FS) Symlink(oldname, newname string) error {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	parent, n, err := fs.resolve("symlink", path.Dir(clean(newname)), true)
+	if err != nil {
+		return err
+	} else if !n.mode.IsDir() {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: syscall.ENOTDIR}
+	}
+	p := path.Join(parent, path.Base(clean(newname)))
+	if _, ok := fs.nodes[p]; ok {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: syscall.EEXIST}
+	}
+	fs.nodes[p] = &node{mode: os.ModeSymlink | 0777, link: oldname, modTime: time.Now()}
+	return nil
+}
+
+// List - returns all paths (sorted), useful to debug tests
+func (fs *FS) List() []string {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	paths := make([]string, 0, len(fs.nodes))
+	for p := range fs.nodes {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (fs *FS) mkdirAll(name string, perm os.FileMode) error {
+	current := "/"
+	for _, part := range strings.Split(strings.TrimPrefix(clean(name), "/"), "/") {
+		if part == "" {
+			continue
+		}
+		next := path.Join(current, part)
+		if _, ok := fs.nodes[next]; !ok {
+			fs.nodes[next] = &node{mode: os.ModeDir | (perm & os.ModePerm), modTime: time.Now()}
+		}
+		resolved, n, err := fs.resolve("mkdir", next, true)
+		if err != nil {
+			return err
+		} else if !n.mode.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+		}
+		current = resolved
+	}
+	return nil
+}
+
+// resolve - returns real path and node of the file, the last path element is followed if it's a symlink
+func (fs *FS) resolve(op, name string, followLast bool) (string, *node, error) {
+	hops := 0
+	parts := strings.Split(strings.TrimPrefix(clean(name), "/"), "/")
+	current := "/"
+	for i := 0; i < len(parts); i++ {
+		if parts[i] == "" {
+			continue
+		}
+		next := path.Join(current, parts[i])
+		n, ok := fs.nodes[next]
+		if !ok {
+			return "", nil, &os.PathError{Op: op, Path: name, Err: syscall.ENOENT}
+		}
+		isLast := i == len(parts)-1
+		if n.mode&os.ModeSymlink != 0 && (!isLast || followLast) {
+			hops++
+			if hops > maxSymlinkHops {
+				return "", nil, &os.PathError{Op: op, Path: name, Err: syscall.ELOOP}
+			}
+			target := n.link
+			if !path.IsAbs(target) {
+				target = path.Join(current, target)
+			}
+			rest := append(strings.Split(strings.TrimPrefix(clean(target), "/"), "/"), parts[i+1:]...)
+			parts = rest
+			current = "/"
+			i = -1
+			continue
+		}
+		if !isLast && !n.mode.IsDir() {
+			return "", nil, &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+		current = next
+	}
+	return current, fs.nodes[current], nil
+}
+
+func clean(name string) string {
+	return path.Clean("/" + name)
+}
+
+// NewFS - creates filesystem with root directory only
+func NewFS() *FS {
+	return &FS{
+		nodes: map[string]*node{
+			"/": {mode: os.ModeDir | 0755, modTime: time.Now()},
+		},
+	}
+}
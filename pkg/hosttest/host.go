@@ -0,0 +1,277 @@
+package hosttest
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// RootDevice - device mounted at "/", returned by findmnt for paths without other mounts
+	RootDevice = "/dev/root"
+
+	// PathToInitiatorName - initiator name file read by NodeServer
+	PathToInitiatorName = "/host/etc/iscsi/initiatorname.iscsi"
+
+	// DevByPathDir - directory with iSCSI device symlinks, as it is seen by NodeServer
+	DevByPathDir = "/host/dev/disk/by-path"
+)
+
+// Device - block device attached to the host
+type Device struct {
+	// Name - device name, e.g. "/dev/sdb"
+	Name string
+
+	// Size - device size in bytes
+	Size int64
+
+	// FsType - filesystem created by mkfs.* command, empty if device is not formatted
+	FsType string
+
+	// UUID - filesystem UUID
+	UUID string
+}
+
+// Host - in-memory node host: filesystem, mount table and commands NodeServer runs,
+// pass FS, Mounter and Exec to driver.Args
+type Host struct {
+	FS      *FS
+	Mounter *Mounter
+	Exec    *Exec
+
+	mux     sync.Mutex
+	devices map[string]*Device
+}
+
+// SetInitiatorName - writes iSCSI initiator name file
+func (h *Host) SetInitiatorName(iqn string) error {
+	return h.FS.WriteFile(PathToInitiatorName, []byte(fmt.Sprintf("InitiatorName=%s\n", iqn)), 0644)
+}
+
+// AddDevice - attaches new block device (e.g. "/dev/sdb") with its sysfs files,
+// byPathLinks are names of symlinks to create in /dev/disk/by-path (e.g. "ip-10.3.199.28:3260-iscsi-<iqn>-lun-0")
+func (h *Host) AddDevice(name string, size int64, byPathLinks ...string) error {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	if _, ok := h.devices[name]; ok {
+		return fmt.Errorf("device '%s' already exists", name)
+	}
+
+	base := path.Base(name)
+	files := map[string]string{
+		name:                     "",
+		path.Join("/host", name): "",
+		fmt.Sprintf("/host/sys/block/%s/device/state", base):  "running\n",
+		fmt.Sprintf("/host/sys/block/%s/device/delete", base): "",
+		fmt.Sprintf("/sys/block/%s/device/rescan", base):      "",
+	}
+	for _, file := range sortedKeys(files) {
+		if err := h.FS.WriteFile(file, []byte(files[file]), 0644); err != nil {
+			return err
+		}
+	}
+	if err := h.FS.MkdirAll(DevByPathDir, 0755); err != nil {
+		return err
+	}
+	for _, link := range byPathLinks {
+		if err := h.FS.Symlink(path.Join("../..", base), path.Join(DevByPathDir, link)); err != nil {
+			return err
+		}
+	}
+
+	h.devices[name] = &Device{
+		Name: name,
+		Size: size,
+	}
+	return nil
+}
+
+// Device - returns copy of the device
+func (h *Host) Device(name string) (Device, bool) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	device, ok := h.devices[name]
+	if !ok {
+		return Device{}, false
+	}
+	return *device, true
+}
+
+// SetDeviceSize - changes device size, e.g. after LUN expansion
+func (h *Host) SetDeviceSize(name string, size int64) error {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	device, ok := h.devices[name]
+	if !ok {
+		return fmt.Errorf("device '%s' not found", name)
+	}
+	device.Size = size
+	return nil
+}
+
+// DeviceState - returns sysfs state of the device and true if "1" was written to its delete file
+func (h *Host) DeviceState(name string) (state string, deleted bool, err error) {
+	base := path.Base(name)
+	stateContent, err := h.FS.ReadFile(fmt.Sprintf("/host/sys/block/%s/device/state", base))
+	if err != nil {
+		return "", false, err
+	}
+	deleteContent, err := h.FS.ReadFile(fmt.Sprintf("/host/sys/block/%s/device/delete", base))
+	if err != nil {
+		return "", false, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(stateContent)), "\n")
+	return lines[len(lines)-1], strings.Contains(string(deleteContent), "1"), nil
+}
+
+// Rescanned - returns number of writes to the device sysfs rescan file
+func (h *Host) Rescanned(name string) int {
+	content, err := h.FS.ReadFile(fmt.Sprintf("/sys/block/%s/device/rescan", path.Base(name)))
+	if err != nil {
+		return 0
+	}
+	return strings.Count(string(content), "1")
+}
+
+func (h *Host) device(name string) (*Device, error) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	device, ok := h.devices[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: No such file or directory", name)
+	}
+	return device, nil
+}
+
+func (h *Host) ln(args []string) ([]byte, error) {
+	if len(args) != 3 || args[0] != "-s" {
+		return []byte("ln: unsupported arguments"), ExitError(1)
+	}
+	if err := h.FS.Symlink(args[1], args[2]); err != nil {
+		return []byte(fmt.Sprintf("ln: failed to create symbolic link '%s': %s", args[2], err)), ExitError(1)
+	}
+	return nil, nil
+}
+
+func (h *Host) realpath(args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return []byte("realpath: unsupported arguments"), ExitError(1)
+	}
+	p, err := h.FS.EvalSymlinks(args[0])
+	if err != nil {
+		return []byte(fmt.Sprintf("realpath: %s", err)), ExitError(1)
+	}
+	return []byte(p + "\n"), nil
+}
+
+func (h *Host) findmnt(args []string) ([]byte, error) {
+	if len(args) < 2 || args[len(args)-2] != "--target" {
+		return []byte("findmnt: unsupported arguments"), ExitError(1)
+	}
+	source, err := h.Mounter.SourceOf(args[len(args)-1])
+	if err != nil {
+		return nil, ExitError(1)
+	}
+	return []byte(source + "\n"), nil
+}
+
+func (h *Host) blkid(args []string) ([]byte, error) {
+	if len(args) == 0 {
+		return []byte("blkid: unsupported arguments"), ExitError(4)
+	}
+	device, err := h.device(args[len(args)-1])
+	if err != nil {
+		return nil, ExitError(2)
+	}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if device.FsType == "" {
+		return nil, ExitError(2)
+	}
+	if len(args) == 1 {
+		return []byte(fmt.Sprintf("%s: UUID=\"%s\" TYPE=\"%s\"\n", device.Name, device.UUID, device.FsType)), nil
+	}
+	return []byte(fmt.Sprintf("DEVNAME=%s\nTYPE=%s\n", device.Name, device.FsType)), nil
+}
+
+func (h *Host) mkfs(fsType string) CommandFunc {
+	return func(args []string) ([]byte, error) {
+		if len(args) == 0 {
+			return []byte("mkfs: no device specified"), ExitError(1)
+		}
+		device, err := h.device(args[len(args)-1])
+		if err != nil {
+			return []byte(err.Error()), ExitError(1)
+		}
+		h.mux.Lock()
+		defer h.mux.Unlock()
+		device.FsType = fsType
+		device.UUID = fmt.Sprintf("00000000-0000-0000-0000-%012d", len(h.devices))
+		return nil, nil
+	}
+}
+
+func (h *Host) blockdev(args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return []byte("blockdev: unsupported arguments"), ExitError(1)
+	}
+	device, err := h.device(args[1])
+	if err != nil {
+		return []byte(fmt.Sprintf("blockdev: cannot open %s", err)), ExitError(1)
+	}
+	switch args[0] {
+	case "--flushbufs":
+		return nil, nil
+	case "--getsize64":
+		h.mux.Lock()
+		defer h.mux.Unlock()
+		return []byte(strconv.FormatInt(device.Size, 10) + "\n"), nil
+	}
+	return []byte(fmt.Sprintf("blockdev: unsupported option %s", args[0])), ExitError(1)
+}
+
+func (h *Host) resize(args []string) ([]byte, error) {
+	if len(args) == 0 {
+		return []byte("no device specified"), ExitError(1)
+	}
+	return nil, nil
+}
+
+// NewHost - creates host with empty filesystem, empty mount table and scripts for commands NodeServer runs,
+// iscsiadm does nothing by default, use Exec.Script("iscsiadm", ...) to attach devices on login
+func NewHost() *Host {
+	fs := NewFS()
+	h := &Host{
+		FS:      fs,
+		Mounter: NewMounter(fs),
+		Exec:    NewExec(),
+		devices: map[string]*Device{},
+	}
+
+	h.Exec.Script("ln", h.ln)
+	h.Exec.Script("realpath", h.realpath)
+	h.Exec.Script("findmnt", h.findmnt)
+	h.Exec.Script("blkid", h.blkid)
+	h.Exec.Script("blockdev", h.blockdev)
+	h.Exec.Script("mkfs.ext3", h.mkfs("ext3"))
+	h.Exec.Script("mkfs.ext4", h.mkfs("ext4"))
+	h.Exec.Script("mkfs.xfs", h.mkfs("xfs"))
+	h.Exec.Script("resize2fs", h.resize)
+	h.Exec.Script("xfs_growfs", h.resize)
+	h.Exec.Script("iscsiadm", func(args []string) ([]byte, error) { return nil, nil })
+
+	return h
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,157 @@
+package hosttest
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	"k8s.io/mount-utils"
+)
+
+// Mounter - mount.Interface implementation that keeps mount table in memory, mount points must exist in FS
+type Mounter struct {
+	fs *FS
+
+	mux         sync.Mutex
+	mountPoints []mount.MountPoint
+}
+
+var _ mount.Interface = &Mounter{}
+
+// Mount - adds mount point to the mount table
+func (m *Mounter) Mount(source string, target string, fstype string, options []string) error {
+	realTarget, err := m.fs.EvalSymlinks(target)
+	if err != nil {
+		return fmt.Errorf("mount failed: mount point %s does not exist: %s", target, err)
+	}
+	info, err := m.fs.Stat(realTarget)
+	if err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("mount failed: mount point %s is not a directory", target)
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.mountPoints = append(m.mountPoints, mount.MountPoint{
+		Device: source,
+		Path:   realTarget,
+		Type:   fstype,
+		Opts:   append([]string{}, options...),
+	})
+	return nil
+}
+
+// MountSensitive - same as Mount(), sensitive options are not stored
+func (m *Mounter) MountSensitive(source, target, fstype string, options, sensitiveOptions []string) error {
+	return m.Mount(source, target, fstype, options)
+}
+
+// MountSensitiveWithoutSystemd - same as Mount(), sensitive options are not stored
+func (m *Mounter) MountSensitiveWithoutSystemd(
+	source, target, fstype string,
+	options, sensitiveOptions []string,
+) error {
+	return m.Mount(source, target, fstype, options)
+}
+
+// Unmount - removes the most recent mount of the target from the mount table
+func (m *Mounter) Unmount(target string) error {
+	realTarget, err := m.fs.EvalSymlinks(target)
+	if err != nil {
+		realTarget = clean(target)
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for i := len(m.mountPoints) - 1; i >= 0; i-- {
+		if m.mountPoints[i].Path == realTarget {
+			m.mountPoints = append(m.mountPoints[:i], m.mountPoints[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("umount: %s: not mounted", target)
+}
+
+// List - returns all mount points
+func (m *Mounter) List() ([]mount.MountPoint, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return append([]mount.MountPoint{}, m.mountPoints...), nil
+}
+
+// IsLikelyNotMountPoint - returns false if the file is a mount point, the file must exist
+func (m *Mounter) IsLikelyNotMountPoint(file string) (bool, error) {
+	realFile, err := m.fs.EvalSymlinks(file)
+	if err != nil {
+		return true, err
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for _, mp := range m.mountPoints {
+		if mp.Path == realFile {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// GetMountRefs - returns all other mount points of the same device
+func (m *Mounter) GetMountRefs(pathname string) ([]string, error) {
+	realPath, err := m.fs.EvalSymlinks(pathname)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	device := ""
+	for _, mp := range m.mountPoints {
+		if mp.Path == realPath {
+			device = mp.Device
+		}
+	}
+	refs := []string{}
+	for _, mp := range m.mountPoints {
+		if device != "" && mp.Device == device && mp.Path != realPath {
+			refs = append(refs, mp.Path)
+		}
+	}
+	return refs, nil
+}
+
+// SourceOf - returns device mounted at the path or at its closest parent, as `findmnt --target` does,
+// returns RootDevice if there is no such mount
+func (m *Mounter) SourceOf(file string) (string, error) {
+	realFile, err := m.fs.EvalSymlinks(file)
+	if err != nil {
+		return "", &os.PathError{Op: "findmnt", Path: file, Err: syscall.ENOENT}
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	source := RootDevice
+	longest := 0
+	for _, mp := range m.mountPoints {
+		if mp.Path == realFile || strings.HasPrefix(realFile, mp.Path+"/") {
+			if len(mp.Path) >= longest {
+				longest = len(mp.Path)
+				source = mp.Device
+			}
+		}
+	}
+	return source, nil
+}
+
+// NewMounter - creates mounter with empty mount table
+func NewMounter(fs *FS) *Mounter {
+	return &Mounter{
+		fs:          fs,
+		mountPoints: []mount.MountPoint{},
+	}
+}
@@ -0,0 +1,199 @@
+// Package leaderelection - leader election of driver controller replicas using Kubernetes Lease object,
+// client-go leader election is used with the service account of the pod
+package leaderelection
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// defaults of leader election timings, the same as Kubernetes sidecars use
+const (
+	DefaultLeaseDuration = 15 * time.Second
+	DefaultRenewDeadline = 10 * time.Second
+	DefaultRetryPeriod   = 5 * time.Second
+)
+
+// namespaceFile - namespace of the pod in the service account files
+const namespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// Args - params to create new elector
+type Args struct {
+	// LeaseName, Namespace - Lease object the replicas compete for
+	LeaseName string
+	Namespace string
+
+	// Identity - unique name of the replica, e.g. pod name
+	Identity string
+
+	// Client - Kubernetes API client
+	Client kubernetes.Interface
+
+	// LeaseDuration - how long other replicas wait for the leader to renew the Lease before they take it over,
+	// RenewDeadline - how long the leader keeps leading if it can't renew the Lease,
+	// RetryPeriod - how often the Lease is renewed or acquired, Default* values are used if not set
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+
+	Log *logrus.Entry
+}
+
+// Elector - acquires the Lease and renews it while the replica is the leader
+type Elector struct {
+	args Args
+	log  *logrus.Entry
+
+	// leading - context of the current term, it's canceled once the replica stops leading.
+	// client-go IsLeader() tells the last observed holder only, it stays true after the Lease is lost.
+	mux     sync.Mutex
+	leading context.Context
+}
+
+// IsLeader - the replica holds the Lease
+func (e *Elector) IsLeader() bool {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.leading != nil && e.leading.Err() == nil
+}
+
+// Run - acquires and renews the Lease until stop is closed, the replica which has lost the Lease competes for it
+// again
+func (e *Elector) Run(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for ctx.Err() == nil {
+		// client-go elector returns once it has lost the Lease, the renewal which has timed out may still be running,
+		// so every term has its own elector and lock
+		elector, err := e.newLeaderElector()
+		if err != nil {
+			e.log.Errorf("cannot run leader election: %s", err)
+			return
+		}
+		elector.Run(ctx)
+	}
+}
+
+func (e *Elector) startedLeading(ctx context.Context) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	// the callback runs in its own goroutine, the term may be over already
+	if ctx.Err() == nil {
+		e.log.Infof("became the leader, Lease '%s/%s'", e.args.Namespace, e.args.LeaseName)
+		e.leading = ctx
+	}
+}
+
+func (e *Elector) stoppedLeading() {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	if e.leading != nil {
+		e.log.Warnf("stopped leading, Lease '%s/%s'", e.args.Namespace, e.args.LeaseName)
+		e.leading = nil
+	}
+}
+
+// New - creates elector, it's not the leader until Run() acquires the Lease
+func New(args Args) (*Elector, error) {
+	if args.LeaseName == "" {
+		return nil, fmt.Errorf("args.LeaseName is required")
+	} else if args.Namespace == "" {
+		return nil, fmt.Errorf("args.Namespace is required")
+	} else if args.Identity == "" {
+		return nil, fmt.Errorf("args.Identity is required")
+	} else if args.Client == nil {
+		return nil, fmt.Errorf("args.Client is required")
+	} else if args.Log == nil {
+		return nil, fmt.Errorf("args.Log is required")
+	}
+
+	if args.LeaseDuration == 0 {
+		args.LeaseDuration = DefaultLeaseDuration
+	}
+	if args.RenewDeadline == 0 {
+		args.RenewDeadline = DefaultRenewDeadline
+	}
+	if args.RetryPeriod == 0 {
+		args.RetryPeriod = DefaultRetryPeriod
+	}
+
+	e := &Elector{
+		args: args,
+		log:  args.Log.WithField("cmp", "LeaderElection"),
+	}
+	// the elector validates timings
+	if _, err := e.newLeaderElector(); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// newLeaderElector - client-go elector of the Lease, the Lease is released once the elector is stopped,
+// so other replicas don't wait for it to expire
+func (e *Elector) newLeaderElector() (*leaderelection.LeaderElector, error) {
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Name: e.args.LeaseName, Namespace: e.args.Namespace},
+			Client:     e.args.Client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: e.args.Identity},
+		},
+		LeaseDuration:   e.args.LeaseDuration,
+		RenewDeadline:   e.args.RenewDeadline,
+		RetryPeriod:     e.args.RetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            e.args.LeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: e.startedLeading,
+			OnStoppedLeading: e.stoppedLeading,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot create leader elector: %s", err)
+	}
+	return elector, nil
+}
+
+// NewInCluster - creates elector using the service account of the pod, namespace of the pod is used
+// if args.Namespace is not set
+func NewInCluster(args Args) (*Elector, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot find Kubernetes API server, leader election works in the cluster only: %s", err)
+	}
+	// a request must not hold the leader beyond the renew deadline
+	config.Timeout = DefaultRenewDeadline / 2
+
+	if args.Namespace == "" {
+		namespace, err := ioutil.ReadFile(namespaceFile)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read namespace of the pod: %s", err)
+		}
+		args.Namespace = strings.TrimSpace(string(namespace))
+	}
+
+	args.Client, err = kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot create Kubernetes API client: %s", err)
+	}
+
+	return New(args)
+}
@@ -0,0 +1,1544 @@
+// Package nstest provides an in-memory NexentaStor appliance that serves the subset of NEF REST API
+// used by the driver, so that driver code can be tested without a real NexentaStor.
+//
+// ns.ProviderInterface cannot be implemented outside of go-nexentastor (GetHostGroups() returns
+// an unexported type), so the fake is plugged in one level below: Client implements
+// rest.ClientInterface and regular ns.Provider instances are created on top of it.
+// This way all NEF error semantics (ns.IsNotExistNefError() etc.) work exactly as with a real appliance.
+package nstest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+)
+
+// DefaultPoolSize - pool capacity used when pool is created implicitly by AddVolumeGroup()
+const DefaultPoolSize int64 = 100 * 1024 * 1024 * 1024
+
+// AllHostGroup - NexentaStor built-in host group that matches all initiators
+const AllHostGroup = "all"
+
+// NEF error codes
+const (
+	CodeNotExist     = "ENOENT"
+	CodeAlreadyExist = "EEXIST"
+	CodeBusy         = "EBUSY"
+	CodeAuth         = "EAUTH"
+	CodeBadArg       = "EBADARG"
+	CodeNoSpace      = "ENOSPC"
+	CodeIO           = "EIO"
+	CodeAccess       = "EACCES"
+)
+
+// API version prefix used by some NEF endpoints, e.g. "v1.2.6/san/iscsi/remoteInitiators"
+var regexpAPIVersion = regexp.MustCompile(`^v[0-9]+(\.[0-9]+)*$`)
+
+var loginPattern = []string{"auth", "login"}
+
+// Pool health values reported by NEF
+const (
+	PoolHealthOnline   = "ONLINE"
+	PoolHealthDegraded = "DEGRADED"
+	PoolHealthFaulted  = "FAULTED"
+)
+
+// Volume status values reported by NEF
+const (
+	VolumeStatusOnline  = "ONLINE"
+	VolumeStatusOffline = "OFFLINE"
+)
+
+type pool struct {
+	name   string
+	size   int64
+	health string
+}
+
+// nefPool - NEF pool object, ns.Pool has the name only
+type nefPool struct {
+	Name   string `json:"poolName"`
+	Health string `json:"health"`
+	Status string `json:"status"`
+}
+
+// DefaultVolumeBlockSize - volumeBlockSize of volumes created without it in volume groups added by AddVolumeGroup()
+const DefaultVolumeBlockSize int64 = 8192
+
+// VolumeProperties - NEF volume ZFS properties, empty values are inherited from the parent
+type VolumeProperties struct {
+	VolumeBlockSize int64             `json:"volumeBlockSize,omitempty"`
+	CompressionMode string            `json:"compressionMode,omitempty"`
+	ChecksumMode    string            `json:"checksumMode,omitempty"`
+	DedupMode       string            `json:"dedupMode,omitempty"`
+	LogicalBias     string            `json:"logicalBias,omitempty"`
+	SyncMode        string            `json:"syncMode,omitempty"`
+	Copies          int               `json:"copies,omitempty"`
+	PrimaryCache    string            `json:"primaryCache,omitempty"`
+	SecondaryCache  string            `json:"secondaryCache,omitempty"`
+	UserProperties  map[string]string `json:"userProperties,omitempty"`
+}
+
+// merge - returns properties overridden by non-empty values of other
+func (p VolumeProperties) merge(other VolumeProperties) VolumeProperties {
+	if other.VolumeBlockSize != 0 {
+		p.VolumeBlockSize = other.VolumeBlockSize
+	}
+	for _, field := range []struct{ to, from *string }{
+		{&p.CompressionMode, &other.CompressionMode},
+		{&p.ChecksumMode, &other.ChecksumMode},
+		{&p.DedupMode, &other.DedupMode},
+		{&p.LogicalBias, &other.LogicalBias},
+		{&p.SyncMode, &other.SyncMode},
+		{&p.PrimaryCache, &other.PrimaryCache},
+		{&p.SecondaryCache, &other.SecondaryCache},
+	} {
+		if *field.from != "" {
+			*field.to = *field.from
+		}
+	}
+	if other.Copies != 0 {
+		p.Copies = other.Copies
+	}
+	userProperties := map[string]string{}
+	for name, value := range p.UserProperties {
+		userProperties[name] = value
+	}
+	for name, value := range other.UserProperties {
+		userProperties[name] = value
+	}
+	p.UserProperties = userProperties
+	return p
+}
+
+// nefVolume - NEF volume object, ns.Volume doesn't have the status and properties
+type nefVolume struct {
+	ns.Volume
+	VolumeProperties
+	VolumeEncryption
+	ReferencedReservationSize int64  `json:"referencedReservationSize"`
+	Status                    string `json:"status"`
+}
+
+type volumeGroup struct {
+	path string
+
+	// volumeBlockSize - volumeBlockSize of volumes created in the volume group without it
+	volumeBlockSize int64
+}
+
+// nefVolumeGroup - NEF volume group object, ns.VolumeGroup doesn't have the volume block size
+type nefVolumeGroup struct {
+	Path            string `json:"path"`
+	BytesAvailable  int64  `json:"bytesAvailable"`
+	BytesUsed       int64  `json:"bytesUsed"`
+	VolumeBlockSize int64  `json:"volumeBlockSize"`
+}
+
+type volume struct {
+	path        string
+	volumeSize  int64
+	origin      string
+	creationTxg int
+	status      string
+	properties  VolumeProperties
+
+	// refReservation - space reserved for the volume, equals to the volume size for thick volumes
+	refReservation int64
+
+	// encryption - cipher, empty for unencrypted volumes, the key is stored by encryption root path
+	encryption     string
+	encryptionRoot string
+}
+
+type snapshot struct {
+	path            string
+	name            string
+	parent          string
+	volumeSize      int64
+	bytesReferenced int64
+	creationTxg     int
+	creationTime    time.Time
+	clones          []string
+
+	// deferDestroy - snapshot is marked for deferred destroy, it's destroyed once its holds are released
+	deferDestroy bool
+
+	// userProperties - ZFS user properties set on snapshot creation
+	userProperties map[string]string
+}
+
+// nefSnapshot - NEF snapshot object, ns.Snapshot doesn't have the size and the state
+type nefSnapshot struct {
+	ns.Snapshot
+	VolumeSize      int64             `json:"volumeSize"`
+	BytesReferenced int64             `json:"bytesReferenced"`
+	DeferDestroy    bool              `json:"deferDestroy"`
+	UserProperties  map[string]string `json:"userProperties,omitempty"`
+}
+
+type hostGroup struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+type remoteInitiator struct {
+	name       string
+	chapUser   string
+	chapSecret string
+}
+
+// ApplianceArgs - params to create Appliance instance
+type ApplianceArgs struct {
+	// NEF credentials, requests with other credentials fail with EAUTH code
+	Username string
+	Password string
+
+	// VolumeGroups - list of volume groups to create [pool/volumeGroup]
+	VolumeGroups []string
+
+	// PoolSize - capacity of each pool in bytes, DefaultPoolSize if not set
+	PoolSize int64
+}
+
+// Appliance - in-memory NexentaStor appliance
+type Appliance struct {
+	username string
+	password string
+	poolSize int64
+
+	mux              sync.Mutex
+	tokens           map[string]bool
+	license          ns.License
+	clusters         []ns.RSFCluster
+	pools            map[string]*pool
+	volumeGroups     map[string]*volumeGroup
+	volumes          map[string]*volume
+	snapshots        map[string]*snapshot
+	lunMappings      map[string]*ns.LunMapping
+	targets          map[string]*ns.ISCSITarget
+	targetGroups     map[string]*ns.TargetGroup
+	hostGroups       map[string]*hostGroup
+	remoteInitiators map[string]*remoteInitiator
+	keys             map[string]*encryptionKey
+	txg              int
+	lastID           int
+
+	replicationServices map[string]*ReplicationService
+
+	// faults have own lock, so injected latency doesn't block other requests
+	faults *Faults
+}
+
+// AddVolumeGroup - creates volume group, pool is created if it doesn't exist
+func (a *Appliance) AddVolumeGroup(vgPath string) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	poolName := strings.Split(vgPath, "/")[0]
+	if _, ok := a.pools[poolName]; !ok {
+		a.pools[poolName] = &pool{name: poolName, size: a.poolSize, health: PoolHealthOnline}
+	}
+	a.volumeGroups[vgPath] = &volumeGroup{path: vgPath, volumeBlockSize: DefaultVolumeBlockSize}
+}
+
+// SetVolumeGroupBlockSize - sets volumeBlockSize of new volumes of the volume group,
+// returns false if there is no such volume group
+func (a *Appliance) SetVolumeGroupBlockSize(vgPath string, volumeBlockSize int64) bool {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	vg, ok := a.volumeGroups[vgPath]
+	if ok {
+		vg.volumeBlockSize = volumeBlockSize
+	}
+	return ok
+}
+
+// SetPoolHealth - sets pool health (e.g. PoolHealthDegraded), returns false if there is no such pool
+func (a *Appliance) SetPoolHealth(poolName, health string) bool {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	p, ok := a.pools[poolName]
+	if ok {
+		p.health = health
+	}
+	return ok
+}
+
+// SetVolumeStatus - sets volume status (e.g. VolumeStatusOffline), returns false if there is no such volume
+func (a *Appliance) SetVolumeStatus(volumePath, status string) bool {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	v, ok := a.volumes[volumePath]
+	if ok {
+		v.status = status
+	}
+	return ok
+}
+
+// SetSnapshotDeferDestroy - marks snapshot for deferred destroy, returns false if there is no such snapshot
+func (a *Appliance) SetSnapshotDeferDestroy(snapshotPath string, deferDestroy bool) bool {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	s, ok := a.snapshots[snapshotPath]
+	if ok {
+		s.deferDestroy = deferDestroy
+	}
+	return ok
+}
+
+// SetLicense - sets license returned by "/settings/license"
+func (a *Appliance) SetLicense(license ns.License) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.license = license
+}
+
+// SetRSFClusters - sets RSF clusters returned by "/rsf/clusters"
+func (a *Appliance) SetRSFClusters(clusters []ns.RSFCluster) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.clusters = clusters
+}
+
+// Volume - returns volume by path, false if it doesn't exist
+func (a *Appliance) Volume(volumePath string) (ns.Volume, bool) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	v, ok := a.volumes[volumePath]
+	if !ok {
+		return ns.Volume{}, false
+	}
+	return a.toNSVolume(v).Volume, true
+}
+
+// VolumeProperties - returns ZFS properties of the volume, false if it doesn't exist
+func (a *Appliance) VolumeProperties(volumePath string) (VolumeProperties, bool) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	v, ok := a.volumes[volumePath]
+	if !ok {
+		return VolumeProperties{}, false
+	}
+	return v.properties, true
+}
+
+// Snapshot - returns snapshot by path, false if it doesn't exist
+func (a *Appliance) Snapshot(snapshotPath string) (ns.Snapshot, bool) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	s, ok := a.snapshots[snapshotPath]
+	if !ok {
+		return ns.Snapshot{}, false
+	}
+	return toNSSnapshot(s), true
+}
+
+// SnapshotUserProperties - returns ZFS user properties of the snapshot, false if it doesn't exist
+func (a *Appliance) SnapshotUserProperties(snapshotPath string) (map[string]string, bool) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	s, ok := a.snapshots[snapshotPath]
+	if !ok {
+		return nil, false
+	}
+	userProperties := map[string]string{}
+	for name, value := range s.userProperties {
+		userProperties[name] = value
+	}
+	return userProperties, true
+}
+
+// LunMappings - returns all LUN mappings of the volume, all mappings if volumePath is empty
+func (a *Appliance) LunMappings(volumePath string) []ns.LunMapping {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return a.findLunMappings(url.Values{"volume": {volumePath}})
+}
+
+// Targets - returns names of all iSCSI targets
+func (a *Appliance) Targets() []string {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return sortedKeys(a.targets)
+}
+
+// TargetGroups - returns names of all target groups
+func (a *Appliance) TargetGroups() []string {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return sortedKeys(a.targetGroups)
+}
+
+// HostGroups - returns names of all host groups
+func (a *Appliance) HostGroups() []string {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return sortedKeys(a.hostGroups)
+}
+
+// route - NEF endpoint handler, "*" in pattern matches any single path segment
+type route struct {
+	method  string
+	pattern []string
+	handler func(a *Appliance, args []string, query url.Values, body []byte) (int, []byte)
+}
+
+var routes = []route{
+	{http.MethodGet, []string{"settings", "license"}, (*Appliance).getLicense},
+	{http.MethodGet, []string{"rsf", "clusters"}, (*Appliance).getRSFClusters},
+	{http.MethodGet, []string{"jobStatus", "*"}, (*Appliance).getJobStatus},
+	{http.MethodGet, []string{"storage", "pools"}, (*Appliance).getPools},
+	{http.MethodGet, []string{"storage", "filesystems"}, (*Appliance).getFilesystems},
+	{http.MethodGet, []string{"storage", "volumeGroups"}, (*Appliance).getVolumeGroups},
+	{http.MethodPost, []string{"storage", "volumeGroups"}, (*Appliance).createVolumeGroup},
+	{http.MethodGet, []string{"storage", "volumes"}, (*Appliance).getVolumes},
+	{http.MethodPost, []string{"storage", "volumes"}, (*Appliance).createVolume},
+	{http.MethodPut, []string{"storage", "volumes", "*"}, (*Appliance).updateVolume},
+	{http.MethodDelete, []string{"storage", "volumes", "*"}, (*Appliance).destroyVolume},
+	{http.MethodPost, []string{"storage", "volumes", "*", "promote"}, (*Appliance).promoteVolume},
+	{http.MethodPost, []string{"storage", "volumes", "*", "rename"}, (*Appliance).renameVolume},
+	{http.MethodPost, []string{"storage", "volumes", "*", "loadKey"}, (*Appliance).loadKey},
+	{http.MethodPost, []string{"storage", "volumes", "*", "unloadKey"}, (*Appliance).unloadKey},
+	{http.MethodGet, []string{"storage", "snapshots"}, (*Appliance).getSnapshots},
+	{http.MethodPost, []string{"storage", "snapshots"}, (*Appliance).createSnapshot},
+	{http.MethodGet, []string{"storage", "snapshots", "*"}, (*Appliance).getSnapshot},
+	{http.MethodDelete, []string{"storage", "snapshots", "*"}, (*Appliance).destroySnapshot},
+	{http.MethodPost, []string{"storage", "snapshots", "*", "clone"}, (*Appliance).cloneSnapshot},
+	{http.MethodGet, []string{"san", "lunMappings"}, (*Appliance).getLunMappings},
+	{http.MethodPost, []string{"san", "lunMappings"}, (*Appliance).createLunMapping},
+	{http.MethodDelete, []string{"san", "lunMappings", "*"}, (*Appliance).destroyLunMapping},
+	{http.MethodGet, []string{"san", "iscsi", "targets"}, (*Appliance).getTargets},
+	{http.MethodPost, []string{"san", "iscsi", "targets"}, (*Appliance).createTarget},
+	{http.MethodPut, []string{"san", "iscsi", "targets", "*"}, (*Appliance).updateTarget},
+	{http.MethodDelete, []string{"san", "iscsi", "targets", "*"}, (*Appliance).destroyTarget},
+	{http.MethodGet, []string{"san", "targetgroups"}, (*Appliance).getTargetGroups},
+	{http.MethodPost, []string{"san", "targetgroups"}, (*Appliance).createTargetGroup},
+	{http.MethodGet, []string{"san", "targetgroups", "*"}, (*Appliance).getTargetGroup},
+	{http.MethodPut, []string{"san", "targetgroups", "*"}, (*Appliance).updateTargetGroup},
+	{http.MethodDelete, []string{"san", "targetgroups", "*"}, (*Appliance).destroyTargetGroup},
+	{http.MethodGet, []string{"san", "hostgroups"}, (*Appliance).getHostGroups},
+	{http.MethodPost, []string{"san", "hostgroups"}, (*Appliance).createHostGroup},
+	{http.MethodPut, []string{"san", "hostgroups", "*"}, (*Appliance).updateHostGroup},
+	{http.MethodDelete, []string{"san", "hostgroups", "*"}, (*Appliance).destroyHostGroup},
+	// go-nexentastor sends host group updates to this path
+	{http.MethodPut, []string{"storage", "hostgroups", "*"}, (*Appliance).updateHostGroup},
+	{http.MethodPost, []string{"san", "iscsi", "remoteInitiators"}, (*Appliance).createRemoteInitiator},
+	{http.MethodGet, []string{"san", "iscsi", "remoteInitiators", "*"}, (*Appliance).getRemoteInitiator},
+	{http.MethodPut, []string{"san", "iscsi", "remoteInitiators", "*"}, (*Appliance).updateRemoteInitiator},
+	{http.MethodPost, []string{"hpr", "services"}, (*Appliance).createReplicationService},
+	{http.MethodGet, []string{"hpr", "services"}, (*Appliance).getReplicationServices},
+	{http.MethodGet, []string{"hpr", "services", "*"}, (*Appliance).getReplicationService},
+	{http.MethodDelete, []string{"hpr", "services", "*"}, (*Appliance).destroyReplicationService},
+	{http.MethodPost, []string{"hpr", "services", "*", "start"}, (*Appliance).startReplicationService},
+	{http.MethodPost, []string{"hpr", "services", "*", "enable"}, (*Appliance).enableReplicationService},
+}
+
+// Handle - serves one NEF REST request, returns HTTP status code and response body
+// uri - request path with query string, path segments may be escaped (e.g. "storage/volumes/p%2Fvg%2Fv")
+// token - auth token from "Authorization: Bearer <token>" header
+func (a *Appliance) Handle(method, uri, token string, body []byte) (int, []byte) {
+	u, segments, err := parseURI(uri)
+	if err != nil {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "%s", err)
+	}
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if method == http.MethodPost && matchSegments(loginPattern, segments) != nil {
+		return a.login(body)
+	}
+	if !a.tokens[token] {
+		return nefErrorResponse(http.StatusUnauthorized, CodeAuth, "Not authenticated")
+	}
+
+	if r, args := findRoute(method, segments); r != nil {
+		return r.handler(a, args, u.Query(), body)
+	}
+
+	return nefErrorResponse(http.StatusNotFound, CodeNotExist, "Endpoint '%s %s' is not supported", method, u.Path)
+}
+
+// Serve - same as Handle(), but injects faults configured by Faults(),
+// returns error if the client doesn't get any response (timeout, dropped response)
+func (a *Appliance) Serve(method, uri, token string, body []byte) (int, []byte, error) {
+	_, segments, err := parseURI(uri)
+	if err != nil {
+		code, response := nefErrorResponse(http.StatusBadRequest, CodeBadArg, "%s", err)
+		return code, response, nil
+	}
+
+	endpoint := strings.Join(segments, "/")
+	if method == http.MethodPost && matchSegments(loginPattern, segments) != nil {
+		endpoint = strings.Join(loginPattern, "/")
+	} else if r, _ := findRoute(method, segments); r != nil {
+		endpoint = strings.Join(r.pattern, "/")
+	}
+
+	rule := a.faults.next(method, endpoint)
+	if rule == nil {
+		code, response := a.Handle(method, uri, token, body)
+		return code, response, nil
+	}
+
+	time.Sleep(rule.Latency)
+	switch rule.Kind {
+	case FaultServerError:
+		statusCode := rule.StatusCode
+		if statusCode == 0 {
+			statusCode = http.StatusInternalServerError
+		}
+		code, response := nefErrorResponse(statusCode, CodeIO, "Injected fault: %s %s", method, endpoint)
+		return code, response, nil
+	case FaultBusy:
+		code, response := nefErrorResponse(http.StatusBadRequest, CodeBusy, "Injected fault: %s %s", method, endpoint)
+		return code, response, nil
+	case FaultTimeout:
+		return 0, nil, ErrTimeout
+	case FaultDropResponse:
+		a.Handle(method, uri, token, body)
+		return 0, nil, ErrDroppedResponse
+	}
+	code, response := a.Handle(method, uri, token, body)
+	return code, response, nil
+}
+
+// Faults - returns fault rules of the appliance, faults are injected by Serve() only
+func (a *Appliance) Faults() *Faults {
+	return a.faults
+}
+
+// parseURI - parses request URI, returns unescaped path segments without API version prefix
+func parseURI(uri string) (*url.URL, []string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot parse request URI '%s': %s", uri, err)
+	}
+
+	var segments []string
+	for _, s := range strings.Split(u.EscapedPath(), "/") {
+		if s == "" {
+			continue
+		}
+		if len(segments) == 0 && regexpAPIVersion.MatchString(s) {
+			continue
+		}
+		unescaped, err := url.PathUnescape(s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Cannot unescape path segment '%s': %s", s, err)
+		}
+		segments = append(segments, unescaped)
+	}
+	return u, segments, nil
+}
+
+// findRoute - returns route that serves the request and values of its "*" pattern segments
+func findRoute(method string, segments []string) (*route, []string) {
+	for i, r := range routes {
+		if r.method != method {
+			continue
+		}
+		if args := matchSegments(r.pattern, segments); args != nil {
+			return &routes[i], args
+		}
+	}
+	return nil, nil
+}
+
+// matchSegments - returns values of "*" pattern segments or nil if path doesn't match the pattern
+func matchSegments(pattern, segments []string) []string {
+	if len(pattern) != len(segments) {
+		return nil
+	}
+	args := []string{}
+	for i, p := range pattern {
+		if p == "*" {
+			args = append(args, segments[i])
+		} else if p != segments[i] {
+			return nil
+		}
+	}
+	return args
+}
+
+func (a *Appliance) login(body []byte) (int, []byte) {
+	credentials := struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}{}
+	if err := json.Unmarshal(body, &credentials); err != nil {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "Cannot parse login request: %s", err)
+	}
+	if credentials.Username != a.username || credentials.Password != a.password {
+		return nefErrorResponse(http.StatusUnauthorized, CodeAuth, "Invalid username or password")
+	}
+	token := a.newID("token")
+	a.tokens[token] = true
+	return jsonResponse(http.StatusOK, map[string]string{"token": token})
+}
+
+func (a *Appliance) getLicense(args []string, query url.Values, body []byte) (int, []byte) {
+	return jsonResponse(http.StatusOK, a.license)
+}
+
+func (a *Appliance) getRSFClusters(args []string, query url.Values, body []byte) (int, []byte) {
+	return dataResponse(a.clusters)
+}
+
+func (a *Appliance) getJobStatus(args []string, query url.Values, body []byte) (int, []byte) {
+	// all jobs are synchronous
+	return jsonResponse(http.StatusOK, map[string]string{})
+}
+
+func (a *Appliance) getPools(args []string, query url.Values, body []byte) (int, []byte) {
+	pools := []nefPool{}
+	for _, name := range sortedKeys(a.pools) {
+		if poolName := query.Get("poolName"); poolName != "" && poolName != name {
+			continue
+		}
+		p := a.pools[name]
+		status := "online"
+		if p.health == PoolHealthFaulted {
+			status = "unavailable"
+		}
+		pools = append(pools, nefPool{Name: name, Health: p.health, Status: status})
+	}
+	return dataResponse(pools)
+}
+
+func (a *Appliance) getFilesystems(args []string, query url.Values, body []byte) (int, []byte) {
+	// volume groups are the only filesystems on block appliance
+	filesystems := []ns.Filesystem{}
+	if vg, ok := a.volumeGroups[query.Get("path")]; ok {
+		available, used := a.volumeGroupUsage(vg.path)
+		filesystems = append(filesystems, ns.Filesystem{
+			Path:           vg.path,
+			MountPoint:     "/" + vg.path,
+			BytesAvailable: available,
+			BytesUsed:      used,
+		})
+	}
+	return dataResponse(filesystems)
+}
+
+// getVolumeGroups - returns the volume group by "path", all volume groups sorted by path if it's not set
+func (a *Appliance) getVolumeGroups(args []string, query url.Values, body []byte) (int, []byte) {
+	volumeGroups := []nefVolumeGroup{}
+	for _, p := range sortedKeys(a.volumeGroups) {
+		if vgPath := query.Get("path"); vgPath != "" && vgPath != p {
+			continue
+		}
+		available, used := a.volumeGroupUsage(p)
+		volumeGroups = append(volumeGroups, nefVolumeGroup{
+			Path:            p,
+			BytesAvailable:  available,
+			BytesUsed:       used,
+			VolumeBlockSize: a.volumeGroups[p].volumeBlockSize,
+		})
+	}
+
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	if offset > len(volumeGroups) {
+		offset = len(volumeGroups)
+	}
+	volumeGroups = volumeGroups[offset:]
+	if limit, err := strconv.Atoi(query.Get("limit")); err == nil && limit < len(volumeGroups) {
+		volumeGroups = volumeGroups[:limit]
+	}
+
+	return dataResponse(volumeGroups)
+}
+
+// createVolumeGroup - creates volume group in existing pool or volume group, block size of new volumes is inherited
+func (a *Appliance) createVolumeGroup(args []string, query url.Values, body []byte) (int, []byte) {
+	params := struct {
+		Path string `json:"path"`
+	}{}
+	if err := json.Unmarshal(body, &params); err != nil {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "Cannot parse request: %s", err)
+	}
+	if params.Path == "" || strings.Contains(params.Path, "@") || !strings.Contains(params.Path, "/") {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "Invalid volume group path '%s'", params.Path)
+	}
+	if _, ok := a.volumeGroups[params.Path]; ok {
+		return nefErrorResponse(
+			http.StatusBadRequest, CodeAlreadyExist, "Volume group '%s' already exists", params.Path)
+	}
+	if _, ok := a.volumes[params.Path]; ok {
+		return nefErrorResponse(http.StatusBadRequest, CodeAlreadyExist, "Volume '%s' already exists", params.Path)
+	}
+
+	volumeBlockSize := DefaultVolumeBlockSize
+	if parent, ok := a.volumeGroups[path.Dir(params.Path)]; ok {
+		volumeBlockSize = parent.volumeBlockSize
+	} else if _, ok := a.pools[path.Dir(params.Path)]; !ok {
+		return nefErrorResponse(http.StatusNotFound, CodeNotExist, "Dataset '%s' not found", path.Dir(params.Path))
+	}
+	a.volumeGroups[params.Path] = &volumeGroup{path: params.Path, volumeBlockSize: volumeBlockSize}
+	return http.StatusCreated, nil
+}
+
+func (a *Appliance) getVolumes(args []string, query url.Values, body []byte) (int, []byte) {
+	volumes := []nefVolume{}
+	if volumePath := query.Get("path"); volumePath != "" {
+		if v, ok := a.volumes[volumePath]; ok {
+			volumes = append(volumes, a.toNSVolume(v))
+		}
+		return dataResponse(volumes)
+	}
+
+	parent := query.Get("parent")
+	for _, p := range sortedKeys(a.volumes) {
+		if path.Dir(p) == parent {
+			volumes = append(volumes, a.toNSVolume(a.volumes[p]))
+		}
+	}
+
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	if offset > len(volumes) {
+		offset = len(volumes)
+	}
+	volumes = volumes[offset:]
+	if limit, err := strconv.Atoi(query.Get("limit")); err == nil && limit < len(volumes) {
+		volumes = volumes[:limit]
+	}
+
+	return dataResponse(volumes)
+}
+
+func (a *Appliance) createVolume(args []string, query url.Values, body []byte) (int, []byte) {
+	params := struct {
+		ns.CreateVolumeParams
+		VolumeProperties
+		newEncryption
+	}{}
+	if err := json.Unmarshal(body, &params); err != nil {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "Cannot parse request: %s", err)
+	}
+	if params.VolumeSize <= 0 {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "Volume size must be greater than 0")
+	}
+	if bs := params.VolumeBlockSize; bs != 0 && (bs < 512 || bs > 1024*1024 || bs&(bs-1) != 0) {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "Invalid volumeBlockSize: %d", bs)
+	}
+	if code, body := a.checkNewVolumePath(params.Path); code != 0 {
+		return code, body
+	}
+	if !params.SparseVolume {
+		if available, _ := a.volumeGroupUsage(path.Dir(params.Path)); available < params.VolumeSize {
+			return nefErrorResponse(
+				http.StatusBadRequest,
+				CodeNoSpace,
+				"Not enough space to create volume '%s': requested %d, available %d",
+				params.Path,
+				params.VolumeSize,
+				available,
+			)
+		}
+	}
+
+	v := &volume{
+		path:       params.Path,
+		volumeSize: params.VolumeSize,
+		status:     VolumeStatusOnline,
+		properties: VolumeProperties{
+			VolumeBlockSize: a.volumeGroups[path.Dir(params.Path)].volumeBlockSize,
+		}.merge(params.VolumeProperties),
+	}
+	if !params.SparseVolume {
+		v.refReservation = params.VolumeSize
+	}
+	if code, body := a.createEncryption(v, params.newEncryption); code != 0 {
+		return code, body
+	}
+	a.txg++
+	v.creationTxg = a.txg
+	a.volumes[params.Path] = v
+	return http.StatusCreated, nil
+}
+
+func (a *Appliance) updateVolume(args []string, query url.Values, body []byte) (int, []byte) {
+	v, ok := a.volumes[args[0]]
+	if !ok {
+		return nefErrorResponse(http.StatusNotFound, CodeNotExist, "Volume '%s' not found", args[0])
+	}
+	params := struct {
+		ns.UpdateVolumeParams
+		VolumeProperties
+		ReferencedReservationSize *int64 `json:"referencedReservationSize"`
+	}{}
+	if err := json.Unmarshal(body, &params); err != nil {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "Cannot parse request: %s", err)
+	}
+	if params.VolumeBlockSize != 0 && params.VolumeBlockSize != v.properties.VolumeBlockSize {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "volumeBlockSize cannot be changed")
+	}
+	if r := params.ReferencedReservationSize; r != nil && (*r < 0 || *r > v.volumeSize) {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "Invalid referencedReservationSize: %d", *r)
+	}
+	if params.VolumeSize != 0 {
+		if v.refReservation == v.volumeSize {
+			// thick volume reservation grows with the volume
+			v.refReservation = params.VolumeSize
+		}
+		v.volumeSize = params.VolumeSize
+	}
+	if params.ReferencedReservationSize != nil {
+		v.refReservation = *params.ReferencedReservationSize
+	}
+	v.properties = v.properties.merge(params.VolumeProperties)
+	return http.StatusOK, nil
+}
+
+func (a *Appliance) destroyVolume(args []string, query url.Values, body []byte) (int, []byte) {
+	v, ok := a.volumes[args[0]]
+	if !ok {
+		return nefErrorResponse(http.StatusNotFound, CodeNotExist, "Volume '%s' not found", args[0])
+	}
+	if len(a.findLunMappings(url.Values{"volume": {v.path}})) != 0 {
+		return nefErrorResponse(http.StatusBadRequest, CodeBusy, "Volume '%s' is in use by LUN mapping", v.path)
+	}
+
+	snapshots := a.findSnapshots(v.path, false)
+	for _, s := range snapshots {
+		if len(s.clones) != 0 {
+			return nefErrorResponse(
+				http.StatusBadRequest,
+				CodeAlreadyExist,
+				"Volume '%s' has dependent clones: %s",
+				v.path,
+				strings.Join(s.clones, ","),
+			)
+		}
+	}
+	if len(snapshots) != 0 && query.Get("snapshots") != "true" {
+		return nefErrorResponse(http.StatusBadRequest, CodeBusy, "Volume '%s' has snapshots", v.path)
+	}
+
+	for _, s := range snapshots {
+		delete(a.snapshots, s.path)
+	}
+	a.detachFromOrigin(v)
+	a.releaseEncryptionRoot(v)
+	delete(a.volumes, v.path)
+	return http.StatusOK, nil
+}
+
+// promoteVolume - moves origin snapshots (up to clone's origin) from origin volume to the clone
+func (a *Appliance) promoteVolume(args []string, query url.Values, body []byte) (int, []byte) {
+	clone, ok := a.volumes[args[0]]
+	if !ok {
+		return nefErrorResponse(http.StatusNotFound, CodeNotExist, "Volume '%s' not found", args[0])
+	}
+	originSnapshot, ok := a.snapshots[clone.origin]
+	if !ok {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "Volume '%s' is not a clone", clone.path)
+	}
+	originVolume := a.volumes[originSnapshot.parent]
+
+	a.detachFromOrigin(clone)
+	for _, s := range a.findSnapshots(originVolume.path, false) {
+		if s.creationTxg > originSnapshot.creationTxg {
+			continue
+		}
+		delete(a.snapshots, s.path)
+		s.parent = clone.path
+		s.path = fmt.Sprintf("%s@%s", clone.path, s.name)
+		a.snapshots[s.path] = s
+		for _, c := range s.clones {
+			if cv, ok := a.volumes[c]; ok {
+				cv.origin = s.path
+			}
+		}
+	}
+	clone.origin = originVolume.origin
+	originVolume.origin = fmt.Sprintf("%s@%s", clone.path, originSnapshot.name)
+	moved := a.snapshots[originVolume.origin]
+	moved.clones = append(moved.clones, originVolume.path)
+	if s, ok := a.snapshots[clone.origin]; ok {
+		s.clones = replaceString(s.clones, originVolume.path, clone.path)
+	}
+	return http.StatusOK, nil
+}
+
+// renameVolume - moves volume with its snapshots to another path in the same pool,
+// clones and the encryption key follow it, mapped volumes can't be renamed
+func (a *Appliance) renameVolume(args []string, query url.Values, body []byte) (int, []byte) {
+	v, ok := a.volumes[args[0]]
+	if !ok {
+		return nefErrorResponse(http.StatusNotFound, CodeNotExist, "Volume '%s' not found", args[0])
+	}
+	params := struct {
+		NewPath string `json:"newPath"`
+	}{}
+	if err := json.Unmarshal(body, &params); err != nil {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "Cannot parse request: %s", err)
+	}
+	if code, body := a.checkNewVolumePath(params.NewPath); code != 0 {
+		return code, body
+	}
+	if strings.Split(params.NewPath, "/")[0] != strings.Split(v.path, "/")[0] {
+		return nefErrorResponse(
+			http.StatusBadRequest, CodeBadArg, "Volume '%s' cannot be moved to another pool", v.path)
+	}
+	if len(a.findLunMappings(url.Values{"volume": {v.path}})) != 0 {
+		return nefErrorResponse(http.StatusBadRequest, CodeBusy, "Volume '%s' is in use by LUN mapping", v.path)
+	}
+
+	oldPath := v.path
+	for _, s := range a.findSnapshots(oldPath, false) {
+		delete(a.snapshots, s.path)
+		s.parent = params.NewPath
+		s.path = fmt.Sprintf("%s@%s", params.NewPath, s.name)
+		a.snapshots[s.path] = s
+		for _, c := range s.clones {
+			if cv, ok := a.volumes[c]; ok {
+				cv.origin = s.path
+			}
+		}
+	}
+	if s, ok := a.snapshots[v.origin]; ok {
+		s.clones = replaceString(s.clones, oldPath, params.NewPath)
+	}
+	if k, ok := a.keys[oldPath]; ok {
+		delete(a.keys, oldPath)
+		a.keys[params.NewPath] = k
+	}
+	for _, other := range a.volumes {
+		if other.encryptionRoot == oldPath {
+			other.encryptionRoot = params.NewPath
+		}
+	}
+	delete(a.volumes, oldPath)
+	v.path = params.NewPath
+	a.volumes[v.path] = v
+	return http.StatusOK, nil
+}
+
+func (a *Appliance) getSnapshots(args []string, query url.Values, body []byte) (int, []byte) {
+	snapshots := []nefSnapshot{}
+	for _, s := range a.findSnapshots(query.Get("parent"), query.Get("recursive") == "true") {
+		snapshots = append(snapshots, toNEFSnapshot(s))
+	}
+	return dataResponse(snapshots)
+}
+
+// createSnapshot - snapshots a volume or a volume group, recursive snapshot of a volume group
+// snapshots all volumes and volume groups in it in one txg, it fails if any of the snapshots exists
+func (a *Appliance) createSnapshot(args []string, query url.Values, body []byte) (int, []byte) {
+	params := struct {
+		ns.CreateSnapshotParams
+		Recursive      bool              `json:"recursive"`
+		UserProperties map[string]string `json:"userProperties"`
+	}{}
+	if err := json.Unmarshal(body, &params); err != nil {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "Cannot parse request: %s", err)
+	}
+	parts := strings.Split(params.Path, "@")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "Invalid snapshot path '%s'", params.Path)
+	}
+	_, isVolume := a.volumes[parts[0]]
+	if _, ok := a.volumeGroups[parts[0]]; !ok && !isVolume {
+		return nefErrorResponse(http.StatusNotFound, CodeNotExist, "Dataset '%s' not found", parts[0])
+	}
+
+	datasets := []string{parts[0]}
+	if params.Recursive {
+		for _, p := range append(sortedKeys(a.volumeGroups), sortedKeys(a.volumes)...) {
+			if strings.HasPrefix(p, parts[0]+"/") {
+				datasets = append(datasets, p)
+			}
+		}
+	}
+	for _, d := range datasets {
+		if _, ok := a.snapshots[d+"@"+parts[1]]; ok {
+			return nefErrorResponse(
+				http.StatusBadRequest, CodeAlreadyExist, "Snapshot '%s@%s' already exists", d, parts[1])
+		}
+	}
+
+	a.txg++
+	creationTime := time.Now().UTC().Truncate(time.Second)
+	for _, d := range datasets {
+		s := &snapshot{
+			path:         d + "@" + parts[1],
+			name:         parts[1],
+			parent:       d,
+			creationTxg:  a.txg,
+			creationTime: creationTime,
+			clones:       []string{},
+		}
+		if len(params.UserProperties) != 0 {
+			s.userProperties = map[string]string{}
+			for name, value := range params.UserProperties {
+				s.userProperties[name] = value
+			}
+		}
+		if v, ok := a.volumes[d]; ok {
+			s.volumeSize = v.volumeSize
+			s.bytesReferenced = v.refReservation
+		}
+		a.snapshots[s.path] = s
+	}
+	return http.StatusCreated, nil
+}
+
+func (a *Appliance) getSnapshot(args []string, query url.Values, body []byte) (int, []byte) {
+	s, ok := a.snapshots[args[0]]
+	if !ok {
+		return nefErrorResponse(http.StatusNotFound, CodeNotExist, "Snapshot '%s' not found", args[0])
+	}
+	return jsonResponse(http.StatusOK, toNEFSnapshot(s))
+}
+
+func (a *Appliance) destroySnapshot(args []string, query url.Values, body []byte) (int, []byte) {
+	s, ok := a.snapshots[args[0]]
+	if !ok {
+		return nefErrorResponse(http.StatusNotFound, CodeNotExist, "Snapshot '%s' not found", args[0])
+	}
+	if len(s.clones) != 0 {
+		return nefErrorResponse(
+			http.StatusBadRequest,
+			CodeBusy,
+			"Snapshot '%s' has dependent clones: %s",
+			s.path,
+			strings.Join(s.clones, ","),
+		)
+	}
+	delete(a.snapshots, s.path)
+	return http.StatusOK, nil
+}
+
+func (a *Appliance) cloneSnapshot(args []string, query url.Values, body []byte) (int, []byte) {
+	s, ok := a.snapshots[args[0]]
+	if !ok {
+		return nefErrorResponse(http.StatusNotFound, CodeNotExist, "Snapshot '%s' not found", args[0])
+	}
+	params := struct {
+		ns.CloneSnapshotParams
+		VolumeProperties
+	}{}
+	if err := json.Unmarshal(body, &params); err != nil {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "Cannot parse request: %s", err)
+	}
+	if params.VolumeBlockSize != 0 {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "volumeBlockSize of a clone cannot be changed")
+	}
+	if code, body := a.checkNewVolumePath(params.TargetPath); code != 0 {
+		return code, body
+	}
+	properties := VolumeProperties{VolumeBlockSize: DefaultVolumeBlockSize}
+	origin := a.volumes[s.parent]
+	if origin != nil {
+		properties = origin.properties
+	}
+
+	clone := &volume{
+		path:       params.TargetPath,
+		volumeSize: s.volumeSize,
+		origin:     s.path,
+		status:     VolumeStatusOnline,
+		properties: properties.merge(params.VolumeProperties),
+	}
+	if code, body := a.inheritEncryption(clone, origin); code != 0 {
+		return code, body
+	}
+	a.txg++
+	clone.creationTxg = a.txg
+	a.volumes[params.TargetPath] = clone
+	s.clones = append(s.clones, params.TargetPath)
+	return http.StatusCreated, nil
+}
+
+func (a *Appliance) getLunMappings(args []string, query url.Values, body []byte) (int, []byte) {
+	return dataResponse(a.findLunMappings(query))
+}
+
+func (a *Appliance) createLunMapping(args []string, query url.Values, body []byte) (int, []byte) {
+	params := ns.CreateLunMappingParams{}
+	if err := json.Unmarshal(body, &params); err != nil {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "Cannot parse request: %s", err)
+	}
+	if _, ok := a.volumes[params.Volume]; !ok {
+		return nefErrorResponse(http.StatusNotFound, CodeNotExist, "Volume '%s' not found", params.Volume)
+	}
+	if _, ok := a.targetGroups[params.TargetGroup]; !ok {
+		return nefErrorResponse(http.StatusNotFound, CodeNotExist, "Target group '%s' not found", params.TargetGroup)
+	}
+	if _, ok := a.hostGroups[params.HostGroup]; !ok && params.HostGroup != AllHostGroup {
+		return nefErrorResponse(http.StatusNotFound, CodeNotExist, "Host group '%s' not found", params.HostGroup)
+	}
+
+	usedLuns := map[int]bool{}
+	for _, m := range a.lunMappings {
+		if m.TargetGroup != params.TargetGroup {
+			continue
+		}
+		if m.Volume == params.Volume && m.HostGroup == params.HostGroup {
+			return nefErrorResponse(
+				http.StatusBadRequest,
+				CodeAlreadyExist,
+				"LUN mapping for '%s' already exists",
+				params.Volume,
+			)
+		}
+		usedLuns[m.Lun] = true
+	}
+	lun := 0
+	for usedLuns[lun] {
+		lun++
+	}
+
+	id := a.newID("lm")
+	a.lunMappings[id] = &ns.LunMapping{
+		Id:          id,
+		Volume:      params.Volume,
+		TargetGroup: params.TargetGroup,
+		HostGroup:   params.HostGroup,
+		Lun:         lun,
+	}
+	return http.StatusCreated, nil
+}
+
+func (a *Appliance) destroyLunMapping(args []string, query url.Values, body []byte) (int, []byte) {
+	if _, ok := a.lunMappings[args[0]]; !ok {
+		return nefErrorResponse(http.StatusNotFound, CodeNotExist, "LUN mapping '%s' not found", args[0])
+	}
+	delete(a.lunMappings, args[0])
+	return http.StatusOK, nil
+}
+
+func (a *Appliance) getTargets(args []string, query url.Values, body []byte) (int, []byte) {
+	targets := []ns.ISCSITarget{}
+	name := query.Get("name")
+	for _, n := range sortedKeys(a.targets) {
+		if name == "" || name == n {
+			targets = append(targets, *a.targets[n])
+		}
+	}
+
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	if offset > len(targets) {
+		offset = len(targets)
+	}
+	targets = targets[offset:]
+	if limit, err := strconv.Atoi(query.Get("limit")); err == nil && limit < len(targets) {
+		targets = targets[:limit]
+	}
+	return dataResponse(targets)
+}
+
+func (a *Appliance) createTarget(args []string, query url.Values, body []byte) (int, []byte) {
+	params := ns.CreateISCSITargetParams{}
+	if err := json.Unmarshal(body, &params); err != nil {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "Cannot parse request: %s", err)
+	}
+	if _, ok := a.targets[params.Name]; ok {
+		return nefErrorResponse(http.StatusBadRequest, CodeAlreadyExist, "Target '%s' already exists", params.Name)
+	}
+	a.targets[params.Name] = &ns.ISCSITarget{
+		Name:           params.Name,
+		State:          "online",
+		Authentication: "none",
+		Portals:        params.Portals,
+	}
+	return http.StatusCreated, nil
+}
+
+func (a *Appliance) updateTarget(args []string, query url.Values, body []byte) (int, []byte) {
+	t, ok := a.targets[args[0]]
+	if !ok {
+		return nefErrorResponse(http.StatusNotFound, CodeNotExist, "Target '%s' not found", args[0])
+	}
+	params := ns.UpdateISCSITargetParams{}
+	if err := json.Unmarshal(body, &params); err != nil {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "Cannot parse request: %s", err)
+	}
+	t.Authentication = params.Authentication
+	return http.StatusOK, nil
+}
+
+func (a *Appliance) destroyTarget(args []string, query url.Values, body []byte) (int, []byte) {
+	if _, ok := a.targets[args[0]]; !ok {
+		return nefErrorResponse(http.StatusNotFound, CodeNotExist, "Target '%s' not found", args[0])
+	}
+	for _, name := range sortedKeys(a.targetGroups) {
+		for _, member := range a.targetGroups[name].Members {
+			if member == args[0] {
+				return nefErrorResponse(
+					http.StatusBadRequest, CodeBusy, "Target '%s' is a member of target group '%s'", args[0], name)
+			}
+		}
+	}
+	delete(a.targets, args[0])
+	return http.StatusOK, nil
+}
+
+func (a *Appliance) getTargetGroups(args []string, query url.Values, body []byte) (int, []byte) {
+	targetGroups := []ns.TargetGroup{}
+	for _, name := range sortedKeys(a.targetGroups) {
+		targetGroups = append(targetGroups, *a.targetGroups[name])
+	}
+	return dataResponse(targetGroups)
+}
+
+func (a *Appliance) getTargetGroup(args []string, query url.Values, body []byte) (int, []byte) {
+	tg, ok := a.targetGroups[args[0]]
+	if !ok {
+		return nefErrorResponse(http.StatusNotFound, CodeNotExist, "Target group '%s' not found", args[0])
+	}
+	return jsonResponse(http.StatusOK, tg)
+}
+
+func (a *Appliance) createTargetGroup(args []string, query url.Values, body []byte) (int, []byte) {
+	params := ns.CreateTargetGroupParams{}
+	if err := json.Unmarshal(body, &params); err != nil {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "Cannot parse request: %s", err)
+	}
+	if _, ok := a.targetGroups[params.Name]; ok {
+		return nefErrorResponse(http.StatusBadRequest, CodeAlreadyExist, "Target group '%s' already exists", params.Name)
+	}
+	if code, body := a.checkTargets(params.Members); code != 0 {
+		return code, body
+	}
+	a.targetGroups[params.Name] = &ns.TargetGroup{Name: params.Name, Members: params.Members}
+	return http.StatusCreated, nil
+}
+
+func (a *Appliance) updateTargetGroup(args []string, query url.Values, body []byte) (int, []byte) {
+	tg, ok := a.targetGroups[args[0]]
+	if !ok {
+		return nefErrorResponse(http.StatusNotFound, CodeNotExist, "Target group '%s' not found", args[0])
+	}
+	params := ns.UpdateTargetGroupParams{}
+	if err := json.Unmarshal(body, &params); err != nil {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "Cannot parse request: %s", err)
+	}
+	if code, body := a.checkTargets(params.Members); code != 0 {
+		return code, body
+	}
+	tg.Members = params.Members
+	return http.StatusOK, nil
+}
+
+func (a *Appliance) destroyTargetGroup(args []string, query url.Values, body []byte) (int, []byte) {
+	if _, ok := a.targetGroups[args[0]]; !ok {
+		return nefErrorResponse(http.StatusNotFound, CodeNotExist, "Target group '%s' not found", args[0])
+	}
+	if len(a.findLunMappings(url.Values{"targetGroup": {args[0]}})) != 0 {
+		return nefErrorResponse(http.StatusBadRequest, CodeBusy, "Target group '%s' is in use by LUN mapping", args[0])
+	}
+	delete(a.targetGroups, args[0])
+	return http.StatusOK, nil
+}
+
+func (a *Appliance) getHostGroups(args []string, query url.Values, body []byte) (int, []byte) {
+	hostGroups := []hostGroup{}
+	for _, name := range sortedKeys(a.hostGroups) {
+		hostGroups = append(hostGroups, *a.hostGroups[name])
+	}
+	return dataResponse(hostGroups)
+}
+
+func (a *Appliance) createHostGroup(args []string, query url.Values, body []byte) (int, []byte) {
+	params := ns.CreateHostGroupParams{}
+	if err := json.Unmarshal(body, &params); err != nil {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "Cannot parse request: %s", err)
+	}
+	if _, ok := a.hostGroups[params.Name]; ok || params.Name == AllHostGroup {
+		return nefErrorResponse(http.StatusBadRequest, CodeAlreadyExist, "Host group '%s' already exists", params.Name)
+	}
+	a.hostGroups[params.Name] = &hostGroup{Name: params.Name, Members: params.Members}
+	return http.StatusCreated, nil
+}
+
+func (a *Appliance) updateHostGroup(args []string, query url.Values, body []byte) (int, []byte) {
+	hg, ok := a.hostGroups[args[0]]
+	if !ok {
+		return nefErrorResponse(http.StatusNotFound, CodeNotExist, "Host group '%s' not found", args[0])
+	}
+	params := ns.UpdateHostGroupParams{}
+	if err := json.Unmarshal(body, &params); err != nil {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "Cannot parse request: %s", err)
+	}
+	hg.Members = params.Members
+	return http.StatusOK, nil
+}
+
+func (a *Appliance) destroyHostGroup(args []string, query url.Values, body []byte) (int, []byte) {
+	if _, ok := a.hostGroups[args[0]]; !ok {
+		return nefErrorResponse(http.StatusNotFound, CodeNotExist, "Host group '%s' not found", args[0])
+	}
+	if len(a.findLunMappings(url.Values{"hostGroup": {args[0]}})) != 0 {
+		return nefErrorResponse(http.StatusBadRequest, CodeBusy, "Host group '%s' is in use by LUN mapping", args[0])
+	}
+	delete(a.hostGroups, args[0])
+	return http.StatusOK, nil
+}
+
+func (a *Appliance) getRemoteInitiator(args []string, query url.Values, body []byte) (int, []byte) {
+	ri, ok := a.remoteInitiators[args[0]]
+	if !ok {
+		return nefErrorResponse(http.StatusNotFound, CodeNotExist, "Remote initiator '%s' not found", args[0])
+	}
+	return jsonResponse(http.StatusOK, ns.RemoteInitiator{
+		Name:          ri.name,
+		ChapUser:      ri.chapUser,
+		ChapSecretSet: ri.chapSecret != "",
+	})
+}
+
+func (a *Appliance) createRemoteInitiator(args []string, query url.Values, body []byte) (int, []byte) {
+	params := ns.CreateRemoteInitiatorParams{}
+	if err := json.Unmarshal(body, &params); err != nil {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "Cannot parse request: %s", err)
+	}
+	if _, ok := a.remoteInitiators[params.Name]; ok {
+		return nefErrorResponse(
+			http.StatusBadRequest,
+			CodeAlreadyExist,
+			"Remote initiator '%s' already exists",
+			params.Name,
+		)
+	}
+	a.remoteInitiators[params.Name] = &remoteInitiator{
+		name:       params.Name,
+		chapUser:   params.ChapUser,
+		chapSecret: params.ChapSecret,
+	}
+	return http.StatusCreated, nil
+}
+
+func (a *Appliance) updateRemoteInitiator(args []string, query url.Values, body []byte) (int, []byte) {
+	ri, ok := a.remoteInitiators[args[0]]
+	if !ok {
+		return nefErrorResponse(http.StatusNotFound, CodeNotExist, "Remote initiator '%s' not found", args[0])
+	}
+	params := ns.UpdateRemoteInitiatorParams{}
+	if err := json.Unmarshal(body, &params); err != nil {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "Cannot parse request: %s", err)
+	}
+	ri.chapUser = params.ChapUser
+	ri.chapSecret = params.ChapSecret
+	return http.StatusOK, nil
+}
+
+// checkNewVolumePath - checks that volume can be created by the path, returns 0 code on success
+func (a *Appliance) checkNewVolumePath(volumePath string) (int, []byte) {
+	if volumePath == "" || strings.Contains(volumePath, "@") {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "Invalid volume path '%s'", volumePath)
+	}
+	if _, ok := a.volumeGroups[path.Dir(volumePath)]; !ok {
+		return nefErrorResponse(
+			http.StatusNotFound,
+			CodeNotExist,
+			"Volume group '%s' not found",
+			path.Dir(volumePath),
+		)
+	}
+	if _, ok := a.volumes[volumePath]; ok {
+		return nefErrorResponse(http.StatusBadRequest, CodeAlreadyExist, "Volume '%s' already exists", volumePath)
+	}
+	return 0, nil
+}
+
+func (a *Appliance) checkTargets(targets []string) (int, []byte) {
+	for _, t := range targets {
+		if _, ok := a.targets[t]; !ok {
+			return nefErrorResponse(http.StatusNotFound, CodeNotExist, "Target '%s' not found", t)
+		}
+	}
+	return 0, nil
+}
+
+// volumeGroupUsage - returns available and used bytes, volume reservations consume pool space
+func (a *Appliance) volumeGroupUsage(vgPath string) (available, used int64) {
+	poolName := strings.Split(vgPath, "/")[0]
+	var poolUsed int64
+	for _, v := range a.volumes {
+		if strings.Split(v.path, "/")[0] == poolName {
+			poolUsed += v.refReservation
+		}
+		if strings.HasPrefix(v.path, vgPath+"/") {
+			used += v.refReservation
+		}
+	}
+	available = a.pools[poolName].size - poolUsed
+	if available < 0 {
+		available = 0
+	}
+	return available, used
+}
+
+func (a *Appliance) findSnapshots(parent string, recursive bool) []*snapshot {
+	snapshots := []*snapshot{}
+	for _, s := range a.snapshots {
+		if s.parent == parent || (recursive && strings.HasPrefix(s.parent, parent+"/")) {
+			snapshots = append(snapshots, s)
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].creationTxg < snapshots[j].creationTxg
+	})
+	return snapshots
+}
+
+// findLunMappings - returns LUN mappings filtered by "volume", "targetGroup" and "hostGroup" values
+func (a *Appliance) findLunMappings(filter url.Values) []ns.LunMapping {
+	lunMappings := []ns.LunMapping{}
+	for _, id := range sortedKeys(a.lunMappings) {
+		m := a.lunMappings[id]
+		if v := filter.Get("volume"); v != "" && v != m.Volume {
+			continue
+		}
+		if v := filter.Get("targetGroup"); v != "" && v != m.TargetGroup {
+			continue
+		}
+		if v := filter.Get("hostGroup"); v != "" && v != m.HostGroup {
+			continue
+		}
+		lunMappings = append(lunMappings, *m)
+	}
+	return lunMappings
+}
+
+func (a *Appliance) detachFromOrigin(v *volume) {
+	if s, ok := a.snapshots[v.origin]; ok {
+		s.clones = replaceString(s.clones, v.path, "")
+	}
+}
+
+func (a *Appliance) toNSVolume(v *volume) nefVolume {
+	available, _ := a.volumeGroupUsage(path.Dir(v.path))
+	return nefVolume{
+		Volume: ns.Volume{
+			Path:           v.path,
+			BytesAvailable: available,
+			BytesUsed:      v.refReservation,
+			VolumeSize:     v.volumeSize,
+		},
+		VolumeProperties:          v.properties,
+		VolumeEncryption:          a.volumeEncryption(v),
+		ReferencedReservationSize: v.refReservation,
+		Status:                    v.status,
+	}
+}
+
+func toNSSnapshot(s *snapshot) ns.Snapshot {
+	return ns.Snapshot{
+		Path:         s.path,
+		Name:         s.name,
+		Parent:       s.parent,
+		Clones:       append([]string{}, s.clones...),
+		CreationTxg:  strconv.Itoa(s.creationTxg),
+		CreationTime: s.creationTime,
+	}
+}
+
+func toNEFSnapshot(s *snapshot) nefSnapshot {
+	return nefSnapshot{
+		Snapshot:        toNSSnapshot(s),
+		VolumeSize:      s.volumeSize,
+		BytesReferenced: s.bytesReferenced,
+		DeferDestroy:    s.deferDestroy,
+		UserProperties:  s.userProperties,
+	}
+}
+
+func (a *Appliance) newID(prefix string) string {
+	a.lastID++
+	return fmt.Sprintf("%s-%08d", prefix, a.lastID)
+}
+
+// replaceString - replaces value in the list, removes it if replacement is empty
+func replaceString(list []string, value, replacement string) []string {
+	result := []string{}
+	for _, v := range list {
+		if v != value {
+			result = append(result, v)
+		} else if replacement != "" {
+			result = append(result, replacement)
+		}
+	}
+	return result
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func jsonResponse(code int, v interface{}) (int, []byte) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nefErrorResponse(http.StatusInternalServerError, "EINTERNAL", "Cannot marshal response: %s", err)
+	}
+	return code, body
+}
+
+func dataResponse(data interface{}) (int, []byte) {
+	return jsonResponse(http.StatusOK, map[string]interface{}{"data": data})
+}
+
+func nefErrorResponse(code int, nefCode, format string, args ...interface{}) (int, []byte) {
+	body, _ := json.Marshal(map[string]string{
+		"name":    "NefError",
+		"message": fmt.Sprintf(format, args...),
+		"code":    nefCode,
+	})
+	return code, body
+}
+
+// NewAppliance - creates in-memory NexentaStor appliance
+func NewAppliance(args ApplianceArgs) *Appliance {
+	poolSize := args.PoolSize
+	if poolSize == 0 {
+		poolSize = DefaultPoolSize
+	}
+
+	a := &Appliance{
+		username:         args.Username,
+		password:         args.Password,
+		poolSize:         poolSize,
+		tokens:           map[string]bool{},
+		license:          ns.License{Valid: true, Expires: "2099-12-31"},
+		clusters:         []ns.RSFCluster{},
+		pools:            map[string]*pool{},
+		volumeGroups:     map[string]*volumeGroup{},
+		volumes:          map[string]*volume{},
+		snapshots:        map[string]*snapshot{},
+		lunMappings:      map[string]*ns.LunMapping{},
+		targets:          map[string]*ns.ISCSITarget{},
+		targetGroups:     map[string]*ns.TargetGroup{},
+		hostGroups:       map[string]*hostGroup{},
+		remoteInitiators: map[string]*remoteInitiator{},
+		keys:             map[string]*encryptionKey{},
+		faults:           NewFaults(),
+
+		replicationServices: map[string]*ReplicationService{},
+	}
+	for _, vg := range args.VolumeGroups {
+		a.AddVolumeGroup(vg)
+	}
+	return a
+}
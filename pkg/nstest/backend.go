@@ -0,0 +1,103 @@
+package nstest
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+	"github.com/sirupsen/logrus"
+)
+
+// Backend - set of in-memory appliances available by their REST addresses
+type Backend struct {
+	mux        sync.Mutex
+	appliances map[string]*Appliance
+
+	// replicationSeq - sequence number of the last snapshot taken by scheduled replication services
+	replicationSeq int
+}
+
+// Add - makes appliance available by the address (e.g. "https://10.3.3.4:8443")
+func (b *Backend) Add(address string, appliance *Appliance) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.appliances[address] = appliance
+}
+
+// Remove - makes the address unreachable
+func (b *Backend) Remove(address string) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	delete(b.appliances, address)
+}
+
+// Appliance - returns appliance by the address, nil if there is no appliance at the address
+func (b *Backend) Appliance(address string) *Appliance {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.appliances[address]
+}
+
+// NewProvider - creates NexentaStor provider for the appliance by the address,
+// requests to addresses without appliance fail with connection error
+func (b *Backend) NewProvider(args ns.ProviderArgs) (ns.ProviderInterface, error) {
+	if args.Address == "" {
+		return nil, fmt.Errorf("NexentaStor address not specified: %s", args.Address)
+	}
+
+	l := args.Log.WithFields(logrus.Fields{
+		"cmp": "NSProvider",
+		"ns":  args.Address,
+	})
+
+	return &ns.Provider{
+		Address:  args.Address,
+		Username: args.Username,
+		Password: args.Password,
+		RestClient: &Client{
+			appliance: func() *Appliance { return b.Appliance(args.Address) },
+			address:   args.Address,
+		},
+		Log: l,
+	}, nil
+}
+
+// NewResolver - creates NexentaStor resolver for the backend appliances,
+// it's a drop-in replacement of ns.NewResolver()
+func (b *Backend) NewResolver(args ns.ResolverArgs) (*ns.Resolver, error) {
+	if args.Address == "" {
+		return nil, fmt.Errorf("NexentaStor address not specified: %s", args.Address)
+	}
+
+	l := args.Log.WithFields(logrus.Fields{
+		"cmp": "NSResolver",
+		"ns":  args.Address,
+	})
+
+	var nodes []ns.ProviderInterface
+	for _, address := range strings.Split(args.Address, ",") {
+		nsProvider, err := b.NewProvider(ns.ProviderArgs{
+			Address:  address,
+			Username: args.Username,
+			Password: args.Password,
+			Log:      args.Log,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Cannot create provider for %s NexentaStor: %s", address, err)
+		}
+		nodes = append(nodes, nsProvider)
+	}
+
+	return &ns.Resolver{
+		Nodes: nodes,
+		Log:   l,
+	}, nil
+}
+
+// NewBackend - creates empty backend
+func NewBackend() *Backend {
+	return &Backend{
+		appliances: map[string]*Appliance{},
+	}
+}
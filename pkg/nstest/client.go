@@ -0,0 +1,76 @@
+package nstest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sync"
+)
+
+// Client - rest.ClientInterface implementation that sends requests to in-memory Appliance
+type Client struct {
+	// appliance is looked up on each request, so appliance can be added or removed at any time
+	appliance func() *Appliance
+	address   string
+
+	mux       sync.Mutex
+	authToken string
+}
+
+// BuildURI builds request URI using [path?params...] format
+func (c *Client) BuildURI(uri string, params map[string]string) string {
+	paramValues := url.Values{}
+	for key, val := range params {
+		if len(val) != 0 {
+			paramValues.Set(key, val)
+		}
+	}
+
+	if paramsStr := paramValues.Encode(); len(paramsStr) != 0 {
+		uri = fmt.Sprintf("%s?%s", uri, paramsStr)
+	}
+
+	return uri
+}
+
+// Send sends request to the appliance, returns connection error if there is no appliance at the address
+func (c *Client) Send(method, path string, data interface{}) (int, []byte, error) {
+	appliance := c.appliance()
+	if appliance == nil {
+		return 0, nil, fmt.Errorf("%s %s/%s: connect: connection refused", method, c.address, path)
+	}
+
+	var body []byte
+	if data != nil {
+		jsonData, err := json.Marshal(data)
+		if err != nil {
+			return 0, nil, err
+		}
+		body = jsonData
+	}
+
+	c.mux.Lock()
+	token := c.authToken
+	c.mux.Unlock()
+
+	code, responseBody, err := appliance.Serve(method, path, token, body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s %s/%s: %s", method, c.address, path, err)
+	}
+	return code, responseBody, nil
+}
+
+// SetAuthToken sets Bearer auth token for all requests
+func (c *Client) SetAuthToken(token string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.authToken = token
+}
+
+// NewClient - creates REST client for the appliance, address is used in error messages only
+func NewClient(appliance *Appliance, address string) *Client {
+	return &Client{
+		appliance: func() *Appliance { return appliance },
+		address:   address,
+	}
+}
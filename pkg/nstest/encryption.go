@@ -0,0 +1,212 @@
+package nstest
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+)
+
+// EncryptionOff - encryption value of unencrypted volumes
+const EncryptionOff = "off"
+
+// DefaultEncryptionCipher - cipher of volumes created with "on" encryption
+const DefaultEncryptionCipher = "aes-256-gcm"
+
+// Encryption key status values reported by NEF
+const (
+	KeyStatusAvailable   = "available"
+	KeyStatusUnavailable = "unavailable"
+	KeyStatusNone        = "none"
+)
+
+var encryptionCiphers = map[string]bool{
+	"aes-128-ccm": true,
+	"aes-192-ccm": true,
+	"aes-256-ccm": true,
+	"aes-128-gcm": true,
+	"aes-192-gcm": true,
+	"aes-256-gcm": true,
+}
+
+// VolumeEncryption - NEF volume encryption fields, clones share encryption root and key of the origin
+type VolumeEncryption struct {
+	Encryption     string `json:"encryption"`
+	KeyFormat      string `json:"keyFormat,omitempty"`
+	KeyStatus      string `json:"keyStatus"`
+	EncryptionRoot string `json:"encryptionRoot,omitempty"`
+}
+
+// encryptionKey - wrapping key of encryption root
+type encryptionKey struct {
+	format string
+	key    string
+	loaded bool
+}
+
+// newEncryption - encryption fields of create volume request
+type newEncryption struct {
+	Encryption string `json:"encryption"`
+	KeyFormat  string `json:"keyFormat"`
+	Key        string `json:"key"`
+}
+
+// VolumeEncryption - returns encryption of the volume, false if it doesn't exist
+func (a *Appliance) VolumeEncryption(volumePath string) (VolumeEncryption, bool) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	v, ok := a.volumes[volumePath]
+	if !ok {
+		return VolumeEncryption{}, false
+	}
+	return a.volumeEncryption(v), true
+}
+
+// UnloadKeys - unloads all encryption keys as appliance reboot does
+func (a *Appliance) UnloadKeys() {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	for _, k := range a.keys {
+		k.loaded = false
+	}
+}
+
+func (a *Appliance) volumeEncryption(v *volume) VolumeEncryption {
+	k, ok := a.keys[v.encryptionRoot]
+	if v.encryption == "" || !ok {
+		return VolumeEncryption{Encryption: EncryptionOff, KeyStatus: KeyStatusNone}
+	}
+	keyStatus := KeyStatusUnavailable
+	if k.loaded {
+		keyStatus = KeyStatusAvailable
+	}
+	return VolumeEncryption{
+		Encryption:     v.encryption,
+		KeyFormat:      k.format,
+		KeyStatus:      keyStatus,
+		EncryptionRoot: v.encryptionRoot,
+	}
+}
+
+// createEncryption - validates encryption of the new volume and makes it an encryption root
+func (a *Appliance) createEncryption(v *volume, e newEncryption) (int, []byte) {
+	if e.Encryption == "" || e.Encryption == EncryptionOff {
+		return 0, nil
+	}
+	cipher := e.Encryption
+	if cipher == "on" {
+		cipher = DefaultEncryptionCipher
+	}
+	if !encryptionCiphers[cipher] {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "Invalid encryption: %s", e.Encryption)
+	}
+	if !validKey(e.KeyFormat, e.Key) {
+		// the key must not be returned to the client
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "Invalid key for keyFormat '%s'", e.KeyFormat)
+	}
+	v.encryption = cipher
+	v.encryptionRoot = v.path
+	a.keys[v.path] = &encryptionKey{format: e.KeyFormat, key: e.Key, loaded: true}
+	return 0, nil
+}
+
+// inheritEncryption - clone shares encryption root of the origin, the key must be loaded
+func (a *Appliance) inheritEncryption(clone, origin *volume) (int, []byte) {
+	if origin == nil || origin.encryption == "" {
+		return 0, nil
+	}
+	if k := a.keys[origin.encryptionRoot]; k == nil || !k.loaded {
+		return nefErrorResponse(
+			http.StatusBadRequest, CodeAccess, "Encryption key of '%s' is not loaded", origin.encryptionRoot)
+	}
+	clone.encryption = origin.encryption
+	clone.encryptionRoot = origin.encryptionRoot
+	return 0, nil
+}
+
+// releaseEncryptionRoot - moves the key of destroyed encryption root to the next volume sharing it
+func (a *Appliance) releaseEncryptionRoot(v *volume) {
+	if v.encryptionRoot != v.path {
+		return
+	}
+	k := a.keys[v.path]
+	delete(a.keys, v.path)
+	sharing := []string{}
+	for p, other := range a.volumes {
+		if p != v.path && other.encryptionRoot == v.path {
+			sharing = append(sharing, p)
+		}
+	}
+	if len(sharing) == 0 {
+		return
+	}
+	sort.Strings(sharing)
+	for _, p := range sharing {
+		a.volumes[p].encryptionRoot = sharing[0]
+	}
+	a.keys[sharing[0]] = k
+}
+
+func (a *Appliance) loadKey(args []string, query url.Values, body []byte) (int, []byte) {
+	v, ok := a.volumes[args[0]]
+	if !ok {
+		return nefErrorResponse(http.StatusNotFound, CodeNotExist, "Volume '%s' not found", args[0])
+	}
+	k, ok := a.keys[v.path]
+	if !ok {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "Volume '%s' is not an encryption root", v.path)
+	}
+	params := struct {
+		Key string `json:"key"`
+	}{}
+	if err := json.Unmarshal(body, &params); err != nil {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "Cannot parse request: %s", err)
+	}
+	if k.loaded {
+		return nefErrorResponse(http.StatusBadRequest, CodeAlreadyExist, "Key of '%s' is already loaded", v.path)
+	}
+	if params.Key != k.key {
+		return nefErrorResponse(http.StatusBadRequest, CodeAccess, "Incorrect key provided for '%s'", v.path)
+	}
+	k.loaded = true
+	return http.StatusOK, nil
+}
+
+func (a *Appliance) unloadKey(args []string, query url.Values, body []byte) (int, []byte) {
+	v, ok := a.volumes[args[0]]
+	if !ok {
+		return nefErrorResponse(http.StatusNotFound, CodeNotExist, "Volume '%s' not found", args[0])
+	}
+	k, ok := a.keys[v.path]
+	if !ok {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "Volume '%s' is not an encryption root", v.path)
+	}
+	if !k.loaded {
+		return nefErrorResponse(http.StatusBadRequest, CodeAccess, "Key of '%s' is already unloaded", v.path)
+	}
+	for p, other := range a.volumes {
+		if other.encryptionRoot == v.path && len(a.findLunMappings(url.Values{"volume": {p}})) != 0 {
+			return nefErrorResponse(http.StatusBadRequest, CodeBusy, "Volume '%s' is in use by LUN mapping", p)
+		}
+		if p != v.path && other.encryptionRoot == v.path {
+			return nefErrorResponse(http.StatusBadRequest, CodeBusy, "Key of '%s' is used by clone '%s'", v.path, p)
+		}
+	}
+	k.loaded = false
+	return http.StatusOK, nil
+}
+
+// validKey - ZFS key requirements: passphrase of 8-512 bytes, 32 bytes as 64 hex digits or raw
+func validKey(format, key string) bool {
+	switch format {
+	case "passphrase":
+		return len(key) >= 8 && len(key) <= 512
+	case "hex":
+		decoded, err := hex.DecodeString(key)
+		return err == nil && len(decoded) == 32
+	case "raw":
+		return len(key) == 32
+	}
+	return false
+}
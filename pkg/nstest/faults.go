@@ -0,0 +1,164 @@
+package nstest
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FaultKind - type of injected NEF failure
+type FaultKind string
+
+const (
+	// FaultLatency - request is served after FaultRule.Latency delay
+	FaultLatency FaultKind = "latency"
+
+	// FaultServerError - request is not served, HTTP 5xx status (FaultRule.StatusCode, 500 by default)
+	// is returned with EIO NEF error
+	FaultServerError FaultKind = "serverError"
+
+	// FaultBusy - request is not served, EBUSY NEF error is returned
+	FaultBusy FaultKind = "busy"
+
+	// FaultTimeout - request is not served, client gets no response
+	FaultTimeout FaultKind = "timeout"
+
+	// FaultDropResponse - request is served, but client gets no response
+	FaultDropResponse FaultKind = "dropResponse"
+)
+
+// FaultKinds - all fault kinds
+var FaultKinds = []FaultKind{FaultLatency, FaultServerError, FaultBusy, FaultTimeout, FaultDropResponse}
+
+var (
+	// ErrTimeout - returned by Appliance.Serve() for FaultTimeout
+	ErrTimeout = errors.New("context deadline exceeded (Client.Timeout exceeded while awaiting headers)")
+
+	// ErrDroppedResponse - returned by Appliance.Serve() for FaultDropResponse
+	ErrDroppedResponse = errors.New("connection reset by peer")
+)
+
+// FaultRule - injects faults into requests matching method and endpoint
+type FaultRule struct {
+	// Method - HTTP method to match, empty value matches all methods
+	Method string
+
+	// Endpoint - NEF endpoint to match, "*" matches any path segment (e.g. "storage/volumes/*"),
+	// empty value matches all endpoints
+	Endpoint string
+
+	Kind FaultKind
+
+	// Latency - delay before the fault, it also delays FaultTimeout and other faults
+	Latency time.Duration
+
+	// StatusCode - HTTP status code for FaultServerError
+	StatusCode int
+
+	// Skip - number of matching requests to pass before injecting the fault
+	Skip int
+
+	// Times - number of faults to inject, 0 means unlimited
+	Times int
+
+	matched  int
+	injected int
+}
+
+func (r *FaultRule) matches(method, endpoint string) bool {
+	if r.Method != "" && r.Method != method {
+		return false
+	}
+	if r.Endpoint == "" {
+		return true
+	}
+	return matchSegments(strings.Split(r.Endpoint, "/"), strings.Split(endpoint, "/")) != nil
+}
+
+// Request - request record, Endpoint is the NEF endpoint pattern that served the request
+// (e.g. "storage/volumes/*") or request path if there is no such endpoint
+type Request struct {
+	Method   string
+	Endpoint string
+}
+
+func (r Request) String() string {
+	return r.Method + " " + r.Endpoint
+}
+
+// Faults - fault rules and journal of requests served by Appliance.Serve()
+type Faults struct {
+	mux      sync.Mutex
+	rules    []*FaultRule
+	requests []Request
+	injected int
+}
+
+// Add - adds the rule, first matching rule with remaining faults is applied to a request
+func (f *Faults) Add(rule FaultRule) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.rules = append(f.rules, &rule)
+}
+
+// Clear - removes all rules
+func (f *Faults) Clear() {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.rules = []*FaultRule{}
+}
+
+// Injected - returns number of injected faults
+func (f *Faults) Injected() int {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.injected
+}
+
+// Requests - returns all served requests in order
+func (f *Faults) Requests() []Request {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return append([]Request{}, f.requests...)
+}
+
+// ResetRequests - clears requests journal
+func (f *Faults) ResetRequests() {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.requests = []Request{}
+}
+
+// next - records the request and returns rule to apply or nil
+func (f *Faults) next(method, endpoint string) *FaultRule {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.requests = append(f.requests, Request{Method: method, Endpoint: endpoint})
+	for _, r := range f.rules {
+		if r.Times != 0 && r.injected >= r.Times {
+			continue
+		}
+		if !r.matches(method, endpoint) {
+			continue
+		}
+		r.matched++
+		if r.matched <= r.Skip {
+			continue
+		}
+		r.injected++
+		f.injected++
+		rule := *r
+		return &rule
+	}
+	return nil
+}
+
+// NewFaults - creates empty rule set
+func NewFaults() *Faults {
+	return &Faults{
+		rules:    []*FaultRule{},
+		requests: []Request{},
+	}
+}
@@ -0,0 +1,402 @@
+package nstest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Replication service states reported by NEF
+const (
+	ReplicationStateIdle    = "idle"
+	ReplicationStateRunning = "running"
+	ReplicationStateFailed  = "failed"
+)
+
+// replicationSnapshotPrefix - name prefix of snapshots taken by scheduled replication services
+const replicationSnapshotPrefix = "hpr-"
+
+// ReplicationRemoteNode - appliance the replication service sends snapshots to
+type ReplicationRemoteNode struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+}
+
+// address - REST address of the remote node in the backend
+func (n ReplicationRemoteNode) address() string {
+	return fmt.Sprintf("https://%s:%d", n.Host, n.Port)
+}
+
+// ReplicationService - NEF HPR (high performance replication) service, it sends snapshots of the local
+// SourceDataset to DestinationDataset on the remote node, transfers are done by Backend.RunReplications().
+// Service with SourceSnapshot sends this snapshot once it's started, other services take a new snapshot
+// for each transfer and send it incrementally, enabled services with Interval run on each RunReplications() call
+type ReplicationService struct {
+	Name               string                `json:"name"`
+	SourceDataset      string                `json:"sourceDataset"`
+	DestinationDataset string                `json:"destinationDataset"`
+	RemoteNode         ReplicationRemoteNode `json:"remoteNode"`
+	SourceSnapshot     string                `json:"sourceSnapshot"`
+	Interval           int                   `json:"interval"`
+	Enabled            bool                  `json:"enabled"`
+	State              string                `json:"state"`
+	Progress           int                   `json:"progress"`
+	LastSnapshot       string                `json:"lastSnapshot"`
+	LastSyncTime       *time.Time            `json:"lastSyncTime,omitempty"`
+	LastError          string                `json:"lastError"`
+}
+
+// snapshotPrefix - name prefix of snapshots taken by the service, they are pruned after each transfer
+func (s *ReplicationService) snapshotPrefix() string {
+	return replicationSnapshotPrefix + s.Name + "-"
+}
+
+// replicationTransfer - snapshot being sent by the replication service
+type replicationTransfer struct {
+	service         string
+	destination     string
+	remote          string
+	snapshot        snapshot
+	volumeBlockSize int64
+
+	// sourceSnapshots - names of all snapshots of the source dataset, incremental stream base is one of them
+	sourceSnapshots map[string]bool
+
+	// prunePrefix - name prefix of older snapshots to destroy on the destination, empty for one-time transfers
+	prunePrefix string
+}
+
+// ReplicationService - returns replication service by name, false if it doesn't exist
+func (a *Appliance) ReplicationService(name string) (ReplicationService, bool) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	s, ok := a.replicationServices[name]
+	if !ok {
+		return ReplicationService{}, false
+	}
+	return *s, true
+}
+
+// RunReplications - runs transfers of all started and enabled scheduled replication services of the backend
+// appliances, transfer fails if its remote node is not in the backend or the destination dataset can't receive it,
+// returns the number of completed transfers
+func (b *Backend) RunReplications() int {
+	b.mux.Lock()
+	appliances := map[string]*Appliance{}
+	for address, a := range b.appliances {
+		appliances[address] = a
+	}
+	b.mux.Unlock()
+
+	completed := 0
+	for _, address := range sortedKeys(appliances) {
+		a := appliances[address]
+		for _, transfer := range a.runningReplications(b.newReplicationSnapshotName) {
+			remote, ok := appliances[transfer.remote]
+			var err error
+			if !ok {
+				err = fmt.Errorf("Remote node %s is unreachable", transfer.remote)
+			} else {
+				err = remote.receiveSnapshot(transfer)
+			}
+			a.finishReplication(transfer, err)
+			if err == nil {
+				completed++
+			}
+		}
+	}
+	return completed
+}
+
+// newReplicationSnapshotName - returns snapshot name unique across the backend appliances,
+// replication direction may be reversed, so names taken on different appliances must not collide
+func (b *Backend) newReplicationSnapshotName(prefix string) string {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.replicationSeq++
+	return fmt.Sprintf("%s%06d", prefix, b.replicationSeq)
+}
+
+// runningReplications - returns snapshots to send by the services, snapshots of scheduled services are taken,
+// services with missing datasets or snapshots fail
+func (a *Appliance) runningReplications(newSnapshotName func(prefix string) string) []replicationTransfer {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	transfers := []replicationTransfer{}
+	for _, name := range sortedKeys(a.replicationServices) {
+		service := a.replicationServices[name]
+		scheduled := service.Enabled && service.Interval > 0
+		if service.State != ReplicationStateRunning && !scheduled {
+			continue
+		}
+
+		v, ok := a.volumes[service.SourceDataset]
+		if !ok {
+			service.State = ReplicationStateFailed
+			service.LastError = fmt.Sprintf("Dataset '%s' not found", service.SourceDataset)
+			continue
+		}
+		snapshotName := service.SourceSnapshot
+		prunePrefix := ""
+		if snapshotName == "" {
+			prunePrefix = service.snapshotPrefix()
+			snapshotName = newSnapshotName(prunePrefix)
+			a.txg++
+			a.snapshots[v.path+"@"+snapshotName] = &snapshot{
+				path:            v.path + "@" + snapshotName,
+				name:            snapshotName,
+				parent:          v.path,
+				volumeSize:      v.volumeSize,
+				bytesReferenced: v.refReservation,
+				creationTxg:     a.txg,
+				creationTime:    time.Now().UTC().Truncate(time.Second),
+				clones:          []string{},
+			}
+		}
+		s, ok := a.snapshots[v.path+"@"+snapshotName]
+		if !ok {
+			service.State = ReplicationStateFailed
+			service.LastError = fmt.Sprintf("Snapshot '%s@%s' not found", v.path, snapshotName)
+			continue
+		}
+
+		service.State = ReplicationStateRunning
+		transfer := replicationTransfer{
+			service:         name,
+			destination:     service.DestinationDataset,
+			remote:          service.RemoteNode.address(),
+			snapshot:        *s,
+			volumeBlockSize: v.properties.VolumeBlockSize,
+			sourceSnapshots: map[string]bool{},
+			prunePrefix:     prunePrefix,
+		}
+		for _, sourceSnapshot := range a.findSnapshots(v.path, false) {
+			transfer.sourceSnapshots[sourceSnapshot.name] = true
+		}
+		transfers = append(transfers, transfer)
+	}
+	return transfers
+}
+
+// receiveSnapshot - creates the destination volume from full replication stream or applies incremental stream
+// to the existing one, the destination is rolled back to the latest snapshot it has in common with the source,
+// ZFS properties other than volblocksize are not sent
+func (a *Appliance) receiveSnapshot(transfer replicationTransfer) error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	v, ok := a.volumes[transfer.destination]
+	if !ok {
+		if _, ok := a.volumeGroups[path.Dir(transfer.destination)]; !ok {
+			return fmt.Errorf("Volume group '%s' not found on remote node", path.Dir(transfer.destination))
+		}
+		a.txg++
+		v = &volume{
+			path:        transfer.destination,
+			volumeSize:  transfer.snapshot.volumeSize,
+			creationTxg: a.txg,
+			status:      VolumeStatusOnline,
+			properties:  VolumeProperties{VolumeBlockSize: transfer.volumeBlockSize},
+		}
+		a.volumes[v.path] = v
+	} else if err := a.rollbackToCommonSnapshot(v, transfer); err != nil {
+		return err
+	}
+
+	snapshotPath := v.path + "@" + transfer.snapshot.name
+	if _, ok := a.snapshots[snapshotPath]; !ok {
+		a.txg++
+		a.snapshots[snapshotPath] = &snapshot{
+			path:            snapshotPath,
+			name:            transfer.snapshot.name,
+			parent:          v.path,
+			volumeSize:      transfer.snapshot.volumeSize,
+			bytesReferenced: transfer.snapshot.bytesReferenced,
+			creationTxg:     a.txg,
+			creationTime:    transfer.snapshot.creationTime,
+			clones:          []string{},
+		}
+		v.volumeSize = transfer.snapshot.volumeSize
+	}
+	a.pruneReplicationSnapshots(v.path, transfer.prunePrefix, transfer.snapshot.name)
+	return nil
+}
+
+// rollbackToCommonSnapshot - checks that incremental stream can be received by the existing volume
+// and destroys volume snapshots newer than the stream base
+func (a *Appliance) rollbackToCommonSnapshot(v *volume, transfer replicationTransfer) error {
+	for _, service := range a.replicationServices {
+		if service.SourceDataset == v.path && service.Enabled {
+			return fmt.Errorf(
+				"Destination dataset '%s' is the source of replication service '%s'", v.path, service.Name)
+		}
+	}
+
+	snapshots := a.findSnapshots(v.path, false)
+	base := -1
+	for i, s := range snapshots {
+		if s.name == transfer.snapshot.name {
+			// the snapshot has been received already
+			return nil
+		} else if transfer.sourceSnapshots[s.name] {
+			base = i
+		}
+	}
+	if base < 0 {
+		return fmt.Errorf("Destination dataset '%s' exists and has no snapshots in common with the source", v.path)
+	}
+	for _, s := range snapshots[base+1:] {
+		if len(s.clones) != 0 {
+			return fmt.Errorf("Cannot roll back '%s', snapshot '%s' has dependent clones", v.path, s.path)
+		}
+	}
+	for _, s := range snapshots[base+1:] {
+		delete(a.snapshots, s.path)
+	}
+	return nil
+}
+
+// pruneReplicationSnapshots - destroys snapshots of the replication service except the last one,
+// it's the base of the next incremental stream
+func (a *Appliance) pruneReplicationSnapshots(datasetPath, prefix, lastSnapshot string) {
+	if prefix == "" {
+		return
+	}
+	for _, s := range a.findSnapshots(datasetPath, false) {
+		if strings.HasPrefix(s.name, prefix) && s.name != lastSnapshot && len(s.clones) == 0 {
+			delete(a.snapshots, s.path)
+		}
+	}
+}
+
+// finishReplication - sets the service state after the transfer
+func (a *Appliance) finishReplication(transfer replicationTransfer, err error) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	service, ok := a.replicationServices[transfer.service]
+	if !ok {
+		return
+	}
+	if err != nil {
+		service.State = ReplicationStateFailed
+		service.LastError = err.Error()
+		return
+	}
+	service.State = ReplicationStateIdle
+	service.Progress = 100
+	service.LastSnapshot = transfer.snapshot.name
+	lastSyncTime := transfer.snapshot.creationTime
+	service.LastSyncTime = &lastSyncTime
+	service.LastError = ""
+	a.pruneReplicationSnapshots(service.SourceDataset, transfer.prunePrefix, transfer.snapshot.name)
+}
+
+func (a *Appliance) getReplicationServices(args []string, query url.Values, body []byte) (int, []byte) {
+	services := []ReplicationService{}
+	for _, name := range sortedKeys(a.replicationServices) {
+		services = append(services, *a.replicationServices[name])
+	}
+
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	if offset > len(services) {
+		offset = len(services)
+	}
+	services = services[offset:]
+	if limit, err := strconv.Atoi(query.Get("limit")); err == nil && limit < len(services) {
+		services = services[:limit]
+	}
+
+	return dataResponse(services)
+}
+
+func (a *Appliance) getReplicationService(args []string, query url.Values, body []byte) (int, []byte) {
+	service, ok := a.replicationServices[args[0]]
+	if !ok {
+		return nefErrorResponse(http.StatusNotFound, CodeNotExist, "Replication service '%s' not found", args[0])
+	}
+	return jsonResponse(http.StatusOK, service)
+}
+
+func (a *Appliance) createReplicationService(args []string, query url.Values, body []byte) (int, []byte) {
+	params := ReplicationService{}
+	if err := json.Unmarshal(body, &params); err != nil {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "Cannot parse request: %s", err)
+	}
+	if params.Name == "" || params.DestinationDataset == "" || params.RemoteNode.Host == "" {
+		return nefErrorResponse(
+			http.StatusBadRequest, CodeBadArg, "name, destinationDataset and remoteNode must be provided")
+	}
+	if params.Interval < 0 {
+		return nefErrorResponse(http.StatusBadRequest, CodeBadArg, "Invalid interval: %d", params.Interval)
+	}
+	if _, ok := a.replicationServices[params.Name]; ok {
+		return nefErrorResponse(
+			http.StatusBadRequest, CodeAlreadyExist, "Replication service '%s' already exists", params.Name)
+	}
+	if _, ok := a.volumes[params.SourceDataset]; !ok {
+		return nefErrorResponse(http.StatusNotFound, CodeNotExist, "Dataset '%s' not found", params.SourceDataset)
+	}
+	if params.RemoteNode.Port == 0 {
+		params.RemoteNode.Port = 8443
+	}
+
+	a.replicationServices[params.Name] = &ReplicationService{
+		Name:               params.Name,
+		SourceDataset:      params.SourceDataset,
+		DestinationDataset: params.DestinationDataset,
+		RemoteNode:         params.RemoteNode,
+		SourceSnapshot:     params.SourceSnapshot,
+		Interval:           params.Interval,
+		State:              ReplicationStateIdle,
+	}
+	return http.StatusCreated, nil
+}
+
+func (a *Appliance) startReplicationService(args []string, query url.Values, body []byte) (int, []byte) {
+	service, ok := a.replicationServices[args[0]]
+	if !ok {
+		return nefErrorResponse(http.StatusNotFound, CodeNotExist, "Replication service '%s' not found", args[0])
+	}
+	if service.State == ReplicationStateRunning {
+		return nefErrorResponse(http.StatusBadRequest, CodeBusy, "Replication service '%s' is running", service.Name)
+	}
+	if service.SourceSnapshot != "" {
+		if _, ok := a.snapshots[service.SourceDataset+"@"+service.SourceSnapshot]; !ok {
+			return nefErrorResponse(
+				http.StatusNotFound,
+				CodeNotExist,
+				"Snapshot '%s@%s' not found",
+				service.SourceDataset,
+				service.SourceSnapshot,
+			)
+		}
+	}
+	service.State = ReplicationStateRunning
+	service.Progress = 0
+	service.LastError = ""
+	return http.StatusOK, nil
+}
+
+func (a *Appliance) enableReplicationService(args []string, query url.Values, body []byte) (int, []byte) {
+	service, ok := a.replicationServices[args[0]]
+	if !ok {
+		return nefErrorResponse(http.StatusNotFound, CodeNotExist, "Replication service '%s' not found", args[0])
+	}
+	service.Enabled = true
+	return http.StatusOK, nil
+}
+
+func (a *Appliance) destroyReplicationService(args []string, query url.Values, body []byte) (int, []byte) {
+	if _, ok := a.replicationServices[args[0]]; !ok {
+		return nefErrorResponse(http.StatusNotFound, CodeNotExist, "Replication service '%s' not found", args[0])
+	}
+	delete(a.replicationServices, args[0])
+	return http.StatusOK, nil
+}
@@ -0,0 +1,60 @@
+package nstest
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Server - http.Handler that serves NEF REST API of the appliance, use it with httptest.NewTLSServer()
+// or http.Server to run driver binary and csi-sanity against the in-memory appliance
+type Server struct {
+	appliance *Appliance
+	log       *logrus.Entry
+}
+
+// ServeHTTP - passes request to the appliance, bearer token is taken from Authorization header
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		code, response := nefErrorResponse(http.StatusBadRequest, CodeBadArg, "Cannot read request body: %s", err)
+		s.write(w, r, code, response)
+		return
+	}
+
+	// go-nexentastor joins address and path with "/", so paths often start with "//"
+	uri := strings.TrimLeft(r.URL.EscapedPath(), "/")
+	if r.URL.RawQuery != "" {
+		uri += "?" + r.URL.RawQuery
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	code, response, err := s.appliance.Serve(r.Method, uri, token, body)
+	if err != nil {
+		// close connection without response
+		s.log.WithField("req", r.Method+" "+r.URL.RequestURI()).Debugf("no response: %s", err)
+		panic(http.ErrAbortHandler)
+	}
+	s.write(w, r, code, response)
+}
+
+func (s *Server) write(w http.ResponseWriter, r *http.Request, code int, response []byte) {
+	s.log.WithField("req", r.Method+" "+r.URL.RequestURI()).Debugf("response: %d %s", code, response)
+	if len(response) != 0 {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(code)
+	if _, err := w.Write(response); err != nil {
+		s.log.Warnf("Cannot write response: %s", err)
+	}
+}
+
+// NewServer - creates NEF REST API handler for the appliance
+func NewServer(appliance *Appliance, log *logrus.Entry) *Server {
+	return &Server{
+		appliance: appliance,
+		log:       log.WithField("cmp", "NefServer"),
+	}
+}
@@ -0,0 +1,253 @@
+package csiid_test
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/csiid"
+)
+
+func TestParseVolumeID(t *testing.T) {
+	t.Run("legacy ID", func(t *testing.T) {
+		id, err := csiid.ParseVolumeID("ns1:pool1/csiVolumeGroup/pvc-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := csiid.VolumeID{
+			Version:     csiid.Version1,
+			ConfigName:  "ns1",
+			VolumeGroup: "pool1/csiVolumeGroup",
+			Name:        "pvc-1",
+		}
+		if id != expected {
+			t.Errorf("expected %+v, got %+v", expected, id)
+		}
+		if id.Pool() != "pool1" {
+			t.Errorf("unexpected pool: %s", id.Pool())
+		}
+		if id.Path() != "pool1/csiVolumeGroup/pvc-1" {
+			t.Errorf("unexpected path: %s", id.Path())
+		}
+		if id.String() != "ns1:pool1/csiVolumeGroup/pvc-1" {
+			t.Errorf("legacy ID must be encoded without changes, got: %s", id.String())
+		}
+	})
+
+	t.Run("nested volume group", func(t *testing.T) {
+		id, err := csiid.ParseVolumeID("ns1:pool1/tenant/env/volumes/pvc-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id.VolumeGroup != "pool1/tenant/env/volumes" || id.Name != "pvc-1" || id.Pool() != "pool1" {
+			t.Errorf("unexpected ID: %+v", id)
+		}
+		snapshot, err := csiid.ParseSnapshotID("ns1:pool1/tenant/env/volumes/pvc-1@snap-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if snapshot.Volume != id || snapshot.Name != "snap-1" {
+			t.Errorf("unexpected snapshot ID: %+v", snapshot)
+		}
+	})
+
+	t.Run("versioned ID", func(t *testing.T) {
+		id, err := csiid.ParseVolumeID("v1:ns1:pool1/csiVolumeGroup/pvc-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id.Version != csiid.Version1 || id.ConfigName != "ns1" || id.Path() != "pool1/csiVolumeGroup/pvc-1" {
+			t.Errorf("unexpected ID: %+v", id)
+		}
+	})
+
+	for _, volumeID := range []string{
+		"",
+		"wrong-id",
+		"ns1:pool1/csiVolumeGroup",
+		"ns1:pool1//pvc-1",
+		"ns1:pool1/csiVolumeGroup/",
+		":pool1/csiVolumeGroup/pvc-1",
+		"ns1:pool1/csiVolumeGroup/pvc-1@snap-1",
+		"a:b:pool1/csiVolumeGroup/pvc-1",
+		"v2:ns1:pool1/csiVolumeGroup/pvc-1",
+	} {
+		t.Run("invalid ID "+volumeID, func(t *testing.T) {
+			_, err := csiid.ParseVolumeID(volumeID)
+			if !csiid.IsInvalid(err) {
+				t.Fatalf("expected ID error, got: %v", err)
+			}
+			if status.Code(err) != codes.InvalidArgument {
+				t.Errorf("expected InvalidArgument, got: %v", err)
+			}
+			if status.Code(csiid.NotFound(err)) != codes.NotFound {
+				t.Errorf("expected NotFound, got: %v", csiid.NotFound(err))
+			}
+		})
+	}
+}
+
+func TestNewVolumeID(t *testing.T) {
+	id, err := csiid.NewVolumeID("ns1", "pool1/csiVolumeGroup/pvc-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Version != csiid.CurrentVersion || id.String() != "ns1:pool1/csiVolumeGroup/pvc-1" {
+		t.Errorf("unexpected ID: %+v", id)
+	}
+
+	parsed, err := csiid.ParseVolumeID(id.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed != id {
+		t.Errorf("expected %+v after round trip, got %+v", id, parsed)
+	}
+
+	if _, err := csiid.NewVolumeID("ns1", "pool1/pvc-1"); !csiid.IsInvalid(err) {
+		t.Errorf("expected ID error for volume outside of volume group, got: %v", err)
+	}
+	if _, err := csiid.NewVolumeID("", "pool1/csiVolumeGroup/pvc-1"); !csiid.IsInvalid(err) {
+		t.Errorf("expected ID error for empty config name, got: %v", err)
+	}
+}
+
+func TestSnapshotID(t *testing.T) {
+	t.Run("legacy ID", func(t *testing.T) {
+		id, err := csiid.ParseSnapshotID("ns1:pool1/csiVolumeGroup/pvc-1@snap-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id.Name != "snap-1" || id.Volume.String() != "ns1:pool1/csiVolumeGroup/pvc-1" {
+			t.Errorf("unexpected ID: %+v", id)
+		}
+		if id.Path() != "pool1/csiVolumeGroup/pvc-1@snap-1" {
+			t.Errorf("unexpected path: %s", id.Path())
+		}
+		if id.String() != "ns1:pool1/csiVolumeGroup/pvc-1@snap-1" {
+			t.Errorf("legacy ID must be encoded without changes, got: %s", id.String())
+		}
+	})
+
+	t.Run("volume snapshot", func(t *testing.T) {
+		volume, err := csiid.ParseVolumeID("ns1:pool1/csiVolumeGroup/pvc-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := volume.Snapshot("snap-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		created, err := csiid.NewSnapshotID("ns1", "pool1/csiVolumeGroup/pvc-1@snap-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != created {
+			t.Errorf("expected %+v, got %+v", created, id)
+		}
+		if _, err := volume.Snapshot(""); !csiid.IsInvalid(err) {
+			t.Errorf("expected ID error for empty snapshot name, got: %v", err)
+		}
+	})
+
+	for _, snapshotID := range []string{
+		"",
+		"snap-1",
+		"ns1:pool1/csiVolumeGroup/pvc-1",
+		"ns1:pool1/csiVolumeGroup/pvc-1@",
+		"ns1:pool1/csiVolumeGroup/pvc-1@a@b",
+		"ns1:pool1/csiVolumeGroup@snap-1",
+		"v3:ns1:pool1/csiVolumeGroup/pvc-1@snap-1",
+	} {
+		t.Run("invalid ID "+snapshotID, func(t *testing.T) {
+			if _, err := csiid.ParseSnapshotID(snapshotID); !csiid.IsInvalid(err) {
+				t.Fatalf("expected ID error, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestGroupSnapshotID(t *testing.T) {
+	t.Run("legacy ID", func(t *testing.T) {
+		id, err := csiid.ParseGroupSnapshotID("ns1:pool1/csiVolumeGroup@group-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := csiid.GroupSnapshotID{
+			Version:     csiid.Version1,
+			ConfigName:  "ns1",
+			VolumeGroup: "pool1/csiVolumeGroup",
+			Name:        "group-1",
+		}
+		if id != expected {
+			t.Errorf("expected %+v, got %+v", expected, id)
+		}
+		if id.Path() != "pool1/csiVolumeGroup@group-1" {
+			t.Errorf("unexpected path: %s", id.Path())
+		}
+		if id.String() != "ns1:pool1/csiVolumeGroup@group-1" {
+			t.Errorf("legacy ID must be encoded without changes, got: %s", id.String())
+		}
+		created, err := csiid.NewGroupSnapshotID("ns1", "pool1/csiVolumeGroup", "group-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created != id {
+			t.Errorf("expected %+v, got %+v", id, created)
+		}
+	})
+
+	t.Run("member snapshot", func(t *testing.T) {
+		id, err := csiid.NewGroupSnapshotID("ns1", "pool1/tenant/volumes", "group-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		volume, err := csiid.ParseVolumeID("ns1:pool1/tenant/volumes/pvc-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		member, ok := id.Member(volume)
+		if !ok {
+			t.Fatalf("volume '%s' must be a member of group snapshot '%s'", volume, id)
+		}
+		parsed, err := csiid.ParseSnapshotID(member.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed != member || member.String() != "ns1:pool1/tenant/volumes/pvc-1@group-1" {
+			t.Errorf("member snapshot ID must be a regular snapshot ID, got: %s", member)
+		}
+
+		for _, volumeID := range []string{"ns2:pool1/tenant/volumes/pvc-1", "ns1:pool1/tenant/other/pvc-1"} {
+			volume, err := csiid.ParseVolumeID(volumeID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := id.Member(volume); ok {
+				t.Errorf("volume '%s' must not be a member of group snapshot '%s'", volume, id)
+			}
+		}
+	})
+
+	for _, groupSnapshotID := range []string{
+		"",
+		"group-1",
+		"ns1:pool1@group-1",
+		"ns1:pool1/csiVolumeGroup",
+		"ns1:pool1/csiVolumeGroup@",
+		"ns1:pool1/csiVolumeGroup@a@b",
+		"ns1:pool1//csiVolumeGroup@group-1",
+		"v3:ns1:pool1/csiVolumeGroup@group-1",
+	} {
+		t.Run("invalid ID "+groupSnapshotID, func(t *testing.T) {
+			if _, err := csiid.ParseGroupSnapshotID(groupSnapshotID); !csiid.IsInvalid(err) {
+				t.Fatalf("expected ID error, got: %v", err)
+			}
+		})
+	}
+
+	if _, err := csiid.NewGroupSnapshotID("ns1", "pool1/csiVolumeGroup", "a/b"); !csiid.IsInvalid(err) {
+		t.Errorf("expected ID error for snapshot name with '/', got: %v", err)
+	}
+}
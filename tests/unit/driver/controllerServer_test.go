@@ -0,0 +1,1791 @@
+package driver_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/nstest"
+)
+
+const gib = 1024 * 1024 * 1024
+
+var testVolumeCapabilities = []*csi.VolumeCapability{
+	{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	},
+}
+
+func createTestVolume(t *testing.T, s csi.ControllerServer, name string, size int64) *csi.Volume {
+	t.Helper()
+	res, err := s.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               name,
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: size},
+		VolumeCapabilities: testVolumeCapabilities,
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume(%s) failed: %s", name, err)
+	}
+	return res.GetVolume()
+}
+
+func createTestSnapshot(t *testing.T, s csi.ControllerServer, volumeID, name string) *csi.Snapshot {
+	t.Helper()
+	res, err := s.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{
+		SourceVolumeId: volumeID,
+		Name:           name,
+	})
+	if err != nil {
+		t.Fatalf("CreateSnapshot(%s) failed: %s", name, err)
+	}
+	return res.GetSnapshot()
+}
+
+func expectCode(t *testing.T, err error, code codes.Code) {
+	t.Helper()
+	if status.Code(err) != code {
+		t.Fatalf("expected '%s' error code, got: %v", code, err)
+	}
+}
+
+func TestControllerServer_CreateVolume(t *testing.T) {
+	env := newTestEnv(t, testConfig)
+	s := env.newControllerServer(t)
+
+	t.Run("new volume", func(t *testing.T) {
+		volume := createTestVolume(t, s, "pvc-1", 2*gib)
+		if volume.GetVolumeId() != testConfigName+":"+testVolumeGroup+"/pvc-1" {
+			t.Errorf("unexpected volume ID: %s", volume.GetVolumeId())
+		}
+		if volume.GetCapacityBytes() != 2*gib {
+			t.Errorf("unexpected capacity: %d", volume.GetCapacityBytes())
+		}
+		if v := volume.GetVolumeContext()["TargetGroup"]; v != "tg01" {
+			t.Errorf("unexpected TargetGroup in volume context: %s", v)
+		}
+		nsVolume, ok := env.appliance.Volume(testVolumeGroup + "/pvc-1")
+		if !ok {
+			t.Fatal("volume has not been created on NexentaStor")
+		} else if nsVolume.VolumeSize != 2*gib {
+			t.Errorf("unexpected NexentaStor volume size: %d", nsVolume.VolumeSize)
+		}
+	})
+
+	t.Run("existing volume with the same size", func(t *testing.T) {
+		createTestVolume(t, s, "pvc-1", 2*gib)
+	})
+
+	t.Run("existing volume with different size", func(t *testing.T) {
+		_, err := s.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:               "pvc-1",
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: 3 * gib},
+			VolumeCapabilities: testVolumeCapabilities,
+		})
+		expectCode(t, err, codes.AlreadyExists)
+	})
+
+	t.Run("default size", func(t *testing.T) {
+		volume := createTestVolume(t, s, "pvc-default-size", 0)
+		if volume.GetCapacityBytes() != gib {
+			t.Errorf("expected 1Gi default capacity, got: %d", volume.GetCapacityBytes())
+		}
+	})
+
+	t.Run("missing volume group", func(t *testing.T) {
+		_, err := s.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:               "pvc-2",
+			VolumeCapabilities: testVolumeCapabilities,
+			Parameters:         map[string]string{"volumeGroup": "pool1/missing"},
+		})
+		if err == nil {
+			t.Fatal("volume has been created in missing volume group")
+		}
+	})
+
+	t.Run("no name", func(t *testing.T) {
+		_, err := s.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			VolumeCapabilities: testVolumeCapabilities,
+		})
+		expectCode(t, err, codes.InvalidArgument)
+	})
+}
+
+func TestControllerServer_CreateVolumeFromSource(t *testing.T) {
+	env := newTestEnv(t, testConfig)
+	s := env.newControllerServer(t)
+
+	source := createTestVolume(t, s, "pvc-source", gib)
+	snapshot := createTestSnapshot(t, s, source.GetVolumeId(), "snapshot-1")
+
+	t.Run("from snapshot", func(t *testing.T) {
+		res, err := s.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:               "pvc-from-snapshot",
+			VolumeCapabilities: testVolumeCapabilities,
+			VolumeContentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Snapshot{
+					Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshot.GetSnapshotId()},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.GetVolume().GetContentSource().GetSnapshot() == nil {
+			t.Error("content source is not set")
+		}
+		if _, ok := env.appliance.Volume(testVolumeGroup + "/pvc-from-snapshot"); !ok {
+			t.Error("volume has not been created on NexentaStor")
+		}
+	})
+
+	t.Run("from missing snapshot", func(t *testing.T) {
+		_, err := s.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:               "pvc-from-missing-snapshot",
+			VolumeCapabilities: testVolumeCapabilities,
+			VolumeContentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Snapshot{
+					Snapshot: &csi.VolumeContentSource_SnapshotSource{
+						SnapshotId: testConfigName + ":" + testVolumeGroup + "/pvc-source@missing",
+					},
+				},
+			},
+		})
+		expectCode(t, err, codes.NotFound)
+	})
+
+	t.Run("clone", func(t *testing.T) {
+		_, err := s.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:               "pvc-clone",
+			VolumeCapabilities: testVolumeCapabilities,
+			VolumeContentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Volume{
+					Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: source.GetVolumeId()},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := env.appliance.Volume(testVolumeGroup + "/pvc-clone"); !ok {
+			t.Error("volume has not been created on NexentaStor")
+		}
+		if _, ok := env.appliance.Snapshot(testVolumeGroup + "/pvc-source@k8s-clone-snapshot-pvc-clone"); !ok {
+			t.Error("clone snapshot has not been created on NexentaStor")
+		}
+	})
+
+	t.Run("delete volume with clones", func(t *testing.T) {
+		_, err := s.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: source.GetVolumeId()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := env.appliance.Volume(testVolumeGroup + "/pvc-source"); ok {
+			t.Error("volume has not been deleted on NexentaStor")
+		}
+		for _, name := range []string{"pvc-from-snapshot", "pvc-clone"} {
+			if _, ok := env.appliance.Volume(testVolumeGroup + "/" + name); !ok {
+				t.Errorf("clone '%s' has been deleted with its origin", name)
+			}
+		}
+	})
+}
+
+func TestControllerServer_CreateVolumeProperties(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, testConfig)
+	s := env.newControllerServer(t)
+
+	createVolume := func(name string, params map[string]string, source *csi.VolumeContentSource) error {
+		_, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:                name,
+			CapacityRange:       &csi.CapacityRange{RequiredBytes: gib},
+			VolumeCapabilities:  testVolumeCapabilities,
+			Parameters:          params,
+			VolumeContentSource: source,
+		})
+		return err
+	}
+
+	err := createVolume("pvc-1", map[string]string{
+		"compression":    "gzip-9",
+		"checksum":       "sha256",
+		"dedup":          "sha256,verify",
+		"volblocksize":   "64K",
+		"logbias":        "throughput",
+		"sync":           "always",
+		"copies":         "2",
+		"primarycache":   "metadata",
+		"secondarycache": "none",
+		"user:team":      "db",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := nstest.VolumeProperties{
+		VolumeBlockSize: 64 * 1024,
+		CompressionMode: "gzip-9",
+		ChecksumMode:    "sha256",
+		DedupMode:       "sha256,verify",
+		LogicalBias:     "throughput",
+		SyncMode:        "always",
+		Copies:          2,
+		PrimaryCache:    "metadata",
+		SecondaryCache:  "none",
+		UserProperties:  map[string]string{"user:team": "db"},
+	}
+	if props, _ := env.appliance.VolumeProperties(testVolumeGroup + "/pvc-1"); !reflect.DeepEqual(props, expected) {
+		t.Errorf("expected properties %+v, got: %+v", expected, props)
+	}
+
+	t.Run("defaults", func(t *testing.T) {
+		if err := createVolume("pvc-2", nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		props, _ := env.appliance.VolumeProperties(testVolumeGroup + "/pvc-2")
+		if props.VolumeBlockSize != nstest.DefaultVolumeBlockSize || props.CompressionMode != "" {
+			t.Errorf("unexpected properties: %+v", props)
+		}
+	})
+
+	t.Run("from snapshot", func(t *testing.T) {
+		snapshot := createTestSnapshot(t, s, testConfigName+":"+testVolumeGroup+"/pvc-1", "snap-1")
+		err := createVolume("pvc-3", map[string]string{"volblocksize": "8K", "sync": "standard"}, &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshot.GetSnapshotId()},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		props, _ := env.appliance.VolumeProperties(testVolumeGroup + "/pvc-3")
+		if props.VolumeBlockSize != 64*1024 || props.SyncMode != "standard" || props.CompressionMode != "gzip-9" {
+			t.Errorf("restored volume must inherit volblocksize and source properties, got: %+v", props)
+		}
+	})
+
+	t.Run("clone", func(t *testing.T) {
+		err := createVolume("pvc-4", map[string]string{"compression": "lz4", "user:env": "test"}, &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: testConfigName + ":" + testVolumeGroup + "/pvc-1"},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		props, _ := env.appliance.VolumeProperties(testVolumeGroup + "/pvc-4")
+		if props.CompressionMode != "lz4" || props.UserProperties["user:env"] != "test" ||
+			props.UserProperties["user:team"] != "db" {
+			t.Errorf("unexpected clone properties: %+v", props)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, params := range []map[string]string{
+			{"compression": "zstd-fast"},
+			{"checksum": "md5"},
+			{"dedup": "maybe"},
+			{"volblocksize": "3K"},
+			{"volblocksize": "256"},
+			{"volblocksize": "2M"},
+			{"volblocksize": "big"},
+			{"volblocksize": "8192i"},
+			{"logbias": "fast"},
+			{"sync": "sometimes"},
+			{"copies": "4"},
+			{"primarycache": "some"},
+			{"secondarycache": "ALL"},
+			{"user:Team": "db"},
+			{"user:team": strings.Repeat("x", 8192)},
+		} {
+			err := createVolume("pvc-invalid", params, nil)
+			if status.Code(err) != codes.InvalidArgument {
+				t.Errorf("expected InvalidArgument error for %v, got: %v", params, err)
+			}
+		}
+		if _, ok := env.appliance.Volume(testVolumeGroup + "/pvc-invalid"); ok {
+			t.Errorf("volume with invalid properties has been created")
+		}
+	})
+}
+
+func TestControllerServer_CreateVolumeEncryption(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, testConfig)
+	s := env.newControllerServer(t)
+
+	var logs bytes.Buffer
+	env.log.Logger.SetOutput(&logs)
+	env.log.Logger.SetLevel(logrus.DebugLevel)
+
+	const key = "correct horse battery staple"
+	secrets := map[string]string{"encryptionKey": key}
+
+	createVolume := func(
+		name string, params, secrets map[string]string, source *csi.VolumeContentSource,
+	) (*csi.Volume, error) {
+		res, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:                name,
+			CapacityRange:       &csi.CapacityRange{RequiredBytes: gib},
+			VolumeCapabilities:  testVolumeCapabilities,
+			Parameters:          params,
+			Secrets:             secrets,
+			VolumeContentSource: source,
+		})
+		return res.GetVolume(), err
+	}
+	volumeSource := func(name string) *csi.VolumeContentSource {
+		return &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: testConfigName + ":" + testVolumeGroup + "/" + name},
+			},
+		}
+	}
+
+	volume, err := createVolume("pvc-1", map[string]string{"encryption": "on"}, secrets, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := nstest.VolumeEncryption{
+		Encryption:     nstest.DefaultEncryptionCipher,
+		KeyFormat:      "passphrase",
+		KeyStatus:      nstest.KeyStatusAvailable,
+		EncryptionRoot: testVolumeGroup + "/pvc-1",
+	}
+	if encryption, _ := env.appliance.VolumeEncryption(testVolumeGroup + "/pvc-1"); encryption != expected {
+		t.Errorf("expected encryption %+v, got: %+v", expected, encryption)
+	}
+	for k, v := range volume.GetVolumeContext() {
+		if strings.Contains(v, key) {
+			t.Errorf("volume context '%s' contains the encryption key", k)
+		}
+	}
+
+	t.Run("existing volume", func(t *testing.T) {
+		if _, err := createVolume("pvc-1", map[string]string{"encryption": "on"}, secrets, nil); err != nil {
+			t.Fatal(err)
+		}
+		_, err := createVolume("pvc-1", nil, nil, nil)
+		expectCode(t, err, codes.AlreadyExists)
+	})
+
+	t.Run("key in config secret", func(t *testing.T) {
+		hexKey := strings.Repeat("0123456789abcdef", 4)
+		_, err := createVolume(
+			"pvc-2",
+			map[string]string{"encryption": "aes-128-ccm", "keyformat": "hex"},
+			map[string]string{"config": testConfig, "encryptionKey": hexKey},
+			nil,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encryption, _ := env.appliance.VolumeEncryption(testVolumeGroup + "/pvc-2")
+		if encryption.Encryption != "aes-128-ccm" || encryption.KeyFormat != "hex" {
+			t.Errorf("unexpected encryption: %+v", encryption)
+		}
+	})
+
+	t.Run("clone", func(t *testing.T) {
+		env.appliance.UnloadKeys()
+		if _, err := createVolume("pvc-3", nil, secrets, volumeSource("pvc-1")); err != nil {
+			t.Fatal(err)
+		}
+		encryption, _ := env.appliance.VolumeEncryption(testVolumeGroup + "/pvc-3")
+		if encryption.EncryptionRoot != testVolumeGroup+"/pvc-1" || encryption.KeyStatus != nstest.KeyStatusAvailable {
+			t.Errorf("clone must share loaded key of the source, got: %+v", encryption)
+		}
+	})
+
+	t.Run("restore", func(t *testing.T) {
+		snapshot := createTestSnapshot(t, s, volume.GetVolumeId(), "snap-1")
+		source := &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshot.GetSnapshotId()},
+			},
+		}
+		env.appliance.UnloadKeys()
+
+		_, err := createVolume("pvc-4", nil, nil, source)
+		expectCode(t, err, codes.FailedPrecondition)
+		_, err = createVolume("pvc-4", nil, map[string]string{"encryptionKey": "wrong passphrase"}, source)
+		expectCode(t, err, codes.FailedPrecondition)
+
+		if _, err := createVolume("pvc-4", map[string]string{"encryption": "on"}, secrets, source); err != nil {
+			t.Fatal(err)
+		}
+		encryption, _ := env.appliance.VolumeEncryption(testVolumeGroup + "/pvc-4")
+		if encryption.EncryptionRoot != testVolumeGroup+"/pvc-1" || encryption.KeyStatus != nstest.KeyStatusAvailable {
+			t.Errorf("restored volume must share loaded key of the source, got: %+v", encryption)
+		}
+	})
+
+	t.Run("encrypted clone of unencrypted volume", func(t *testing.T) {
+		if _, err := createVolume("pvc-plain", nil, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		_, err := createVolume("pvc-5", map[string]string{"encryption": "on"}, secrets, volumeSource("pvc-plain"))
+		expectCode(t, err, codes.InvalidArgument)
+	})
+
+	t.Run("volume condition", func(t *testing.T) {
+		env.appliance.UnloadKeys()
+		res, err := s.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: volume.GetVolumeId()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		condition := res.GetStatus().GetVolumeCondition()
+		if !condition.GetAbnormal() || !strings.Contains(condition.GetMessage(), "encryption key") {
+			t.Errorf("volume with unloaded key is expected to be abnormal, got: %+v", condition)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, tc := range []struct {
+			params  map[string]string
+			secrets map[string]string
+		}{
+			{map[string]string{"encryption": "aes-512-gcm"}, secrets},
+			{map[string]string{"encryption": "on", "keyformat": "pem"}, secrets},
+			{map[string]string{"keyformat": "hex"}, secrets},
+			{map[string]string{"encryption": "on"}, nil},
+			{map[string]string{"encryption": "on"}, map[string]string{"encryptionKey": "short"}},
+			{map[string]string{"encryption": "on", "keyformat": "hex"}, secrets},
+			{map[string]string{"encryption": "on", "keyformat": "raw"}, secrets},
+		} {
+			_, err := createVolume("pvc-invalid", tc.params, tc.secrets, nil)
+			if status.Code(err) != codes.InvalidArgument {
+				t.Errorf("expected InvalidArgument error for %v, got: %v", tc.params, err)
+			}
+			if err != nil && strings.Contains(err.Error(), key) {
+				t.Errorf("error contains the encryption key: %s", err)
+			}
+		}
+		if _, ok := env.appliance.Volume(testVolumeGroup + "/pvc-invalid"); ok {
+			t.Errorf("volume with invalid encryption has been created")
+		}
+	})
+
+	if !strings.Contains(logs.String(), "******") {
+		t.Errorf("NEF requests with the encryption key are expected to be logged with the key hidden")
+	}
+	if strings.Contains(logs.String(), key) {
+		t.Errorf("logs contain the encryption key")
+	}
+}
+
+func TestControllerServer_DeleteVolume(t *testing.T) {
+	env := newTestEnv(t, testConfig)
+	s := env.newControllerServer(t)
+
+	volume := createTestVolume(t, s, "pvc-1", gib)
+	createTestSnapshot(t, s, volume.GetVolumeId(), "snapshot-1")
+
+	t.Run("mapped volume with snapshots", func(t *testing.T) {
+		p := newTestProvider(t, env)
+		mapTestVolume(t, p, testVolumeGroup+"/pvc-1")
+
+		_, err := s.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volume.GetVolumeId()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := env.appliance.Volume(testVolumeGroup + "/pvc-1"); ok {
+			t.Error("volume has not been deleted on NexentaStor")
+		}
+		if lunMappings := env.appliance.LunMappings(testVolumeGroup + "/pvc-1"); len(lunMappings) != 0 {
+			t.Errorf("LUN mappings have not been deleted: %+v", lunMappings)
+		}
+	})
+
+	t.Run("missing volume", func(t *testing.T) {
+		_, err := s.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volume.GetVolumeId()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("unknown volume group", func(t *testing.T) {
+		_, err := s.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{
+			VolumeId: testConfigName + ":pool1/missing/pvc-1",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("encrypted volume with clone", func(t *testing.T) {
+		ctx := context.Background()
+		params := map[string]string{"encryption": "on"}
+		secrets := map[string]string{"encryptionKey": "correct horse battery staple"}
+		volume, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               "pvc-2",
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: gib},
+			VolumeCapabilities: testVolumeCapabilities,
+			Parameters:         params,
+			Secrets:            secrets,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               "pvc-3",
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: gib},
+			VolumeCapabilities: testVolumeCapabilities,
+			Secrets:            secrets,
+			VolumeContentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Volume{
+					Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: volume.GetVolume().GetVolumeId()},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = s.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volume.GetVolume().GetVolumeId()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := env.appliance.Volume(testVolumeGroup + "/pvc-2"); ok {
+			t.Error("volume has not been deleted on NexentaStor")
+		}
+		encryption, _ := env.appliance.VolumeEncryption(testVolumeGroup + "/pvc-3")
+		if encryption.KeyStatus != nstest.KeyStatusAvailable {
+			t.Errorf("key used by the clone must stay loaded, got: %+v", encryption)
+		}
+
+		_, err = s.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: testConfigName + ":" + testVolumeGroup + "/pvc-3"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("volume which can't be marked for deletion", func(t *testing.T) {
+		volume := createTestVolume(t, s, "pvc-4", gib)
+		env.appliance.Faults().Add(nstest.FaultRule{
+			Method:   http.MethodPut,
+			Endpoint: "storage/volumes/*",
+			Kind:     nstest.FaultServerError,
+		})
+		defer env.appliance.Faults().Clear()
+
+		_, err := s.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volume.GetVolumeId()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := env.appliance.Volume(testVolumeGroup + "/pvc-4"); ok {
+			t.Error("volume has not been deleted on NexentaStor")
+		}
+	})
+
+	t.Run("wrong volume ID", func(t *testing.T) {
+		_, err := s.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "wrong-id"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestControllerServer_ControllerExpandVolume(t *testing.T) {
+	env := newTestEnv(t, testConfig)
+	s := env.newControllerServer(t)
+
+	volume := createTestVolume(t, s, "pvc-1", gib)
+
+	res, err := s.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+		VolumeId:      volume.GetVolumeId(),
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 2 * gib},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.GetNodeExpansionRequired() {
+		t.Error("node expansion is expected")
+	}
+	if nsVolume, _ := env.appliance.Volume(testVolumeGroup + "/pvc-1"); nsVolume.VolumeSize != 2*gib {
+		t.Errorf("volume has not been expanded on NexentaStor, size: %d", nsVolume.VolumeSize)
+	}
+}
+
+func TestControllerServer_Snapshots(t *testing.T) {
+	env := newTestEnv(t, testConfig)
+	s := env.newControllerServer(t)
+
+	volume1 := createTestVolume(t, s, "pvc-1", gib)
+	volume2 := createTestVolume(t, s, "pvc-2", gib)
+	snapshot1 := createTestSnapshot(t, s, volume1.GetVolumeId(), "snapshot-1")
+	createTestSnapshot(t, s, volume1.GetVolumeId(), "snapshot-2")
+	createTestSnapshot(t, s, volume2.GetVolumeId(), "snapshot-3")
+
+	t.Run("create existing snapshot", func(t *testing.T) {
+		snapshot := createTestSnapshot(t, s, volume1.GetVolumeId(), "snapshot-1")
+		if snapshot.GetSnapshotId() != snapshot1.GetSnapshotId() {
+			t.Errorf("unexpected snapshot ID: %s", snapshot.GetSnapshotId())
+		}
+	})
+
+	t.Run("create snapshot with name of another volume snapshot", func(t *testing.T) {
+		_, err := s.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{
+			SourceVolumeId: volume2.GetVolumeId(),
+			Name:           "snapshot-1",
+		})
+		expectCode(t, err, codes.AlreadyExists)
+	})
+
+	t.Run("list by volume", func(t *testing.T) {
+		res, err := s.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{
+			SourceVolumeId: volume1.GetVolumeId(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.GetEntries()) != 2 {
+			t.Errorf("expected 2 snapshots, got: %+v", res.GetEntries())
+		}
+	})
+
+	t.Run("list by ID", func(t *testing.T) {
+		res, err := s.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{
+			SnapshotId: snapshot1.GetSnapshotId(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.GetEntries()) != 1 || res.GetEntries()[0].GetSnapshot().GetSnapshotId() != snapshot1.GetSnapshotId() {
+			t.Errorf("expected '%s' snapshot, got: %+v", snapshot1.GetSnapshotId(), res.GetEntries())
+		}
+	})
+
+	t.Run("list all with pagination", func(t *testing.T) {
+		res, err := s.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{MaxEntries: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.GetEntries()) != 2 || res.GetNextToken() == "" {
+			t.Fatalf("expected 2 snapshots and next token, got: %+v", res)
+		}
+		res, err = s.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{
+			MaxEntries:    2,
+			StartingToken: res.GetNextToken(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.GetEntries()) != 1 || res.GetNextToken() != "" {
+			t.Errorf("expected last snapshot w/o next token, got: %+v", res)
+		}
+	})
+
+	t.Run("size and state", func(t *testing.T) {
+		if !snapshot1.GetReadyToUse() || snapshot1.GetSizeBytes() != gib {
+			t.Errorf("expected ready snapshot of %d bytes, got: %+v", gib, snapshot1)
+		}
+		res, err := s.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{
+			SourceVolumeId: volume1.GetVolumeId(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range res.GetEntries() {
+			if !entry.GetSnapshot().GetReadyToUse() || entry.GetSnapshot().GetSizeBytes() != gib {
+				t.Errorf("expected ready snapshot of %d bytes, got: %+v", gib, entry.GetSnapshot())
+			}
+		}
+	})
+
+	t.Run("snapshot being destroyed", func(t *testing.T) {
+		snapshotPath := testVolumeGroup + "/pvc-1@snapshot-2"
+		snapshotID := testConfigName + ":" + snapshotPath
+		env.appliance.SetSnapshotDeferDestroy(snapshotPath, true)
+		defer env.appliance.SetSnapshotDeferDestroy(snapshotPath, false)
+
+		res, err := s.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SnapshotId: snapshotID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.GetEntries()) != 1 || res.GetEntries()[0].GetSnapshot().GetReadyToUse() {
+			t.Errorf("expected snapshot which is not ready to use, got: %+v", res.GetEntries())
+		}
+
+		_, err = s.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:               "pvc-3",
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: gib},
+			VolumeCapabilities: testVolumeCapabilities,
+			VolumeContentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Snapshot{
+					Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshotID},
+				},
+			},
+		})
+		expectCode(t, err, codes.FailedPrecondition)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			_, err := s.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{
+				SnapshotId: snapshot1.GetSnapshotId(),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, ok := env.appliance.Snapshot(testVolumeGroup + "/pvc-1@snapshot-1"); ok {
+			t.Error("snapshot has not been deleted on NexentaStor")
+		}
+	})
+}
+
+func TestControllerServer_SnapshotsWithSecrets(t *testing.T) {
+	ctx := context.Background()
+	// config file has wrong credentials, the tenant's ones are passed in request secrets
+	env := newTestEnv(t, strings.Replace(testConfig, "password: "+testPassword, "password: wrong", 1))
+	s := env.newControllerServer(t)
+	secrets := map[string]string{"config": testConfig}
+
+	volume, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: gib},
+		VolumeCapabilities: testVolumeCapabilities,
+		Secrets:            secrets,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeID := volume.GetVolume().GetVolumeId()
+
+	if _, err := s.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{
+		SourceVolumeId: volumeID,
+		Name:           "snapshot-1",
+	}); err == nil {
+		t.Fatal("snapshot must not be created with credentials from the config file")
+	}
+
+	res, err := s.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{
+		SourceVolumeId: volumeID,
+		Name:           "snapshot-1",
+		Secrets:        secrets,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotID := res.GetSnapshot().GetSnapshotId()
+
+	list, err := s.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SourceVolumeId: volumeID, Secrets: secrets})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.GetEntries()) != 1 || list.GetEntries()[0].GetSnapshot().GetSnapshotId() != snapshotID {
+		t.Errorf("expected '%s' snapshot, got: %+v", snapshotID, list.GetEntries())
+	}
+
+	_, err = s.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: snapshotID, Secrets: secrets})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := env.appliance.Snapshot(testVolumeGroup + "/pvc-1@snapshot-1"); ok {
+		t.Error("snapshot has not been deleted on NexentaStor")
+	}
+}
+
+func TestControllerServer_ListVolumes(t *testing.T) {
+	env := newTestEnv(t, testConfig)
+	s := env.newControllerServer(t)
+
+	for _, name := range []string{"pvc-1", "pvc-2", "pvc-3"} {
+		createTestVolume(t, s, name, gib)
+	}
+
+	res, err := s.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.GetEntries()) != 3 {
+		t.Errorf("expected 3 volumes, got: %+v", res.GetEntries())
+	}
+
+	res, err = s.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.GetEntries()) != 2 {
+		t.Errorf("expected 2 volumes, got: %+v", res.GetEntries())
+	}
+}
+
+// testConfigTwoAppliances - testConfig with the second appliance, its name sorts before the first one
+const testConfigTwoAppliances = testConfig + `
+  nstor-box0:
+    restIp: https://10.3.199.29:8443
+    username: admin
+    password: Nexenta@1
+    defaultDataIp: 10.3.199.29
+    defaultVolumeGroup: pool2/csiVolumeGroup
+    defaultTargetGroup: tg01
+    defaultTarget: iqn.2005-07.com.nexenta:01:test
+    defaultHostGroup: all
+    dynamicTargetLunAllocation: true
+`
+
+func TestControllerServer_ListVolumesPagination(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, testConfigTwoAppliances)
+	env.backend.Add("https://10.3.199.29:8443", nstest.NewAppliance(nstest.ApplianceArgs{
+		Username:     testUsername,
+		Password:     testPassword,
+		VolumeGroups: []string{"pool2/csiVolumeGroup"},
+	}))
+	s := env.newControllerServer(t)
+
+	for name, configName := range map[string]string{
+		"pvc-3": testConfigName,
+		"pvc-1": testConfigName,
+		"pvc-2": testConfigName,
+		"pvc-5": "nstor-box0",
+		"pvc-4": "nstor-box0",
+	} {
+		_, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               name,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: gib},
+			VolumeCapabilities: testVolumeCapabilities,
+			Parameters:         map[string]string{"configName": configName},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []string{
+		"nstor-box0:pool2/csiVolumeGroup/pvc-4",
+		"nstor-box0:pool2/csiVolumeGroup/pvc-5",
+		testConfigName + ":" + testVolumeGroup + "/pvc-1",
+		testConfigName + ":" + testVolumeGroup + "/pvc-2",
+		testConfigName + ":" + testVolumeGroup + "/pvc-3",
+	}
+
+	listAll := func(t *testing.T, maxEntries int32) []string {
+		t.Helper()
+		ids := []string{}
+		token := ""
+		for i := 0; i <= len(expected); i++ {
+			res, err := s.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: maxEntries, StartingToken: token})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if maxEntries > 0 && len(res.GetEntries()) > int(maxEntries) {
+				t.Fatalf("expected at most %d entries, got: %+v", maxEntries, res.GetEntries())
+			}
+			for _, entry := range res.GetEntries() {
+				ids = append(ids, entry.GetVolume().GetVolumeId())
+			}
+			if token = res.GetNextToken(); token == "" {
+				return ids
+			}
+		}
+		t.Fatalf("pagination has not finished, listed: %v", ids)
+		return nil
+	}
+
+	for _, maxEntries := range []int32{0, 1, 2, 3, 5, 10} {
+		t.Run(fmt.Sprintf("max entries %d", maxEntries), func(t *testing.T) {
+			if ids := listAll(t, maxEntries); strings.Join(ids, ",") != strings.Join(expected, ",") {
+				t.Errorf("expected volumes %v, got: %v", expected, ids)
+			}
+		})
+	}
+
+	t.Run("next volume deleted", func(t *testing.T) {
+		res, err := s.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.GetNextToken() != expected[2] {
+			t.Fatalf("expected next token '%s', got: '%s'", expected[2], res.GetNextToken())
+		}
+		_, err = s.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: expected[2]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err = s.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: 2, StartingToken: res.GetNextToken()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []string{}
+		for _, entry := range res.GetEntries() {
+			ids = append(ids, entry.GetVolume().GetVolumeId())
+		}
+		if strings.Join(ids, ",") != strings.Join(expected[3:], ",") || res.GetNextToken() != "" {
+			t.Errorf("expected volumes %v, got: %v, next token: '%s'", expected[3:], ids, res.GetNextToken())
+		}
+	})
+
+	t.Run("invalid token", func(t *testing.T) {
+		for _, token := range []string{"invalid-token", "nstor-box9:pool1/csiVolumeGroup/pvc-1"} {
+			_, err := s.ListVolumes(ctx, &csi.ListVolumesRequest{StartingToken: token})
+			expectCode(t, err, codes.Aborted)
+		}
+	})
+}
+
+func TestControllerServer_ListVolumesVolumeGroups(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, testConfig)
+	env.appliance.AddVolumeGroup(testVolumeGroup + "/nested")
+	env.appliance.AddVolumeGroup("pool1/otherGroup")
+	s := env.newControllerServer(t)
+
+	for name, params := range map[string]map[string]string{
+		"pvc-1": {},
+		"pvc-2": {"volumeGroup": testVolumeGroup + "/nested"},
+		"pvc-3": {"volumeGroup": "pool1/otherGroup"},
+		"pvc-4": {"trashRetention": "1h"},
+	} {
+		_, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               name,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: gib},
+			VolumeCapabilities: testVolumeCapabilities,
+			Parameters:         params,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// trashed volumes are not listed
+	_, err := s.DeleteVolume(ctx, &csi.DeleteVolumeRequest{
+		VolumeId: testConfigName + ":" + testVolumeGroup + "/pvc-4",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		testConfigName + ":" + testVolumeGroup + "/nested/pvc-2",
+		testConfigName + ":" + testVolumeGroup + "/pvc-1",
+		testConfigName + ":pool1/otherGroup/pvc-3",
+	}
+
+	for _, maxEntries := range []int32{0, 1, 2} {
+		t.Run(fmt.Sprintf("max entries %d", maxEntries), func(t *testing.T) {
+			ids := []string{}
+			token := ""
+			for i := 0; i <= len(expected); i++ {
+				res, err := s.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: maxEntries, StartingToken: token})
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, entry := range res.GetEntries() {
+					ids = append(ids, entry.GetVolume().GetVolumeId())
+				}
+				if token = res.GetNextToken(); token == "" {
+					break
+				}
+			}
+			if strings.Join(ids, ",") != strings.Join(expected, ",") {
+				t.Errorf("expected volumes %v, got: %v", expected, ids)
+			}
+		})
+	}
+}
+
+func TestControllerServer_ListSnapshotsPagination(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, testConfigTwoAppliances)
+	env.backend.Add("https://10.3.199.29:8443", nstest.NewAppliance(nstest.ApplianceArgs{
+		Username:     testUsername,
+		Password:     testPassword,
+		VolumeGroups: []string{"pool2/csiVolumeGroup"},
+	}))
+	env.appliance.AddVolumeGroup(testVolumeGroup + "/nested")
+	s := env.newControllerServer(t)
+
+	for _, volume := range []struct{ name, configName, volumeGroup string }{
+		{"pvc-1", testConfigName, ""},
+		{"pvc-2", testConfigName, testVolumeGroup + "/nested"},
+		{"pvc-3", "nstor-box0", ""},
+	} {
+		params := map[string]string{"configName": volume.configName}
+		if volume.volumeGroup != "" {
+			params["volumeGroup"] = volume.volumeGroup
+		}
+		res, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               volume.name,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: gib},
+			VolumeCapabilities: testVolumeCapabilities,
+			Parameters:         params,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		createTestSnapshot(t, s, res.GetVolume().GetVolumeId(), "snapshot-"+volume.name)
+	}
+	// snapshots of volume groups are not CSI snapshots
+	err := newTestProvider(t, env).CreateSnapshot(ns.CreateSnapshotParams{Path: testVolumeGroup + "/nested@group-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"nstor-box0:pool2/csiVolumeGroup/pvc-3@snapshot-pvc-3",
+		testConfigName + ":" + testVolumeGroup + "/nested/pvc-2@snapshot-pvc-2",
+		testConfigName + ":" + testVolumeGroup + "/pvc-1@snapshot-pvc-1",
+	}
+
+	for _, maxEntries := range []int32{0, 1, 2} {
+		t.Run(fmt.Sprintf("max entries %d", maxEntries), func(t *testing.T) {
+			ids := []string{}
+			token := ""
+			for i := 0; i <= len(expected); i++ {
+				res, err := s.ListSnapshots(ctx, &csi.ListSnapshotsRequest{MaxEntries: maxEntries, StartingToken: token})
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, entry := range res.GetEntries() {
+					ids = append(ids, entry.GetSnapshot().GetSnapshotId())
+				}
+				if token = res.GetNextToken(); token == "" {
+					break
+				}
+			}
+			if strings.Join(ids, ",") != strings.Join(expected, ",") {
+				t.Errorf("expected snapshots %v, got: %v", expected, ids)
+			}
+		})
+	}
+
+	t.Run("invalid starting token", func(t *testing.T) {
+		for _, token := range []string{"pvc-1@snapshot-pvc-1", "unknown:" + testVolumeGroup + "/pvc-1@snapshot-pvc-1"} {
+			_, err := s.ListSnapshots(ctx, &csi.ListSnapshotsRequest{StartingToken: token})
+			expectCode(t, err, codes.Aborted)
+		}
+	})
+
+	t.Run("appliance error", func(t *testing.T) {
+		env.backend.Remove("https://10.3.199.29:8443")
+		_, err := s.ListSnapshots(ctx, &csi.ListSnapshotsRequest{})
+		if err == nil {
+			t.Error("expected error of unavailable appliance")
+		}
+	})
+}
+
+func TestControllerServer_ListVolumesMoreThanNEFLimit(t *testing.T) {
+	env := newTestEnv(t, testConfig)
+	s := env.newControllerServer(t)
+
+	// NEF returns at most 99 volumes per request
+	count := 150
+	for i := 0; i < count; i++ {
+		createTestVolume(t, s, fmt.Sprintf("pvc-%03d", i), gib)
+	}
+
+	res, err := s.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.GetEntries()) != count || res.GetNextToken() != "" {
+		t.Errorf("expected %d volumes, got: %d, next token: '%s'", count, len(res.GetEntries()), res.GetNextToken())
+	}
+}
+
+func TestControllerServer_ListVolumesStatus(t *testing.T) {
+	env := newTestEnv(t, testConfig)
+	s := env.newControllerServer(t)
+
+	volume := createTestVolume(t, s, "pvc-1", gib)
+	createTestVolume(t, s, "pvc-2", 2*gib)
+	mapTestVolume(t, newTestProvider(t, env), testVolumeGroup+"/pvc-1")
+	env.appliance.SetVolumeStatus(testVolumeGroup+"/pvc-2", nstest.VolumeStatusOffline)
+	_, err := s.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volume.GetVolumeId(),
+		NodeId:           "node-1",
+		VolumeCapability: testVolumeCapabilities[0],
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := s.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := res.GetEntries()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 volumes, got: %+v", entries)
+	}
+
+	published := entries[0]
+	if published.GetVolume().GetCapacityBytes() != gib {
+		t.Errorf("unexpected capacity: %d", published.GetVolume().GetCapacityBytes())
+	}
+	volumeContext := published.GetVolume().GetVolumeContext()
+	if volumeContext["VolumeGroup"] != testVolumeGroup || volumeContext["DataIP"] != "10.3.199.28" ||
+		volumeContext["TargetGroup"] != "tg01" {
+		t.Errorf("unexpected volume context: %+v", volumeContext)
+	}
+	if nodes := published.GetStatus().GetPublishedNodeIds(); len(nodes) != 1 || nodes[0] != "node-1" {
+		t.Errorf("unexpected published nodes: %v", nodes)
+	}
+	if condition := published.GetStatus().GetVolumeCondition(); condition.GetAbnormal() {
+		t.Errorf("volume is reported abnormal: %+v", condition)
+	}
+
+	offline := entries[1]
+	if offline.GetVolume().GetCapacityBytes() != 2*gib {
+		t.Errorf("unexpected capacity: %d", offline.GetVolume().GetCapacityBytes())
+	}
+	if nodes := offline.GetStatus().GetPublishedNodeIds(); len(nodes) != 0 {
+		t.Errorf("unexpected published nodes: %v", nodes)
+	}
+	condition := offline.GetStatus().GetVolumeCondition()
+	if !condition.GetAbnormal() || !strings.Contains(condition.GetMessage(), nstest.VolumeStatusOffline) {
+		t.Errorf("offline volume is not reported abnormal: %+v", condition)
+	}
+
+	env.appliance.SetPoolHealth("pool1", nstest.PoolHealthDegraded)
+	res, err = s.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range res.GetEntries() {
+		if condition := entry.GetStatus().GetVolumeCondition(); !condition.GetAbnormal() {
+			t.Errorf("volume on degraded pool is not reported abnormal: %+v", entry)
+		}
+	}
+}
+
+func TestControllerServer_ControllerModifyVolume(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, testConfig)
+	s := env.newControllerServer(t)
+
+	volumeID := createTestVolume(t, s, "pvc-1", gib).GetVolumeId()
+	volumePath := testVolumeGroup + "/pvc-1"
+	modify := func(params map[string]string) error {
+		_, err := s.ControllerModifyVolume(ctx, &csi.ControllerModifyVolumeRequest{
+			VolumeId:          volumeID,
+			MutableParameters: params,
+		})
+		return err
+	}
+
+	t.Run("properties", func(t *testing.T) {
+		params := map[string]string{
+			"compression":    "lz4",
+			"logbias":        "throughput",
+			"sync":           "disabled",
+			"primarycache":   "metadata",
+			"secondarycache": "none",
+			"user:team":      "db",
+		}
+		// retried request must succeed with the same result
+		for i := 0; i < 2; i++ {
+			if err := modify(params); err != nil {
+				t.Fatal(err)
+			}
+		}
+		props, _ := env.appliance.VolumeProperties(volumePath)
+		if props.CompressionMode != "lz4" || props.LogicalBias != "throughput" || props.SyncMode != "disabled" ||
+			props.PrimaryCache != "metadata" || props.SecondaryCache != "none" || props.UserProperties["user:team"] != "db" {
+			t.Errorf("volume properties have not been changed: %+v", props)
+		}
+		if props.VolumeBlockSize != nstest.DefaultVolumeBlockSize {
+			t.Errorf("volblocksize has been changed: %+v", props)
+		}
+	})
+
+	t.Run("refreservation", func(t *testing.T) {
+		for value, reserved := range map[string]int64{"auto": gib, "512Mi": gib / 2, "none": 0} {
+			if err := modify(map[string]string{"refreservation": value}); err != nil {
+				t.Fatal(err)
+			}
+			if v, _ := env.appliance.Volume(volumePath); v.BytesUsed != reserved {
+				t.Errorf("expected %d bytes reserved for '%s', got: %d", reserved, value, v.BytesUsed)
+			}
+		}
+		expectCode(t, modify(map[string]string{"refreservation": "2G"}), codes.InvalidArgument)
+	})
+
+	t.Run("invalid parameters", func(t *testing.T) {
+		for _, params := range []map[string]string{
+			{"volblocksize": "16K"},
+			{"sparseVolume": "false"},
+			{"volumeGroup": "pool1/other"},
+			{"compression": "fast"},
+			{"refreservation": "lots"},
+			{"user:Team": "db"},
+		} {
+			err := modify(params)
+			if status.Code(err) != codes.InvalidArgument {
+				t.Errorf("expected InvalidArgument error for %v, got: %v", params, err)
+			}
+		}
+		err := modify(map[string]string{"volblocksize": "16K"})
+		if !strings.Contains(status.Convert(err).Message(), "volblocksize") {
+			t.Errorf("error doesn't explain which parameter is immutable: %s", err)
+		}
+	})
+
+	t.Run("wrong volume", func(t *testing.T) {
+		for volumeID, code := range map[string]codes.Code{
+			"":            codes.InvalidArgument,
+			"pool1/pvc-1": codes.NotFound,
+			"nstor-box1:pool1/csiVolumeGroup/pvc-missing": codes.NotFound,
+		} {
+			_, err := s.ControllerModifyVolume(ctx, &csi.ControllerModifyVolumeRequest{
+				VolumeId:          volumeID,
+				MutableParameters: map[string]string{"compression": "off"},
+			})
+			if status.Code(err) != code {
+				t.Errorf("expected '%s' error for volume ID '%s', got: %v", code, volumeID, err)
+			}
+		}
+	})
+}
+
+func TestControllerServer_ControllerUnpublishVolume(t *testing.T) {
+	env := newTestEnv(t, testConfig)
+	s := env.newControllerServer(t)
+
+	volume := createTestVolume(t, s, "pvc-1", gib)
+	mapTestVolume(t, newTestProvider(t, env), testVolumeGroup+"/pvc-1")
+
+	_, err := s.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: volume.GetVolumeId(),
+		NodeId:   "node-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lunMappings := env.appliance.LunMappings(testVolumeGroup + "/pvc-1"); len(lunMappings) != 0 {
+		t.Errorf("LUN mappings have not been deleted: %+v", lunMappings)
+	}
+}
+
+func TestControllerServer_GetCapacity(t *testing.T) {
+	env := newTestEnv(t, testConfig)
+	s := env.newControllerServer(t)
+
+	before, err := s.GetCapacity(context.Background(), &csi.GetCapacityRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "pvc-thick",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: gib},
+		VolumeCapabilities: testVolumeCapabilities,
+		Parameters:         map[string]string{"sparseVolume": "false"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := s.GetCapacity(context.Background(), &csi.GetCapacityRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.GetAvailableCapacity()-after.GetAvailableCapacity() != gib {
+		t.Errorf(
+			"thick volume should consume capacity, before: %d, after: %d",
+			before.GetAvailableCapacity(),
+			after.GetAvailableCapacity(),
+		)
+	}
+}
+
+const testConfigZones = `
+nexentastor_map:
+  nstor-box1:
+    restIp: https://10.3.199.28:8443
+    username: admin
+    password: Nexenta@1
+    defaultVolumeGroup: pool1/csiVolumeGroup
+    zone: zone-a
+    dynamicTargetLunAllocation: true
+  nstor-box0:
+    restIp: https://10.3.199.29:8443
+    username: admin
+    password: Nexenta@1
+    defaultVolumeGroup: pool2/csiVolumeGroup
+    zone: zone-a
+    dynamicTargetLunAllocation: true
+  nstor-box2:
+    restIp: https://10.3.199.30:8443
+    username: admin
+    password: Nexenta@1
+    defaultVolumeGroup: pool3/csiVolumeGroup
+    zone: zone-b
+    dynamicTargetLunAllocation: true
+`
+
+func TestControllerServer_GetCapacityByTopology(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, testConfigZones)
+	for address, vg := range map[string]string{
+		"https://10.3.199.29:8443": "pool2/csiVolumeGroup",
+		"https://10.3.199.30:8443": "pool3/csiVolumeGroup",
+	} {
+		env.backend.Add(address, nstest.NewAppliance(nstest.ApplianceArgs{
+			Username:     testUsername,
+			Password:     testPassword,
+			VolumeGroups: []string{vg},
+			PoolSize:     50 * gib,
+		}))
+	}
+	env.backend.Appliance("https://10.3.199.29:8443").SetVolumeGroupBlockSize("pool2/csiVolumeGroup", 4096)
+	s := env.newControllerServer(t)
+
+	_, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "pvc-thick",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 10 * gib},
+		VolumeCapabilities: testVolumeCapabilities,
+		Parameters:         map[string]string{"configName": "nstor-box0", "sparseVolume": "false"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getCapacity := func(zone string, params map[string]string) (*csi.GetCapacityResponse, error) {
+		req := &csi.GetCapacityRequest{Parameters: params}
+		if zone != "" {
+			req.AccessibleTopology = &csi.Topology{Segments: map[string]string{"topology.kubernetes.io/zone": zone}}
+		}
+		return s.GetCapacity(ctx, req)
+	}
+	expectCapacity := func(res *csi.GetCapacityResponse, available, maxSize, minSize int64) {
+		t.Helper()
+		if res.GetAvailableCapacity() != available ||
+			res.GetMaximumVolumeSize().GetValue() != maxSize ||
+			res.GetMinimumVolumeSize().GetValue() != minSize {
+			t.Errorf(
+				"expected capacity %d, max volume size %d, min volume size %d, got: %+v",
+				available,
+				maxSize,
+				minSize,
+				res,
+			)
+		}
+	}
+
+	for _, tc := range []struct {
+		name               string
+		zone               string
+		params             map[string]string
+		available, maxSize int64
+		minSize            int64
+	}{
+		{"all appliances", "", nil, 100*gib + 40*gib + 50*gib, 100 * gib, 4096},
+		{"zone", "zone-a", nil, 100*gib + 40*gib, 100 * gib, 4096},
+		{"other zone", "zone-b", nil, 50 * gib, 50 * gib, 8192},
+		{"config name", "", map[string]string{"configName": "nstor-box0"}, 40 * gib, 40 * gib, 4096},
+		{"config name and zone", "zone-a", map[string]string{"configName": "nstor-box1"}, 100 * gib, 100 * gib, 8192},
+		{"config name in other zone", "zone-b", map[string]string{"configName": "nstor-box1"}, 0, 0, 0},
+		{"volume group", "", map[string]string{"volumeGroup": "pool3/csiVolumeGroup"}, 50 * gib, 50 * gib, 8192},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := getCapacity(tc.zone, tc.params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectCapacity(res, tc.available, tc.maxSize, tc.minSize)
+		})
+	}
+
+	t.Run("zone without appliances", func(t *testing.T) {
+		res, err := getCapacity("zone-c", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.GetAvailableCapacity() != 0 || res.GetMaximumVolumeSize() != nil || res.GetMinimumVolumeSize() != nil {
+			t.Errorf("expected no capacity, got: %+v", res)
+		}
+	})
+
+	t.Run("unknown config name", func(t *testing.T) {
+		_, err := getCapacity("", map[string]string{"configName": "nstor-box9"})
+		expectCode(t, err, codes.InvalidArgument)
+	})
+
+	t.Run("unreachable appliance", func(t *testing.T) {
+		other := env.backend.Appliance("https://10.3.199.29:8443")
+		env.backend.Remove("https://10.3.199.29:8443")
+		defer env.backend.Add("https://10.3.199.29:8443", other)
+
+		res, err := getCapacity("zone-a", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectCapacity(res, 100*gib, 100*gib, 8192)
+		_, err = getCapacity("", map[string]string{"configName": "nstor-box0"})
+		expectCode(t, err, codes.Internal)
+	})
+}
+
+func TestControllerServer_ValidateVolumeCapabilities(t *testing.T) {
+	env := newTestEnv(t, testConfig)
+	s := env.newControllerServer(t)
+
+	volume := createTestVolume(t, s, "pvc-1", gib)
+
+	res, err := s.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           volume.GetVolumeId(),
+		VolumeCapabilities: testVolumeCapabilities,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.GetConfirmed() == nil {
+		t.Errorf("capabilities are not confirmed: %s", res.GetMessage())
+	}
+
+	_, err = s.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId: volume.GetVolumeId(),
+	})
+	expectCode(t, err, codes.InvalidArgument)
+}
+
+func TestControllerServer_MalformedIDs(t *testing.T) {
+	env := newTestEnv(t, testConfig)
+	s := env.newControllerServer(t)
+	ctx := context.Background()
+
+	for _, id := range []string{"wrong-id", testConfigName + ":pool1/pvc-1", "v9:" + testConfigName + ":pool1/a/b"} {
+		t.Run(id, func(t *testing.T) {
+			_, err := s.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId:           id,
+				VolumeCapabilities: testVolumeCapabilities,
+			})
+			expectCode(t, err, codes.NotFound)
+
+			_, err = s.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+				VolumeId:         id,
+				NodeId:           "node-1",
+				VolumeCapability: testVolumeCapabilities[0],
+			})
+			expectCode(t, err, codes.NotFound)
+
+			_, err = s.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+				VolumeId:      id,
+				CapacityRange: &csi.CapacityRange{RequiredBytes: gib},
+			})
+			expectCode(t, err, codes.InvalidArgument)
+
+			_, err = s.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{SourceVolumeId: id, Name: "snap-1"})
+			expectCode(t, err, codes.InvalidArgument)
+
+			_, err = s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+				Name:               "pvc-1",
+				VolumeCapabilities: testVolumeCapabilities,
+				VolumeContentSource: &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Volume{
+						Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: id},
+					},
+				},
+			})
+			expectCode(t, err, codes.NotFound)
+
+			_, err = s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+				Name:               "pvc-1",
+				VolumeCapabilities: testVolumeCapabilities,
+				VolumeContentSource: &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Snapshot{
+						Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: id + "@snap-1"},
+					},
+				},
+			})
+			expectCode(t, err, codes.NotFound)
+
+			_, err = s.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: id})
+			expectCode(t, err, codes.OK)
+
+			_, err = s.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: id, NodeId: "node-1"})
+			expectCode(t, err, codes.OK)
+
+			_, err = s.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: id + "@snap-1"})
+			expectCode(t, err, codes.OK)
+
+			res, err := s.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SourceVolumeId: id})
+			expectCode(t, err, codes.OK)
+			if len(res.GetEntries()) != 0 {
+				t.Errorf("expected no snapshots, got: %+v", res.GetEntries())
+			}
+
+			res, err = s.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SnapshotId: id + "@snap-1"})
+			expectCode(t, err, codes.OK)
+			if len(res.GetEntries()) != 0 {
+				t.Errorf("expected no snapshots, got: %+v", res.GetEntries())
+			}
+		})
+	}
+}
+
+func TestControllerServer_NestedVolumeGroup(t *testing.T) {
+	const nestedVolumeGroup = "pool1/tenant/env/volumes"
+	env := newTestEnv(t, strings.Replace(testConfig, testVolumeGroup, nestedVolumeGroup, 1))
+	env.appliance.AddVolumeGroup(nestedVolumeGroup)
+	s := env.newControllerServer(t)
+	ctx := context.Background()
+
+	volume := createTestVolume(t, s, "pvc-1", gib)
+	volumeID := testConfigName + ":" + nestedVolumeGroup + "/pvc-1"
+	if volume.GetVolumeId() != volumeID {
+		t.Fatalf("unexpected volume ID: %s", volume.GetVolumeId())
+	}
+	if volume.GetVolumeContext()["VolumeGroup"] != nestedVolumeGroup {
+		t.Errorf("unexpected volume context: %+v", volume.GetVolumeContext())
+	}
+
+	t.Run("volumeGroup parameter", func(t *testing.T) {
+		res, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               "pvc-2",
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: gib},
+			VolumeCapabilities: testVolumeCapabilities,
+			Parameters:         map[string]string{"volumeGroup": testVolumeGroup},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.GetVolume().GetVolumeId() != testConfigName+":"+testVolumeGroup+"/pvc-2" {
+			t.Errorf("unexpected volume ID: %s", res.GetVolume().GetVolumeId())
+		}
+	})
+
+	t.Run("ListVolumes", func(t *testing.T) {
+		res, err := s.ListVolumes(ctx, &csi.ListVolumesRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// volumes of all volume groups are listed, not only of the default one
+		entries := res.GetEntries()
+		if len(entries) != 2 ||
+			entries[0].GetVolume().GetVolumeId() != testConfigName+":"+testVolumeGroup+"/pvc-2" ||
+			entries[1].GetVolume().GetVolumeId() != volumeID {
+			t.Errorf("unexpected entries: %+v", entries)
+		}
+	})
+
+	t.Run("ControllerExpandVolume", func(t *testing.T) {
+		_, err := s.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+			VolumeId:      volumeID,
+			CapacityRange: &csi.CapacityRange{RequiredBytes: 2 * gib},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, _ := env.appliance.Volume(nestedVolumeGroup + "/pvc-1"); v.VolumeSize != 2*gib {
+			t.Errorf("volume has not been expanded, size: %d", v.VolumeSize)
+		}
+	})
+
+	t.Run("snapshots", func(t *testing.T) {
+		snapshot := createTestSnapshot(t, s, volumeID, "snap-1")
+		if snapshot.GetSnapshotId() != volumeID+"@snap-1" {
+			t.Errorf("unexpected snapshot ID: %s", snapshot.GetSnapshotId())
+		}
+
+		for _, req := range []*csi.ListSnapshotsRequest{
+			{SourceVolumeId: volumeID},
+			{SnapshotId: snapshot.GetSnapshotId()},
+			{},
+		} {
+			res, err := s.ListSnapshots(ctx, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries := res.GetEntries()
+			if len(entries) != 1 || entries[0].GetSnapshot().GetSourceVolumeId() != volumeID {
+				t.Errorf("unexpected entries for %+v: %+v", req, entries)
+			}
+		}
+
+		_, err := s.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: snapshot.GetSnapshotId()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := env.appliance.Snapshot(nestedVolumeGroup + "/pvc-1@snap-1"); ok {
+			t.Error("snapshot has not been deleted")
+		}
+	})
+
+	t.Run("ControllerUnpublishVolume and DeleteVolume", func(t *testing.T) {
+		mapTestVolume(t, newTestProvider(t, env), nestedVolumeGroup+"/pvc-1")
+
+		_, err := s.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+			VolumeId: volumeID,
+			NodeId:   "node-1",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mappings := env.appliance.LunMappings(nestedVolumeGroup + "/pvc-1"); len(mappings) != 0 {
+			t.Errorf("LUN mappings have not been deleted: %+v", mappings)
+		}
+
+		_, err = s.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := env.appliance.Volume(nestedVolumeGroup + "/pvc-1"); ok {
+			t.Error("volume has not been deleted")
+		}
+	})
+}
+
+func TestControllerServer_ControllerGetVolume(t *testing.T) {
+	env := newTestEnv(t, testConfig)
+	s := env.newControllerServer(t)
+	ctx := context.Background()
+
+	volume := createTestVolume(t, s, "pvc-1", 2*gib)
+	volumePath := testVolumeGroup + "/pvc-1"
+
+	getVolume := func(t *testing.T) *csi.ControllerGetVolumeResponse {
+		t.Helper()
+		res, err := s.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: volume.GetVolumeId()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.GetVolume().GetVolumeId() != volume.GetVolumeId() {
+			t.Errorf("unexpected volume ID: %s", res.GetVolume().GetVolumeId())
+		}
+		return res
+	}
+
+	t.Run("healthy volume", func(t *testing.T) {
+		res := getVolume(t)
+		if res.GetVolume().GetCapacityBytes() != 2*gib {
+			t.Errorf("unexpected capacity: %d", res.GetVolume().GetCapacityBytes())
+		}
+		if res.GetStatus().GetVolumeCondition().GetAbnormal() {
+			t.Errorf("volume is expected to be normal: %+v", res.GetStatus().GetVolumeCondition())
+		}
+		if nodes := res.GetStatus().GetPublishedNodeIds(); len(nodes) != 0 {
+			t.Errorf("volume is not published, got nodes: %v", nodes)
+		}
+	})
+
+	t.Run("published volume", func(t *testing.T) {
+		p := newTestProvider(t, env)
+		mapTestVolume(t, p, volumePath)
+		initiator := "iqn.1993-08.org.debian:01:node-2"
+		if err := p.CreateHostGroup(ns.CreateHostGroupParams{Name: "hg-1", Members: []string{initiator}}); err != nil {
+			t.Fatal(err)
+		}
+		err := p.CreateLunMapping(ns.CreateLunMappingParams{HostGroup: "hg-1", Volume: volumePath, TargetGroup: "tg01"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// initiators of host groups are not CSI node IDs
+		if nodes := getVolume(t).GetStatus().GetPublishedNodeIds(); len(nodes) != 0 {
+			t.Errorf("unexpected published nodes: %v", nodes)
+		}
+
+		for _, nodeID := range []string{"node-2", "Node_1", "node-2"} {
+			_, err := s.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+				VolumeId:         volume.GetVolumeId(),
+				NodeId:           nodeID,
+				VolumeCapability: testVolumeCapabilities[0],
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if nodes := getVolume(t).GetStatus().GetPublishedNodeIds(); !reflect.DeepEqual(nodes, []string{"Node_1", "node-2"}) {
+			t.Errorf("expected published nodes [Node_1 node-2], got: %v", nodes)
+		}
+
+		_, err = s.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+			VolumeId: volume.GetVolumeId(),
+			NodeId:   "Node_1",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nodes := getVolume(t).GetStatus().GetPublishedNodeIds(); !reflect.DeepEqual(nodes, []string{"node-2"}) {
+			t.Errorf("expected published nodes [node-2], got: %v", nodes)
+		}
+
+		// the volume is unpublished from all nodes without the node ID
+		_, err = s.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: volume.GetVolumeId()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nodes := getVolume(t).GetStatus().GetPublishedNodeIds(); len(nodes) != 0 {
+			t.Errorf("unexpected published nodes: %v", nodes)
+		}
+	})
+
+	t.Run("offline volume", func(t *testing.T) {
+		env.appliance.SetVolumeStatus(volumePath, nstest.VolumeStatusOffline)
+		defer env.appliance.SetVolumeStatus(volumePath, nstest.VolumeStatusOnline)
+
+		condition := getVolume(t).GetStatus().GetVolumeCondition()
+		if !condition.GetAbnormal() || !strings.Contains(condition.GetMessage(), nstest.VolumeStatusOffline) {
+			t.Errorf("volume is expected to be abnormal: %+v", condition)
+		}
+	})
+
+	t.Run("degraded pool", func(t *testing.T) {
+		env.appliance.SetPoolHealth("pool1", nstest.PoolHealthDegraded)
+		defer env.appliance.SetPoolHealth("pool1", nstest.PoolHealthOnline)
+
+		condition := getVolume(t).GetStatus().GetVolumeCondition()
+		if !condition.GetAbnormal() || !strings.Contains(condition.GetMessage(), nstest.PoolHealthDegraded) {
+			t.Errorf("volume is expected to be abnormal: %+v", condition)
+		}
+	})
+
+	t.Run("missing volume", func(t *testing.T) {
+		res, err := s.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{
+			VolumeId: testConfigName + ":" + testVolumeGroup + "/pvc-missing",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.GetStatus().GetVolumeCondition().GetAbnormal() {
+			t.Errorf("volume is expected to be abnormal: %+v", res.GetStatus().GetVolumeCondition())
+		}
+		if res.GetVolume().GetCapacityBytes() != 0 {
+			t.Errorf("unexpected capacity: %d", res.GetVolume().GetCapacityBytes())
+		}
+	})
+
+	t.Run("wrong volume ID", func(t *testing.T) {
+		_, err := s.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: "wrong-id"})
+		expectCode(t, err, codes.NotFound)
+
+		_, err = s.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{
+			VolumeId: "unknown:" + volumePath,
+		})
+		expectCode(t, err, codes.NotFound)
+
+		_, err = s.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{})
+		expectCode(t, err, codes.InvalidArgument)
+	})
+
+	t.Run("capabilities", func(t *testing.T) {
+		res, err := s.ControllerGetCapabilities(ctx, &csi.ControllerGetCapabilitiesRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := map[csi.ControllerServiceCapability_RPC_Type]bool{}
+		for _, capability := range res.GetCapabilities() {
+			found[capability.GetRpc().GetType()] = true
+		}
+		if !found[csi.ControllerServiceCapability_RPC_GET_VOLUME] ||
+			!found[csi.ControllerServiceCapability_RPC_VOLUME_CONDITION] ||
+			!found[csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES] {
+			t.Errorf("GET_VOLUME, VOLUME_CONDITION and LIST_VOLUMES_PUBLISHED_NODES capabilities are expected, got: %+v",
+				res.GetCapabilities())
+		}
+	})
+}
@@ -0,0 +1,179 @@
+package driver_test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/config"
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/driver"
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/hosttest"
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/nstest"
+)
+
+const (
+	testConfigName  = "nstor-box1"
+	testAddress     = "https://10.3.199.28:8443"
+	testUsername    = "admin"
+	testPassword    = "Nexenta@1"
+	testVolumeGroup = "pool1/csiVolumeGroup"
+)
+
+const testConfig = `
+nexentastor_map:
+  nstor-box1:
+    restIp: https://10.3.199.28:8443
+    username: admin
+    password: Nexenta@1
+    defaultDataIp: 10.3.199.28
+    defaultVolumeGroup: pool1/csiVolumeGroup
+    defaultTargetGroup: tg01
+    defaultTarget: iqn.2005-07.com.nexenta:01:test
+    defaultHostGroup: all
+    dynamicTargetLunAllocation: true
+`
+
+// testLeaderElector - leader election of the controller, the controller is the leader by default
+type testLeaderElector struct {
+	leader bool
+}
+
+func (e *testLeaderElector) IsLeader() bool {
+	return e.leader
+}
+
+// testEnv - driver instance with in-memory NexentaStor backend and node host
+type testEnv struct {
+	backend   *nstest.Backend
+	appliance *nstest.Appliance
+	host      *hosttest.Host
+	driver    *driver.Driver
+	config    *config.Config
+	leader    *testLeaderElector
+	log       *logrus.Entry
+}
+
+func newTestLog() *logrus.Entry {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	if os.Getenv("DEBUG") != "" {
+		logger.SetOutput(os.Stderr)
+		logger.SetLevel(logrus.DebugLevel)
+	}
+	return logger.WithField("title", "tests")
+}
+
+// newTestEnv - creates driver with one appliance configured by configContent
+func newTestEnv(t *testing.T, configContent string) *testEnv {
+	t.Helper()
+
+	configDir := t.TempDir()
+	err := os.WriteFile(filepath.Join(configDir, "driver-config.yaml"), []byte(configContent), 0600)
+	if err != nil {
+		t.Fatalf("Cannot write config file: %s", err)
+	}
+	cfg, err := config.New(configDir)
+	if err != nil {
+		t.Fatalf("Cannot load config: %s", err)
+	}
+
+	appliance := nstest.NewAppliance(nstest.ApplianceArgs{
+		Username:     testUsername,
+		Password:     testPassword,
+		VolumeGroups: []string{testVolumeGroup},
+	})
+	backend := nstest.NewBackend()
+	backend.Add(testAddress, appliance)
+
+	host := hosttest.NewHost()
+	if err := host.SetInitiatorName("iqn.1993-08.org.debian:01:node-1"); err != nil {
+		t.Fatalf("Cannot write initiator name: %s", err)
+	}
+
+	l := newTestLog()
+	leader := &testLeaderElector{leader: true}
+	d, err := driver.NewDriver(driver.Args{
+		Role:            driver.RoleAll,
+		NodeID:          "node-1",
+		Endpoint:        "unix:///tmp/csi.sock",
+		Config:          cfg,
+		Log:             l,
+		ResolverFactory: backend.NewResolver,
+		LeaderElector:   leader,
+		Exec:            host.Exec,
+		HostFS:          host.FS,
+		Mounter:         host.Mounter,
+	})
+	if err != nil {
+		t.Fatalf("Cannot create driver: %s", err)
+	}
+
+	return &testEnv{
+		backend:   backend,
+		appliance: appliance,
+		host:      host,
+		driver:    d,
+		config:    cfg,
+		leader:    leader,
+		log:       l,
+	}
+}
+
+func (e *testEnv) newControllerServer(t *testing.T) *driver.ControllerServer {
+	t.Helper()
+	s, err := driver.NewControllerServer(e.driver)
+	if err != nil {
+		t.Fatalf("Cannot create controller server: %s", err)
+	}
+	return s
+}
+
+func (e *testEnv) newNodeServer(t *testing.T) *driver.NodeServer {
+	t.Helper()
+	s, err := driver.NewNodeServer(e.driver)
+	if err != nil {
+		t.Fatalf("Cannot create node server: %s", err)
+	}
+	return s
+}
+
+// newTestProvider - creates NexentaStor provider to prepare appliance state in tests
+func newTestProvider(t *testing.T, e *testEnv) ns.ProviderInterface {
+	t.Helper()
+	p, err := e.backend.NewProvider(ns.ProviderArgs{
+		Address:  testAddress,
+		Username: testUsername,
+		Password: testPassword,
+		Log:      e.log,
+	})
+	if err != nil {
+		t.Fatalf("Cannot create NexentaStor provider: %s", err)
+	}
+	return p
+}
+
+// mapTestVolume - creates target, target group and LUN mapping for the volume
+func mapTestVolume(t *testing.T, p ns.ProviderInterface, volumePath string) {
+	t.Helper()
+	target := "iqn.2005-07.com.nexenta:01:test"
+	if err := p.CreateISCSITarget(ns.CreateISCSITargetParams{Name: target}); err != nil {
+		t.Fatalf("Cannot create target: %s", err)
+	}
+	err := p.CreateUpdateTargetGroup(ns.CreateTargetGroupParams{Name: "tg01", Members: []string{target}})
+	if err != nil {
+		t.Fatalf("Cannot create target group: %s", err)
+	}
+	err = p.CreateLunMapping(ns.CreateLunMappingParams{
+		HostGroup:   nstest.AllHostGroup,
+		Volume:      volumePath,
+		TargetGroup: "tg01",
+	})
+	if err != nil {
+		t.Fatalf("Cannot create LUN mapping: %s", err)
+	}
+}
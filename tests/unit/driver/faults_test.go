@@ -0,0 +1,337 @@
+package driver_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/nstest"
+)
+
+// faultScenarioAttempts - RPC is retried this many times after a failure, as CO would do
+const faultScenarioAttempts = 3
+
+// faultScenario - RPC that must be idempotent and converge when retried after any single NEF failure
+type faultScenario struct {
+	name string
+
+	// prepare - creates initial state, faults are not injected
+	prepare func(t *testing.T, env *testEnv)
+
+	// call - runs the RPC once
+	call func(t *testing.T, env *testEnv) error
+
+	// check - verifies the state after successful RPC
+	check func(t *testing.T, env *testEnv)
+}
+
+func (sc faultScenario) newEnv(t *testing.T) *testEnv {
+	t.Helper()
+	env := newTestEnv(t, testConfig)
+	attachOnLogin(t, env, testVolumeGroup+"/pvc-1", testDevice)
+	if sc.prepare != nil {
+		sc.prepare(t, env)
+	}
+	return env
+}
+
+// run - runs RPC without faults to collect NEF requests it sends, then for every request and every fault kind
+// runs RPC in a new environment with the fault injected into this request once
+func (sc faultScenario) run(t *testing.T) {
+	env := sc.newEnv(t)
+	env.appliance.Faults().ResetRequests()
+	if err := sc.call(t, env); err != nil {
+		t.Fatalf("%s failed without faults: %s", sc.name, err)
+	}
+	requests := env.appliance.Faults().Requests()
+	sc.check(t, env)
+
+	seen := map[nstest.Request]int{}
+	for _, request := range requests {
+		skip := seen[request]
+		seen[request]++
+		for _, kind := range nstest.FaultKinds {
+			name := fmt.Sprintf("%s #%d %s", request, skip, kind)
+			t.Run(name, func(t *testing.T) {
+				env := sc.newEnv(t)
+				env.appliance.Faults().Add(nstest.FaultRule{
+					Method:   request.Method,
+					Endpoint: request.Endpoint,
+					Kind:     kind,
+					Latency:  time.Millisecond,
+					Skip:     skip,
+					Times:    1,
+				})
+
+				var err error
+				for i := 0; i < faultScenarioAttempts; i++ {
+					if err = sc.call(t, env); err == nil {
+						break
+					}
+				}
+				if err != nil {
+					t.Fatalf("%s has not converged after %d attempts: %s", sc.name, faultScenarioAttempts, err)
+				}
+				if env.appliance.Faults().Injected() != 1 {
+					t.Fatalf("fault has not been injected")
+				}
+				sc.check(t, env)
+			})
+		}
+	}
+}
+
+func TestFaults_ControllerServer(t *testing.T) {
+	volumeID := testConfigName + ":" + testVolumeGroup + "/pvc-1"
+
+	scenarios := []faultScenario{
+		{
+			name: "CreateVolume",
+			call: func(t *testing.T, env *testEnv) error {
+				_, err := env.newControllerServer(t).CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+					Name:               "pvc-1",
+					CapacityRange:      &csi.CapacityRange{RequiredBytes: 2 * gib},
+					VolumeCapabilities: testVolumeCapabilities,
+				})
+				return err
+			},
+			check: func(t *testing.T, env *testEnv) {
+				if v, ok := env.appliance.Volume(testVolumeGroup + "/pvc-1"); !ok || v.VolumeSize != 2*gib {
+					t.Errorf("volume has not been created: %+v", v)
+				}
+			},
+		},
+		{
+			name: "CreateVolume from snapshot",
+			prepare: func(t *testing.T, env *testEnv) {
+				s := env.newControllerServer(t)
+				createTestVolume(t, s, "pvc-1", 2*gib)
+				createTestSnapshot(t, s, volumeID, "snap-1")
+			},
+			call: func(t *testing.T, env *testEnv) error {
+				_, err := env.newControllerServer(t).CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+					Name:               "pvc-2",
+					CapacityRange:      &csi.CapacityRange{RequiredBytes: 2 * gib},
+					VolumeCapabilities: testVolumeCapabilities,
+					VolumeContentSource: &csi.VolumeContentSource{
+						Type: &csi.VolumeContentSource_Snapshot{
+							Snapshot: &csi.VolumeContentSource_SnapshotSource{
+								SnapshotId: volumeID + "@snap-1",
+							},
+						},
+					},
+				})
+				return err
+			},
+			check: func(t *testing.T, env *testEnv) {
+				if v, ok := env.appliance.Volume(testVolumeGroup + "/pvc-2"); !ok || v.VolumeSize != 2*gib {
+					t.Errorf("volume has not been restored from snapshot: %+v", v)
+				}
+			},
+		},
+		{
+			name: "DeleteVolume",
+			prepare: func(t *testing.T, env *testEnv) {
+				createTestVolume(t, env.newControllerServer(t), "pvc-1", 2*gib)
+				mapTestVolume(t, newTestProvider(t, env), testVolumeGroup+"/pvc-1")
+			},
+			call: func(t *testing.T, env *testEnv) error {
+				_, err := env.newControllerServer(t).DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{
+					VolumeId: volumeID,
+				})
+				return err
+			},
+			check: func(t *testing.T, env *testEnv) {
+				if _, ok := env.appliance.Volume(testVolumeGroup + "/pvc-1"); ok {
+					t.Errorf("volume has not been deleted")
+				}
+				if mappings := env.appliance.LunMappings(testVolumeGroup + "/pvc-1"); len(mappings) != 0 {
+					t.Errorf("LUN mappings have not been deleted: %+v", mappings)
+				}
+			},
+		},
+		{
+			name: "ControllerExpandVolume",
+			prepare: func(t *testing.T, env *testEnv) {
+				createTestVolume(t, env.newControllerServer(t), "pvc-1", 2*gib)
+			},
+			call: func(t *testing.T, env *testEnv) error {
+				_, err := env.newControllerServer(t).ControllerExpandVolume(
+					context.Background(),
+					&csi.ControllerExpandVolumeRequest{
+						VolumeId:      volumeID,
+						CapacityRange: &csi.CapacityRange{RequiredBytes: 3 * gib},
+					},
+				)
+				return err
+			},
+			check: func(t *testing.T, env *testEnv) {
+				if v, _ := env.appliance.Volume(testVolumeGroup + "/pvc-1"); v.VolumeSize != 3*gib {
+					t.Errorf("volume has not been expanded, size: %d", v.VolumeSize)
+				}
+			},
+		},
+		{
+			name: "ControllerGetVolume",
+			prepare: func(t *testing.T, env *testEnv) {
+				createTestVolume(t, env.newControllerServer(t), "pvc-1", 2*gib)
+				mapTestVolume(t, newTestProvider(t, env), testVolumeGroup+"/pvc-1")
+			},
+			call: func(t *testing.T, env *testEnv) error {
+				res, err := env.newControllerServer(t).ControllerGetVolume(
+					context.Background(),
+					&csi.ControllerGetVolumeRequest{VolumeId: volumeID},
+				)
+				if err == nil && res.GetStatus().GetVolumeCondition().GetAbnormal() {
+					return fmt.Errorf("volume is reported abnormal: %+v", res.GetStatus().GetVolumeCondition())
+				}
+				return err
+			},
+			check: func(t *testing.T, env *testEnv) {},
+		},
+		{
+			name: "ControllerModifyVolume",
+			prepare: func(t *testing.T, env *testEnv) {
+				createTestVolume(t, env.newControllerServer(t), "pvc-1", 2*gib)
+			},
+			call: func(t *testing.T, env *testEnv) error {
+				_, err := env.newControllerServer(t).ControllerModifyVolume(
+					context.Background(),
+					&csi.ControllerModifyVolumeRequest{
+						VolumeId:          volumeID,
+						MutableParameters: map[string]string{"compression": "lz4", "refreservation": "auto"},
+					},
+				)
+				return err
+			},
+			check: func(t *testing.T, env *testEnv) {
+				props, _ := env.appliance.VolumeProperties(testVolumeGroup + "/pvc-1")
+				if v, _ := env.appliance.Volume(testVolumeGroup + "/pvc-1"); props.CompressionMode != "lz4" ||
+					v.BytesUsed != v.VolumeSize {
+					t.Errorf("volume has not been modified: %+v, %+v", v, props)
+				}
+			},
+		},
+		{
+			name: "ControllerUnpublishVolume",
+			prepare: func(t *testing.T, env *testEnv) {
+				createTestVolume(t, env.newControllerServer(t), "pvc-1", 2*gib)
+				mapTestVolume(t, newTestProvider(t, env), testVolumeGroup+"/pvc-1")
+			},
+			call: func(t *testing.T, env *testEnv) error {
+				_, err := env.newControllerServer(t).ControllerUnpublishVolume(
+					context.Background(),
+					&csi.ControllerUnpublishVolumeRequest{VolumeId: volumeID, NodeId: "node-1"},
+				)
+				return err
+			},
+			check: func(t *testing.T, env *testEnv) {
+				if mappings := env.appliance.LunMappings(testVolumeGroup + "/pvc-1"); len(mappings) != 0 {
+					t.Errorf("LUN mappings have not been deleted: %+v", mappings)
+				}
+			},
+		},
+		{
+			name: "CreateSnapshot",
+			prepare: func(t *testing.T, env *testEnv) {
+				createTestVolume(t, env.newControllerServer(t), "pvc-1", 2*gib)
+			},
+			call: func(t *testing.T, env *testEnv) error {
+				_, err := env.newControllerServer(t).CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{
+					SourceVolumeId: volumeID,
+					Name:           "snap-1",
+				})
+				return err
+			},
+			check: func(t *testing.T, env *testEnv) {
+				if _, ok := env.appliance.Snapshot(testVolumeGroup + "/pvc-1@snap-1"); !ok {
+					t.Errorf("snapshot has not been created")
+				}
+			},
+		},
+		{
+			name: "DeleteSnapshot",
+			prepare: func(t *testing.T, env *testEnv) {
+				s := env.newControllerServer(t)
+				createTestVolume(t, s, "pvc-1", 2*gib)
+				createTestSnapshot(t, s, volumeID, "snap-1")
+			},
+			call: func(t *testing.T, env *testEnv) error {
+				_, err := env.newControllerServer(t).DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{
+					SnapshotId: volumeID + "@snap-1",
+				})
+				return err
+			},
+			check: func(t *testing.T, env *testEnv) {
+				if _, ok := env.appliance.Snapshot(testVolumeGroup + "/pvc-1@snap-1"); ok {
+					t.Errorf("snapshot has not been deleted")
+				}
+			},
+		},
+	}
+
+	for _, sc := range scenarios {
+		t.Run(sc.name, sc.run)
+	}
+}
+
+func TestFaults_NodeServer(t *testing.T) {
+	volumeID := testConfigName + ":" + testVolumeGroup + "/pvc-1"
+	var volume *csi.Volume
+
+	scenarios := []faultScenario{
+		{
+			name: "NodeStageVolume",
+			prepare: func(t *testing.T, env *testEnv) {
+				volume = createTestVolume(t, env.newControllerServer(t), "pvc-1", testBlockCapacity)
+			},
+			call: func(t *testing.T, env *testEnv) error {
+				_, err := env.newNodeServer(t).NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+					VolumeId:          volumeID,
+					StagingTargetPath: testStagingPath,
+					VolumeCapability:  testMountCapability(testMountFsType),
+					VolumeContext:     volume.GetVolumeContext(),
+				})
+				return err
+			},
+			check: func(t *testing.T, env *testEnv) {
+				if mappings := env.appliance.LunMappings(testVolumeGroup + "/pvc-1"); len(mappings) != 1 {
+					t.Errorf("expected one LUN mapping, got: %+v", mappings)
+				}
+				if groups := env.appliance.TargetGroups(); len(groups) != 1 {
+					t.Errorf("expected one target group, got: %v", groups)
+				}
+				if mountPoints, _ := env.host.Mounter.List(); len(mountPoints) != 1 {
+					t.Errorf("expected one mount point, got: %+v", mountPoints)
+				}
+			},
+		},
+		{
+			name: "NodeExpandVolume",
+			prepare: func(t *testing.T, env *testEnv) {
+				volume = createTestVolume(t, env.newControllerServer(t), "pvc-1", testBlockCapacity)
+				stageTestVolume(t, env, env.newNodeServer(t), volume, testStagingPath, testMountCapability(testMountFsType))
+			},
+			call: func(t *testing.T, env *testEnv) error {
+				_, err := env.newNodeServer(t).NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{
+					VolumeId:         volumeID,
+					VolumePath:       testStagingPath,
+					VolumeCapability: testMountCapability(testMountFsType),
+				})
+				return err
+			},
+			check: func(t *testing.T, env *testEnv) {
+				if resize := env.host.Exec.CommandsByName("resize2fs"); len(resize) == 0 {
+					t.Errorf("filesystem has not been resized")
+				}
+			},
+		},
+	}
+
+	for _, sc := range scenarios {
+		t.Run(sc.name, sc.run)
+	}
+}
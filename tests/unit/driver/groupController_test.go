@@ -0,0 +1,267 @@
+package driver_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/nstest"
+)
+
+func TestControllerServer_VolumeGroupSnapshots(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, testConfig)
+	s := env.newControllerServer(t)
+
+	volume1 := createTestVolume(t, s, "pvc-1", gib)
+	volume2 := createTestVolume(t, s, "pvc-2", 2*gib)
+	createTestVolume(t, s, "pvc-3", gib)
+	env.appliance.AddVolumeGroup(testVolumeGroup + "/nested")
+	sourceVolumeIDs := []string{volume1.GetVolumeId(), volume2.GetVolumeId()}
+	groupSnapshotID := testConfigName + ":" + testVolumeGroup + "@group-1"
+	memberIDs := []string{volume1.GetVolumeId() + "@group-1", volume2.GetVolumeId() + "@group-1"}
+
+	res, err := s.CreateVolumeGroupSnapshot(ctx, &csi.CreateVolumeGroupSnapshotRequest{
+		Name:            "group-1",
+		SourceVolumeIds: sourceVolumeIDs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupSnapshot := res.GetGroupSnapshot()
+
+	t.Run("create", func(t *testing.T) {
+		if groupSnapshot.GetGroupSnapshotId() != groupSnapshotID || !groupSnapshot.GetReadyToUse() {
+			t.Errorf("expected ready group snapshot '%s', got: %+v", groupSnapshotID, groupSnapshot)
+		}
+		if len(groupSnapshot.GetSnapshots()) != 2 {
+			t.Fatalf("expected 2 snapshots, got: %+v", groupSnapshot.GetSnapshots())
+		}
+		for i, snapshot := range groupSnapshot.GetSnapshots() {
+			if snapshot.GetSnapshotId() != memberIDs[i] ||
+				snapshot.GetSourceVolumeId() != sourceVolumeIDs[i] ||
+				snapshot.GetGroupSnapshotId() != groupSnapshotID ||
+				!snapshot.GetReadyToUse() {
+				t.Errorf("unexpected member snapshot: %+v", snapshot)
+			}
+		}
+
+		snapshot1, ok1 := env.appliance.Snapshot(testVolumeGroup + "/pvc-1@group-1")
+		snapshot2, ok2 := env.appliance.Snapshot(testVolumeGroup + "/pvc-2@group-1")
+		if !ok1 || !ok2 {
+			t.Fatal("member snapshots have not been created on NexentaStor")
+		}
+		if snapshot1.CreationTxg != snapshot2.CreationTxg {
+			t.Errorf("member snapshots must be created in one txg, got: %s, %s",
+				snapshot1.CreationTxg, snapshot2.CreationTxg)
+		}
+		for _, snapshotPath := range []string{
+			testVolumeGroup + "@group-1",
+			testVolumeGroup + "/pvc-3@group-1",
+			testVolumeGroup + "/nested@group-1",
+		} {
+			if _, ok := env.appliance.Snapshot(snapshotPath); ok {
+				t.Errorf("snapshot '%s' is not in the group and must be destroyed", snapshotPath)
+			}
+		}
+	})
+
+	t.Run("create existing", func(t *testing.T) {
+		res, err := s.CreateVolumeGroupSnapshot(ctx, &csi.CreateVolumeGroupSnapshotRequest{
+			Name:            "group-1",
+			SourceVolumeIds: sourceVolumeIDs,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.GetGroupSnapshot().GetGroupSnapshotId() != groupSnapshotID ||
+			len(res.GetGroupSnapshot().GetSnapshots()) != 2 {
+			t.Errorf("expected existing group snapshot, got: %+v", res.GetGroupSnapshot())
+		}
+	})
+
+	t.Run("create after leftover snapshot", func(t *testing.T) {
+		// the request failed after the recursive snapshot, before snapshots of other volumes were destroyed
+		err := newTestProvider(t, env).CreateSnapshot(ns.CreateSnapshotParams{Path: testVolumeGroup + "/pvc-3@group-1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := s.CreateVolumeGroupSnapshot(ctx, &csi.CreateVolumeGroupSnapshotRequest{
+			Name:            "group-1",
+			SourceVolumeIds: sourceVolumeIDs,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.GetGroupSnapshot().GetSnapshots()) != 2 {
+			t.Errorf("expected existing group snapshot, got: %+v", res.GetGroupSnapshot())
+		}
+		if _, ok := env.appliance.Snapshot(testVolumeGroup + "/pvc-3@group-1"); ok {
+			t.Error("leftover snapshot of a volume which is not in the group must be destroyed")
+		}
+	})
+
+	t.Run("restore member snapshot", func(t *testing.T) {
+		res, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               "pvc-restored",
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: 2 * gib},
+			VolumeCapabilities: testVolumeCapabilities,
+			VolumeContentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Snapshot{
+					Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: memberIDs[1]},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: res.GetVolume().GetVolumeId()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("get", func(t *testing.T) {
+		res, err := s.GetVolumeGroupSnapshot(ctx, &csi.GetVolumeGroupSnapshotRequest{
+			GroupSnapshotId: groupSnapshotID,
+			SnapshotIds:     memberIDs,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.GetGroupSnapshot().GetSnapshots()) != 2 ||
+			!res.GetGroupSnapshot().GetCreationTime().AsTime().Equal(groupSnapshot.GetCreationTime().AsTime()) {
+			t.Errorf("expected created group snapshot, got: %+v", res.GetGroupSnapshot())
+		}
+
+		_, err = s.GetVolumeGroupSnapshot(ctx, &csi.GetVolumeGroupSnapshotRequest{
+			GroupSnapshotId: groupSnapshotID,
+			SnapshotIds:     []string{testConfigName + ":" + testVolumeGroup + "/pvc-1@group-2"},
+		})
+		expectCode(t, err, codes.InvalidArgument)
+
+		for _, id := range []string{testConfigName + ":" + testVolumeGroup + "@group-2", "group-1"} {
+			_, err = s.GetVolumeGroupSnapshot(ctx, &csi.GetVolumeGroupSnapshotRequest{GroupSnapshotId: id})
+			expectCode(t, err, codes.NotFound)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			_, err := s.DeleteVolumeGroupSnapshot(ctx, &csi.DeleteVolumeGroupSnapshotRequest{
+				GroupSnapshotId: groupSnapshotID,
+				SnapshotIds:     memberIDs,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, snapshotPath := range []string{testVolumeGroup + "/pvc-1@group-1", testVolumeGroup + "/pvc-2@group-1"} {
+			if _, ok := env.appliance.Snapshot(snapshotPath); ok {
+				t.Errorf("snapshot '%s' has not been deleted on NexentaStor", snapshotPath)
+			}
+		}
+		_, err = s.GetVolumeGroupSnapshot(ctx, &csi.GetVolumeGroupSnapshotRequest{GroupSnapshotId: groupSnapshotID})
+		expectCode(t, err, codes.NotFound)
+	})
+
+}
+
+func TestControllerServer_VolumeGroupSnapshotExisting(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, testConfig)
+	s := env.newControllerServer(t)
+
+	volume1 := createTestVolume(t, s, "pvc-1", gib)
+	_, err := s.CreateVolumeGroupSnapshot(ctx, &csi.CreateVolumeGroupSnapshotRequest{
+		Name:            "group-1",
+		SourceVolumeIds: []string{volume1.GetVolumeId()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the name is used by the group snapshot of pvc-1 only
+	volume2 := createTestVolume(t, s, "pvc-2", gib)
+	_, err = s.CreateVolumeGroupSnapshot(ctx, &csi.CreateVolumeGroupSnapshotRequest{
+		Name:            "group-1",
+		SourceVolumeIds: []string{volume1.GetVolumeId(), volume2.GetVolumeId()},
+	})
+	expectCode(t, err, codes.AlreadyExists)
+	if _, ok := env.appliance.Snapshot(testVolumeGroup + "/pvc-1@group-1"); !ok {
+		t.Error("snapshot of the existing group snapshot must be kept")
+	}
+}
+
+func TestControllerServer_VolumeGroupSnapshotSources(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, testConfigTwoAppliances)
+	env.backend.Add("https://10.3.199.29:8443", nstest.NewAppliance(nstest.ApplianceArgs{
+		Username:     testUsername,
+		Password:     testPassword,
+		VolumeGroups: []string{"pool2/csiVolumeGroup"},
+	}))
+	env.appliance.AddVolumeGroup("pool1/otherGroup")
+	s := env.newControllerServer(t)
+
+	createVolume := func(name string, params map[string]string) *csi.Volume {
+		t.Helper()
+		res, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               name,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: gib},
+			VolumeCapabilities: testVolumeCapabilities,
+			Parameters:         params,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.GetVolume()
+	}
+
+	volume := createVolume("pvc-1", map[string]string{"configName": testConfigName})
+	for name, params := range map[string]map[string]string{
+		"pvc-2": {"configName": "nstor-box0"},
+		"pvc-3": {"configName": testConfigName, "volumeGroup": "pool1/otherGroup"},
+	} {
+		other := createVolume(name, params)
+
+		t.Run("volumes of "+name+" and pvc-1", func(t *testing.T) {
+			_, err := s.CreateVolumeGroupSnapshot(ctx, &csi.CreateVolumeGroupSnapshotRequest{
+				Name:            "group-1",
+				SourceVolumeIds: []string{volume.GetVolumeId(), other.GetVolumeId()},
+			})
+			expectCode(t, err, codes.InvalidArgument)
+		})
+	}
+
+	t.Run("volume not found", func(t *testing.T) {
+		_, err := s.CreateVolumeGroupSnapshot(ctx, &csi.CreateVolumeGroupSnapshotRequest{
+			Name:            "group-1",
+			SourceVolumeIds: []string{volume.GetVolumeId(), testConfigName + ":" + testVolumeGroup + "/pvc-4"},
+		})
+		expectCode(t, err, codes.NotFound)
+		if _, ok := env.appliance.Snapshot(testVolumeGroup + "/pvc-1@group-1"); ok {
+			t.Error("snapshot must not be created if a source volume doesn't exist")
+		}
+	})
+
+	t.Run("no source volumes", func(t *testing.T) {
+		_, err := s.CreateVolumeGroupSnapshot(ctx, &csi.CreateVolumeGroupSnapshotRequest{Name: "group-1"})
+		expectCode(t, err, codes.InvalidArgument)
+	})
+
+	t.Run("capabilities", func(t *testing.T) {
+		res, err := s.GroupControllerGetCapabilities(ctx, &csi.GroupControllerGetCapabilitiesRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		capabilities := res.GetCapabilities()
+		if len(capabilities) != 1 || capabilities[0].GetRpc().GetType() !=
+			csi.GroupControllerServiceCapability_RPC_CREATE_DELETE_GET_VOLUME_GROUP_SNAPSHOT {
+			t.Errorf("unexpected capabilities: %+v", capabilities)
+		}
+	})
+}
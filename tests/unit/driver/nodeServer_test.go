@@ -0,0 +1,322 @@
+package driver_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/hosttest"
+)
+
+const (
+	testTarget        = "iqn.2005-07.com.nexenta:01:test"
+	testPortal        = "10.3.199.28:3260"
+	testStagingPath   = "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1/globalmount"
+	testBlockStaging  = "/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/staging/pvc-1"
+	testDevice        = "/dev/sdb"
+	testMountFsType   = "ext4"
+	testBlockCapacity = 2 * gib
+)
+
+func testMountCapability(fsType string) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsType}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+}
+
+func testBlockCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+}
+
+// attachOnLogin - scripts iscsiadm to attach the volume as the device once the volume is mapped,
+// repeated logins fail with "already present" as real iscsiadm does
+func attachOnLogin(t *testing.T, env *testEnv, volumePath, device string) {
+	t.Helper()
+	loggedIn := false
+	env.host.Exec.Script("iscsiadm", func(args []string) ([]byte, error) {
+		login := strings.Join(args, " ")
+		if strings.HasSuffix(login, " -l") && loggedIn {
+			return []byte("iscsiadm: default: 1 session requested, but 1 already present."), hosttest.ExitError(15)
+		} else if strings.HasSuffix(login, " -l") {
+			loggedIn = true
+		}
+		if _, ok := env.host.Device(device); ok {
+			return nil, nil
+		}
+		mappings := env.appliance.LunMappings(volumePath)
+		if len(mappings) == 0 {
+			return nil, nil
+		}
+		link := fmt.Sprintf("ip-%s-iscsi-%s-lun-%d", testPortal, testTarget, mappings[0].Lun)
+		return nil, env.host.AddDevice(device, testBlockCapacity, link)
+	})
+}
+
+func stageTestVolume(
+	t *testing.T,
+	env *testEnv,
+	s csi.NodeServer,
+	volume *csi.Volume,
+	stagingPath string,
+	capability *csi.VolumeCapability,
+) {
+	t.Helper()
+	_, err := s.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          volume.GetVolumeId(),
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  capability,
+		VolumeContext:     volume.GetVolumeContext(),
+	})
+	if err != nil {
+		t.Fatalf("NodeStageVolume(%s) failed: %s, commands: %v", volume.GetVolumeId(), err, env.host.Exec.Commands())
+	}
+}
+
+func TestNodeServer_NodeStageVolume(t *testing.T) {
+	t.Run("mount volume", func(t *testing.T) {
+		env := newTestEnv(t, testConfig)
+		cs := env.newControllerServer(t)
+		s := env.newNodeServer(t)
+		volume := createTestVolume(t, cs, "pvc-1", testBlockCapacity)
+		attachOnLogin(t, env, testVolumeGroup+"/pvc-1", testDevice)
+
+		stageTestVolume(t, env, s, volume, testStagingPath, testMountCapability(testMountFsType))
+
+		if len(env.appliance.LunMappings(testVolumeGroup+"/pvc-1")) != 1 {
+			t.Errorf("LUN mapping has not been created")
+		}
+		if device, _ := env.host.Device(testDevice); device.FsType != testMountFsType {
+			t.Errorf("device is expected to be formatted in %s, got: '%s'", testMountFsType, device.FsType)
+		}
+		mountPoints, _ := env.host.Mounter.List()
+		if len(mountPoints) != 1 {
+			t.Fatalf("expected one mount point, got: %v", mountPoints)
+		} else if mountPoints[0].Device != testDevice || mountPoints[0].Path != testStagingPath {
+			t.Errorf("unexpected mount point: %+v", mountPoints[0])
+		}
+
+		t.Run("already staged", func(t *testing.T) {
+			stageTestVolume(t, env, s, volume, testStagingPath, testMountCapability(testMountFsType))
+			if mountPoints, _ := env.host.Mounter.List(); len(mountPoints) != 1 {
+				t.Errorf("volume has been mounted again: %v", mountPoints)
+			}
+			if mkfs := env.host.Exec.CommandsByName("mkfs.ext4"); len(mkfs) != 1 {
+				t.Errorf("volume has been formatted again: %v", mkfs)
+			}
+		})
+	})
+
+	t.Run("already formatted volume", func(t *testing.T) {
+		env := newTestEnv(t, testConfig)
+		cs := env.newControllerServer(t)
+		s := env.newNodeServer(t)
+		volume := createTestVolume(t, cs, "pvc-1", testBlockCapacity)
+		attachOnLogin(t, env, testVolumeGroup+"/pvc-1", testDevice)
+
+		stageTestVolume(t, env, s, volume, testStagingPath, testMountCapability("xfs"))
+		if mkfs := env.host.Exec.CommandsByName("mkfs.xfs"); len(mkfs) != 1 {
+			t.Fatalf("expected one mkfs.xfs command, got: %v", mkfs)
+		}
+		if err := env.host.Mounter.Unmount(testStagingPath); err != nil {
+			t.Fatal(err)
+		}
+
+		stageTestVolume(t, env, s, volume, testStagingPath, testMountCapability("xfs"))
+		if mkfs := env.host.Exec.CommandsByName("mkfs.xfs"); len(mkfs) != 1 {
+			t.Errorf("formatted volume has been formatted again: %v", mkfs)
+		}
+
+		if err := env.host.Mounter.Unmount(testStagingPath); err != nil {
+			t.Fatal(err)
+		}
+		_, err := s.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          volume.GetVolumeId(),
+			StagingTargetPath: testStagingPath,
+			VolumeCapability:  testMountCapability("ext4"),
+			VolumeContext:     volume.GetVolumeContext(),
+		})
+		if err == nil {
+			t.Errorf("volume formatted in xfs has been staged as ext4")
+		}
+	})
+
+	t.Run("block volume", func(t *testing.T) {
+		env := newTestEnv(t, testConfig)
+		cs := env.newControllerServer(t)
+		s := env.newNodeServer(t)
+		volume := createTestVolume(t, cs, "pvc-1", testBlockCapacity)
+		attachOnLogin(t, env, testVolumeGroup+"/pvc-1", testDevice)
+		if err := env.host.FS.MkdirAll(testBlockStaging, 0750); err != nil {
+			t.Fatal(err)
+		}
+
+		stageTestVolume(t, env, s, volume, testBlockStaging, testBlockCapability())
+
+		if device, err := env.host.FS.EvalSymlinks(testBlockStaging + "/device"); err != nil {
+			t.Errorf("device symlink has not been created: %s", err)
+		} else if device != testDevice {
+			t.Errorf("device symlink points to %s, expected: %s", device, testDevice)
+		}
+		if mkfs := env.host.Exec.CommandsByName("mkfs.ext4"); len(mkfs) != 0 {
+			t.Errorf("block volume has been formatted: %v", mkfs)
+		}
+	})
+
+	t.Run("missing arguments", func(t *testing.T) {
+		env := newTestEnv(t, testConfig)
+		s := env.newNodeServer(t)
+		_, err := s.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			StagingTargetPath: testStagingPath,
+			VolumeCapability:  testMountCapability(testMountFsType),
+		})
+		expectCode(t, err, codes.InvalidArgument)
+		_, err = s.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:         testConfigName + ":" + testVolumeGroup + "/pvc-1",
+			VolumeCapability: testMountCapability(testMountFsType),
+		})
+		expectCode(t, err, codes.InvalidArgument)
+		_, err = s.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          "pvc-1",
+			StagingTargetPath: testStagingPath,
+			VolumeCapability:  testMountCapability(testMountFsType),
+		})
+		expectCode(t, err, codes.InvalidArgument)
+	})
+}
+
+func TestNodeServer_NodeUnstageVolume(t *testing.T) {
+	t.Run("mount volume", func(t *testing.T) {
+		env := newTestEnv(t, testConfig)
+		cs := env.newControllerServer(t)
+		s := env.newNodeServer(t)
+		volume := createTestVolume(t, cs, "pvc-1", testBlockCapacity)
+		attachOnLogin(t, env, testVolumeGroup+"/pvc-1", testDevice)
+		stageTestVolume(t, env, s, volume, testStagingPath, testMountCapability(testMountFsType))
+
+		_, err := s.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+			VolumeId:          volume.GetVolumeId(),
+			StagingTargetPath: testStagingPath,
+		})
+		if err != nil {
+			t.Fatalf("NodeUnstageVolume failed: %s", err)
+		}
+
+		if mountPoints, _ := env.host.Mounter.List(); len(mountPoints) != 0 {
+			t.Errorf("volume is still mounted: %v", mountPoints)
+		}
+		if state, deleted, err := env.host.DeviceState(testDevice); err != nil {
+			t.Error(err)
+		} else if state != "offline" || !deleted {
+			t.Errorf("device has not been removed, state: '%s', deleted: %t", state, deleted)
+		}
+		if _, err := env.host.FS.Stat(testStagingPath); err == nil {
+			t.Errorf("staging path has not been removed")
+		}
+	})
+
+	t.Run("block volume", func(t *testing.T) {
+		env := newTestEnv(t, testConfig)
+		cs := env.newControllerServer(t)
+		s := env.newNodeServer(t)
+		volume := createTestVolume(t, cs, "pvc-1", testBlockCapacity)
+		attachOnLogin(t, env, testVolumeGroup+"/pvc-1", testDevice)
+		if err := env.host.FS.MkdirAll(testBlockStaging, 0750); err != nil {
+			t.Fatal(err)
+		}
+		stageTestVolume(t, env, s, volume, testBlockStaging, testBlockCapability())
+
+		_, err := s.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+			VolumeId:          volume.GetVolumeId(),
+			StagingTargetPath: testBlockStaging,
+		})
+		if err != nil {
+			t.Fatalf("NodeUnstageVolume failed: %s", err)
+		}
+
+		if flush := env.host.Exec.CommandsByName("blockdev"); len(flush) != 1 || flush[0].Args[1] != testDevice {
+			t.Errorf("expected device buffers flush, got: %v", flush)
+		}
+		if _, deleted, err := env.host.DeviceState(testDevice); err != nil {
+			t.Error(err)
+		} else if !deleted {
+			t.Errorf("device has not been removed")
+		}
+		if _, err := env.host.FS.Stat(testBlockStaging); err == nil {
+			t.Errorf("staging path has not been removed")
+		}
+	})
+
+	t.Run("not staged volume", func(t *testing.T) {
+		env := newTestEnv(t, testConfig)
+		s := env.newNodeServer(t)
+		_, err := s.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+			VolumeId:          testConfigName + ":" + testVolumeGroup + "/pvc-1",
+			StagingTargetPath: testStagingPath,
+		})
+		if err != nil {
+			t.Errorf("NodeUnstageVolume of not staged volume failed: %s", err)
+		}
+	})
+}
+
+func TestNodeServer_NodeExpandVolume(t *testing.T) {
+	env := newTestEnv(t, testConfig)
+	cs := env.newControllerServer(t)
+	s := env.newNodeServer(t)
+	volume := createTestVolume(t, cs, "pvc-1", testBlockCapacity)
+	attachOnLogin(t, env, testVolumeGroup+"/pvc-1", testDevice)
+	stageTestVolume(t, env, s, volume, testStagingPath, testMountCapability(testMountFsType))
+
+	_, err := cs.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+		VolumeId:      volume.GetVolumeId(),
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 3 * gib},
+	})
+	if err != nil {
+		t.Fatalf("ControllerExpandVolume failed: %s", err)
+	}
+	if err := env.host.SetDeviceSize(testDevice, 3*gib); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{
+		VolumeId:         volume.GetVolumeId(),
+		VolumePath:       testStagingPath,
+		VolumeCapability: testMountCapability(testMountFsType),
+	})
+	if err != nil {
+		t.Fatalf("NodeExpandVolume failed: %s, commands: %v", err, env.host.Exec.Commands())
+	}
+
+	if n := env.host.Rescanned(testDevice); n != 1 {
+		t.Errorf("expected one device rescan, got: %d", n)
+	}
+	if resize := env.host.Exec.CommandsByName("resize2fs"); len(resize) != 1 || resize[0].Args[0] != testDevice {
+		t.Errorf("expected resize2fs of %s, got: %v", testDevice, resize)
+	}
+
+	t.Run("not mounted path", func(t *testing.T) {
+		_, err := s.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{
+			VolumeId:         volume.GetVolumeId(),
+			VolumePath:       "/",
+			VolumeCapability: testMountCapability(testMountFsType),
+		})
+		expectCode(t, err, codes.InvalidArgument)
+	})
+
+	t.Run("not existing volume", func(t *testing.T) {
+		_, err := s.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{
+			VolumeId:         testConfigName + ":" + testVolumeGroup + "/pvc-missing",
+			VolumePath:       testStagingPath,
+			VolumeCapability: testMountCapability(testMountFsType),
+		})
+		expectCode(t, err, codes.NotFound)
+	})
+}
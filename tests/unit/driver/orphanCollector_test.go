@@ -0,0 +1,347 @@
+package driver_test
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/driver"
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/nstest"
+)
+
+// driver-owned SAN objects are named by UUIDs
+const (
+	testLiveUUID         = "1b4e28ba-2fa1-11d2-883f-0016d3cca427"
+	testOrphanUUID       = "6fa459ea-ee8a-3ca4-894e-db77e160355e"
+	testFailedVolumeUUID = "9c5b94b1-35ad-49bb-b118-8e8fc24abf80"
+	testOrphanHostUUID   = "16fd2706-8baf-433b-82eb-8c7fada847da"
+	testLateHostUUID     = "886313e1-3b8a-5372-9b90-0c9aee199e5d"
+)
+
+// createTestTargetGroup - creates target group with one target, like the node does it
+func createTestTargetGroup(t *testing.T, nsProvider ns.ProviderInterface, targetGroup, target string) {
+	t.Helper()
+	err := nsProvider.CreateISCSITarget(ns.CreateISCSITargetParams{
+		Name:    target,
+		Portals: []ns.Portal{{Address: "10.3.199.28", Port: 3260}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nsProvider.CreateUpdateTargetGroup(ns.CreateTargetGroupParams{Name: targetGroup, Members: []string{target}})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func createTestHostGroup(t *testing.T, nsProvider ns.ProviderInterface, hostGroup string) {
+	t.Helper()
+	err := nsProvider.CreateHostGroup(ns.CreateHostGroupParams{
+		Name:    hostGroup,
+		Members: []string{"iqn.1993-08.org.debian:01:node-1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func createTestLunMapping(t *testing.T, nsProvider ns.ProviderInterface, volumePath, targetGroup, hostGroup string) {
+	t.Helper()
+	err := nsProvider.CreateLunMapping(ns.CreateLunMappingParams{
+		Volume:      volumePath,
+		TargetGroup: targetGroup,
+		HostGroup:   hostGroup,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// orphanNames - "<kind> <name>" of the orphans, sorted, LUN mappings are named by their volumes
+func orphanNames(orphans []driver.Orphan, reclaimed bool) []string {
+	names := []string{}
+	for _, orphan := range orphans {
+		if orphan.Reclaimed != reclaimed {
+			continue
+		}
+		name := orphan.Name
+		if orphan.Kind == "LUN mapping" {
+			name = "of " + orphan.Reason
+		}
+		names = append(names, orphan.Kind+" "+name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func expectNames(t *testing.T, what string, names, expected []string) {
+	t.Helper()
+	sort.Strings(expected)
+	if len(names) != len(expected) {
+		t.Fatalf("expected %s: %q, got: %q", what, expected, names)
+	}
+	for i := range names {
+		if names[i] != expected[i] {
+			t.Fatalf("expected %s: %q, got: %q", what, expected, names)
+		}
+	}
+}
+
+func TestControllerServer_CollectOrphans(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	t.Run("reclaim", func(t *testing.T) {
+		env := newTestEnv(t, testConfig+"orphanCollector: reclaim\norphanGracePeriod: 1h\n")
+		s := env.newControllerServer(t)
+		nsProvider := newTestProvider(t, env)
+
+		// live volume mapped to driver-owned target group and host group
+		createTestVolume(t, s, "pvc-live", gib)
+		createTestTargetGroup(t, nsProvider, testLiveUUID, "iqn.2005-07.com.nexenta:"+testLiveUUID)
+		createTestHostGroup(t, nsProvider, "csi-"+testLiveUUID)
+		createTestLunMapping(t, nsProvider, testVolumeGroup+"/pvc-live", testLiveUUID, "csi-"+testLiveUUID)
+
+		// objects created by admins are never orphaned
+		createTestTargetGroup(t, nsProvider, "tg-manual", "iqn.2005-07.com.nexenta:manual")
+		createTestHostGroup(t, nsProvider, "admins")
+
+		// target group and host group nothing uses
+		createTestTargetGroup(t, nsProvider, testOrphanUUID, "iqn.2005-07.com.nexenta:"+testOrphanUUID)
+		createTestHostGroup(t, nsProvider, "csi-"+testOrphanHostUUID)
+
+		// volume deletion has failed and is not retried, the volume is still mapped
+		failed := createTestVolume(t, s, "pvc-failed", gib)
+		env.appliance.Faults().Add(nstest.FaultRule{
+			Method:   http.MethodDelete,
+			Endpoint: "storage/volumes/*",
+			Kind:     nstest.FaultServerError,
+		})
+		if _, err := s.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: failed.GetVolumeId()}); err == nil {
+			t.Fatal("volume deletion must fail")
+		}
+		env.appliance.Faults().Clear()
+		createTestTargetGroup(t, nsProvider, testFailedVolumeUUID, "iqn.2005-07.com.nexenta:"+testFailedVolumeUUID)
+		createTestLunMapping(t, nsProvider, testVolumeGroup+"/pvc-failed", testFailedVolumeUUID, "all")
+
+		expected := []string{
+			"volume " + testVolumeGroup + "/pvc-failed",
+			"LUN mapping of volume '" + testVolumeGroup + "/pvc-failed' is orphaned",
+			"target group " + testOrphanUUID,
+			"target group " + testFailedVolumeUUID,
+			"iSCSI target iqn.2005-07.com.nexenta:" + testOrphanUUID,
+			"iSCSI target iqn.2005-07.com.nexenta:" + testFailedVolumeUUID,
+			"host group csi-" + testOrphanHostUUID,
+		}
+		for _, now := range []time.Time{start, start.Add(59 * time.Minute)} {
+			orphans, err := s.CollectOrphans(now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectNames(t, "orphans", orphanNames(orphans, false), expected)
+			for _, orphan := range orphans {
+				if !orphan.FirstSeen.Equal(start) {
+					t.Errorf("expected %s first seen at %s, got: %s", orphan, start, orphan.FirstSeen)
+				}
+			}
+		}
+		if _, ok := env.appliance.Volume(testVolumeGroup + "/pvc-failed"); !ok {
+			t.Fatal("orphaned volume must be kept for the grace period")
+		}
+
+		// host group which appears later has its own grace period
+		createTestHostGroup(t, nsProvider, "csi-"+testLateHostUUID)
+		orphans, err := s.CollectOrphans(start.Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectNames(t, "reclaimed orphans", orphanNames(orphans, true), expected)
+		expectNames(t, "kept orphans", orphanNames(orphans, false), []string{"host group csi-" + testLateHostUUID})
+
+		if _, ok := env.appliance.Volume(testVolumeGroup + "/pvc-failed"); ok {
+			t.Error("orphaned volume must be reclaimed")
+		}
+		if _, ok := env.appliance.Volume(testVolumeGroup + "/pvc-live"); !ok {
+			t.Error("live volume must be kept")
+		}
+		if len(env.appliance.LunMappings(testVolumeGroup+"/pvc-live")) != 1 {
+			t.Error("LUN mapping of live volume must be kept")
+		}
+		expectNames(t, "target groups", env.appliance.TargetGroups(), []string{"tg-manual", testLiveUUID})
+		expectNames(t, "targets", env.appliance.Targets(), []string{
+			"iqn.2005-07.com.nexenta:manual",
+			"iqn.2005-07.com.nexenta:" + testLiveUUID,
+		})
+		expectNames(t, "host groups", env.appliance.HostGroups(), []string{
+			"admins",
+			"csi-" + testLiveUUID,
+			"csi-" + testLateHostUUID,
+		})
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		env := newTestEnv(t, testConfig+"orphanCollector: dryRun\n")
+		s := env.newControllerServer(t)
+		createTestHostGroup(t, newTestProvider(t, env), "csi-"+testOrphanHostUUID)
+
+		for _, now := range []time.Time{start, start.Add(48 * time.Hour)} {
+			orphans, err := s.CollectOrphans(now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectNames(t, "orphans", orphanNames(orphans, false), []string{"host group csi-" + testOrphanHostUUID})
+		}
+		expectNames(t, "host groups", env.appliance.HostGroups(), []string{"csi-" + testOrphanHostUUID})
+	})
+
+	t.Run("off by default", func(t *testing.T) {
+		env := newTestEnv(t, testConfig)
+		s := env.newControllerServer(t)
+		createTestHostGroup(t, newTestProvider(t, env), "csi-"+testOrphanHostUUID)
+
+		orphans, err := s.CollectOrphans(start)
+		if err != nil || len(orphans) != 0 {
+			t.Errorf("expected no orphans if the collector is off, got: %v, error: %v", orphans, err)
+		}
+	})
+
+	t.Run("reclaim requires elected leader", func(t *testing.T) {
+		env := newTestEnv(t, testConfig+"orphanCollector: reclaim\norphanGracePeriod: 0s\n")
+		env.leader.leader = false
+		s := env.newControllerServer(t)
+		createTestHostGroup(t, newTestProvider(t, env), "csi-"+testOrphanHostUUID)
+
+		orphans, err := s.CollectOrphans(start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectNames(t, "kept orphans", orphanNames(orphans, false), []string{"host group csi-" + testOrphanHostUUID})
+		expectNames(t, "host groups", env.appliance.HostGroups(), []string{"csi-" + testOrphanHostUUID})
+	})
+
+	t.Run("config of request secrets is not used", func(t *testing.T) {
+		env := newTestEnv(t, testConfig+"orphanCollector: reclaim\norphanGracePeriod: 0s\n")
+		s := env.newControllerServer(t)
+		createTestHostGroup(t, newTestProvider(t, env), "csi-"+testOrphanHostUUID)
+
+		// the secret points the same config name to another appliance
+		other := nstest.NewAppliance(nstest.ApplianceArgs{
+			Username:     testUsername,
+			Password:     testPassword,
+			VolumeGroups: []string{testVolumeGroup},
+		})
+		env.backend.Add("https://10.3.199.29:8443", other)
+		createTestVolume(t, s, "pvc-live", gib)
+		secret := strings.Replace(testConfig, "https://10.3.199.28:8443", "https://10.3.199.29:8443", 1)
+		_, err := s.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+			VolumeId:           testConfigName + ":" + testVolumeGroup + "/pvc-live",
+			VolumeCapabilities: testVolumeCapabilities,
+			Secrets:            map[string]string{"config": secret},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		orphans, err := s.CollectOrphans(start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectNames(t, "reclaimed orphans", orphanNames(orphans, true), []string{"host group csi-" + testOrphanHostUUID})
+		if _, ok := env.appliance.Volume(testVolumeGroup + "/pvc-live"); !ok {
+			t.Error("volume of the config file must be kept")
+		}
+	})
+}
+
+func TestControllerServer_CollectOrphanedVolumeCopies(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	env := newTestEnv(t, testConfigTwoAppliances+"orphanCollector: reclaim\norphanGracePeriod: 1h\n")
+	other := nstest.NewAppliance(nstest.ApplianceArgs{
+		Username:     testUsername,
+		Password:     testPassword,
+		VolumeGroups: []string{"pool2/csiVolumeGroup"},
+	})
+	env.backend.Add("https://10.3.199.29:8443", other)
+	s := env.newControllerServer(t)
+
+	source, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: gib},
+		VolumeCapabilities: testVolumeCapabilities,
+		Parameters:         map[string]string{"configName": testConfigName},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sourceVolumeID := source.GetVolume().GetVolumeId()
+	snapshotID := createTestSnapshot(t, s, sourceVolumeID, "snap-1").GetSnapshotId()
+
+	// PVCs are deleted while CreateVolume waits for the copies, so CreateVolume is not called again
+	copyVolume := func(name string, contentSource *csi.VolumeContentSource) {
+		t.Helper()
+		_, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:                name,
+			CapacityRange:       &csi.CapacityRange{RequiredBytes: gib},
+			VolumeCapabilities:  testVolumeCapabilities,
+			VolumeContentSource: contentSource,
+			Parameters:          map[string]string{"configName": "nstor-box0"},
+		})
+		expectCode(t, err, codes.Aborted)
+	}
+	copyVolume("pvc-restored", &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshotID},
+		},
+	})
+	copyVolume("pvc-clone", &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Volume{
+			Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: sourceVolumeID},
+		},
+	})
+	if n := env.backend.RunReplications(); n != 2 {
+		t.Fatalf("expected 2 completed replications, got: %d", n)
+	}
+	copyVolume("pvc-running", &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshotID},
+		},
+	})
+
+	expected := []string{"volume copy csi-copy-pvc-clone", "volume copy csi-copy-pvc-restored"}
+	orphans, err := s.CollectOrphans(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectNames(t, "orphans", orphanNames(orphans, false), expected)
+
+	orphans, err = s.CollectOrphans(start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectNames(t, "reclaimed orphans", orphanNames(orphans, true), expected)
+	for _, name := range []string{"pvc-restored", "pvc-clone"} {
+		if _, ok := env.appliance.ReplicationService("csi-copy-" + name); ok {
+			t.Errorf("replication service of %s must be destroyed", name)
+		}
+		if _, ok := other.Volume("pool2/csiVolumeGroup/" + name); ok {
+			t.Errorf("copy of %s must be destroyed", name)
+		}
+	}
+	if _, ok := env.appliance.Snapshot(testVolumeGroup + "/pvc-1@k8s-clone-snapshot-pvc-clone"); ok {
+		t.Error("snapshot taken for the copy must be destroyed")
+	}
+	if _, ok := env.appliance.Snapshot(testVolumeGroup + "/pvc-1@snap-1"); !ok {
+		t.Error("restored snapshot must be kept")
+	}
+	if _, ok := env.appliance.ReplicationService("csi-copy-pvc-running"); !ok {
+		t.Error("running copy must be kept")
+	}
+}
@@ -0,0 +1,280 @@
+package driver_test
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/csi-addons/spec/lib/go/replication"
+	"google.golang.org/grpc/codes"
+
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/driver"
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/nstest"
+)
+
+func TestReplicationServer(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, testConfigTwoAppliances)
+	otherAddress := "https://10.3.199.29:8443"
+	other := nstest.NewAppliance(nstest.ApplianceArgs{
+		Username:     testUsername,
+		Password:     testPassword,
+		VolumeGroups: []string{"pool2/csiVolumeGroup"},
+	})
+	env.backend.Add(otherAddress, other)
+	s := env.newControllerServer(t)
+	r := driver.NewReplicationServer(s)
+
+	res, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: gib},
+		VolumeCapabilities: testVolumeCapabilities,
+		Parameters: map[string]string{
+			"configName":          testConfigName,
+			"replicationTarget":   "nstor-box0",
+			"replicationInterval": "10m",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeID := res.GetVolume().GetVolumeId()
+	peerVolumeID := "nstor-box0:pool2/csiVolumeGroup/pvc-1"
+	params := map[string]string{"replicationTarget": "nstor-box0", "replicationInterval": "10m"}
+	peerParams := map[string]string{"replicationTarget": testConfigName, "replicationInterval": "10m"}
+
+	// snapshotNames - names of the volume snapshots sorted by name
+	snapshotNames := func(volumeID string) []string {
+		t.Helper()
+		res, err := s.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SourceVolumeId: volumeID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, entry := range res.GetEntries() {
+			names = append(names, strings.TrimPrefix(entry.GetSnapshot().GetSnapshotId(), volumeID+"@"))
+		}
+		sort.Strings(names)
+		return names
+	}
+	expectSnapshots := func(volumeID string, expected ...string) {
+		t.Helper()
+		if names := snapshotNames(volumeID); !reflect.DeepEqual(names, expected) {
+			t.Errorf("expected snapshots of '%s': %v, got: %v", volumeID, expected, names)
+		}
+	}
+	resync := func(volumeID string, params map[string]string) bool {
+		t.Helper()
+		res, err := r.ResyncVolume(ctx, &replication.ResyncVolumeRequest{VolumeId: volumeID, Parameters: params})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.GetReady()
+	}
+
+	t.Run("replicate new volume", func(t *testing.T) {
+		service, ok := env.appliance.ReplicationService("csi-replication-pvc-1")
+		if !ok || !service.Enabled || service.Interval != 600 ||
+			service.DestinationDataset != "pool2/csiVolumeGroup/pvc-1" || service.RemoteNode.Host != "10.3.199.29" {
+			t.Fatalf("expected enabled replication service, got: %+v", service)
+		}
+		info, err := r.GetVolumeReplicationInfo(ctx, &replication.GetVolumeReplicationInfoRequest{VolumeId: volumeID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.GetLastSyncTime() != nil {
+			t.Errorf("volume must not be synced yet, got: %s", info.GetLastSyncTime())
+		}
+
+		if n := env.backend.RunReplications(); n != 1 {
+			t.Fatalf("expected 1 completed replication, got: %d", n)
+		}
+		if n := env.backend.RunReplications(); n != 1 {
+			t.Fatalf("expected 1 completed replication, got: %d", n)
+		}
+		// older snapshots are destroyed, the last one is the base of the next incremental stream
+		expectSnapshots(volumeID, "hpr-csi-replication-pvc-1-000002")
+		expectSnapshots(peerVolumeID, "hpr-csi-replication-pvc-1-000002")
+
+		info, err = r.GetVolumeReplicationInfo(ctx, &replication.GetVolumeReplicationInfoRequest{VolumeId: volumeID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.GetLastSyncTime() == nil {
+			t.Error("last sync time must be reported")
+		}
+	})
+
+	t.Run("enable is idempotent", func(t *testing.T) {
+		for _, id := range []string{volumeID, peerVolumeID} {
+			p := params
+			if id == peerVolumeID {
+				p = peerParams
+			}
+			_, err := r.EnableVolumeReplication(ctx, &replication.EnableVolumeReplicationRequest{
+				VolumeId:   id,
+				Parameters: p,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, ok := other.ReplicationService("csi-replication-pvc-1"); ok {
+			t.Error("secondary volume must not be replicated back")
+		}
+	})
+
+	t.Run("planned failover", func(t *testing.T) {
+		_, err := r.DemoteVolume(ctx, &replication.DemoteVolumeRequest{VolumeId: volumeID, Parameters: params})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := env.appliance.ReplicationService("csi-replication-pvc-1"); ok {
+			t.Fatal("demoted volume must not be replicated")
+		}
+		_, err = r.PromoteVolume(ctx, &replication.PromoteVolumeRequest{VolumeId: peerVolumeID, Parameters: peerParams})
+		if err != nil {
+			t.Fatal(err)
+		}
+		service, ok := other.ReplicationService("csi-replication-pvc-1")
+		if !ok || !service.Enabled || service.DestinationDataset != testVolumeGroup+"/pvc-1" {
+			t.Fatalf("promoted volume must be replicated back, got: %+v", service)
+		}
+
+		if resync(volumeID, params) {
+			t.Error("volume must not be ready before the first sync")
+		}
+		env.backend.RunReplications()
+		if !resync(volumeID, params) {
+			t.Error("volume must be ready after the sync")
+		}
+		expectSnapshots(volumeID, "hpr-csi-replication-pvc-1-000003")
+	})
+
+	t.Run("forced failover", func(t *testing.T) {
+		env.backend.Remove(otherAddress)
+		_, err := r.PromoteVolume(ctx, &replication.PromoteVolumeRequest{VolumeId: volumeID, Parameters: params})
+		expectCode(t, err, codes.Unavailable)
+		_, err = r.PromoteVolume(ctx, &replication.PromoteVolumeRequest{
+			VolumeId:   volumeID,
+			Parameters: params,
+			Force:      true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// both volumes are primary once the peer is back, neither of them receives snapshots
+		env.backend.Add(otherAddress, other)
+		if n := env.backend.RunReplications(); n != 0 {
+			t.Fatalf("replication to primary volume must fail, completed: %d", n)
+		}
+		_, err = r.DemoteVolume(ctx, &replication.DemoteVolumeRequest{VolumeId: peerVolumeID, Parameters: peerParams})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resync(peerVolumeID, peerParams) {
+			t.Error("volume must not be ready before the resync")
+		}
+		env.backend.RunReplications()
+		if !resync(peerVolumeID, peerParams) {
+			t.Error("volume must be ready after the resync")
+		}
+		// the snapshot taken by the demoted volume is rolled back
+		expectSnapshots(peerVolumeID, "hpr-csi-replication-pvc-1-000006")
+	})
+
+	t.Run("resync primary volume", func(t *testing.T) {
+		_, err := r.ResyncVolume(ctx, &replication.ResyncVolumeRequest{VolumeId: volumeID, Parameters: params})
+		expectCode(t, err, codes.FailedPrecondition)
+	})
+
+	t.Run("disable", func(t *testing.T) {
+		_, err := r.DisableVolumeReplication(ctx, &replication.DisableVolumeReplicationRequest{
+			VolumeId:   volumeID,
+			Parameters: params,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := env.appliance.ReplicationService("csi-replication-pvc-1"); ok {
+			t.Error("replication service must be destroyed")
+		}
+		if _, ok := other.Volume("pool2/csiVolumeGroup/pvc-1"); !ok {
+			t.Error("replica must be kept")
+		}
+		_, err = r.GetVolumeReplicationInfo(ctx, &replication.GetVolumeReplicationInfoRequest{VolumeId: volumeID})
+		expectCode(t, err, codes.FailedPrecondition)
+	})
+
+	t.Run("delete replicated volume", func(t *testing.T) {
+		res, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               "pvc-2",
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: gib},
+			VolumeCapabilities: testVolumeCapabilities,
+			Parameters:         map[string]string{"configName": testConfigName},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		volumeID := res.GetVolume().GetVolumeId()
+		_, err = r.EnableVolumeReplication(ctx, &replication.EnableVolumeReplicationRequest{
+			VolumeId:   volumeID,
+			Parameters: params,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		env.backend.RunReplications()
+		if _, err := s.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID}); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := env.appliance.ReplicationService("csi-replication-pvc-2"); ok {
+			t.Error("replication service must be destroyed with the volume")
+		}
+		if _, ok := other.Volume("pool2/csiVolumeGroup/pvc-2"); !ok {
+			t.Error("replica must be kept as disaster recovery copy")
+		}
+	})
+
+	t.Run("delete volume which is not replicated", func(t *testing.T) {
+		res, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               "pvc-3",
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: gib},
+			VolumeCapabilities: testVolumeCapabilities,
+			Parameters:         map[string]string{"configName": testConfigName},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		env.appliance.Faults().ResetRequests()
+		if _, err := s.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: res.GetVolume().GetVolumeId()}); err != nil {
+			t.Fatal(err)
+		}
+		for _, request := range env.appliance.Faults().Requests() {
+			if strings.HasPrefix(request.Endpoint, "hpr/") {
+				t.Errorf("replication services must not be requested for volume which is not replicated: %s", request)
+			}
+		}
+	})
+
+	for name, params := range map[string]map[string]string{
+		"replication to itself": {"configName": testConfigName, "replicationTarget": testConfigName},
+		"unknown target":        {"replicationTarget": "nstor-box9"},
+		"short interval":        {"replicationTarget": "nstor-box0", "replicationInterval": "30s"},
+		"no target":             {"replicationInterval": "10m"},
+	} {
+		t.Run("invalid parameters "+name, func(t *testing.T) {
+			_, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+				Name:               "pvc-invalid",
+				CapacityRange:      &csi.CapacityRange{RequiredBytes: gib},
+				VolumeCapabilities: testVolumeCapabilities,
+				Parameters:         params,
+			})
+			expectCode(t, err, codes.InvalidArgument)
+		})
+	}
+}
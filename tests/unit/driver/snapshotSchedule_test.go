@@ -0,0 +1,181 @@
+package driver_test
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+)
+
+func TestControllerServer_SnapshotSchedules(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, testConfig)
+	s := env.newControllerServer(t)
+
+	res, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: gib},
+		VolumeCapabilities: testVolumeCapabilities,
+		Parameters:         map[string]string{"snapshotSchedule": "daily=1, hourly=2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeID := res.GetVolume().GetVolumeId()
+	otherVolumeID := createTestVolume(t, s, "pvc-2", gib).GetVolumeId()
+
+	// snapshotNames - names of the volume snapshots sorted by name
+	snapshotNames := func(volumeID string) []string {
+		t.Helper()
+		res, err := s.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SourceVolumeId: volumeID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, entry := range res.GetEntries() {
+			names = append(names, strings.TrimPrefix(entry.GetSnapshot().GetSnapshotId(), volumeID+"@"))
+		}
+		sort.Strings(names)
+		return names
+	}
+	run := func(now time.Time, expected ...string) {
+		t.Helper()
+		if err := s.RunSnapshotSchedules(now); err != nil {
+			t.Fatal(err)
+		}
+		if names := snapshotNames(volumeID); !reflect.DeepEqual(names, expected) {
+			t.Errorf("expected snapshots %v at %s, got: %v", expected, now, names)
+		}
+	}
+
+	start := time.Date(2026, 10, 16, 10, 30, 0, 0, time.UTC)
+
+	t.Run("take snapshots", func(t *testing.T) {
+		properties, _ := env.appliance.VolumeProperties(testVolumeGroup + "/pvc-1")
+		if schedule := properties.UserProperties["user:csi.nexenta.com:snapshot-schedule"]; schedule != "hourly=2,daily=1" {
+			t.Errorf("schedule must be kept in volume user property, got: '%s'", schedule)
+		}
+		expected := []string{"scheduled-daily-pvc-1-20261016-000000", "scheduled-hourly-pvc-1-20261016-100000"}
+		run(start, expected...)
+		// snapshots of the current period are taken once
+		run(start.Add(29*time.Minute), expected...)
+		if names := snapshotNames(otherVolumeID); len(names) != 0 {
+			t.Errorf("volume without schedule must have no snapshots, got: %v", names)
+		}
+	})
+
+	t.Run("retention", func(t *testing.T) {
+		run(
+			start.Add(time.Hour),
+			"scheduled-daily-pvc-1-20261016-000000",
+			"scheduled-hourly-pvc-1-20261016-100000",
+			"scheduled-hourly-pvc-1-20261016-110000",
+		)
+		run(
+			start.Add(2*time.Hour),
+			"scheduled-daily-pvc-1-20261016-000000",
+			"scheduled-hourly-pvc-1-20261016-110000",
+			"scheduled-hourly-pvc-1-20261016-120000",
+		)
+		run(
+			start.Add(24*time.Hour),
+			"scheduled-daily-pvc-1-20261017-000000",
+			"scheduled-hourly-pvc-1-20261016-120000",
+			"scheduled-hourly-pvc-1-20261017-100000",
+		)
+	})
+
+	t.Run("snapshot with clone is kept", func(t *testing.T) {
+		_, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               "pvc-restored",
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: gib},
+			VolumeCapabilities: testVolumeCapabilities,
+			VolumeContentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Snapshot{
+					Snapshot: &csi.VolumeContentSource_SnapshotSource{
+						SnapshotId: volumeID + "@scheduled-hourly-pvc-1-20261016-120000",
+					},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		run(
+			start.Add(25*time.Hour),
+			"scheduled-daily-pvc-1-20261017-000000",
+			"scheduled-hourly-pvc-1-20261016-120000",
+			"scheduled-hourly-pvc-1-20261017-100000",
+			"scheduled-hourly-pvc-1-20261017-110000",
+		)
+	})
+
+	t.Run("remove schedule", func(t *testing.T) {
+		_, err := s.ControllerModifyVolume(ctx, &csi.ControllerModifyVolumeRequest{
+			VolumeId:          volumeID,
+			MutableParameters: map[string]string{"snapshotSchedule": "none"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		run(
+			start.Add(26*time.Hour),
+			"scheduled-daily-pvc-1-20261017-000000",
+			"scheduled-hourly-pvc-1-20261016-120000",
+			"scheduled-hourly-pvc-1-20261017-100000",
+			"scheduled-hourly-pvc-1-20261017-110000",
+		)
+	})
+
+	for _, schedule := range []string{"hourly", "hourly=0", "hourly=x", "minutely=5", "hourly=1,hourly=2"} {
+		t.Run("invalid schedule "+schedule, func(t *testing.T) {
+			_, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+				Name:               "pvc-invalid",
+				CapacityRange:      &csi.CapacityRange{RequiredBytes: gib},
+				VolumeCapabilities: testVolumeCapabilities,
+				Parameters:         map[string]string{"snapshotSchedule": schedule},
+			})
+			expectCode(t, err, codes.InvalidArgument)
+		})
+	}
+}
+
+func TestControllerServer_SnapshotSchedulesListSnapshotsOnce(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, testConfig)
+	s := env.newControllerServer(t)
+
+	for _, name := range []string{"pvc-1", "pvc-2", "pvc-3"} {
+		_, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               name,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: gib},
+			VolumeCapabilities: testVolumeCapabilities,
+			Parameters:         map[string]string{"snapshotSchedule": "hourly=1,daily=1,weekly=1"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Date(2026, 10, 16, 10, 30, 0, 0, time.UTC)
+	for _, now := range []time.Time{start, start.Add(time.Hour)} {
+		env.appliance.Faults().ResetRequests()
+		if err := s.RunSnapshotSchedules(now); err != nil {
+			t.Fatal(err)
+		}
+		lists := 0
+		for _, request := range env.appliance.Faults().Requests() {
+			if request.String() == "GET storage/snapshots" {
+				lists++
+			}
+		}
+		if lists != 1 {
+			t.Errorf("expected snapshots of the volume group to be listed once at %s, got %d lists", now, lists)
+		}
+	}
+}
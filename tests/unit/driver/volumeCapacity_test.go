@@ -0,0 +1,201 @@
+package driver_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+)
+
+func TestControllerServer_VolumeCapacity(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, testConfig)
+	s := env.newControllerServer(t)
+
+	const blockSize = 64 * 1024
+	if !env.appliance.SetVolumeGroupBlockSize(testVolumeGroup, blockSize) {
+		t.Fatalf("volume group '%s' not found", testVolumeGroup)
+	}
+
+	createVolume := func(
+		name string, capacityRange *csi.CapacityRange, params map[string]string, source *csi.VolumeContentSource,
+	) (*csi.Volume, error) {
+		res, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:                name,
+			CapacityRange:       capacityRange,
+			VolumeCapabilities:  testVolumeCapabilities,
+			Parameters:          params,
+			VolumeContentSource: source,
+		})
+		return res.GetVolume(), err
+	}
+	expandVolume := func(name string, size int64) (int64, error) {
+		res, err := s.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+			VolumeId:      testConfigName + ":" + testVolumeGroup + "/" + name,
+			CapacityRange: &csi.CapacityRange{RequiredBytes: size},
+		})
+		return res.GetCapacityBytes(), err
+	}
+	expectSize := func(t *testing.T, volume *csi.Volume, name string, size int64) {
+		t.Helper()
+		if volume != nil && volume.GetCapacityBytes() != size {
+			t.Errorf("expected capacity %d of volume '%s', got: %d", size, name, volume.GetCapacityBytes())
+		}
+		if v, _ := env.appliance.Volume(testVolumeGroup + "/" + name); v.VolumeSize != size {
+			t.Errorf("expected volume '%s' of %d bytes, got: %d", name, size, v.VolumeSize)
+		}
+	}
+	expectNoVolume := func(t *testing.T, name string) {
+		t.Helper()
+		if _, ok := env.appliance.Volume(testVolumeGroup + "/" + name); ok {
+			t.Errorf("volume '%s' must not be created", name)
+		}
+	}
+
+	t.Run("rounding to volume block size", func(t *testing.T) {
+		volume, err := createVolume("pvc-round", &csi.CapacityRange{RequiredBytes: 100000}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectSize(t, volume, "pvc-round", 2*blockSize)
+
+		// retried request gets the same volume
+		volume, err = createVolume("pvc-round", &csi.CapacityRange{RequiredBytes: 100000}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectSize(t, volume, "pvc-round", 2*blockSize)
+
+		// volblocksize of the StorageClass is used instead of the volume group one
+		volume, err = createVolume("pvc-round-8k", &csi.CapacityRange{RequiredBytes: 100000},
+			map[string]string{"volblocksize": "8K"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectSize(t, volume, "pvc-round-8k", 13*8192)
+	})
+
+	t.Run("limit bytes", func(t *testing.T) {
+		volume, err := createVolume("pvc-limit",
+			&csi.CapacityRange{RequiredBytes: blockSize, LimitBytes: blockSize}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectSize(t, volume, "pvc-limit", blockSize)
+
+		// no size required, default size is reduced to fit the limit
+		volume, err = createVolume("pvc-limit-only", &csi.CapacityRange{LimitBytes: 100000}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectSize(t, volume, "pvc-limit-only", blockSize)
+
+		// rounded size doesn't fit the limit
+		_, err = createVolume("pvc-limit-round",
+			&csi.CapacityRange{RequiredBytes: 100000, LimitBytes: 120000}, nil, nil)
+		expectCode(t, err, codes.OutOfRange)
+		expectNoVolume(t, "pvc-limit-round")
+
+		_, err = createVolume("pvc-limit-less", &csi.CapacityRange{RequiredBytes: 2 * gib, LimitBytes: gib}, nil, nil)
+		expectCode(t, err, codes.OutOfRange)
+		expectNoVolume(t, "pvc-limit-less")
+	})
+
+	t.Run("StorageClass size limits", func(t *testing.T) {
+		params := map[string]string{"minVolumeSize": "2G", "maxVolumeSize": "4G"}
+
+		volume, err := createVolume("pvc-min", nil, params, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectSize(t, volume, "pvc-min", 2*gib)
+
+		for name, capacityRange := range map[string]*csi.CapacityRange{
+			"pvc-below-min": {RequiredBytes: gib},
+			"pvc-above-max": {RequiredBytes: 5 * gib},
+			"pvc-limit-min": {LimitBytes: gib},
+		} {
+			_, err := createVolume(name, capacityRange, params, nil)
+			expectCode(t, err, codes.OutOfRange)
+			expectNoVolume(t, name)
+		}
+
+		// max size is kept on the volume for expansion
+		size, err := expandVolume("pvc-min", 3*gib+1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != 3*gib+blockSize {
+			t.Errorf("expected volume expanded to %d bytes, got: %d", 3*gib+blockSize, size)
+		}
+		expectSize(t, nil, "pvc-min", 3*gib+blockSize)
+
+		_, err = expandVolume("pvc-min", 4*gib+1)
+		expectCode(t, err, codes.OutOfRange)
+		expectSize(t, nil, "pvc-min", 3*gib+blockSize)
+
+		// smaller size doesn't shrink the volume
+		if size, err = expandVolume("pvc-min", gib); err != nil {
+			t.Fatal(err)
+		}
+		if size != 3*gib+blockSize {
+			t.Errorf("expected capacity %d of not shrunk volume, got: %d", 3*gib+blockSize, size)
+		}
+	})
+
+	t.Run("clone expansion", func(t *testing.T) {
+		source, err := createVolume("pvc-source", &csi.CapacityRange{RequiredBytes: gib}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cloneOf := &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: source.GetVolumeId()},
+			},
+		}
+
+		volume, err := createVolume("pvc-clone", &csi.CapacityRange{RequiredBytes: 2 * gib}, nil, cloneOf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectSize(t, volume, "pvc-clone", 2*gib)
+
+		// clone without required size gets the size of the source
+		volume, err = createVolume("pvc-clone-same", nil, nil, cloneOf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectSize(t, volume, "pvc-clone-same", gib)
+
+		snapshot := createTestSnapshot(t, s, source.GetVolumeId(), "snapshot-1")
+		volume, err = createVolume("pvc-restore", &csi.CapacityRange{RequiredBytes: 3 * gib}, nil,
+			&csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Snapshot{
+					Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshot.GetSnapshotId()},
+				},
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectSize(t, volume, "pvc-restore", 3*gib)
+
+		// volume can't be shrunk to the limit
+		_, err = createVolume("pvc-clone-small", &csi.CapacityRange{LimitBytes: gib / 2}, nil, cloneOf)
+		expectCode(t, err, codes.OutOfRange)
+		expectNoVolume(t, "pvc-clone-small")
+	})
+
+	for name, params := range map[string]map[string]string{
+		"invalid min size":     {"minVolumeSize": "small"},
+		"negative max size":    {"maxVolumeSize": "-1G"},
+		"overflowing max size": {"maxVolumeSize": "8388608T"},
+		"min greater than max": {"minVolumeSize": "2G", "maxVolumeSize": "1G"},
+	} {
+		t.Run("invalid parameters "+name, func(t *testing.T) {
+			_, err := createVolume("pvc-invalid", &csi.CapacityRange{RequiredBytes: gib}, params, nil)
+			expectCode(t, err, codes.InvalidArgument)
+			expectNoVolume(t, "pvc-invalid")
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package driver_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/nstest"
+)
+
+func TestControllerServer_CopyVolumeBetweenAppliances(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, testConfigTwoAppliances)
+	otherAddress := "https://10.3.199.29:8443"
+	other := nstest.NewAppliance(nstest.ApplianceArgs{
+		Username:     testUsername,
+		Password:     testPassword,
+		VolumeGroups: []string{"pool2/csiVolumeGroup"},
+	})
+	env.backend.Add(otherAddress, other)
+	s := env.newControllerServer(t)
+
+	source, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 2 * gib},
+		VolumeCapabilities: testVolumeCapabilities,
+		Parameters:         map[string]string{"configName": testConfigName, "volblocksize": "32K"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sourceVolumeID := source.GetVolume().GetVolumeId()
+	snapshotID := createTestSnapshot(t, s, sourceVolumeID, "snap-1").GetSnapshotId()
+
+	createVolume := func(name string, contentSource *csi.VolumeContentSource) (*csi.Volume, error) {
+		res, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:                name,
+			CapacityRange:       &csi.CapacityRange{RequiredBytes: 2 * gib},
+			VolumeCapabilities:  testVolumeCapabilities,
+			VolumeContentSource: contentSource,
+			Parameters:          map[string]string{"configName": "nstor-box0", "compression": "lz4"},
+		})
+		return res.GetVolume(), err
+	}
+	snapshotSource := &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshotID},
+		},
+	}
+	volumeSource := &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Volume{
+			Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: sourceVolumeID},
+		},
+	}
+
+	t.Run("restore snapshot", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			_, err := createVolume("pvc-restored", snapshotSource)
+			expectCode(t, err, codes.Aborted)
+		}
+		service, ok := env.appliance.ReplicationService("csi-copy-pvc-restored")
+		if !ok || service.State != nstest.ReplicationStateRunning ||
+			service.DestinationDataset != "pool2/csiVolumeGroup/pvc-restored" ||
+			service.RemoteNode.Host != "10.3.199.29" || service.RemoteNode.Port != 8443 {
+			t.Fatalf("expected running replication service, got: %+v", service)
+		}
+		if _, ok := other.Volume("pool2/csiVolumeGroup/pvc-restored"); ok {
+			t.Fatal("volume must not be reported before the copy is done")
+		}
+
+		if n := env.backend.RunReplications(); n != 1 {
+			t.Fatalf("expected 1 completed replication, got: %d", n)
+		}
+		for i := 0; i < 2; i++ {
+			volume, err := createVolume("pvc-restored", snapshotSource)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if volume.GetVolumeId() != "nstor-box0:pool2/csiVolumeGroup/pvc-restored" {
+				t.Errorf("unexpected volume ID: %s", volume.GetVolumeId())
+			}
+		}
+
+		volume, _ := other.Volume("pool2/csiVolumeGroup/pvc-restored")
+		properties, _ := other.VolumeProperties("pool2/csiVolumeGroup/pvc-restored")
+		if volume.VolumeSize != 2*gib || properties.VolumeBlockSize != 32*1024 || properties.CompressionMode != "lz4" {
+			t.Errorf("unexpected copied volume: %+v, properties: %+v", volume, properties)
+		}
+		if properties.UserProperties["user:csi.nexenta.com:copied-from"] != testVolumeGroup+"/pvc-1@snap-1" {
+			t.Errorf("copied volume must keep the snapshot it's copied from, got: %+v", properties.UserProperties)
+		}
+		if _, ok := other.Snapshot("pool2/csiVolumeGroup/pvc-restored@snap-1"); ok {
+			t.Error("replicated snapshot must be destroyed")
+		}
+		if _, ok := env.appliance.Snapshot(testVolumeGroup + "/pvc-1@snap-1"); !ok {
+			t.Error("source snapshot must be kept")
+		}
+		if _, ok := env.appliance.ReplicationService("csi-copy-pvc-restored"); ok {
+			t.Error("replication service must be destroyed after the copy")
+		}
+	})
+
+	t.Run("clone volume", func(t *testing.T) {
+		_, err := createVolume("pvc-clone", volumeSource)
+		expectCode(t, err, codes.Aborted)
+		env.backend.RunReplications()
+		volume, err := createVolume("pvc-clone", volumeSource)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if volume.GetVolumeId() != "nstor-box0:pool2/csiVolumeGroup/pvc-clone" {
+			t.Errorf("unexpected volume ID: %s", volume.GetVolumeId())
+		}
+		if _, ok := env.appliance.Snapshot(testVolumeGroup + "/pvc-1@k8s-clone-snapshot-pvc-clone"); ok {
+			t.Error("snapshot taken for the copy must be destroyed")
+		}
+	})
+
+	t.Run("failed copy starts over", func(t *testing.T) {
+		_, err := createVolume("pvc-failed", snapshotSource)
+		expectCode(t, err, codes.Aborted)
+		env.backend.Remove(otherAddress)
+		if n := env.backend.RunReplications(); n != 0 {
+			t.Fatalf("replication to unreachable node must fail, completed: %d", n)
+		}
+		env.backend.Add(otherAddress, other)
+
+		_, err = createVolume("pvc-failed", snapshotSource)
+		expectCode(t, err, codes.Internal)
+		_, err = createVolume("pvc-failed", snapshotSource)
+		expectCode(t, err, codes.Aborted)
+		env.backend.RunReplications()
+		if _, err := createVolume("pvc-failed", snapshotSource); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("volume which is not a copy", func(t *testing.T) {
+		_, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               "pvc-other",
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: 2 * gib},
+			VolumeCapabilities: testVolumeCapabilities,
+			Parameters:         map[string]string{"configName": "nstor-box0"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = createVolume("pvc-other", snapshotSource)
+		expectCode(t, err, codes.AlreadyExists)
+		if _, ok := env.appliance.ReplicationService("csi-copy-pvc-other"); ok {
+			t.Error("copy must not be started")
+		}
+	})
+
+	t.Run("same appliance", func(t *testing.T) {
+		res, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:                "pvc-local",
+			CapacityRange:       &csi.CapacityRange{RequiredBytes: 2 * gib},
+			VolumeCapabilities:  testVolumeCapabilities,
+			VolumeContentSource: snapshotSource,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.GetVolume().GetVolumeId() != testConfigName+":"+testVolumeGroup+"/pvc-local" {
+			t.Errorf("volume must be cloned on the source appliance, got: %s", res.GetVolume().GetVolumeId())
+		}
+	})
+
+	t.Run("encrypted source", func(t *testing.T) {
+		_, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               "pvc-encrypted",
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: gib},
+			VolumeCapabilities: testVolumeCapabilities,
+			Parameters:         map[string]string{"configName": testConfigName, "encryption": "on"},
+			Secrets:            map[string]string{"encryptionKey": "correct horse battery staple"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = createVolume("pvc-encrypted-copy", &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{
+					VolumeId: testConfigName + ":" + testVolumeGroup + "/pvc-encrypted",
+				},
+			},
+		})
+		expectCode(t, err, codes.InvalidArgument)
+		snapshotPath := testVolumeGroup + "/pvc-encrypted@k8s-clone-snapshot-pvc-encrypted-copy"
+		if _, ok := env.appliance.Snapshot(snapshotPath); ok {
+			t.Error("snapshot must not be taken if the volume can't be copied")
+		}
+	})
+}
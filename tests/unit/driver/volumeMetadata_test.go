@@ -0,0 +1,132 @@
+package driver_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+)
+
+func TestControllerServer_VolumeMetadata(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, testConfig)
+	s := env.newControllerServer(t)
+
+	metadata := map[string]string{
+		"csi.storage.k8s.io/pvc/name":      "data-postgres-0",
+		"csi.storage.k8s.io/pvc/namespace": "db",
+		"csi.storage.k8s.io/pv/name":       "pvc-1",
+	}
+	withMetadata := func(params map[string]string) map[string]string {
+		for name, value := range metadata {
+			params[name] = value
+		}
+		return params
+	}
+	createVolume := func(name string, params map[string]string) (*csi.Volume, error) {
+		res, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               name,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: gib},
+			VolumeCapabilities: testVolumeCapabilities,
+			Parameters:         params,
+		})
+		return res.GetVolume(), err
+	}
+	expectProperties := func(t *testing.T, userProperties, expected map[string]string) {
+		t.Helper()
+		for name, value := range expected {
+			if userProperties[name] != value {
+				t.Errorf("expected user property %s='%s', got: '%s'", name, value, userProperties[name])
+			}
+		}
+	}
+
+	t.Run("volume and snapshot properties", func(t *testing.T) {
+		volume, err := createVolume("pvc-1", withMetadata(map[string]string{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		properties, _ := env.appliance.VolumeProperties(testVolumeGroup + "/pvc-1")
+		expectProperties(t, properties.UserProperties, map[string]string{
+			"user:csi.nexenta.com:pvc-name":      "data-postgres-0",
+			"user:csi.nexenta.com:pvc-namespace": "db",
+			"user:csi.nexenta.com:pv-name":       "pvc-1",
+		})
+
+		_, err = s.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{
+			SourceVolumeId: volume.GetVolumeId(),
+			Name:           "snapshot-1",
+			Parameters: map[string]string{
+				"csi.storage.k8s.io/volumesnapshot/name":        "backup",
+				"csi.storage.k8s.io/volumesnapshot/namespace":   "db",
+				"csi.storage.k8s.io/volumesnapshotcontent/name": "snapcontent-1",
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		userProperties, _ := env.appliance.SnapshotUserProperties(testVolumeGroup + "/pvc-1@snapshot-1")
+		expectProperties(t, userProperties, map[string]string{
+			"user:csi.nexenta.com:volumesnapshot-name":        "backup",
+			"user:csi.nexenta.com:volumesnapshot-namespace":   "db",
+			"user:csi.nexenta.com:volumesnapshotcontent-name": "snapcontent-1",
+			"user:csi.nexenta.com:pvc-name":                   "data-postgres-0",
+			"user:csi.nexenta.com:pvc-namespace":              "db",
+		})
+
+		// snapshots aren't tagged without csi-snapshotter metadata
+		createTestSnapshot(t, s, volume.GetVolumeId(), "snapshot-2")
+		userProperties, _ = env.appliance.SnapshotUserProperties(testVolumeGroup + "/pvc-1@snapshot-2")
+		if len(userProperties) != 0 {
+			t.Errorf("expected no user properties of snapshot, got: %v", userProperties)
+		}
+	})
+
+	t.Run("volume name template", func(t *testing.T) {
+		params := withMetadata(map[string]string{"volumeNameTemplate": "${pvc.namespace}_${pvc.name}-${pv.name}"})
+		volume, err := createVolume("pvc-2", params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id := volume.GetVolumeId(); id != testConfigName+":"+testVolumeGroup+"/db_data-postgres-0-pvc-2" {
+			t.Errorf("unexpected volume ID: %s", id)
+		}
+
+		// retried request gets the same volume
+		volume, err = createVolume("pvc-2", params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id := volume.GetVolumeId(); id != testConfigName+":"+testVolumeGroup+"/db_data-postgres-0-pvc-2" {
+			t.Errorf("unexpected volume ID of retried request: %s", id)
+		}
+	})
+
+	t.Run("volume name sanitization", func(t *testing.T) {
+		params := withMetadata(map[string]string{"volumeNameTemplate": "@k8s:${pvc.namespace}/${pvc.name}@${pv.name}"})
+		params["csi.storage.k8s.io/pvc/name"] = strings.Repeat("a", 100)
+		volume, err := createVolume("pvc-3", params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "k8s-db-" + strings.Repeat("a", 63) + "-pvc-3"
+		if id := volume.GetVolumeId(); id != testConfigName+":"+testVolumeGroup+"/"+expected {
+			t.Errorf("expected sanitized volume name '%s', got volume ID: %s", expected, id)
+		}
+	})
+
+	for name, params := range map[string]map[string]string{
+		"template without PV name":   withMetadata(map[string]string{"volumeNameTemplate": "${pvc.namespace}-${pvc.name}"}),
+		"unknown placeholder":        withMetadata(map[string]string{"volumeNameTemplate": "${pvc.uid}-${pv.name}"}),
+		"template without metadata":  {"volumeNameTemplate": "${pvc.name}-${pv.name}"},
+		"too long volume name":       {"volumeNameTemplate": strings.Repeat("v", 130) + "${pv.name}"},
+		"template of invalid volume": {"volumeNameTemplate": "${pv.name}", "compression": "fast"},
+	} {
+		t.Run("invalid parameters "+name, func(t *testing.T) {
+			_, err := createVolume("pvc-invalid", params)
+			expectCode(t, err, codes.InvalidArgument)
+		})
+	}
+}
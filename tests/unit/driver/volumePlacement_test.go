@@ -0,0 +1,179 @@
+package driver_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/nstest"
+)
+
+func TestControllerServer_VolumePlacement(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, testConfigZones)
+	env.backend.Add("https://10.3.199.29:8443", nstest.NewAppliance(nstest.ApplianceArgs{
+		Username:     testUsername,
+		Password:     testPassword,
+		VolumeGroups: []string{"pool2/csiVolumeGroup", "pool2/fast"},
+		PoolSize:     50 * gib,
+	}))
+	env.backend.Add("https://10.3.199.30:8443", nstest.NewAppliance(nstest.ApplianceArgs{
+		Username:     testUsername,
+		Password:     testPassword,
+		VolumeGroups: []string{"pool3/csiVolumeGroup"},
+		PoolSize:     50 * gib,
+	}))
+	s := env.newControllerServer(t)
+
+	createVolume := func(name string, size int64, zone string, params map[string]string) (*csi.Volume, error) {
+		req := &csi.CreateVolumeRequest{
+			Name:               name,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: size},
+			VolumeCapabilities: testVolumeCapabilities,
+			Parameters:         params,
+		}
+		if zone != "" {
+			req.AccessibilityRequirements = &csi.TopologyRequirement{
+				Preferred: []*csi.Topology{{Segments: map[string]string{"topology.kubernetes.io/zone": zone}}},
+			}
+		}
+		res, err := s.CreateVolume(ctx, req)
+		return res.GetVolume(), err
+	}
+	// place - creates the volume and returns its placement reported in VolumeContext
+	place := func(t *testing.T, name string, size int64, zone string, params map[string]string) string {
+		t.Helper()
+		volume, err := createVolume(name, size, zone, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return volume.GetVolumeContext()["Placement"]
+	}
+	expectPlacement := func(t *testing.T, placement, expected string) {
+		t.Helper()
+		if placement != expected {
+			t.Errorf("expected placement '%s', got: '%s'", expected, placement)
+		}
+	}
+
+	t.Run("most free space", func(t *testing.T) {
+		volume, err := createVolume("pvc-1", gib, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id := volume.GetVolumeId(); id != testConfigName+":"+testVolumeGroup+"/pvc-1" {
+			t.Errorf("volume must be created on the appliance with the most free space, got: %s", id)
+		}
+		volumeContext := volume.GetVolumeContext()
+		if volumeContext["PlacementPolicy"] != "mostFreeSpace" ||
+			volumeContext["Placement"] != "nstor-box1:pool1/csiVolumeGroup" ||
+			volumeContext["PlacementReason"] != fmt.Sprintf("%d bytes available", 100*gib) {
+			t.Errorf("unexpected placement in volume context: %+v", volumeContext)
+		}
+
+		expectPlacement(t, place(t, "pvc-2", gib, "zone-b", nil), "nstor-box2:pool3/csiVolumeGroup")
+
+		// thick volume takes space of the pool, the tie of the others is broken by config name
+		expectPlacement(t, place(t, "pvc-3", 60*gib, "", map[string]string{"sparseVolume": "false"}),
+			"nstor-box1:pool1/csiVolumeGroup")
+		expectPlacement(t, place(t, "pvc-4", 30*gib, "", map[string]string{"sparseVolume": "false"}),
+			"nstor-box0:pool2/csiVolumeGroup")
+	})
+
+	t.Run("retried request", func(t *testing.T) {
+		// nstor-box2 has the most free space now, but the volume exists on nstor-box0
+		expectPlacement(t, place(t, "pvc-4", 30*gib, "", map[string]string{"sparseVolume": "false"}),
+			"nstor-box0:pool2/csiVolumeGroup")
+	})
+
+	t.Run("round robin", func(t *testing.T) {
+		params := map[string]string{
+			"placementPolicy": "roundRobin",
+			"volumeGroups":    "pool1/csiVolumeGroup, pool2/csiVolumeGroup,pool2/fast",
+		}
+		for i, expected := range []string{
+			"nstor-box0:pool2/csiVolumeGroup",
+			"nstor-box0:pool2/fast",
+			"nstor-box1:pool1/csiVolumeGroup",
+			"nstor-box0:pool2/csiVolumeGroup",
+		} {
+			expectPlacement(t, place(t, fmt.Sprintf("pvc-rr-%d", i), gib, "", params), expected)
+		}
+	})
+
+	t.Run("weighted", func(t *testing.T) {
+		params := map[string]string{
+			"placementPolicy":  "weighted",
+			"placementWeights": "nstor-box1=3,nstor-box2=1,nstor-box0=0",
+		}
+		placements := map[string]int{}
+		for i := 0; i < 40; i++ {
+			name := fmt.Sprintf("pvc-weighted-%d", i)
+			placement := place(t, name, gib, "", params)
+			placements[placement]++
+			// volume name decides the placement, so it doesn't change until weights are changed
+			if _, err := s.DeleteVolume(ctx, &csi.DeleteVolumeRequest{
+				VolumeId: placement + "/" + name,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			expectPlacement(t, place(t, name, gib, "", params), placement)
+		}
+		if len(placements) != 2 ||
+			placements["nstor-box1:pool1/csiVolumeGroup"] <= placements["nstor-box2:pool3/csiVolumeGroup"] {
+			t.Errorf("volumes must be spread by weights, got: %v", placements)
+		}
+
+		_, err := createVolume("pvc-weighted-none", gib, "zone-a", map[string]string{
+			"placementPolicy":  "weighted",
+			"placementWeights": "nstor-box0=0,nstor-box1=0",
+		})
+		expectCode(t, err, codes.InvalidArgument)
+	})
+
+	t.Run("pinned", func(t *testing.T) {
+		expectPlacement(t, place(t, "pvc-pinned", gib, "", map[string]string{
+			"placementPolicy": "pinned",
+			"configName":      "nstor-box0",
+			"volumeGroups":    "pool2/fast,pool2/csiVolumeGroup",
+		}), "nstor-box0:pool2/fast")
+
+		// no fallback to other volume groups
+		_, err := createVolume("pvc-pinned-missing", gib, "", map[string]string{
+			"placementPolicy": "pinned",
+			"configName":      "nstor-box0",
+			"volumeGroups":    "pool9/csiVolumeGroup,pool2/csiVolumeGroup",
+		})
+		expectCode(t, err, codes.NotFound)
+	})
+
+	t.Run("unreachable appliance", func(t *testing.T) {
+		appliance := env.backend.Appliance(testAddress)
+		env.backend.Remove(testAddress)
+		defer env.backend.Add(testAddress, appliance)
+
+		expectPlacement(t, place(t, "pvc-unreachable", gib, "zone-a", nil), "nstor-box0:pool2/csiVolumeGroup")
+	})
+
+	t.Run("zone of another appliance", func(t *testing.T) {
+		_, err := createVolume("pvc-zone", gib, "zone-b", map[string]string{"configName": "nstor-box0"})
+		expectCode(t, err, codes.FailedPrecondition)
+	})
+
+	for name, params := range map[string]map[string]string{
+		"unknown policy":             {"placementPolicy": "random"},
+		"pinned without config name": {"placementPolicy": "pinned"},
+		"weights of another policy":  {"placementPolicy": "roundRobin", "placementWeights": "nstor-box1=1"},
+		"invalid weight":             {"placementPolicy": "weighted", "placementWeights": "nstor-box1=-1"},
+		"empty volume groups":        {"volumeGroups": " , "},
+		"both volume group params":   {"volumeGroup": testVolumeGroup, "volumeGroups": testVolumeGroup},
+	} {
+		t.Run("invalid parameters "+name, func(t *testing.T) {
+			_, err := createVolume("pvc-invalid", gib, "", params)
+			expectCode(t, err, codes.InvalidArgument)
+		})
+	}
+}
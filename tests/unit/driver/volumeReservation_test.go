@@ -0,0 +1,198 @@
+package driver_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+)
+
+func TestControllerServer_Overcommit(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, testConfig+"    overcommitRatio: 1.5\n")
+	s := env.newControllerServer(t)
+
+	createVolume := func(name string, size int64, params map[string]string) (*csi.Volume, error) {
+		res, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               name,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: size},
+			VolumeCapabilities: testVolumeCapabilities,
+			Parameters:         params,
+		})
+		return res.GetVolume(), err
+	}
+	expandVolume := func(name string, size int64) error {
+		_, err := s.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+			VolumeId:      testConfigName + ":" + testVolumeGroup + "/" + name,
+			CapacityRange: &csi.CapacityRange{RequiredBytes: size},
+		})
+		return err
+	}
+	expectSize := func(t *testing.T, name string, size int64) {
+		t.Helper()
+		if v, _ := env.appliance.Volume(testVolumeGroup + "/" + name); v.VolumeSize != size {
+			t.Errorf("expected volume '%s' of %d bytes, got: %d", name, size, v.VolumeSize)
+		}
+	}
+	deleteVolumes := func(t *testing.T, names ...string) {
+		t.Helper()
+		for _, name := range names {
+			_, err := s.DeleteVolume(ctx, &csi.DeleteVolumeRequest{
+				VolumeId: testConfigName + ":" + testVolumeGroup + "/" + name,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	t.Run("config ratio", func(t *testing.T) {
+		for name, size := range map[string]int64{"pvc-1": 100 * gib, "pvc-2": 50 * gib} {
+			if _, err := createVolume(name, size, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err := createVolume("pvc-3", gib, nil)
+		expectCode(t, err, codes.ResourceExhausted)
+		if _, ok := env.appliance.Volume(testVolumeGroup + "/pvc-3"); ok {
+			t.Error("volume must not be created")
+		}
+
+		// retried request doesn't add the volume twice
+		if _, err := createVolume("pvc-2", 50*gib, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		expectCode(t, expandVolume("pvc-2", 51*gib), codes.ResourceExhausted)
+		expectSize(t, "pvc-2", 50*gib)
+	})
+
+	t.Run("StorageClass ratio", func(t *testing.T) {
+		if _, err := createVolume("pvc-3", gib, map[string]string{"overcommitRatio": "2"}); err != nil {
+			t.Fatal(err)
+		}
+		// StorageClass ratio is kept on the volume for expansion
+		if err := expandVolume("pvc-3", 50*gib); err != nil {
+			t.Fatal(err)
+		}
+		expectSize(t, "pvc-3", 50*gib)
+		expectCode(t, expandVolume("pvc-3", 51*gib), codes.ResourceExhausted)
+		expectSize(t, "pvc-3", 50*gib)
+
+		if _, err := createVolume("pvc-unlimited", 500*gib, map[string]string{"overcommitRatio": "0"}); err != nil {
+			t.Fatal(err)
+		}
+		deleteVolumes(t, "pvc-1", "pvc-2", "pvc-3", "pvc-unlimited")
+	})
+
+	t.Run("thick volumes", func(t *testing.T) {
+		params := map[string]string{"overcommitRatio": "1"}
+		thick := map[string]string{"overcommitRatio": "1", "sparseVolume": "false"}
+		if _, err := createVolume("pvc-thick", 30*gib, thick); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := createVolume("pvc-thin", 30*gib, params); err != nil {
+			t.Fatal(err)
+		}
+		// the limit is the sum of volume sizes, reserved space isn't available any more: 80GiB > 70GiB
+		_, err := createVolume("pvc-over", 20*gib, params)
+		expectCode(t, err, codes.ResourceExhausted)
+		deleteVolumes(t, "pvc-thick", "pvc-thin")
+	})
+
+	t.Run("refreservation", func(t *testing.T) {
+		expectReserved := func(t *testing.T, name string, reserved int64) {
+			t.Helper()
+			if v, _ := env.appliance.Volume(testVolumeGroup + "/" + name); v.BytesUsed != reserved {
+				t.Errorf("expected %d bytes reserved for '%s', got: %d", reserved, name, v.BytesUsed)
+			}
+		}
+
+		if _, err := createVolume("pvc-part", 5*gib, map[string]string{"refreservation": "2G"}); err != nil {
+			t.Fatal(err)
+		}
+		expectReserved(t, "pvc-part", 2*gib)
+		if err := expandVolume("pvc-part", 6*gib); err != nil {
+			t.Fatal(err)
+		}
+		expectReserved(t, "pvc-part", 2*gib)
+
+		if _, err := createVolume("pvc-auto", 5*gib, map[string]string{"refreservation": "auto"}); err != nil {
+			t.Fatal(err)
+		}
+		expectReserved(t, "pvc-auto", 5*gib)
+		// guaranteed volume reservation grows with the volume
+		if err := expandVolume("pvc-auto", 6*gib); err != nil {
+			t.Fatal(err)
+		}
+		expectReserved(t, "pvc-auto", 6*gib)
+
+		volume, err := createVolume("pvc-clone", 8*gib, map[string]string{"refreservation": "auto"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               "pvc-clone-2",
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: 8 * gib},
+			VolumeCapabilities: testVolumeCapabilities,
+			Parameters:         map[string]string{"refreservation": "1G"},
+			VolumeContentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Volume{
+					Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: volume.GetVolumeId()},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectReserved(t, "pvc-clone-2", gib)
+	})
+
+	for name, params := range map[string]map[string]string{
+		"negative ratio":                 {"overcommitRatio": "-1"},
+		"invalid ratio":                  {"overcommitRatio": "lots"},
+		"refreservation above size":      {"refreservation": "2G"},
+		"invalid refreservation":         {"refreservation": "some"},
+		"refreservation of thick volume": {"refreservation": "512M", "sparseVolume": "false"},
+	} {
+		t.Run("invalid parameters "+name, func(t *testing.T) {
+			_, err := createVolume("pvc-invalid", gib, params)
+			expectCode(t, err, codes.InvalidArgument)
+			if _, ok := env.appliance.Volume(testVolumeGroup + "/pvc-invalid"); ok {
+				t.Error("volume must not be created")
+			}
+		})
+	}
+}
+
+func TestControllerServer_OvercommitPool(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, testConfig+"    overcommitRatio: 1\n")
+	env.appliance.AddVolumeGroup("pool1/otherGroup")
+	env.appliance.AddVolumeGroup("pool2/csiVolumeGroup")
+	s := env.newControllerServer(t)
+
+	createVolume := func(name string, size int64, volumeGroup string) error {
+		_, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               name,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: size},
+			VolumeCapabilities: testVolumeCapabilities,
+			Parameters:         map[string]string{"volumeGroup": volumeGroup},
+		})
+		return err
+	}
+
+	// volumes of all volume groups in the pool are counted, other pools have their own limit
+	if err := createVolume("pvc-1", 60*gib, testVolumeGroup); err != nil {
+		t.Fatal(err)
+	}
+	if err := createVolume("pvc-2", 40*gib, "pool1/otherGroup"); err != nil {
+		t.Fatal(err)
+	}
+	expectCode(t, createVolume("pvc-3", gib, testVolumeGroup), codes.ResourceExhausted)
+	expectCode(t, createVolume("pvc-3", gib, "pool1/otherGroup"), codes.ResourceExhausted)
+	if err := createVolume("pvc-3", 100*gib, "pool2/csiVolumeGroup"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,294 @@
+package driver_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/nstest"
+)
+
+const testTrashVolumeGroup = "pool1/csi-trash"
+
+func TestControllerServer_VolumeTrash(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, testConfig)
+	s := env.newControllerServer(t)
+	nsProvider := newTestProvider(t, env)
+
+	createVolume := func(name string, params map[string]string) (*csi.Volume, error) {
+		res, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               name,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: gib},
+			VolumeCapabilities: testVolumeCapabilities,
+			Parameters:         params,
+		})
+		return res.GetVolume(), err
+	}
+	deleteVolume := func(t *testing.T, volumeID string) {
+		t.Helper()
+		if _, err := s.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// trashedVolume - path of the only trashed volume of the given one
+	trashedVolume := func(t *testing.T, name string) string {
+		t.Helper()
+		volumes, err := nsProvider.GetVolumes(testTrashVolumeGroup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found []string
+		for _, volume := range volumes {
+			if strings.HasPrefix(volume.Path, testTrashVolumeGroup+"/"+name+"-deleted-") {
+				found = append(found, volume.Path)
+			}
+		}
+		if len(found) != 1 {
+			t.Fatalf("expected one trashed volume of '%s', got: %v", name, found)
+		}
+		return found[0]
+	}
+	expectNoVolume := func(t *testing.T, volumePath string) {
+		t.Helper()
+		if _, ok := env.appliance.Volume(volumePath); ok {
+			t.Errorf("volume '%s' must not exist", volumePath)
+		}
+	}
+
+	t.Run("deleted volume is moved to trash and restored", func(t *testing.T) {
+		volume, err := createVolume("pvc-1", map[string]string{"trashRetention": "2h"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mapTestVolume(t, nsProvider, testVolumeGroup+"/pvc-1")
+		createTestSnapshot(t, s, volume.GetVolumeId(), "snapshot-1")
+
+		deleteVolume(t, volume.GetVolumeId())
+		expectNoVolume(t, testVolumeGroup+"/pvc-1")
+		trashed := trashedVolume(t, "pvc-1")
+		if len(env.appliance.LunMappings(trashed)) != 0 {
+			t.Errorf("trashed volume '%s' must be unmapped", trashed)
+		}
+		if _, ok := env.appliance.Snapshot(trashed + "@snapshot-1"); !ok {
+			t.Errorf("snapshots must be moved to trash with the volume")
+		}
+		properties, _ := env.appliance.VolumeProperties(trashed)
+		if from := properties.UserProperties["user:csi.nexenta.com:trashed-from"]; from != testVolumeGroup+"/pvc-1" {
+			t.Errorf("unexpected original path of trashed volume: '%s'", from)
+		}
+		if _, ok := properties.UserProperties["user:csi.nexenta.com:deleting"]; ok {
+			t.Errorf("trashed volume must not be marked for deletion")
+		}
+
+		// retried request finds nothing to delete
+		deleteVolume(t, volume.GetVolumeId())
+		trashedVolume(t, "pvc-1")
+
+		params := map[string]string{"restoreFromTrash": testConfigName + ":" + trashed, "compression": "lz4"}
+		for i := 0; i < 2; i++ {
+			restored, err := createVolume("pvc-restored", params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id := restored.GetVolumeId(); id != testConfigName+":"+testVolumeGroup+"/pvc-restored" {
+				t.Errorf("unexpected ID of restored volume: %s", id)
+			}
+		}
+		expectNoVolume(t, trashed)
+		if _, ok := env.appliance.Snapshot(testVolumeGroup + "/pvc-restored@snapshot-1"); !ok {
+			t.Errorf("snapshots must be restored with the volume")
+		}
+		properties, _ = env.appliance.VolumeProperties(testVolumeGroup + "/pvc-restored")
+		if properties.CompressionMode != "lz4" {
+			t.Errorf("expected StorageClass compression of restored volume, got: '%s'", properties.CompressionMode)
+		}
+
+		// restored volume isn't purged
+		if err := s.PurgeTrash(time.Now().Add(3 * time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := env.appliance.Volume(testVolumeGroup + "/pvc-restored"); !ok {
+			t.Error("restored volume must not be purged")
+		}
+	})
+
+	t.Run("trashed volume is purged after retention", func(t *testing.T) {
+		volume, err := createVolume("pvc-2", map[string]string{"trashRetention": "1d"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		createTestSnapshot(t, s, volume.GetVolumeId(), "snapshot-2")
+		deleteVolume(t, volume.GetVolumeId())
+		trashed := trashedVolume(t, "pvc-2")
+
+		if err := s.PurgeTrash(time.Now().Add(23 * time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := env.appliance.Volume(trashed); !ok {
+			t.Fatal("trashed volume must be kept until the retention passes")
+		}
+		if err := s.PurgeTrash(time.Now().Add(25 * time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		expectNoVolume(t, trashed)
+		if _, ok := env.appliance.Snapshot(trashed + "@snapshot-2"); ok {
+			t.Error("snapshots of purged volume must be destroyed")
+		}
+	})
+
+	t.Run("trash is purged by elected leader only", func(t *testing.T) {
+		volume, err := createVolume("pvc-follower", map[string]string{"trashRetention": "1h"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		deleteVolume(t, volume.GetVolumeId())
+		trashed := trashedVolume(t, "pvc-follower")
+
+		env.leader.leader = false
+		defer func() { env.leader.leader = true }()
+		if err := s.PurgeTrash(time.Now().Add(2 * time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := env.appliance.Volume(trashed); !ok {
+			t.Fatal("trashed volume must be kept by the controller which isn't the leader")
+		}
+		env.leader.leader = true
+		if err := s.PurgeTrash(time.Now().Add(2 * time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		expectNoVolume(t, trashed)
+	})
+
+	t.Run("restore by PVC name", func(t *testing.T) {
+		pvcParams := func(namespace, name string, params map[string]string) map[string]string {
+			params["csi.storage.k8s.io/pvc/namespace"] = namespace
+			params["csi.storage.k8s.io/pvc/name"] = name
+			return params
+		}
+		for _, name := range []string{"pvc-db-1", "pvc-db-2", "pvc-other"} {
+			claim := "data"
+			if name == "pvc-other" {
+				claim = "other"
+			}
+			volume, err := createVolume(name, pvcParams("db", claim, map[string]string{"trashRetention": "1h"}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			deleteVolume(t, volume.GetVolumeId())
+			if name == "pvc-db-1" {
+				// the latest trashed volume is found by the deletion time kept in seconds
+				time.Sleep(time.Second)
+			}
+		}
+		latest := trashedVolume(t, "pvc-db-2")
+
+		params := pvcParams("db", "data", map[string]string{"restoreFromTrash": "pvc"})
+		for i := 0; i < 2; i++ {
+			restored, err := createVolume("pvc-db-3", params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id := restored.GetVolumeId(); id != testConfigName+":"+testVolumeGroup+"/pvc-db-3" {
+				t.Errorf("unexpected ID of restored volume: %s", id)
+			}
+		}
+		expectNoVolume(t, latest)
+		trashedVolume(t, "pvc-db-1")
+		trashedVolume(t, "pvc-other")
+
+		_, err := createVolume("pvc-invalid", pvcParams("db", "missing", map[string]string{"restoreFromTrash": "pvc"}))
+		expectCode(t, err, codes.NotFound)
+		_, err = createVolume("pvc-invalid", map[string]string{"restoreFromTrash": "pvc"})
+		expectCode(t, err, codes.InvalidArgument)
+	})
+
+	t.Run("trashed volume is deleted permanently", func(t *testing.T) {
+		volume, err := createVolume("pvc-3", map[string]string{"trashRetention": "1h"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		deleteVolume(t, volume.GetVolumeId())
+		trashed := trashedVolume(t, "pvc-3")
+		deleteVolume(t, testConfigName+":"+trashed)
+		expectNoVolume(t, trashed)
+	})
+
+	t.Run("failed move to trash is retried", func(t *testing.T) {
+		volume, err := createVolume("pvc-retry", map[string]string{"trashRetention": "1h"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		env.appliance.Faults().Add(nstest.FaultRule{
+			Method:   http.MethodPost,
+			Endpoint: "storage/volumes/*/rename",
+			Kind:     nstest.FaultServerError,
+			Times:    1,
+		})
+		if _, err := s.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volume.GetVolumeId()}); err == nil {
+			t.Fatal("volume deletion must fail")
+		}
+		deleteVolume(t, volume.GetVolumeId())
+		trashedVolume(t, "pvc-retry")
+	})
+
+	t.Run("volume without retention is destroyed", func(t *testing.T) {
+		volume := createTestVolume(t, s, "pvc-4", gib)
+		deleteVolume(t, volume.GetVolumeId())
+		expectNoVolume(t, testVolumeGroup+"/pvc-4")
+		volumes, _ := nsProvider.GetVolumes(testTrashVolumeGroup)
+		for _, v := range volumes {
+			if strings.HasPrefix(v.Path, testTrashVolumeGroup+"/pvc-4") {
+				t.Errorf("volume without retention must not be moved to trash: %s", v.Path)
+			}
+		}
+	})
+
+	t.Run("retention set by VolumeAttributesClass", func(t *testing.T) {
+		volume := createTestVolume(t, s, "pvc-5", gib)
+		_, err := s.ControllerModifyVolume(ctx, &csi.ControllerModifyVolumeRequest{
+			VolumeId:          volume.GetVolumeId(),
+			MutableParameters: map[string]string{"trashRetention": "12h", "trashVolumeGroup": "trash/k8s"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		deleteVolume(t, volume.GetVolumeId())
+		volumes, err := nsProvider.GetVolumes("pool1/trash/k8s")
+		if err != nil || len(volumes) != 1 {
+			t.Errorf("expected volume in the trash volume group, got: %v, error: %v", volumes, err)
+		}
+	})
+
+	t.Run("restore errors", func(t *testing.T) {
+		createTestVolume(t, s, "pvc-live", gib)
+		_, err := createVolume("pvc-invalid", map[string]string{
+			"restoreFromTrash": testConfigName + ":" + testVolumeGroup + "/pvc-live",
+		})
+		expectCode(t, err, codes.FailedPrecondition)
+
+		_, err = createVolume("pvc-invalid", map[string]string{
+			"restoreFromTrash": testConfigName + ":" + testTrashVolumeGroup + "/pvc-missing-deleted-20240301-100000",
+		})
+		expectCode(t, err, codes.NotFound)
+		expectNoVolume(t, testVolumeGroup+"/pvc-invalid")
+	})
+
+	for name, params := range map[string]map[string]string{
+		"negative retention":           {"trashRetention": "-1h"},
+		"retention without unit":       {"trashRetention": "7"},
+		"absolute trash volume group":  {"trashRetention": "1h", "trashVolumeGroup": "/pool1/trash"},
+		"invalid trashed volume ID":    {"restoreFromTrash": "pvc-1"},
+		"restore to another appliance": {"restoreFromTrash": testConfigName + ":pool1/csi-trash/v", "configName": "x"},
+	} {
+		t.Run("invalid parameters "+name, func(t *testing.T) {
+			_, err := createVolume("pvc-invalid", params)
+			expectCode(t, err, codes.InvalidArgument)
+		})
+	}
+}
@@ -0,0 +1,279 @@
+package leaderelection_test
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/leaderelection"
+)
+
+const (
+	testNamespace = "csi"
+	testLeaseName = "nexentastor-block-csi-driver-nexenta-com-controller"
+)
+
+// test timings, the Lease expires long after the renew deadline, so the leader which has lost it competes first
+const (
+	testLeaseDuration = 3 * time.Second
+	testRenewDeadline = time.Second
+	testRetryPeriod   = 100 * time.Millisecond
+)
+
+var leasesResource = schema.GroupVersionResource{Group: "coordination.k8s.io", Version: "v1", Resource: "leases"}
+
+// leaseServer - Kubernetes API server of the fake clientset, it sets resourceVersion of Leases on writes
+// and rejects updates of stale ones with conflict like the real API server does
+type leaseServer struct {
+	client *fake.Clientset
+
+	mux     sync.Mutex
+	version int
+	down    bool
+
+	// intruder - identity of a replica which updates the Lease right before the next update, so it conflicts
+	intruder string
+}
+
+func newLeaseServer() *leaseServer {
+	s := &leaseServer{client: fake.NewSimpleClientset()}
+	s.client.PrependReactor("*", "leases", s.react)
+	return s
+}
+
+func (s *leaseServer) react(action k8stesting.Action) (bool, runtime.Object, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.down {
+		return true, nil, apierrors.NewServiceUnavailable("API server is down")
+	}
+
+	tracker := s.client.Tracker()
+	// create and update actions have the same methods, so they're told apart by the verb
+	switch action.GetVerb() {
+	case "create":
+		lease := action.(k8stesting.CreateAction).GetObject().(*coordinationv1.Lease).DeepCopy()
+		s.version++
+		lease.ResourceVersion = strconv.Itoa(s.version)
+		if err := tracker.Create(leasesResource, lease, action.GetNamespace()); err != nil {
+			return true, nil, err
+		}
+		return true, lease, nil
+	case "update":
+		lease := action.(k8stesting.UpdateAction).GetObject().(*coordinationv1.Lease).DeepCopy()
+		if s.intruder != "" {
+			if err := s.updateHolder(lease.Namespace, lease.Name, s.intruder); err != nil {
+				return true, nil, err
+			}
+			s.intruder = ""
+		}
+		current, err := tracker.Get(leasesResource, lease.Namespace, lease.Name)
+		if err != nil {
+			return true, nil, err
+		}
+		if current.(*coordinationv1.Lease).ResourceVersion != lease.ResourceVersion {
+			return true, nil, apierrors.NewConflict(
+				leasesResource.GroupResource(), lease.Name, errors.New("the object has been modified"))
+		}
+		s.version++
+		lease.ResourceVersion = strconv.Itoa(s.version)
+		if err := tracker.Update(leasesResource, lease, lease.Namespace); err != nil {
+			return true, nil, err
+		}
+		return true, lease, nil
+	}
+	return false, nil, nil
+}
+
+// updateHolder - writes the Lease of another holder, s.mux must be locked
+func (s *leaseServer) updateHolder(namespace, name, holder string) error {
+	current, err := s.client.Tracker().Get(leasesResource, namespace, name)
+	if err != nil {
+		return err
+	}
+	lease := current.(*coordinationv1.Lease).DeepCopy()
+	lease.Spec.HolderIdentity = &holder
+	s.version++
+	lease.ResourceVersion = strconv.Itoa(s.version)
+	return s.client.Tracker().Update(leasesResource, lease, namespace)
+}
+
+func (s *leaseServer) holder() string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	current, err := s.client.Tracker().Get(leasesResource, testNamespace, testLeaseName)
+	if err != nil || current.(*coordinationv1.Lease).Spec.HolderIdentity == nil {
+		return ""
+	}
+	return *current.(*coordinationv1.Lease).Spec.HolderIdentity
+}
+
+func (s *leaseServer) setDown(down bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.down = down
+}
+
+func (s *leaseServer) setIntruder(identity string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.intruder = identity
+}
+
+func newTestLog() *logrus.Entry {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger.WithField("title", "tests")
+}
+
+// runTestElector - starts the elector, it stops at the end of the test or once the returned function is called
+func runTestElector(t *testing.T, server *leaseServer, identity string) (*leaderelection.Elector, func()) {
+	t.Helper()
+	elector, err := leaderelection.New(leaderelection.Args{
+		LeaseName:     testLeaseName,
+		Namespace:     testNamespace,
+		Identity:      identity,
+		Client:        server.client,
+		LeaseDuration: testLeaseDuration,
+		RenewDeadline: testRenewDeadline,
+		RetryPeriod:   testRetryPeriod,
+		Log:           newTestLog(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		elector.Run(stop)
+		close(done)
+	}()
+	var once sync.Once
+	stopElector := func() {
+		once.Do(func() {
+			close(stop)
+			<-done
+		})
+	}
+	t.Cleanup(stopElector)
+	return elector, stopElector
+}
+
+// waitFor - polls the condition until it's true or the timeout passes
+func waitFor(timeout time.Duration, condition func() bool) bool {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+	return condition()
+}
+
+func TestElector(t *testing.T) {
+	server := newLeaseServer()
+	first, stopFirst := runTestElector(t, server, "controller-0")
+
+	if !waitFor(testLeaseDuration, first.IsLeader) {
+		t.Fatal("the only replica must become the leader")
+	}
+	second, _ := runTestElector(t, server, "controller-1")
+
+	t.Run("leader renews the lease", func(t *testing.T) {
+		if waitFor(testLeaseDuration+testRenewDeadline, second.IsLeader) {
+			t.Fatal("lease renewed by the leader must not be taken over")
+		}
+		if !first.IsLeader() || server.holder() != "controller-0" {
+			t.Errorf("expected the first replica to hold the lease, holder: '%s'", server.holder())
+		}
+	})
+
+	t.Run("leader keeps leading until the renew deadline", func(t *testing.T) {
+		server.setDown(true)
+		time.Sleep(testRenewDeadline / 5)
+		if !first.IsLeader() {
+			t.Error("leader must keep leading before the renew deadline")
+		}
+		if !waitFor(3*testRenewDeadline, func() bool { return !first.IsLeader() }) {
+			t.Error("leader must stop leading after the renew deadline")
+		}
+		server.setDown(false)
+		if !waitFor(testLeaseDuration, first.IsLeader) {
+			t.Error("holder of the lease must lead again once it renews the lease")
+		}
+		if second.IsLeader() {
+			t.Error("lease must not be taken over before it expires")
+		}
+	})
+
+	t.Run("stopped leader releases the lease", func(t *testing.T) {
+		start := time.Now()
+		stopFirst()
+		if first.IsLeader() {
+			t.Error("stopped replica must not be the leader")
+		}
+		if !waitFor(testLeaseDuration, second.IsLeader) {
+			t.Fatal("released lease must be taken over")
+		}
+		if elapsed := time.Since(start); elapsed >= testLeaseDuration {
+			t.Errorf("released lease must be taken over before it expires, took %s", elapsed)
+		}
+		if holder := server.holder(); holder != "controller-1" {
+			t.Errorf("expected lease holder 'controller-1', got: '%s'", holder)
+		}
+	})
+}
+
+func TestElectorConflict(t *testing.T) {
+	server := newLeaseServer()
+	elector, _ := runTestElector(t, server, "controller-0")
+
+	if !waitFor(testLeaseDuration, elector.IsLeader) {
+		t.Fatal("the only replica must become the leader")
+	}
+
+	// another replica updates the lease after the leader has read it, the leader's update of the stale lease conflicts
+	server.setIntruder("controller-1")
+	if !waitFor(3*testRenewDeadline, func() bool { return !elector.IsLeader() }) {
+		t.Error("leader must stop leading once another replica has updated the lease")
+	}
+	if holder := server.holder(); holder != "controller-1" {
+		t.Errorf("update of the stale lease must not be applied, expected holder 'controller-1', got: '%s'", holder)
+	}
+}
+
+func TestNew(t *testing.T) {
+	_, err := leaderelection.New(leaderelection.Args{
+		Namespace: testNamespace,
+		Identity:  "controller-0",
+		Client:    fake.NewSimpleClientset(),
+		Log:       newTestLog(),
+	})
+	if err == nil {
+		t.Error("lease name must be required")
+	}
+
+	_, err = leaderelection.New(leaderelection.Args{
+		LeaseName:     testLeaseName,
+		Namespace:     testNamespace,
+		Identity:      "controller-0",
+		Client:        fake.NewSimpleClientset(),
+		RenewDeadline: testLeaseDuration,
+		LeaseDuration: testRenewDeadline,
+		Log:           newTestLog(),
+	})
+	if err == nil {
+		t.Error("renew deadline must be shorter than lease duration")
+	}
+}
@@ -0,0 +1,171 @@
+package nstest_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/config"
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/driver"
+	"github.com/Nexenta/nexentastor-csi-driver-block/pkg/nstest"
+)
+
+const (
+	testUsername    = "admin"
+	testPassword    = "Nexenta@1"
+	testVolumeGroup = "pool1/csiVolumeGroup"
+)
+
+func newTestLog() *logrus.Entry {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	if os.Getenv("DEBUG") != "" {
+		logger.SetOutput(os.Stderr)
+		logger.SetLevel(logrus.DebugLevel)
+	}
+	return logger.WithField("title", "tests")
+}
+
+func newTestServer(t *testing.T) (*httptest.Server, *nstest.Appliance) {
+	t.Helper()
+	appliance := nstest.NewAppliance(nstest.ApplianceArgs{
+		Username:     testUsername,
+		Password:     testPassword,
+		VolumeGroups: []string{testVolumeGroup},
+	})
+	server := httptest.NewTLSServer(nstest.NewServer(appliance, newTestLog()))
+	t.Cleanup(server.Close)
+	return server, appliance
+}
+
+func TestServer_Provider(t *testing.T) {
+	server, appliance := newTestServer(t)
+
+	p, err := ns.NewProvider(ns.ProviderArgs{
+		Address:            server.URL,
+		Username:           testUsername,
+		Password:           testPassword,
+		Log:                newTestLog(),
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	license, err := p.GetLicense()
+	if err != nil {
+		t.Fatalf("GetLicense() failed: %s", err)
+	} else if !license.Valid {
+		t.Errorf("license is expected to be valid: %+v", license)
+	}
+
+	err = p.CreateVolume(ns.CreateVolumeParams{Path: testVolumeGroup + "/vol1", VolumeSize: 1024 * 1024})
+	if err != nil {
+		t.Fatalf("CreateVolume() failed: %s", err)
+	}
+	if _, ok := appliance.Volume(testVolumeGroup + "/vol1"); !ok {
+		t.Errorf("volume has not been created on the appliance")
+	}
+
+	volume, err := p.GetVolume(testVolumeGroup + "/vol1")
+	if err != nil {
+		t.Fatalf("GetVolume() failed: %s", err)
+	} else if volume.VolumeSize != 1024*1024 {
+		t.Errorf("unexpected volume size: %d", volume.VolumeSize)
+	}
+
+	if _, err := p.GetVolume(testVolumeGroup + "/vol2"); !ns.IsNotExistNefError(err) {
+		t.Errorf("expected ENOENT error for missing volume, got: %v", err)
+	}
+}
+
+func TestServer_NotAuthenticated(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	res, err := server.Client().Get(server.URL + "/storage/volumes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected %d status code, got: %d", http.StatusUnauthorized, res.StatusCode)
+	}
+}
+
+func TestServer_Driver(t *testing.T) {
+	server, appliance := newTestServer(t)
+
+	configDir := t.TempDir()
+	configContent := fmt.Sprintf(`
+nexentastor_map:
+  nstor-box1:
+    restIp: %s
+    username: %s
+    password: %s
+    defaultDataIp: 127.0.0.1
+    defaultVolumeGroup: %s
+    defaultTargetGroup: tg01
+    defaultTarget: iqn.2005-07.com.nexenta:01:test
+    defaultHostGroup: all
+    dynamicTargetLunAllocation: true
+`, server.URL, testUsername, testPassword, testVolumeGroup)
+	err := os.WriteFile(filepath.Join(configDir, "driver-config.yaml"), []byte(configContent), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.New(configDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := driver.NewDriver(driver.Args{
+		Role:     driver.RoleController,
+		NodeID:   "node-1",
+		Endpoint: "unix:///tmp/csi.sock",
+		Config:   cfg,
+		Log:      newTestLog(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Validate(); err != nil {
+		t.Fatalf("Validate() failed: %s", err)
+	}
+
+	s, err := driver.NewControllerServer(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "pvc-1",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1024 * 1024 * 1024},
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume() failed: %s", err)
+	}
+	if _, ok := appliance.Volume(testVolumeGroup + "/pvc-1"); !ok {
+		t.Fatalf("volume has not been created on the appliance")
+	}
+
+	_, err = s.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: res.GetVolume().GetVolumeId()})
+	if err != nil {
+		t.Fatalf("DeleteVolume() failed: %s", err)
+	}
+	if _, ok := appliance.Volume(testVolumeGroup + "/pvc-1"); ok {
+		t.Errorf("volume has not been deleted on the appliance")
+	}
+}